@@ -0,0 +1,54 @@
+package vmtest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// BootBanner is a console line printed by a boot stage
+type BootBanner struct {
+	// Name of the boot stage used in errors
+	Name string
+	// Regexp matches the banner line
+	Regexp *regexp.Regexp
+}
+
+// Banners of the common firmware and bootloaders on the serial console
+var (
+	BANNER_SEABIOS      = BootBanner{"SeaBIOS", regexp.MustCompile(`SeaBIOS \(version [^)]+\)`)}
+	BANNER_SEABIOS_BOOT = BootBanner{"SeaBIOS boot", regexp.MustCompile(`Booting from (Hard Disk|DVD/CD|Floppy|ROM)`)}
+	BANNER_OVMF_BOOT    = BootBanner{"OVMF boot", regexp.MustCompile(`BdsDxe: (loading|starting) Boot[0-9A-F]{4}`)}
+	BANNER_GRUB         = BootBanner{"GRUB", regexp.MustCompile(`GNU GRUB +version \S+`)}
+	BANNER_SYSTEMD_BOOT = BootBanner{"systemd-boot", regexp.MustCompile(`systemd-boot \d+|Boot in \d+ s\.`)}
+	BANNER_LINUX        = BootBanner{"Linux kernel", regexp.MustCompile(`Linux version \d+\.\d+`)}
+)
+
+// ExpectBootBanners waits until the console prints the banners in order, e.g. BANNER_SEABIOS,
+// BANNER_SEABIOS_BOOT, BANNER_GRUB for a disk booting GRUB in BIOS mode
+func (q *Qemu) ExpectBootBanners(banners ...BootBanner) error {
+	for _, b := range banners {
+		if _, err := q.ConsoleExpectREMatch(b.Regexp); err != nil {
+			return fmt.Errorf("%v banner: %w", b.Name, err)
+		}
+	}
+	return nil
+}
+
+// SeaBIOSSelectBoot opens the SeaBIOS boot menu and boots the n-th device of the list (1-based).
+// It needs QemuOptions.BootMenu, the menu is operated with the emulated keyboard.
+func (q *Qemu) SeaBIOSSelectBoot(n int) error {
+	if n < 1 || n > 9 {
+		return fmt.Errorf("invalid SeaBIOS boot menu entry %d", n)
+	}
+	if err := q.ConsoleExpect("Press ESC for boot menu"); err != nil {
+		return err
+	}
+	if err := q.SendKeys(KEY_ESC); err != nil {
+		return err
+	}
+	if err := q.ConsoleExpect("Select boot device:"); err != nil {
+		return err
+	}
+	return q.SendKeys(Key(strconv.Itoa(n)))
+}
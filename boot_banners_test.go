@@ -0,0 +1,80 @@
+package vmtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySequence(t *testing.T) {
+	for key, want := range map[Key]string{KEY_DOWN: "\x1b[B", KEY_ENTER: "\r", Key("e"): "e", Key("ctrl-x"): "\x18"} {
+		s, err := key.sequence()
+		require.NoError(t, err)
+		require.Equal(t, want, s)
+	}
+	_, err := Key("ctrl-alt-delete").sequence()
+	require.Error(t, err)
+}
+
+func TestBootBanners(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+
+	qmpClient, qmpServer := net.Pipe()
+	defer qmpClient.Close()
+	var pressed [][]string
+	go func() {
+		_, _ = qmpServer.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+		scanner := bufio.NewScanner(qmpServer)
+		for scanner.Scan() {
+			var cmd struct {
+				Execute   string `json:"execute"`
+				Arguments struct {
+					Keys []struct{ Data string } `json:"keys"`
+				} `json:"arguments"`
+			}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &cmd))
+			if cmd.Execute == "send-key" {
+				var codes []string
+				for _, k := range cmd.Arguments.Keys {
+					codes = append(codes, k.Data)
+				}
+				pressed = append(pressed, codes)
+				if codes[0] == "esc" {
+					go func() { _, _ = server.Write([]byte("Select boot device:\r\n\r\n1. DVD/CD\r\n2. Hard Disk\r\n")) }()
+				}
+			}
+			_, _ = qmpServer.Write([]byte(`{"return": {}}` + "\n"))
+		}
+	}()
+	qmp, err := newQMPClient(qmpClient)
+	require.NoError(t, err)
+	q.qmp = qmp
+
+	go func() {
+		_, _ = server.Write([]byte("SeaBIOS (version 1.16.3-debian-1.16.3-2)\r\nPress ESC for boot menu.\r\n"))
+	}()
+	require.NoError(t, q.ExpectBootBanners(BANNER_SEABIOS))
+	require.NoError(t, q.SeaBIOSSelectBoot(2))
+	require.Equal(t, [][]string{{"esc"}, {"2"}}, pressed)
+
+	go func() {
+		_, _ = server.Write([]byte("Booting from Hard Disk...\r\n                             GNU GRUB  version 2.12\r\n"))
+	}()
+	require.NoError(t, q.ExpectBootBanners(BANNER_SEABIOS_BOOT, BANNER_GRUB))
+
+	input := make(chan string)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := server.Read(buf)
+		input <- string(buf[:n])
+	}()
+	require.NoError(t, q.ConsoleSendKeys(KEY_DOWN, KEY_ENTER))
+	require.Equal(t, "\x1b[B\r", <-input)
+	require.Error(t, q.SeaBIOSSelectBoot(10))
+}
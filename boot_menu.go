@@ -0,0 +1,236 @@
+package vmtest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// BootMenuKind is a bootloader that draws the menu
+type BootMenuKind string
+
+const (
+	// BOOT_MENU_GRUB is GRUB 2 with the serial terminal ('terminal_output serial' or 'console')
+	BOOT_MENU_GRUB = BootMenuKind("grub")
+	// BOOT_MENU_SYSTEMD_BOOT is systemd-boot at the UEFI firmware serial console
+	BOOT_MENU_SYSTEMD_BOOT = BootMenuKind("systemd-boot")
+)
+
+// defaultBootMenuTimeout is the time to wait for the menu and its redraws
+const defaultBootMenuTimeout = time.Minute
+
+// grubEditorHelp is printed by GRUB below the entry editor
+const grubEditorHelp = "Minimum Emacs-like screen editing is supported"
+
+var bootMenuStatusRe = regexp.MustCompile(`Boot in \d+ s\.|The highlighted entry will be executed automatically`)
+
+// BootMenu drives a bootloader menu drawn at the serial console. The menu is read from the emulated screen,
+// so it works with the menus redrawn by cursor movement.
+type BootMenu struct {
+	console *console
+	kind    BootMenuKind
+	// Timeout limits the wait for the menu updates after a key press
+	Timeout time.Duration
+}
+
+// BootMenu waits until the console shows a GRUB or systemd-boot menu. The timeout of the menu keeps running,
+// press a key (e.g. BootMenu.Select()) to stop it.
+func (q *Qemu) BootMenu() (*BootMenu, error) {
+	m := &BootMenu{console: q.console, Timeout: defaultBootMenuTimeout}
+	if err := m.waitFor(func() bool {
+		kind, entries, _ := parseBootMenu(q.console.screen.lines())
+		m.kind = kind
+		return len(entries) > 0
+	}); err != nil {
+		return nil, fmt.Errorf("boot menu is not shown: %v", err)
+	}
+	return m, nil
+}
+
+// Kind returns the detected bootloader
+func (m *BootMenu) Kind() BootMenuKind {
+	return m.kind
+}
+
+// Entries returns the titles of the menu entries visible at the screen
+func (m *BootMenu) Entries() []string {
+	_, entries, _ := parseBootMenu(m.console.screen.lines())
+	return entries
+}
+
+// Selected returns the index of the highlighted entry or -1 if it is not visible
+func (m *BootMenu) Selected() int {
+	_, _, selected := parseBootMenu(m.console.screen.lines())
+	return selected
+}
+
+// Select highlights the entry with the given index in Entries()
+func (m *BootMenu) Select(entry int) error {
+	if n := len(m.Entries()); entry < 0 || entry >= n {
+		return fmt.Errorf("boot menu entry %d is out of range, the menu has %d entries", entry, n)
+	}
+	for {
+		selected := m.Selected()
+		if selected == entry {
+			return nil
+		}
+		key := KEY_DOWN
+		if selected > entry {
+			key = KEY_UP
+		}
+		if err := m.sendKeys(key); err != nil {
+			return err
+		}
+		if err := m.waitFor(func() bool { return m.Selected() != selected }); err != nil {
+			return fmt.Errorf("boot menu highlight does not move after %v key: %v", key, err)
+		}
+	}
+}
+
+// Boot boots the entry with the given index in Entries()
+func (m *BootMenu) Boot(entry int) error {
+	if err := m.Select(entry); err != nil {
+		return err
+	}
+	return m.sendKeys(KEY_ENTER)
+}
+
+// BootWithArgs appends the kernel parameters to the entry and boots it. GRUB entries get the parameters at
+// the 'linux' command line, systemd-boot entries at the options line.
+func (m *BootMenu) BootWithArgs(entry int, args ...string) error {
+	if err := m.Select(entry); err != nil {
+		return err
+	}
+	updates := m.console.screen.updateCount()
+	if err := m.sendKeys(Key("e")); err != nil {
+		return err
+	}
+	params := " " + strings.Join(args, " ")
+
+	if m.kind != BOOT_MENU_GRUB {
+		if !m.console.screen.waitUpdate(updates, time.Now().Add(m.timeout())) {
+			return fmt.Errorf("boot entry editor is not shown")
+		}
+		if err := m.sendKeys(KEY_END); err != nil {
+			return err
+		}
+		if err := m.console.write(params); err != nil {
+			return err
+		}
+		return m.sendKeys(KEY_ENTER)
+	}
+
+	if err := m.waitFor(func() bool { return m.screenContains(grubEditorHelp) }); err != nil {
+		return fmt.Errorf("GRUB entry editor is not shown: %v", err)
+	}
+	// the cursor starts at the first line of the entry script, move it to the kernel command
+	for i := 0; ; i++ {
+		line := strings.TrimLeft(strings.Trim(m.console.screen.cursorLine(), "│| "), " \t")
+		if strings.HasPrefix(line, "linux") {
+			break
+		}
+		if i == screenHeight {
+			return fmt.Errorf("GRUB entry has no 'linux' command")
+		}
+		row := m.console.screen.cursorRow()
+		if err := m.sendKeys(KEY_DOWN); err != nil {
+			return err
+		}
+		if err := m.waitFor(func() bool { return m.console.screen.cursorRow() != row }); err != nil {
+			return fmt.Errorf("GRUB entry has no 'linux' command")
+		}
+	}
+	if err := m.sendKeys(Key("ctrl-e")); err != nil {
+		return err
+	}
+	if err := m.console.write(params); err != nil {
+		return err
+	}
+	// Ctrl-X boots the edited entry
+	return m.sendKeys(Key("ctrl-x"))
+}
+
+func (m *BootMenu) timeout() time.Duration {
+	if m.Timeout == 0 {
+		return defaultBootMenuTimeout
+	}
+	return m.Timeout
+}
+
+func (m *BootMenu) sendKeys(keys ...Key) error {
+	input, err := keysInput(keys)
+	if err != nil {
+		return err
+	}
+	return m.console.write(input)
+}
+
+func (m *BootMenu) screenContains(str string) bool {
+	for _, l := range m.console.screen.lines() {
+		if strings.Contains(l.text, str) {
+			return true
+		}
+	}
+	return false
+}
+
+// waitFor waits until the condition evaluated at screen updates is true
+func (m *BootMenu) waitFor(cond func() bool) error {
+	deadline := time.Now().Add(m.timeout())
+	for {
+		updates := m.console.screen.updateCount()
+		if cond() {
+			return nil
+		}
+		if !m.console.screen.waitUpdate(updates, deadline) {
+			return ErrConsoleTimeout
+		}
+	}
+}
+
+// boxBorders are the characters of the GRUB menu frame
+const boxBorders = "│|┌┐└┘─-+"
+
+// parseBootMenu finds the menu entries at the screen and the highlighted one
+func parseBootMenu(lines []screenLine) (BootMenuKind, []string, int) {
+	kind := BOOT_MENU_SYSTEMD_BOOT
+	for _, l := range lines {
+		if strings.Contains(l.text, "GNU GRUB") {
+			kind = BOOT_MENU_GRUB
+		}
+	}
+
+	var entries []string
+	selected := -1
+	highlighted := false
+	for _, l := range lines {
+		text := strings.TrimSpace(l.text)
+		if kind == BOOT_MENU_GRUB {
+			// GRUB entries are framed by the box, the highlighted one is marked with '*'
+			if !strings.HasPrefix(text, "│") && !strings.HasPrefix(text, "|") {
+				continue
+			}
+			text = strings.TrimSpace(strings.Trim(text, boxBorders))
+			if strings.HasPrefix(text, "*") {
+				text = strings.TrimSpace(text[1:])
+				selected = len(entries)
+			}
+		} else if bootMenuStatusRe.MatchString(text) {
+			continue
+		}
+		if text == "" || strings.Trim(text, boxBorders) == "" {
+			continue
+		}
+		if l.highlighted && !highlighted {
+			highlighted = true
+			selected = len(entries)
+		}
+		entries = append(entries, text)
+	}
+	if kind == BOOT_MENU_SYSTEMD_BOOT && !highlighted {
+		// text without a highlighted line is not a menu
+		return kind, nil, -1
+	}
+	return kind, entries, selected
+}
@@ -0,0 +1,130 @@
+package vmtest
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGRUB draws a GRUB menu on the console the way GRUB does with the vt100 terminfo and handles the arrow keys
+// and the entry editor
+func fakeGRUB(t *testing.T, conn net.Conn, entries []string) {
+	selected := 0
+	draw := func() {
+		out := "\x1b[2J\x1b[1;27HGNU GRUB  version 2.12\x1b[3;2H+" + strings.Repeat("-", 76) + "+"
+		for i, e := range entries {
+			mark, color := " ", "\x1b[0m"
+			if i == selected {
+				mark, color = "*", "\x1b[30m\x1b[47m"
+			}
+			out += fmt.Sprintf("\x1b[%d;2H|%s%s%-75s\x1b[0m|", 4+i, color, mark, e)
+		}
+		out += fmt.Sprintf("\x1b[%d;2H+%s+", 4+len(entries), strings.Repeat("-", 76))
+		out += "\x1b[20;5HThe highlighted entry will be executed automatically in 5s."
+		_, _ = conn.Write([]byte(out))
+	}
+	draw()
+
+	script := []string{"load_video", "insmod gzio", "linux /vmlinuz root=/dev/sda1", "initrd /initramfs.img"}
+	editing, line, typed := false, 0, ""
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		input := string(buf[:n])
+		for input != "" {
+			switch {
+			case strings.HasPrefix(input, "\x1b[B"):
+				input = input[3:]
+				if editing {
+					line++
+					_, _ = conn.Write([]byte(fmt.Sprintf("\x1b[%d;7H", 3+line)))
+				} else if selected < len(entries)-1 {
+					selected++
+					draw()
+				}
+			case strings.HasPrefix(input, "\x1b[A"):
+				input = input[3:]
+				if selected > 0 {
+					selected--
+					draw()
+				}
+			case input[0] == 'e' && !editing:
+				input = input[1:]
+				editing = true
+				out := "\x1b[2J\x1b[1;27HGNU GRUB  version 2.12"
+				for i, l := range script {
+					out += fmt.Sprintf("\x1b[%d;2H|    %s", 3+i, l)
+				}
+				out += "\x1b[18;5H" + grubEditorHelp + ".\x1b[3;7H"
+				_, _ = conn.Write([]byte(out))
+			case input[0] == '\x05': // ctrl-e
+				input = input[1:]
+			case input[0] == '\x18': // ctrl-x
+				input = input[1:]
+				_, _ = conn.Write([]byte(fmt.Sprintf("\r\nbooting: %s%s\r\n", script[line], typed)))
+			case input[0] == '\r':
+				input = input[1:]
+				_, _ = conn.Write([]byte(fmt.Sprintf("\r\nbooting entry %s\r\n", entries[selected])))
+			default:
+				if editing {
+					typed += input[:1]
+				}
+				input = input[1:]
+			}
+		}
+	}
+}
+
+func TestBootMenu(t *testing.T) {
+	entries := []string{"Arch Linux", "Arch Linux (fallback initramfs)", "UEFI Firmware Settings"}
+	newMenu := func() (*Qemu, func()) {
+		client, server := net.Pipe()
+		q := &Qemu{console: newConsole(client, consoleConfig{})}
+		go q.console.pump(nil)
+		go fakeGRUB(t, server, entries)
+		return q, func() { _ = server.Close() }
+	}
+
+	q, closeMenu := newMenu()
+	menu, err := q.BootMenu()
+	require.NoError(t, err)
+	menu.Timeout = 5 * time.Second
+	require.Equal(t, BOOT_MENU_GRUB, menu.Kind())
+	require.Equal(t, entries, menu.Entries())
+	require.Equal(t, 0, menu.Selected())
+	require.NoError(t, menu.Select(2))
+	require.Equal(t, 2, menu.Selected())
+	require.Error(t, menu.Select(3))
+	require.NoError(t, menu.Boot(1))
+	require.NoError(t, q.ConsoleExpect("booting entry Arch Linux (fallback initramfs)"))
+	closeMenu()
+
+	q, closeMenu = newMenu()
+	defer closeMenu()
+	menu, err = q.BootMenu()
+	require.NoError(t, err)
+	require.NoError(t, menu.BootWithArgs(0, "systemd.unit=rescue.target", "debug"))
+	require.NoError(t, q.ConsoleExpect("booting: linux /vmlinuz root=/dev/sda1 systemd.unit=rescue.target debug"))
+}
+
+func TestParseSystemdBootMenu(t *testing.T) {
+	var s screen
+	s.init()
+	s.write([]byte("\x1b[0m\x1b[37m\x1b[40m\x1b[2J\x1b[10;30HArch Linux (linux)\x1b[30m\x1b[47m\x1b[11;30HArch Linux (linux-lts)" +
+		"\x1b[37m\x1b[40m\x1b[12;30HReboot Into Firmware Interface\x1b[24;1HBoot in 4 s."))
+	kind, entries, selected := parseBootMenu(s.lines())
+	require.Equal(t, BOOT_MENU_SYSTEMD_BOOT, kind)
+	require.Equal(t, []string{"Arch Linux (linux)", "Arch Linux (linux-lts)", "Reboot Into Firmware Interface"}, entries)
+	require.Equal(t, 1, selected)
+
+	s.write([]byte("\x1b[0m\x1b[2Jplain text"))
+	_, entries, _ = parseBootMenu(s.lines())
+	require.Empty(t, entries)
+}
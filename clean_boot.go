@@ -0,0 +1,126 @@
+package vmtest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// CleanBootReport describes the problems a guest booted with, see CleanBoot()
+type CleanBootReport struct {
+	// FailedUnits are the systemd units in failed state
+	FailedUnits []string
+	// KernelErrors are the kernel log records with error or more severe level
+	KernelErrors KernelMessages
+	// Coredumps are the crashes recorded by systemd-coredump, as listed by 'coredumpctl list'
+	Coredumps []string
+}
+
+// Clean reports whether no problems were found
+func (r *CleanBootReport) Clean() bool {
+	return len(r.FailedUnits) == 0 && len(r.KernelErrors) == 0 && len(r.Coredumps) == 0
+}
+
+func (r *CleanBootReport) String() string {
+	var sb strings.Builder
+	if len(r.FailedUnits) > 0 {
+		fmt.Fprintf(&sb, "failed systemd units: %v\n", strings.Join(r.FailedUnits, ", "))
+	}
+	if len(r.KernelErrors) > 0 {
+		fmt.Fprintf(&sb, "%d kernel errors:\n", len(r.KernelErrors))
+		for _, m := range r.KernelErrors {
+			fmt.Fprintf(&sb, "  [%12.6f] %v\n", m.Timestamp.Seconds(), m.Message)
+		}
+	}
+	if len(r.Coredumps) > 0 {
+		fmt.Fprintf(&sb, "coredumps:\n  %v\n", strings.Join(r.Coredumps, "\n  "))
+	}
+	return sb.String()
+}
+
+// guestRun runs a shell command in the guest with the agent if it is enabled or with the shell at the console
+func (q *Qemu) guestRun(cmd string) (string, int, error) {
+	if q.agent == nil {
+		return q.Shell().Run(cmd)
+	}
+	res, err := q.GuestExec("/bin/sh", "-c", cmd)
+	if err != nil {
+		return "", 0, err
+	}
+	return strings.TrimRight(string(res.Stdout), "\n"), res.ExitCode, nil
+}
+
+// CleanBoot gathers the failed systemd units, the kernel errors and the coredumps of a booted guest. The commands
+// run with the guest agent if it is enabled, otherwise the console must provide a root shell.
+func (q *Qemu) CleanBoot() (*CleanBootReport, error) {
+	return cleanBoot(q.guestRun)
+}
+
+// VerifyCleanBoot fails the test if the guest has failed systemd units, kernel errors or coredumps.
+// It is a cheap smoke test for init and initramfs projects.
+func (q *Qemu) VerifyCleanBoot(t testing.TB) {
+	t.Helper()
+	r, err := q.CleanBoot()
+	if err != nil {
+		t.Fatalf("verifying clean boot: %v", err)
+	}
+	if !r.Clean() {
+		t.Errorf("guest boot is not clean:\n%v", r)
+	}
+}
+
+// exitCodeNotFound is the shell exit code for a missing command
+const exitCodeNotFound = 127
+
+func cleanBoot(run func(cmd string) (string, int, error)) (*CleanBootReport, error) {
+	r := &CleanBootReport{}
+
+	out, code, err := run("systemctl --failed --no-legend --plain --no-pager")
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("systemctl --failed: exit code %d: %v", code, out)
+	}
+	for _, l := range nonEmptyLines(out) {
+		r.FailedUnits = append(r.FailedUnits, strings.Fields(l)[0])
+	}
+
+	// the raw format includes the log levels
+	out, code, err = run("dmesg --raw --level=emerg,alert,crit,err")
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		return nil, fmt.Errorf("dmesg: exit code %d: %v", code, out)
+	}
+	for _, l := range nonEmptyLines(out) {
+		if msg, ok := ParseKernelMessage(l); ok {
+			r.KernelErrors = append(r.KernelErrors, msg)
+		}
+	}
+
+	out, code, err = run("coredumpctl list --no-legend --no-pager")
+	if err != nil {
+		return nil, err
+	}
+	// coredumpctl exits with 1 if there are no coredumps, systems without systemd-coredump have none recorded
+	switch code {
+	case 0:
+		r.Coredumps = nonEmptyLines(out)
+	case 1, exitCodeNotFound:
+	default:
+		return nil, fmt.Errorf("coredumpctl list: exit code %d: %v", code, out)
+	}
+	return r, nil
+}
+
+func nonEmptyLines(s string) []string {
+	var lines []string
+	for _, l := range strings.Split(s, "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
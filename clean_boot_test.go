@@ -0,0 +1,36 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanBoot(t *testing.T) {
+	outputs := map[string]string{
+		"systemctl --failed --no-legend --plain --no-pager": "systemd-networkd-wait-online.service loaded failed failed Wait for Network\n",
+		"dmesg --raw --level=emerg,alert,crit,err":          "<3>[    1.500000] ata1: SATA link down\n",
+		"coredumpctl list --no-legend --no-pager":           "",
+	}
+	codes := map[string]int{"coredumpctl list --no-legend --no-pager": 1}
+	run := func(cmd string) (string, int, error) {
+		out, ok := outputs[cmd]
+		require.True(t, ok, cmd)
+		return out, codes[cmd], nil
+	}
+
+	r, err := cleanBoot(run)
+	require.NoError(t, err)
+	require.False(t, r.Clean())
+	require.Equal(t, []string{"systemd-networkd-wait-online.service"}, r.FailedUnits)
+	require.Len(t, r.KernelErrors, 1)
+	require.Equal(t, KERN_ERR, r.KernelErrors[0].Level)
+	require.Empty(t, r.Coredumps)
+	require.Contains(t, r.String(), "failed systemd units: systemd-networkd-wait-online.service")
+
+	outputs["systemctl --failed --no-legend --plain --no-pager"] = ""
+	outputs["dmesg --raw --level=emerg,alert,crit,err"] = ""
+	r, err = cleanBoot(run)
+	require.NoError(t, err)
+	require.True(t, r.Clean())
+}
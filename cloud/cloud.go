@@ -0,0 +1,186 @@
+// Package cloud runs tests at short-lived cloud instances, e.g. the tests that need a whole machine with its own
+// kernel, privileges or network interfaces not available at containerized CI runners. The instances are virtual
+// machines themselves and the common providers, Hetzner Cloud included, do not expose KVM to them. An instance
+// is provisioned by a Provider, driven over SSH like vmtest.SSH and deleted when the VM is stopped.
+//
+// The package is experimental, its API might change.
+package cloud
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anatol/vmtest"
+)
+
+const (
+	// sshPollInterval is the pause between the checks of the instance SSH server
+	sshPollInterval = 2 * time.Second
+	// deleteTimeout limits the instance deletion by Shutdown() and Kill()
+	deleteTimeout = 2 * time.Minute
+)
+
+// Instance is a cloud machine created by a Provider
+type Instance struct {
+	// ID identifies the instance for the provider
+	ID string
+	// Address is the public IP address or the host name of the instance
+	Address string
+}
+
+// Provider creates and deletes the instances of a cloud
+type Provider interface {
+	// Create provisions a machine with the given name and returns when its address is known. The machine
+	// has to accept the SSH connections of the test once booted, e.g. by authorizing the key of the test.
+	Create(ctx context.Context, name string) (*Instance, error)
+	// Delete destroys the machine, its disks are destroyed as well
+	Delete(ctx context.Context, instance *Instance) error
+}
+
+// Options configures the instance of a VM
+type Options struct {
+	// Name is the instance name, default is 'vmtest-' with a random suffix
+	Name string
+	// User is the SSH user, default is root
+	User string
+	// SSH configures the connection, its Host is set from the instance address and the user. The host key
+	// of the new instance is accepted and kept in a known hosts file of the instance unless Args configure
+	// StrictHostKeyChecking and UserKnownHostsFile. KillHook is called before the instance is deleted.
+	SSH vmtest.SSHOptions
+}
+
+// VM is a cloud instance driven over SSH. The instance is deleted by Shutdown() and Kill(), so a test
+// must stop the VM even if it fails, e.g. with 'defer vm.Kill()'.
+type VM struct {
+	*vmtest.SSH
+	provider   Provider
+	instance   *Instance
+	knownHosts string // the temporary directory of the instance host key
+	deleteOnce sync.Once
+}
+
+var _ vmtest.VM = (*VM)(nil)
+
+// New creates an instance and waits till it accepts SSH connections. A failed instance is deleted,
+// ctx limits the whole provisioning.
+func New(ctx context.Context, provider Provider, opts *Options) (*VM, error) {
+	name := opts.Name
+	if name == "" {
+		id, err := randomSuffix()
+		if err != nil {
+			return nil, err
+		}
+		name = "vmtest-" + id
+	}
+	instance, err := provider.Create(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("creating instance %v: %v", name, err)
+	}
+	vm := &VM{provider: provider, instance: instance}
+	// the addresses of deleted instances are reused, so their host keys are not trusted across instances
+	vm.knownHosts, err = os.MkdirTemp("", "vmtest-cloud")
+	if err != nil {
+		_ = vm.delete()
+		return nil, err
+	}
+
+	sshOpts := opts.SSH
+	user := opts.User
+	if user == "" {
+		user = "root"
+	}
+	sshOpts.Host = user + "@" + instance.Address
+	// ssh uses the first value of an option, so the user arguments take precedence
+	sshOpts.Args = append(append([]string(nil), opts.SSH.Args...),
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile="+filepath.Join(vm.knownHosts, "known_hosts"))
+	killHook := opts.SSH.KillHook
+	sshOpts.KillHook = func() error {
+		var err error
+		if killHook != nil {
+			err = killHook()
+		}
+		return errors.Join(err, vm.delete())
+	}
+	if err := waitSSH(ctx, &sshOpts); err != nil {
+		_ = vm.delete()
+		return nil, fmt.Errorf("instance %v: %v", name, err)
+	}
+	vm.SSH, err = vmtest.NewSSH(&sshOpts)
+	if err != nil {
+		_ = vm.delete()
+		return nil, err
+	}
+	return vm, nil
+}
+
+// Instance returns the cloud instance of the VM
+func (vm *VM) Instance() *Instance {
+	return vm.instance
+}
+
+// Shutdown powers off the instance like vmtest.SSH does and deletes it
+func (vm *VM) Shutdown() {
+	vm.SSH.Shutdown()
+	if err := vm.delete(); err != nil {
+		log.Printf("deleting instance %v: %v", vm.instance.ID, err)
+	}
+}
+
+// delete destroys the instance once, it is called by Kill() from vmtest.SSHOptions.KillHook
+func (vm *VM) delete() error {
+	var err error
+	vm.deleteOnce.Do(func() {
+		if vm.knownHosts != "" {
+			_ = os.RemoveAll(vm.knownHosts)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+		defer cancel()
+		err = vm.provider.Delete(ctx, vm.instance)
+	})
+	return err
+}
+
+// waitSSH waits till the SSH server accepts the port connections and then the client authentication,
+// the booting instances open the port before the keys are installed
+func waitSSH(ctx context.Context, opts *vmtest.SSHOptions) error {
+	_, host, _ := strings.Cut(opts.Host, "@")
+	port := opts.Port
+	if port == 0 {
+		port = 22
+	}
+	probe := vmtest.TCPProbe{Addr: net.JoinHostPort(host, strconv.Itoa(port))}
+	if err := vmtest.WaitReady(ctx, nil, probe); err != nil {
+		return err
+	}
+	for {
+		out, err := opts.Command("true").CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("ssh is not ready: %v: %s: %w", err, out, ctx.Err())
+		case <-time.After(sshPollInterval):
+		}
+	}
+}
+
+func randomSuffix() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,141 @@
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anatol/vmtest/internal/fakessh"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeHetzner serves the servers API, a server is running after the first status check
+type fakeHetzner struct {
+	mutex    sync.Mutex
+	requests []string
+	created  map[string]interface{}
+	// malformed makes the server creation response undecodable
+	malformed bool
+}
+
+func (f *fakeHetzner) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.requests = append(f.requests, r.Method+" "+r.URL.Path)
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"error": {"code": "unauthorized", "message": "unable to authenticate"}}`)
+		return
+	}
+	switch r.Method + " " + r.URL.Path {
+	case "POST /servers":
+		_ = json.NewDecoder(r.Body).Decode(&f.created)
+		if f.malformed {
+			_, _ = io.WriteString(w, `{"server": {"id": "42"}}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"server": {"id": 42, "status": "initializing", "public_net": {"ipv4": {"ip": "127.0.0.1"}}}}`)
+	case "GET /servers":
+		if r.URL.Query().Get("name") == f.created["name"] {
+			_, _ = io.WriteString(w, `{"servers": [{"id": 42, "status": "initializing"}]}`)
+		} else {
+			_, _ = io.WriteString(w, `{"servers": []}`)
+		}
+	case "GET /servers/42":
+		_, _ = io.WriteString(w, `{"server": {"id": 42, "status": "running", "public_net": {"ipv4": {"ip": "127.0.0.1"}}}}`)
+	case "DELETE /servers/42":
+		_, _ = io.WriteString(w, `{"action": {"id": 1, "command": "delete_server"}}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestHetzner(t *testing.T) {
+	api := &fakeHetzner{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+
+	h := &Hetzner{Token: "bad", Endpoint: server.URL, SSHKeys: []string{"ci"}, pollInterval: time.Millisecond}
+	_, err := h.Create(context.Background(), "vmtest-1")
+	require.EqualError(t, err, "hetzner POST /servers: unauthorized: unable to authenticate")
+
+	h.Token = "secret"
+	instance, err := h.Create(context.Background(), "vmtest-1")
+	require.NoError(t, err)
+	require.Equal(t, &Instance{ID: "42", Address: "127.0.0.1"}, instance)
+	require.Equal(t, "cx22", api.created["server_type"])
+	require.Equal(t, []interface{}{"ci"}, api.created["ssh_keys"])
+	require.Equal(t, map[string]interface{}{"vmtest": "true"}, api.created["labels"])
+	require.NoError(t, h.Delete(context.Background(), instance))
+	require.Equal(t, []string{"POST /servers", "POST /servers", "GET /servers/42", "DELETE /servers/42"}, api.requests)
+
+	// the server created with an undecodable response is found by its name and deleted
+	api.requests, api.malformed = nil, true
+	_, err = h.Create(context.Background(), "vmtest-2")
+	require.ErrorContains(t, err, "malformed response")
+	require.Equal(t, []string{"POST /servers", "GET /servers", "DELETE /servers/42"}, api.requests)
+}
+
+func TestVM(t *testing.T) {
+	sshLog := fakessh.Install(t)
+
+	// sshd of the instance
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _, _ = io.Copy(io.Discard, conn) }()
+		}
+	}()
+
+	api := &fakeHetzner{}
+	server := httptest.NewServer(api)
+	defer server.Close()
+	provider := &Hetzner{Token: "secret", Endpoint: server.URL, pollInterval: time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	opts := &Options{Name: "vmtest-vm"}
+	opts.SSH.Port = l.Addr().(*net.TCPAddr).Port
+	killed := false
+	opts.SSH.KillHook = func() error {
+		killed = true
+		return nil
+	}
+	vm, err := New(ctx, provider, opts)
+	require.NoError(t, err)
+	require.Equal(t, "vmtest-vm", api.created["name"])
+
+	require.NoError(t, vm.ConsoleWrite("echo ready\n"))
+	require.NoError(t, vm.ConsoleExpect("ready"))
+	res, err := vm.GuestExec("echo", "exec")
+	require.NoError(t, err)
+	require.Equal(t, "exec\n", string(res.Stdout))
+
+	log, err := os.ReadFile(sshLog)
+	require.NoError(t, err)
+	require.Contains(t, string(log), "-o StrictHostKeyChecking=accept-new -o UserKnownHostsFile="+filepath.Join(vm.knownHosts, "known_hosts"))
+	require.DirExists(t, vm.knownHosts)
+
+	vm.Kill()
+	vm.Kill()
+	require.True(t, killed)
+	require.NoDirExists(t, vm.knownHosts)
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	require.Equal(t, "DELETE /servers/42", api.requests[len(api.requests)-1])
+	require.Len(t, api.requests, 3)
+}
@@ -0,0 +1,198 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	hetznerEndpoint = "https://api.hetzner.cloud/v1"
+	// hetznerPollInterval is the pause between the server status checks
+	hetznerPollInterval = 2 * time.Second
+)
+
+// Hetzner is a Provider of Hetzner Cloud servers, see https://docs.hetzner.cloud
+type Hetzner struct {
+	// Token is the API token of the project
+	Token string
+	// ServerType is the machine type, default is 'cx22'
+	ServerType string
+	// Image is the OS image name or ID, default is 'debian-12'
+	Image string
+	// Location is the data center location, e.g. 'fsn1', default is chosen by the API
+	Location string
+	// SSHKeys are the names or IDs of the project SSH keys authorized for root
+	SSHKeys []string
+	// UserData is the cloud-init configuration of the server
+	UserData string
+	// Endpoint is the API URL, default is https://api.hetzner.cloud/v1
+	Endpoint string
+	// Client is the HTTP client, default is http.DefaultClient
+	Client *http.Client
+
+	pollInterval time.Duration // the tests poll faster
+}
+
+var _ Provider = (*Hetzner)(nil)
+
+// errHetznerResponse is returned by call if the request succeeded but its response cannot be decoded
+var errHetznerResponse = errors.New("malformed response")
+
+type hetznerServer struct {
+	ID        int64  `json:"id"`
+	Status    string `json:"status"`
+	PublicNet struct {
+		IPv4 struct {
+			IP string `json:"ip"`
+		} `json:"ipv4"`
+	} `json:"public_net"`
+}
+
+// Create creates the server and waits till it is running
+func (h *Hetzner) Create(ctx context.Context, name string) (*Instance, error) {
+	req := map[string]interface{}{
+		"name":        name,
+		"server_type": valueOr(h.ServerType, "cx22"),
+		"image":       valueOr(h.Image, "debian-12"),
+		// the label helps to find the servers leaked by crashed tests
+		"labels": map[string]string{"vmtest": "true"},
+	}
+	if h.Location != "" {
+		req["location"] = h.Location
+	}
+	if len(h.SSHKeys) > 0 {
+		req["ssh_keys"] = h.SSHKeys
+	}
+	if h.UserData != "" {
+		req["user_data"] = h.UserData
+	}
+	var resp struct {
+		Server hetznerServer `json:"server"`
+	}
+	if err := h.call(ctx, http.MethodPost, "/servers", req, &resp); err != nil {
+		if errors.Is(err, errHetznerResponse) {
+			// the server is created but its id is unknown
+			h.abortByName(name)
+		}
+		return nil, err
+	}
+	instance := &Instance{ID: strconv.FormatInt(resp.Server.ID, 10)}
+
+	server := resp.Server
+	for server.Status != "running" {
+		select {
+		case <-ctx.Done():
+			h.abort(instance)
+			return nil, fmt.Errorf("server %v is %v: %w", server.ID, server.Status, ctx.Err())
+		case <-time.After(durationOr(h.pollInterval, hetznerPollInterval)):
+		}
+		if err := h.call(ctx, http.MethodGet, "/servers/"+instance.ID, nil, &resp); err != nil {
+			h.abort(instance)
+			return nil, err
+		}
+		server = resp.Server
+	}
+	instance.Address = server.PublicNet.IPv4.IP
+	return instance, nil
+}
+
+// Delete deletes the server
+func (h *Hetzner) Delete(ctx context.Context, instance *Instance) error {
+	return h.call(ctx, http.MethodDelete, "/servers/"+instance.ID, nil, nil)
+}
+
+// abort deletes the server that failed to start
+func (h *Hetzner) abort(instance *Instance) {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+	_ = h.Delete(ctx, instance)
+}
+
+// abortByName deletes the server that failed to start if its id is unknown
+func (h *Hetzner) abortByName(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), deleteTimeout)
+	defer cancel()
+	var resp struct {
+		Servers []hetznerServer `json:"servers"`
+	}
+	if err := h.call(ctx, http.MethodGet, "/servers?name="+url.QueryEscape(name), nil, &resp); err != nil {
+		return
+	}
+	for _, server := range resp.Servers {
+		_ = h.Delete(ctx, &Instance{ID: strconv.FormatInt(server.ID, 10)})
+	}
+}
+
+// call sends the API request and decodes the response into out unless it is nil
+func (h *Hetzner) call(ctx context.Context, method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, valueOr(h.Endpoint, hetznerEndpoint)+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+h.Token)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Code != "" {
+			return fmt.Errorf("hetzner %v %v: %v: %v", method, path, apiErr.Error.Code, apiErr.Error.Message)
+		}
+		return fmt.Errorf("hetzner %v %v: %v", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("hetzner %v %v: %w: %v", method, path, errHetznerResponse, err)
+	}
+	return nil
+}
+
+func valueOr(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
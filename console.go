@@ -0,0 +1,654 @@
+package vmtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// console accumulates output of a VM serial console and matches expectations against it.
+// It is shared by all VM implementations.
+//
+// All methods are safe for concurrent use. The output is read by a single pump goroutine and every field belongs
+// to one of the groups below. The shared expectations (expect*, process*, Read) consume one stream: the data
+// is taken out of the console while it is processed, so they are serialized by consumeMutex and a call waits
+// till the previous one returns. Independent concurrent waits use ConsoleCursor over the history instead.
+type console struct {
+	// conn, config and started are not modified after newConsole
+	conn    io.ReadWriteCloser
+	config  consoleConfig
+	started time.Time
+
+	// consumeMutex serializes the consumers of data
+	consumeMutex sync.Mutex
+
+	// pumpMutex guards the fields below up to the pump goroutine ones
+	pumpMutex sync.Mutex
+	// dataCond is signaled when new data arrives or the console is closed
+	dataCond *sync.Cond
+	dataEOF  bool
+	data     []byte
+	// dataTimes are arrival times of the lines in data, raw mode data has no times
+	dataTimes   []time.Time
+	dataArrived bool
+	// offset is the position of data in the whole console output
+	offset int64
+	// discarded is the number of bytes dropped from data because of the scrollback limit
+	discarded int64
+	// partial is the line being printed by the VM, data contains completed lines only unless in raw mode.
+	// The slice is replaced and never modified, so it can be used after the mutex is released.
+	partial     []byte
+	partialTime time.Time
+	stats       ConsoleStats
+	// history is the retained output for ConsoleSince() regardless of whether it was consumed, historyOffset is
+	// its position in the whole console output
+	history       []byte
+	historyOffset int64
+	// recent are the last completed lines regardless of whether they were consumed, used by the reports
+	recent []string
+
+	// the fields below are used by the pump goroutine only
+	term terminal
+	// printed is the part of partial line already written to the sinks
+	printed []byte
+	// lastPrinted is the last line written to the sinks and repeats is the number of its copies suppressed
+	// in the coalescing mode
+	lastPrinted []byte
+	repeats     int
+
+	// the fields below synchronize themselves
+	// screen is the whole screen content, it is read by BootMenu
+	screen screen
+	// secrets are redacted from the sinks output and the expectation errors
+	secrets consoleSecrets
+	// sinks receive the rendered output, e.g. the verbose output and QemuOptions.ConsoleSinks
+	sinks     consoleSinks
+	kernelLog kernelLog
+	patterns  consolePatterns
+}
+
+// defaultConsoleBufferSize is the size of a single console read
+const defaultConsoleBufferSize = 4096
+
+// consoleConfig specifies the console buffering
+type consoleConfig struct {
+	// bufferSize is the maximum size of a single read
+	bufferSize int
+	// scrollback limits the size of data not consumed by expectations yet, zero means unlimited
+	scrollback int
+	// spill receives the data dropped because of the scrollback limit, it might be nil
+	spill io.Writer
+	// raw disables the terminal emulation and lines processing (kernel log, console patterns)
+	raw bool
+	// newOutputOnly makes the expectations skip the data printed before they are called
+	newOutputOnly bool
+	// coalesce replaces identical repeated lines in the sinks output with a repeat count
+	coalesce bool
+}
+
+func newConsole(conn io.ReadWriteCloser, config consoleConfig) *console {
+	if config.bufferSize <= 0 {
+		config.bufferSize = defaultConsoleBufferSize
+	}
+	c := &console{conn: conn, config: config, started: time.Now()}
+	c.dataCond = sync.NewCond(&c.pumpMutex)
+	c.screen.init()
+	return c
+}
+
+// pump reads the console till it is closed, the rendered output is copied to the sinks and to verbose
+// if it is not nil
+func (c *console) pump(verbose io.Writer) {
+	if verbose != nil {
+		c.sinks.add(verbose)
+	}
+	defer c.sinks.close()
+	buf := make([]byte, c.config.bufferSize)
+
+	for {
+		num, err := c.conn.Read(buf)
+		if num > 0 {
+			c.screen.write(buf[:num])
+			if c.config.raw {
+				c.pumpRaw(buf[:num])
+			} else {
+				c.pumpLines(buf[:num])
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				log.Print(err)
+			}
+			if out := c.flushRepeats(nil); len(out) > 0 {
+				_, _ = c.sinks.Write(c.secrets.redact(out))
+			}
+			// expectations waiting for more data fail with EOF
+			c.pumpMutex.Lock()
+			c.dataEOF = true
+			c.dataCond.Broadcast()
+			c.pumpMutex.Unlock()
+			return
+		}
+	}
+}
+
+// pumpRaw adds the data to the console as is
+func (c *console) pumpRaw(data []byte) {
+	_, _ = c.sinks.Write(c.secrets.redact(data))
+
+	c.pumpMutex.Lock()
+	c.stats.Bytes += int64(len(data))
+	c.data = append(c.data, data...)
+	c.addHistory(data)
+	c.trimScrollback()
+	c.dataArrived = true
+	c.dataCond.Broadcast()
+	c.pumpMutex.Unlock()
+}
+
+// pumpLines renders the data with the terminal emulator and adds the completed lines to the console
+func (c *console) pumpLines(data []byte) {
+	lines := c.term.write(data)
+	partial := c.term.current()
+	if !c.sinks.empty() {
+		c.printSinks(lines, partial)
+	}
+
+	for _, line := range lines {
+		// the kernel log, the pattern callbacks and errors, e.g. OnConsoleLine, see the line like the sinks do
+		text := c.secrets.redactString(string(line))
+		c.kernelLog.addLine(text)
+		c.patterns.check(text)
+	}
+
+	now := time.Now()
+	c.pumpMutex.Lock()
+	c.stats.Bytes += int64(len(data))
+	c.stats.Lines += int64(len(lines))
+	for _, line := range lines {
+		c.data = append(c.data, line...)
+		c.data = append(c.data, '\n')
+		c.dataTimes = append(c.dataTimes, now)
+		c.recent = append(c.recent, string(line))
+		c.addHistory(line)
+		c.addHistory([]byte{'\n'})
+	}
+	if len(c.recent) > reportConsoleLines {
+		c.recent = append([]string(nil), c.recent[len(c.recent)-reportConsoleLines:]...)
+	}
+	c.trimScrollback()
+	c.partial = partial
+	c.partialTime = now
+	c.dataArrived = true
+	c.dataCond.Broadcast()
+	c.pumpMutex.Unlock()
+}
+
+// printSinks writes the rendered console output to the sinks. The line being printed is shown as soon as it grows,
+// if its printed part is redrawn then the final line is printed once it is completed.
+func (c *console) printSinks(lines [][]byte, partial []byte) {
+	var out []byte
+	for _, line := range lines {
+		if c.config.coalesce && len(c.printed) == 0 && c.lastPrinted != nil && bytes.Equal(line, c.lastPrinted) {
+			c.repeats++
+			c.pumpMutex.Lock()
+			c.stats.Repeated++
+			c.pumpMutex.Unlock()
+			continue
+		}
+		out = c.flushRepeats(out)
+		c.lastPrinted = append(c.lastPrinted[:0], line...)
+		if bytes.HasPrefix(line, c.printed) {
+			out = append(out, line[len(c.printed):]...)
+		} else {
+			out = append(out, '\n')
+			out = append(out, line...)
+		}
+		out = append(out, '\n')
+		c.printed = nil
+	}
+	// in the coalescing mode a possible repeat of the last line is held till it is completed
+	held := c.config.coalesce && len(c.printed) == 0 && bytes.HasPrefix(c.lastPrinted, partial)
+	// a secret being printed is not split between the writes, so it is redacted as a whole
+	held = held || c.secrets.endsWithPrefix(partial)
+	if !held && len(partial) > len(c.printed) && bytes.HasPrefix(partial, c.printed) {
+		out = c.flushRepeats(out)
+		out = append(out, partial[len(c.printed):]...)
+		c.printed = partial
+	}
+	_, _ = c.sinks.Write(c.secrets.redact(out))
+}
+
+// flushRepeats appends the count of the suppressed repeated lines to out
+func (c *console) flushRepeats(out []byte) []byte {
+	if c.repeats == 0 {
+		return out
+	}
+	out = append(out, fmt.Sprintf("[previous line repeated %d times]\n", c.repeats)...)
+	c.repeats = 0
+	return out
+}
+
+// trimScrollback drops the oldest data exceeding the scrollback limit. pumpMutex must be held.
+func (c *console) trimScrollback() {
+	drop := len(c.data) - c.config.scrollback
+	if c.config.scrollback == 0 || drop <= 0 {
+		return
+	}
+	if c.config.spill != nil {
+		if _, err := c.config.spill.Write(c.data[:drop]); err != nil {
+			log.Printf("console spill: %v", err)
+		}
+	}
+	c.discarded += int64(drop)
+	c.offset += int64(drop)
+	if n := bytes.Count(c.data[:drop], []byte{'\n'}); n <= len(c.dataTimes) {
+		c.dataTimes = c.dataTimes[n:]
+	}
+	// the dropped part of the backing array is released once append reallocates it
+	c.data = c.data[drop:]
+}
+
+// discardedBytes returns the number of bytes dropped because of the scrollback limit
+func (c *console) discardedBytes() int64 {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	return c.discarded
+}
+
+// ConsoleStats describes the console output volume, e.g. to detect a guest flooding the console
+type ConsoleStats struct {
+	// Bytes and Lines are the amounts of the output received
+	Bytes, Lines int64
+	// Repeated is the number of identical repeated lines suppressed in the verbose output and the sinks,
+	// see QemuOptions.ConsoleCoalesce
+	Repeated int64
+	// Elapsed is the time since the console was attached
+	Elapsed time.Duration
+}
+
+// BytesPerSecond returns the average output rate
+func (s ConsoleStats) BytesPerSecond() float64 {
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// LinesPerSecond returns the average rate of the lines
+func (s ConsoleStats) LinesPerSecond() float64 {
+	return float64(s.Lines) / s.Elapsed.Seconds()
+}
+
+// getStats returns the output statistics
+func (c *console) getStats() ConsoleStats {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	stats := c.stats
+	stats.Elapsed = time.Since(c.started)
+	return stats
+}
+
+// LineProcessor accepts byte array as input data. It returns whether processing has matched the input line
+// and thus processing need to be stopped.
+type LineProcessor func(data []byte) bool
+
+// TimedLineProcessor is a LineProcessor that also receives the time the line arrived at
+type TimedLineProcessor func(data []byte, timestamp time.Time) bool
+
+// ConsoleMatch describes a console line matched by an expectation
+type ConsoleMatch struct {
+	// Line is the matched console line without the line terminator
+	Line string
+	// Start and End are byte offsets of the match in Line
+	Start, End int
+	// Offset is the position of Line in the whole console output
+	Offset int64
+	// Timestamp is the time the line arrived at
+	Timestamp time.Time
+	// Groups are the regexp submatches, Groups[0] is the text of the whole match
+	Groups []string
+	// Before are the lines that arrived since the previous expectation and did not match
+	Before []string
+}
+
+// ConsoleExpectError is returned when the console is closed or a console pattern fails before the expected
+// text appears. It contains the lines processed while waiting.
+type ConsoleExpectError struct {
+	// Pattern is the expected text or regexp
+	Pattern string
+	// Lines are the console lines processed while waiting for the pattern
+	Lines []string
+	Err   error
+}
+
+func (e *ConsoleExpectError) Error() string {
+	msg := fmt.Sprintf("console expectation %q failed: %v", e.Pattern, e.Err)
+	if len(e.Lines) == 0 {
+		return msg
+	}
+	const tail = 10
+	lines := e.Lines
+	if len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return msg + "\nlast console lines:\n" + strings.Join(lines, "\n")
+}
+
+func (e *ConsoleExpectError) Unwrap() error {
+	return e.Err
+}
+
+// skipPending drops the data not consumed yet if the expectations search the new output only
+func (c *console) skipPending() {
+	if !c.config.newOutputOnly {
+		return
+	}
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	c.offset += int64(len(c.data))
+	c.data = nil
+	c.dataTimes = nil
+	c.dataArrived = false
+}
+
+// contains reports whether str is in the data not consumed yet or in the line being printed
+func (c *console) contains(str string) bool {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	return bytes.Contains(c.data, []byte(str)) || bytes.Contains(c.partial, []byte(str))
+}
+
+// expectMatch waits for the line where find returns the match indexes in regexp.FindSubmatchIndex format
+func (c *console) expectMatch(pattern string, find func(line []byte) []int) (*ConsoleMatch, error) {
+	c.skipPending()
+	var before []string
+	var match *ConsoleMatch
+	err := c.processLines(time.Time{}, func(data []byte, timestamp time.Time, offset int64) bool {
+		line := bytes.TrimRight(data, "\r\n")
+		loc := find(line)
+		if loc == nil {
+			if bytes.HasSuffix(data, []byte{'\n'}) {
+				before = append(before, string(line))
+			}
+			return false
+		}
+		match = newConsoleMatch(line, loc, offset, timestamp, before)
+		return true
+	})
+	if err != nil {
+		return nil, c.expectError(pattern, before, err)
+	}
+	return match, nil
+}
+
+// newConsoleMatch returns the match of line at the indexes loc, or nil if loc is nil
+func newConsoleMatch(line []byte, loc []int, offset int64, timestamp time.Time, before []string) *ConsoleMatch {
+	if loc == nil {
+		return nil
+	}
+	m := &ConsoleMatch{
+		Line:      string(line),
+		Start:     loc[0],
+		End:       loc[1],
+		Offset:    offset,
+		Timestamp: timestamp,
+		Before:    before,
+	}
+	for i := 0; i+1 < len(loc); i += 2 {
+		group := ""
+		if loc[i] >= 0 {
+			group = string(line[loc[i]:loc[i+1]])
+		}
+		m.Groups = append(m.Groups, group)
+	}
+	return m
+}
+
+// countMatches counts the complete lines matching re till n of them arrive if exact is false, or till the deadline
+func (c *console) countMatches(re *regexp.Regexp, n int, deadline time.Time, exact bool) (int, error) {
+	c.skipPending()
+	count := 0
+	err := c.processLines(deadline, func(data []byte, _ time.Time, _ int64) bool {
+		// the incomplete line is processed again once it is completed
+		if !bytes.HasSuffix(data, []byte{'\n'}) {
+			return false
+		}
+		if re.Match(bytes.TrimRight(data, "\r\n")) {
+			count++
+		}
+		return !exact && count >= n
+	})
+	return count, err
+}
+
+func (c *console) expect(str string) error {
+	c.skipPending()
+	match := []byte(str)
+	p := func(data []byte) bool {
+		return bytes.Contains(data, match)
+	}
+	return c.process(p)
+}
+
+func (c *console) expectRE(re *regexp.Regexp) ([]string, error) {
+	c.skipPending()
+	var matches []string
+	p := func(data []byte) bool {
+		m := re.FindAllSubmatch(data, -1)
+		if m == nil {
+			return false
+		}
+		for _, s := range m {
+			matches = append(matches, string(s[1]))
+		}
+		return true
+	}
+	err := c.process(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return matches, nil
+}
+
+func (c *console) process(processor LineProcessor) error {
+	return c.processTimed(func(data []byte, _ time.Time) bool {
+		return processor(data)
+	})
+}
+
+func (c *console) processTimed(processor TimedLineProcessor) error {
+	return c.processLines(time.Time{}, func(data []byte, timestamp time.Time, _ int64) bool {
+		return processor(data, timestamp)
+	})
+}
+
+// ErrConsoleTimeout is returned when the console expectation is not met in time
+var ErrConsoleTimeout = errors.New("console expectation timed out")
+
+// wakeAt wakes up the dataCond waiters at the deadline unless it is zero. It returns a function reporting whether
+// the deadline has passed and a function stopping the timer.
+func (c *console) wakeAt(deadline time.Time) (func() bool, func()) {
+	if deadline.IsZero() {
+		return func() bool { return false }, func() {}
+	}
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		c.pumpMutex.Lock()
+		c.dataCond.Broadcast()
+		c.pumpMutex.Unlock()
+	})
+	expired := func() bool {
+		return !time.Now().Before(deadline)
+	}
+	return expired, func() { timer.Stop() }
+}
+
+// processLines feeds the console lines to processor along with their arrival time and position
+// in the whole console output. If deadline is not zero then ErrConsoleTimeout is returned once it passes.
+func (c *console) processLines(deadline time.Time, processor func(data []byte, timestamp time.Time, offset int64) bool) error {
+	c.consumeMutex.Lock()
+	defer c.consumeMutex.Unlock()
+	expired, stop := c.wakeAt(deadline)
+	defer stop()
+
+	var buf []byte
+	var times []time.Time
+	var bufOffset int64
+	for {
+		if err := c.patterns.firstFailure(); err != nil {
+			return err
+		}
+
+		c.pumpMutex.Lock()
+		// the console is read with blocking calls, wait till the pump signals new data
+		for !c.dataArrived && !c.dataEOF && !expired() {
+			c.dataCond.Wait()
+		}
+		if len(buf) == 0 {
+			bufOffset = c.offset
+		}
+		buf = append(buf, c.data...)
+		times = append(times, c.dataTimes...)
+		c.offset += int64(len(c.data))
+		partial, partialTime, partialOffset := c.partial, c.partialTime, c.offset
+		newDataArrived := c.dataArrived
+		consoleDataEOF := c.dataEOF
+		c.data = nil
+		c.dataTimes = nil
+		c.dataArrived = false
+		c.pumpMutex.Unlock()
+
+		if newDataArrived {
+			for {
+				var newLine bool
+
+				idx := bytes.IndexByte(buf, '\n')
+				if idx == -1 {
+					// In some cases we want to check str on lines without '\n'.
+					// For example when the process prints "Please enter the password: '
+					idx = len(buf)
+				} else {
+					idx++ // remove trailing \n
+					newLine = true
+				}
+				toProcess := buf[:idx]
+				lineOffset := bufOffset
+				timestamp := time.Now()
+				if newLine {
+					buf = buf[idx:]
+					bufOffset += int64(idx)
+					if len(times) > 0 {
+						timestamp = times[0]
+						times = times[1:]
+					}
+				}
+
+				matched := processor(toProcess, timestamp, lineOffset)
+
+				if matched {
+					// add non-processed data back to the pump
+					c.pumpMutex.Lock()
+					c.data = append(buf, c.data...)
+					c.dataTimes = append(times, c.dataTimes...)
+					c.offset -= int64(len(buf))
+					c.dataArrived = true
+					c.pumpMutex.Unlock()
+
+					return nil
+				}
+
+				if !newLine {
+					break
+				}
+			}
+
+			// the line being printed might be a prompt without newline, e.g. "Please enter the password: "
+			if len(buf) == 0 && len(partial) > 0 && processor(partial, partialTime, partialOffset) {
+				return nil
+			}
+		} else if consoleDataEOF {
+			return io.EOF
+		} else if expired() {
+			return ErrConsoleTimeout
+		}
+	}
+}
+
+// waitOutput waits till the console prints anything and reports whether it happened before the deadline
+func (c *console) waitOutput(deadline time.Time) bool {
+	expired, stop := c.wakeAt(deadline)
+	defer stop()
+
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	for {
+		if c.offset+int64(len(c.data)) > 0 || len(c.partial) > 0 {
+			return true
+		}
+		if c.dataEOF || expired() {
+			return false
+		}
+		c.dataCond.Wait()
+	}
+}
+
+// recentLines returns the last completed console lines
+func (c *console) recentLines() []string {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	return append([]string(nil), c.recent...)
+}
+
+// lastLine returns the line being printed or the last completed one if it is empty
+func (c *console) lastLine() string {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	if len(c.partial) > 0 || len(c.recent) == 0 {
+		return string(c.partial)
+	}
+	return c.recent[len(c.recent)-1]
+}
+
+// eof reports whether the console connection is closed
+func (c *console) eof() bool {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	return c.dataEOF
+}
+
+func (c *console) write(str string) error {
+	_, err := c.conn.Write([]byte(str))
+	return err
+}
+
+// Read consumes the console data not processed by expectations yet. It blocks till some data arrives.
+func (c *console) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	c.consumeMutex.Lock()
+	defer c.consumeMutex.Unlock()
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	for len(c.data) == 0 && !c.dataEOF {
+		c.dataCond.Wait()
+	}
+	if len(c.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data)
+	if k := bytes.Count(c.data[:n], []byte{'\n'}); k <= len(c.dataTimes) {
+		c.dataTimes = c.dataTimes[k:]
+	}
+	c.data = c.data[n:]
+	c.offset += int64(n)
+	if len(c.data) == 0 {
+		c.dataArrived = false
+	}
+	return n, nil
+}
@@ -0,0 +1,160 @@
+package vmtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ConsoleCursor is an independent reader position in the console output. Expectations of a cursor consume
+// the output for this cursor only, so several goroutines can wait for different output at the same time, e.g.
+// one watching for a panic while another drives the test. The cursors do not affect ConsoleExpect() and
+// the other shared expectations, those must not be called concurrently.
+//
+// A cursor reads the console history, so it fails once it falls behind the retained output, see ConsoleSince().
+// The secrets are redacted from the history lines before they are matched.
+type ConsoleCursor struct {
+	console *console
+	mutex   sync.Mutex
+	// offset is the position of the next output to process, it might point into the line being printed
+	offset int64
+	// deadline fails the expectations with ErrConsoleTimeout, zero means no deadline
+	deadline time.Time
+}
+
+// ConsoleCursor returns a cursor positioned after the completed console output
+func (q *Qemu) ConsoleCursor() *ConsoleCursor {
+	return newConsoleCursor(q.console)
+}
+
+// ConsoleCursor returns a cursor positioned after the completed console output
+func (vb *VirtualBox) ConsoleCursor() *ConsoleCursor {
+	return newConsoleCursor(vb.console)
+}
+
+// ConsoleCursor returns a cursor positioned after the completed console output
+func (e *External) ConsoleCursor() *ConsoleCursor {
+	return newConsoleCursor(e.console)
+}
+
+func newConsoleCursor(c *console) *ConsoleCursor {
+	return &ConsoleCursor{console: c, offset: int64(c.mark())}
+}
+
+// Mark returns the cursor position
+func (cur *ConsoleCursor) Mark() ConsoleMark {
+	cur.mutex.Lock()
+	defer cur.mutex.Unlock()
+	return ConsoleMark(cur.offset)
+}
+
+// SetDeadline makes the following expectations fail with ErrConsoleTimeout once t passes, the zero value
+// removes the deadline. Without a deadline an expectation waits till the console is closed.
+func (cur *ConsoleCursor) SetDeadline(t time.Time) {
+	cur.mutex.Lock()
+	defer cur.mutex.Unlock()
+	cur.deadline = t
+}
+
+// Expect waits until str is printed after the cursor and moves the cursor after the matched line
+func (cur *ConsoleCursor) Expect(str string) error {
+	match := []byte(str)
+	_, err := cur.expectMatch(str, func(line []byte) []int {
+		if i := bytes.Index(line, match); i != -1 {
+			return []int{i, i + len(match)}
+		}
+		return nil
+	})
+	return err
+}
+
+// ExpectRE waits until a line after the cursor matches re and moves the cursor after the matched line
+func (cur *ConsoleCursor) ExpectRE(re *regexp.Regexp) (*ConsoleMatch, error) {
+	return cur.expectMatch(re.String(), re.FindSubmatchIndex)
+}
+
+// expectMatch waits for the line where find returns the match indexes in regexp.FindSubmatchIndex format.
+// Calls of the same cursor are serialized.
+func (cur *ConsoleCursor) expectMatch(pattern string, find func(line []byte) []int) (*ConsoleMatch, error) {
+	cur.mutex.Lock()
+	defer cur.mutex.Unlock()
+	c := cur.console
+
+	if !cur.deadline.IsZero() {
+		// wake up the wait below at the deadline
+		timer := time.AfterFunc(time.Until(cur.deadline), func() {
+			c.pumpMutex.Lock()
+			c.dataCond.Broadcast()
+			c.pumpMutex.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	var before []string
+	for {
+		if err := c.patterns.firstFailure(); err != nil {
+			return nil, c.expectError(pattern, before, err)
+		}
+
+		c.pumpMutex.Lock()
+		start := cur.offset - c.historyOffset
+		if start < 0 {
+			c.pumpMutex.Unlock()
+			return nil, fmt.Errorf("console cursor at %d is not retained, the oldest retained output is at %d", cur.offset, c.historyOffset)
+		}
+		var out, partial []byte
+		end, printing := c.historyOffset+int64(len(c.history)), c.partial
+		partialOffset := end
+		if start <= int64(len(c.history)) {
+			out = append(out, c.history[start:]...)
+			partial = append(partial, c.partial...)
+		} else if skip := start - int64(len(c.history)); skip <= int64(len(c.partial)) {
+			// the rest of the line being printed after the previous match
+			partial = append(partial, c.partial[skip:]...)
+			partialOffset = cur.offset
+		}
+		eof := c.dataEOF
+		c.pumpMutex.Unlock()
+
+		for len(out) > 0 {
+			line := out
+			if i := bytes.IndexByte(out, '\n'); i != -1 {
+				line = out[:i+1]
+			}
+			lineOffset := cur.offset
+			out = out[len(line):]
+			cur.offset += int64(len(line))
+			text := c.secrets.redact(bytes.TrimRight(line, "\r\n"))
+			if m := newConsoleMatch(text, find(text), lineOffset, time.Now(), before); m != nil {
+				return m, nil
+			}
+			before = append(before, string(text))
+		}
+		// the line being printed might be a prompt without newline
+		shown := c.secrets.redact(partial)
+		if m := newConsoleMatch(shown, find(shown), partialOffset, time.Now(), before); m != nil {
+			cur.offset = partialOffset + int64(len(partial))
+			return m, nil
+		}
+		if eof {
+			return nil, c.expectError(pattern, before, io.EOF)
+		}
+		if cur.expired() {
+			return nil, c.expectError(pattern, before, ErrConsoleTimeout)
+		}
+
+		c.pumpMutex.Lock()
+		if c.historyOffset+int64(len(c.history)) == end && bytes.Equal(c.partial, printing) && !c.dataEOF && !cur.expired() {
+			c.dataCond.Wait()
+		}
+		c.pumpMutex.Unlock()
+	}
+}
+
+// expired reports whether the deadline passed, cur.mutex must be held
+func (cur *ConsoleCursor) expired() bool {
+	return !cur.deadline.IsZero() && !time.Now().Before(cur.deadline)
+}
@@ -0,0 +1,102 @@
+package vmtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// defaultConsoleHistory limits the output retained for ConsoleSince() unless QemuOptions.ConsoleScrollback is set
+const defaultConsoleHistory = 16 * 1024 * 1024
+
+// ConsoleMark is a position in the whole console output, see ConsoleMark()
+type ConsoleMark int64
+
+// addHistory appends the completed output to the history, keeping at least the limited number of the last bytes.
+// pumpMutex must be held.
+func (c *console) addHistory(data []byte) {
+	c.history = append(c.history, data...)
+	limit := c.config.scrollback
+	if limit == 0 {
+		limit = defaultConsoleHistory
+	}
+	// the history is trimmed in batches so the retained data is not copied at every line
+	if drop := len(c.history) - limit; drop > limit/4 {
+		c.historyOffset += int64(drop)
+		c.history = append([]byte(nil), c.history[drop:]...)
+	}
+}
+
+// mark returns the position after the completed output, the line being printed belongs to the output after it
+func (c *console) mark() ConsoleMark {
+	c.pumpMutex.Lock()
+	defer c.pumpMutex.Unlock()
+	return ConsoleMark(c.historyOffset + int64(len(c.history)))
+}
+
+// since returns the output printed after the mark including the line being printed. pumpMutex must be held.
+func (c *console) since(mark ConsoleMark) ([]byte, error) {
+	start := int64(mark) - c.historyOffset
+	if start < 0 {
+		return nil, fmt.Errorf("console mark %d is not retained, the oldest retained output is at %d", mark, c.historyOffset)
+	}
+	if start > int64(len(c.history)) {
+		return nil, fmt.Errorf("console mark %d is beyond the output end %d", mark, c.historyOffset+int64(len(c.history)))
+	}
+	out := append([]byte(nil), c.history[start:]...)
+	return append(out, c.partial...), nil
+}
+
+// expectSince waits till str is printed after the mark. It does not consume the output.
+func (c *console) expectSince(mark ConsoleMark, str string) error {
+	for {
+		if err := c.patterns.firstFailure(); err != nil {
+			return c.expectError(str, nil, err)
+		}
+		c.pumpMutex.Lock()
+		out, err := c.since(mark)
+		eof := c.dataEOF
+		if err == nil && !bytes.Contains(out, []byte(str)) && !eof {
+			c.dataCond.Wait()
+		}
+		c.pumpMutex.Unlock()
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(out, []byte(str)) {
+			return nil
+		}
+		if eof {
+			return c.expectError(str, splitLines(out), io.EOF)
+		}
+	}
+}
+
+func splitLines(data []byte) []string {
+	var lines []string
+	for _, l := range bytes.Split(bytes.TrimSuffix(data, []byte{'\n'}), []byte{'\n'}) {
+		lines = append(lines, string(l))
+	}
+	return lines
+}
+
+// ConsoleMark returns the current console position, so the following ConsoleSince() and ConsoleExpectSince()
+// calls are scoped to the output printed after it, e.g. after a command is run
+func (q *Qemu) ConsoleMark() ConsoleMark {
+	return q.console.mark()
+}
+
+// ConsoleSince returns the console output printed after the mark, regardless of whether it was consumed by
+// expectations. The output is retained up to QemuOptions.ConsoleScrollback or 16MiB, the secrets are redacted.
+func (q *Qemu) ConsoleSince(mark ConsoleMark) (string, error) {
+	q.console.pumpMutex.Lock()
+	out, err := q.console.since(mark)
+	q.console.pumpMutex.Unlock()
+	return string(q.console.secrets.redact(out)), err
+}
+
+// ConsoleExpectSince waits until str is printed after the mark. Unlike ConsoleExpect it ignores older output
+// and does not consume the output, so it can be combined with other expectations.
+func (q *Qemu) ConsoleExpectSince(mark ConsoleMark, str string) error {
+	return q.reportError(q.console.expectSince(mark, str))
+}
@@ -0,0 +1,118 @@
+package vmtest
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sync"
+)
+
+// PatternSeverity defines what happens when a console pattern is seen
+type PatternSeverity int
+
+const (
+	// PATTERN_WARN logs the matched line
+	PATTERN_WARN PatternSeverity = iota
+	// PATTERN_FAIL records a failure, it makes the following console expectations and PatternFailures() return an error
+	PATTERN_FAIL
+	// PATTERN_CALLBACK only calls the pattern Callback
+	PATTERN_CALLBACK
+)
+
+// ConsolePattern is a pattern checked against every console line during the whole VM lifetime
+type ConsolePattern struct {
+	// Name describes the pattern in logs and errors
+	Name string
+	// Regexp is matched against each console line
+	Regexp *regexp.Regexp
+	// Severity of the match
+	Severity PatternSeverity
+	// Callback is an optional function called for every matched line. It is called from the console pump
+	// goroutine so it must not block, and it must not call t.Fatal() (use t.Error() instead).
+	Callback func(line string)
+}
+
+// CommonFailurePatterns is a list of patterns that indicate latent problems in Linux guests
+var CommonFailurePatterns = []ConsolePattern{
+	{Name: "kernel panic", Regexp: regexp.MustCompile(`Kernel panic - not syncing`), Severity: PATTERN_FAIL},
+	{Name: "kernel bug", Regexp: regexp.MustCompile(`\] (BUG|Oops|general protection fault)[: ]`), Severity: PATTERN_FAIL},
+	{Name: "segfault", Regexp: regexp.MustCompile(`segfault at [0-9a-f]+`), Severity: PATTERN_FAIL},
+	{Name: "ext4 error", Regexp: regexp.MustCompile(`EXT4-fs error`), Severity: PATTERN_FAIL},
+	{Name: "kernel warning", Regexp: regexp.MustCompile(`WARNING: CPU: \d+ PID: \d+`), Severity: PATTERN_WARN},
+	{Name: "failed systemd unit", Regexp: regexp.MustCompile(`\[FAILED\] Failed to start`), Severity: PATTERN_WARN},
+}
+
+// ConsolePatternError reports a console line matched by PATTERN_FAIL pattern
+type ConsolePatternError struct {
+	Pattern string
+	Line    string
+}
+
+func (e *ConsolePatternError) Error() string {
+	return fmt.Sprintf("console failure pattern %q matched: %v", e.Pattern, e.Line)
+}
+
+// consolePatterns evaluates registered patterns against console lines
+type consolePatterns struct {
+	mutex    sync.Mutex
+	patterns []ConsolePattern
+	failures []error
+}
+
+func (c *consolePatterns) add(p ConsolePattern) {
+	c.mutex.Lock()
+	c.patterns = append(c.patterns, p)
+	c.mutex.Unlock()
+}
+
+func (c *consolePatterns) check(line string) {
+	c.mutex.Lock()
+	patterns := c.patterns
+	c.mutex.Unlock()
+
+	for _, p := range patterns {
+		if !p.Regexp.MatchString(line) {
+			continue
+		}
+		switch p.Severity {
+		case PATTERN_FAIL:
+			c.mutex.Lock()
+			c.failures = append(c.failures, &ConsolePatternError{Pattern: p.Name, Line: line})
+			c.mutex.Unlock()
+		case PATTERN_CALLBACK:
+		default:
+			log.Printf("console warning pattern %q matched: %v", p.Name, line)
+		}
+		if p.Callback != nil {
+			p.Callback(line)
+		}
+	}
+}
+
+// fail records a failure detected by a pattern callback
+func (c *consolePatterns) fail(err error) {
+	c.mutex.Lock()
+	c.failures = append(c.failures, err)
+	c.mutex.Unlock()
+}
+
+// firstFailure returns the first recorded failure or nil
+func (c *consolePatterns) firstFailure() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.failures) == 0 {
+		return nil
+	}
+	return c.failures[0]
+}
+
+// AddConsolePattern registers a pattern checked against all console lines printed from now on
+func (q *Qemu) AddConsolePattern(p ConsolePattern) {
+	q.console.patterns.add(p)
+}
+
+// PatternFailures returns an error if any PATTERN_FAIL console pattern has been matched so far.
+// Call it at the end of the test to detect guest failures the test was not expecting.
+func (q *Qemu) PatternFailures() error {
+	return q.console.patterns.firstFailure()
+}
@@ -0,0 +1,44 @@
+package vmtest
+
+import (
+	"net"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsolePatterns(t *testing.T) {
+	var c consolePatterns
+	for _, p := range CommonFailurePatterns {
+		c.add(p)
+	}
+	var warnings []string
+	c.add(ConsolePattern{
+		Name:     "oom",
+		Regexp:   regexp.MustCompile(`Out of memory`),
+		Callback: func(line string) { warnings = append(warnings, line) },
+	})
+
+	c.check("[    1.000000] Out of memory: Killed process 123")
+	require.NoError(t, c.firstFailure())
+	require.Len(t, warnings, 1)
+
+	c.check("[    2.000000] EXT4-fs error (device sda1): ext4_lookup:1234: inode #2: comm ls: deleted inode referenced")
+	var patternErr *ConsolePatternError
+	require.ErrorAs(t, c.firstFailure(), &patternErr)
+	require.Equal(t, "ext4 error", patternErr.Pattern)
+}
+
+func TestResetLoop(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	q.AddConsolePattern((&QemuResetLoop{Count: 2}).pattern(&q.console.patterns))
+	go q.console.pump(nil)
+
+	_, _ = server.Write([]byte("SeaBIOS (version 1.16.0)\nBooting from Hard Disk...\n"))
+	require.NoError(t, q.PatternFailures())
+	_, _ = server.Write([]byte("SeaBIOS (version 1.16.0)\nBooting from Hard Disk...\n"))
+	require.ErrorIs(t, q.ConsoleExpect("login:"), ErrResetLoop)
+}
@@ -0,0 +1,78 @@
+package vmtest
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// redactedSecret replaces the secrets in the console transcripts
+const redactedSecret = "[REDACTED]"
+
+// consoleSecrets are strings redacted from the verbose output, console sinks, reports, error messages and
+// the console history and lines returned to the test
+type consoleSecrets struct {
+	mutex sync.RWMutex
+	list  [][]byte
+}
+
+func (s *consoleSecrets) add(secret string) {
+	if secret == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.list = append(s.list, []byte(secret))
+}
+
+// redact replaces the secrets in data
+func (s *consoleSecrets) redact(data []byte) []byte {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, secret := range s.list {
+		data = bytes.ReplaceAll(data, secret, []byte(redactedSecret))
+	}
+	return data
+}
+
+func (s *consoleSecrets) redactString(str string) string {
+	return string(s.redact([]byte(str)))
+}
+
+func (s *consoleSecrets) redactLines(lines []string) []string {
+	if len(lines) == 0 {
+		return lines
+	}
+	return strings.Split(s.redactString(strings.Join(lines, "\n")), "\n")
+}
+
+// endsWithPrefix reports whether data ends with the beginning of a secret, such a line is not printed till it
+// grows enough to tell whether it contains the secret
+func (s *consoleSecrets) endsWithPrefix(data []byte) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, secret := range s.list {
+		for k := len(secret) - 1; k > 0; k-- {
+			if bytes.HasSuffix(data, secret[:k]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expectError returns an expectation error with the secrets redacted from the console lines
+func (c *console) expectError(pattern string, lines []string, err error) *ConsoleExpectError {
+	return &ConsoleExpectError{
+		Pattern: c.secrets.redactString(pattern),
+		Lines:   c.secrets.redactLines(lines),
+		Err:     err,
+	}
+}
+
+// AddSecret registers a string, e.g. a LUKS passphrase written with ConsoleWrite(), that is redacted from
+// the verbose output, console sinks, reports, console expectation errors, ConsoleSince(), ConsoleCursor matches,
+// KernelMessages() and console patterns
+func (q *Qemu) AddSecret(secret string) {
+	q.console.secrets.add(secret)
+}
@@ -0,0 +1,146 @@
+package vmtest
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+// consoleSinks copies the rendered console output to any number of writers. Every sink is written by its own
+// goroutine from an unbounded queue, so a slow sink delays neither the pump nor the other sinks, and no data
+// is dropped.
+type consoleSinks struct {
+	mutex sync.Mutex
+	sinks []*consoleSink
+	// closed is set once the console is closed, sinks added later receive nothing
+	closed bool
+}
+
+type consoleSink struct {
+	w       io.Writer
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	pending [][]byte
+	closed  bool
+	done    chan struct{}
+}
+
+// add starts copying the output to w. The returned function flushes the queued data and removes the sink.
+func (s *consoleSinks) add(w io.Writer) func() {
+	sink := &consoleSink{w: w, done: make(chan struct{})}
+	sink.cond = sync.NewCond(&sink.mutex)
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return func() {}
+	}
+	s.sinks = append(s.sinks, sink)
+	s.mutex.Unlock()
+	go sink.run()
+
+	return func() {
+		s.mutex.Lock()
+		for i, e := range s.sinks {
+			if e == sink {
+				s.sinks = append(s.sinks[:i:i], s.sinks[i+1:]...)
+				break
+			}
+		}
+		s.mutex.Unlock()
+		sink.close()
+	}
+}
+
+// Write queues the data to every sink
+func (s *consoleSinks) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	// the sinks write asynchronously and the caller might reuse p
+	data := append([]byte(nil), p...)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, sink := range s.sinks {
+		sink.mutex.Lock()
+		sink.pending = append(sink.pending, data)
+		sink.cond.Signal()
+		sink.mutex.Unlock()
+	}
+	return len(p), nil
+}
+
+// close flushes all sinks, it is called once the console is closed
+func (s *consoleSinks) close() {
+	s.mutex.Lock()
+	sinks := s.sinks
+	s.sinks = nil
+	s.closed = true
+	s.mutex.Unlock()
+	for _, sink := range sinks {
+		sink.close()
+	}
+}
+
+// empty reports whether there are no sinks, so the pump skips rendering the output for them
+func (s *consoleSinks) empty() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.sinks) == 0
+}
+
+func (k *consoleSink) run() {
+	defer close(k.done)
+	failed := false
+	for {
+		k.mutex.Lock()
+		for len(k.pending) == 0 && !k.closed {
+			k.cond.Wait()
+		}
+		pending := k.pending
+		k.pending = nil
+		closed := k.closed
+		k.mutex.Unlock()
+
+		for _, data := range pending {
+			if failed {
+				break
+			}
+			if _, err := k.w.Write(data); err != nil {
+				// a broken sink does not affect the others
+				log.Printf("console sink: %v", err)
+				failed = true
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
+
+// close waits till the queued data is written
+func (k *consoleSink) close() {
+	k.mutex.Lock()
+	k.closed = true
+	k.cond.Signal()
+	k.mutex.Unlock()
+	<-k.done
+}
+
+// AddConsoleSink starts copying the rendered console output to w. The returned function removes the sink
+// once the queued output is written to it.
+func (q *Qemu) AddConsoleSink(w io.Writer) func() {
+	return q.console.sinks.add(w)
+}
+
+// AddConsoleSink starts copying the rendered console output to w. The returned function removes the sink
+// once the queued output is written to it.
+func (vb *VirtualBox) AddConsoleSink(w io.Writer) func() {
+	return vb.console.sinks.add(w)
+}
+
+// AddConsoleSink starts copying the rendered console output to w. The returned function removes the sink
+// once the queued output is written to it.
+func (e *External) AddConsoleSink(w io.Writer) func() {
+	return e.console.sinks.add(w)
+}
@@ -0,0 +1,457 @@
+package vmtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsoleExpect(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{bufferSize: 16})
+	go c.pump(nil)
+
+	go func() {
+		_, _ = server.Write([]byte("Booting the kernel\r\n\x1b[0mWelcome to Linux\r\n"))
+		_ = server.Close()
+	}()
+
+	require.NoError(t, c.expect("Booting"))
+	require.NoError(t, c.expect("Welcome to Linux"))
+	require.ErrorIs(t, c.expect("login:"), io.EOF)
+}
+
+func TestConsoleScrollback(t *testing.T) {
+	client, server := net.Pipe()
+	var spill bytes.Buffer
+	c := newConsole(client, consoleConfig{scrollback: 8, spill: &spill})
+	done := make(chan struct{})
+	go func() {
+		c.pump(nil)
+		close(done)
+	}()
+
+	_, err := server.Write([]byte("0123456789abcdef\n"))
+	require.NoError(t, err)
+	_ = server.Close()
+	<-done
+
+	require.Equal(t, int64(9), c.discardedBytes())
+	require.Equal(t, "012345678", spill.String())
+	require.NoError(t, c.expect("9abcdef"))
+}
+
+func TestConsoleRaw(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{raw: true})
+	go c.pump(nil)
+
+	frame := []byte{0x01, 0x1b, '[', '0', 'm', 0x00, 0xff, '\n'}
+	go func() {
+		_, _ = server.Write(frame)
+		_ = server.Close()
+	}()
+
+	data, err := io.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, frame, data)
+	require.Empty(t, c.kernelLog.get())
+}
+
+func TestIncompleteUTF8Suffix(t *testing.T) {
+	require.Equal(t, 0, incompleteUTF8Suffix([]byte("ascii")))
+	require.Equal(t, 0, incompleteUTF8Suffix([]byte("Привет")))
+	require.Equal(t, 1, incompleteUTF8Suffix([]byte("Прив\xd0")))
+	require.Equal(t, 2, incompleteUTF8Suffix([]byte("日\xe6\x9c")))
+	require.Equal(t, 0, incompleteUTF8Suffix([]byte("\x80\x80\x80")))
+}
+
+func TestConsoleSplitUTF8(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	go c.pump(nil)
+
+	go func() {
+		msg := []byte("Установка завершена\n")
+		// split in the middle of a character, every write is a separate read
+		_, _ = server.Write(msg[:3])
+		_, _ = server.Write(msg[3:])
+		_ = server.Close()
+	}()
+
+	require.NoError(t, c.expect("Установка завершена"))
+}
+
+func TestConsoleProcessTimed(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	go c.pump(nil)
+
+	start := time.Now()
+	go func() {
+		_, _ = server.Write([]byte("CPU0 online\nCPU1 online\n"))
+		time.Sleep(20 * time.Millisecond)
+		_, _ = server.Write([]byte("CPU2 online\nsmp: Brought up 3 CPUs\n"))
+		_ = server.Close()
+	}()
+
+	var stamps []time.Time
+	err := c.processTimed(func(line []byte, ts time.Time) bool {
+		if bytes.HasPrefix(line, []byte("CPU")) {
+			stamps = append(stamps, ts)
+		}
+		return bytes.HasPrefix(line, []byte("smp:"))
+	})
+	require.NoError(t, err)
+	require.Len(t, stamps, 3)
+	require.False(t, stamps[0].Before(start))
+	require.Equal(t, stamps[0], stamps[1])
+	require.GreaterOrEqual(t, stamps[2].Sub(stamps[1]), 20*time.Millisecond)
+}
+
+func TestConsoleExpectMatch(t *testing.T) {
+	client, server := net.Pipe()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+
+	go func() {
+		_, _ = server.Write([]byte("Loading kernel\r\nrun test\r\nexit_code=3 elapsed=12ms\r\n"))
+		_ = server.Close()
+	}()
+
+	m, err := q.ConsoleExpectREMatch(regexp.MustCompile(`exit_code=(\d+) elapsed=(\w+)`))
+	require.NoError(t, err)
+	require.Equal(t, "exit_code=3 elapsed=12ms", m.Line)
+	require.Equal(t, []string{"exit_code=3 elapsed=12ms", "3", "12ms"}, m.Groups)
+	require.Equal(t, 0, m.Start)
+	require.Equal(t, len(m.Line), m.End)
+	require.Equal(t, int64(len("Loading kernel\nrun test\n")), m.Offset)
+	require.Equal(t, []string{"Loading kernel", "run test"}, m.Before)
+
+	_, err = q.ConsoleExpectMatch("login:")
+	var expectErr *ConsoleExpectError
+	require.ErrorAs(t, err, &expectErr)
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestConsoleCollectUntil(t *testing.T) {
+	client, server := net.Pipe()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+
+	go func() {
+		_, _ = server.Write([]byte("# ls /\r\nbin\r\netc\r\n__DONE_0__\r\n# "))
+		_ = server.Close()
+	}()
+
+	require.NoError(t, q.ConsoleExpect("# ls /"))
+	lines, err := q.ConsoleCollectUntil(regexp.MustCompile(`__DONE_\d+__`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"bin", "etc", "__DONE_0__"}, lines)
+}
+
+func TestConsoleExpectCount(t *testing.T) {
+	client, server := net.Pipe()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+	defer server.Close()
+
+	go func() {
+		_, _ = server.Write([]byte("smpboot: CPU 1 is now online\nsmpboot: CPU 2 is now online\n"))
+		_, _ = server.Write([]byte("smpboot: CPU 3 is ")) // incomplete line is not counted twice
+		_, _ = server.Write([]byte("now online\nudev: event\n"))
+	}()
+
+	cpu := regexp.MustCompile(`CPU \d+ is now online`)
+	require.NoError(t, q.ConsoleExpectCount(cpu, 2, time.Second))
+	require.NoError(t, q.ConsoleExpectExactCount(cpu, 1, 50*time.Millisecond))
+
+	err := q.ConsoleExpectCount(regexp.MustCompile(`udev`), 2, 50*time.Millisecond)
+	require.ErrorIs(t, err, ErrConsoleTimeout)
+	var qemuErr *QemuError
+	require.ErrorAs(t, err, &qemuErr)
+
+	err = q.ConsoleExpectExactCount(cpu, 1, 50*time.Millisecond)
+	require.ErrorContains(t, err, "expected 1")
+	require.ErrorAs(t, err, &qemuErr)
+}
+
+// blockingWriter is a sink that does not return till it is released
+type blockingWriter struct {
+	release chan struct{}
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.buf.Write(p)
+}
+
+func TestConsoleSinks(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	var fast bytes.Buffer
+	c.sinks.add(&fast)
+	slow := &blockingWriter{release: make(chan struct{})}
+	removeSlow := c.sinks.add(slow)
+	done := make(chan struct{})
+	go func() {
+		c.pump(nil)
+		close(done)
+	}()
+
+	_, err := server.Write([]byte("Booting\r\nWelcome\r\n"))
+	require.NoError(t, err)
+	// the blocked sink delays neither the expectations nor the other sinks
+	require.NoError(t, c.expect("Welcome"))
+	close(slow.release)
+	removeSlow()
+	require.Equal(t, "Booting\nWelcome\n", slow.buf.String())
+
+	_, err = server.Write([]byte("login: "))
+	require.NoError(t, err)
+	require.NoError(t, c.expect("login:"))
+	_ = server.Close()
+	<-done
+	require.Equal(t, "Booting\nWelcome\nlogin: ", fast.String())
+	require.Equal(t, "Booting\nWelcome\n", slow.buf.String())
+}
+
+func TestConsoleContains(t *testing.T) {
+	client, server := net.Pipe()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+	defer server.Close()
+
+	_, err := server.Write([]byte("Welcome\r\nlogin: "))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return q.ConsoleContains("login:") }, time.Second, time.Millisecond)
+	require.True(t, q.ConsoleContains("Welcome"))
+	// the text printed before the call is found by the expectation
+	require.NoError(t, q.ConsoleExpect("Welcome"))
+	require.False(t, q.ConsoleContains("Welcome"))
+	require.False(t, q.ConsoleContains("Password:"))
+}
+
+func TestConsoleExpectNewOutput(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{newOutputOnly: true})
+	go c.pump(nil)
+	defer server.Close()
+
+	_, err := server.Write([]byte("ready\r\n"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return c.contains("ready") }, time.Second, time.Millisecond)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = server.Write([]byte("done\r\nready again\r\n"))
+	}()
+	m, err := c.expectMatch("ready", func(line []byte) []int { return regexp.MustCompile("ready").FindIndex(line) })
+	require.NoError(t, err)
+	require.Equal(t, "ready again", m.Line)
+}
+
+func TestConsoleMark(t *testing.T) {
+	client, server := net.Pipe()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+
+	_, err := server.Write([]byte("# run test\r\nok\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, q.ConsoleExpect("ok"))
+
+	mark := q.ConsoleMark()
+	go func() {
+		_, _ = server.Write([]byte("# run test\r\n"))
+		time.Sleep(10 * time.Millisecond)
+		_, _ = server.Write([]byte("failed\r\n# "))
+		_ = server.Close()
+	}()
+	// the stale 'ok' printed before the mark is not matched
+	err = q.ConsoleExpectSince(mark, "ok")
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, q.ConsoleExpectSince(mark, "failed"))
+
+	out, err := q.ConsoleSince(mark)
+	require.NoError(t, err)
+	require.Equal(t, "# run test\nfailed\n# ", out)
+	out, err = q.ConsoleSince(0)
+	require.NoError(t, err)
+	require.Equal(t, "# run test\nok\n# run test\nfailed\n# ", out)
+	_, err = q.ConsoleSince(mark + 1000)
+	require.Error(t, err)
+}
+
+func TestConsoleCoalesce(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{coalesce: true})
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		c.pump(&out)
+		close(done)
+	}()
+
+	_, err := server.Write([]byte("probe\r\nerror -5\r\nerror -5\r\nerr"))
+	require.NoError(t, err)
+	_, err = server.Write([]byte("or -5\r\nerror -5\r\nfailed\r\nerror -5\r\nerror -5\r\n# "))
+	require.NoError(t, err)
+	_ = server.Close()
+	<-done
+
+	require.Equal(t, "probe\nerror -5\n[previous line repeated 3 times]\nfailed\nerror -5\n[previous line repeated 1 times]\n# ", out.String())
+	stats := c.getStats()
+	require.Equal(t, int64(8), stats.Lines)
+	require.Equal(t, int64(4), stats.Repeated)
+	require.Greater(t, stats.LinesPerSecond(), 0.0)
+	// expectations see every line
+	n, err := c.countMatches(regexp.MustCompile("error -5"), 0, time.Time{}, true)
+	require.ErrorIs(t, err, io.EOF)
+	require.Equal(t, 6, n)
+}
+
+func TestConsoleSecrets(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	c.secrets.add("hunter2")
+	q := &Qemu{console: c}
+	mark := q.ConsoleMark()
+	cursor := q.ConsoleCursor()
+	var lines []string
+	c.patterns.add(ConsolePattern{Name: "OnConsoleLine", Regexp: anyLineRe, Severity: PATTERN_CALLBACK, Callback: func(line string) {
+		lines = append(lines, line)
+	}})
+	c.patterns.add(ConsolePattern{Name: "bad passphrase", Regexp: regexp.MustCompile("^bad passphrase"), Severity: PATTERN_FAIL})
+	var out bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		c.pump(&out)
+		close(done)
+	}()
+
+	_, err := server.Write([]byte("Enter passphrase: hun"))
+	require.NoError(t, err)
+	_, err = server.Write([]byte("ter2\r\nunlocked with hunter2\r\n[    1.000000] key hunter2\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, c.expect("unlocked"))
+	m, err := cursor.ExpectRE(regexp.MustCompile(`unlocked with (.*)`))
+	require.NoError(t, err)
+	require.Equal(t, "[REDACTED]", m.Groups[1])
+	require.Equal(t, []string{"Enter passphrase: [REDACTED]"}, m.Before)
+	require.NoError(t, c.expect("key"))
+	since, err := q.ConsoleSince(mark)
+	require.NoError(t, err)
+	require.Equal(t, "Enter passphrase: [REDACTED]\nunlocked with [REDACTED]\n[    1.000000] key [REDACTED]\n", since)
+	require.Equal(t, "key [REDACTED]", q.KernelMessages()[0].Message)
+	_, err = server.Write([]byte("bad passphrase hunter2\r\n"))
+	require.NoError(t, err)
+	_ = server.Close()
+	<-done
+	require.Equal(t, "Enter passphrase: [REDACTED]\nunlocked with [REDACTED]\n[    1.000000] key [REDACTED]\nbad passphrase [REDACTED]\n", out.String())
+	require.Equal(t, []string{"Enter passphrase: [REDACTED]", "unlocked with [REDACTED]", "[    1.000000] key [REDACTED]", "bad passphrase [REDACTED]"}, lines)
+	require.EqualError(t, c.patterns.firstFailure(), `console failure pattern "bad passphrase" matched: bad passphrase [REDACTED]`)
+
+	_, err = c.expectMatch("hunter2 accepted", func(line []byte) []int { return nil })
+	var expectErr *ConsoleExpectError
+	require.ErrorAs(t, err, &expectErr)
+	require.NotContains(t, err.Error(), "hunter2")
+}
+
+func TestConsoleCursor(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	go c.pump(nil)
+	q := &Qemu{console: c}
+
+	_, _ = server.Write([]byte("old line\n"))
+	require.NoError(t, q.ConsoleExpect("old line"))
+
+	panics := q.ConsoleCursor()
+	driver := q.ConsoleCursor()
+	panicked := make(chan *ConsoleMatch)
+	go func() {
+		m, err := panics.ExpectRE(regexp.MustCompile(`Kernel panic - (.*)`))
+		require.NoError(t, err)
+		panicked <- m
+	}()
+
+	_, _ = server.Write([]byte("login: "))
+	require.NoError(t, driver.Expect("login:"))
+	_, _ = server.Write([]byte("root\nPassword: "))
+	require.NoError(t, driver.Expect("Password:"))
+	_, _ = server.Write([]byte("\nKernel panic - not syncing: test\n"))
+
+	m := <-panicked
+	require.Equal(t, "not syncing: test", m.Groups[1])
+	require.Equal(t, []string{"login: root", "Password: "}, m.Before)
+	require.Equal(t, int64(len("old line\nlogin: root\nPassword: \n")), m.Offset)
+
+	// the shared expectations see the whole output
+	require.NoError(t, q.ConsoleExpect("login: root"))
+
+	driver.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	require.ErrorIs(t, driver.Expect("never printed"), ErrConsoleTimeout)
+	driver.SetDeadline(time.Time{})
+
+	_ = server.Close()
+	// the consumed output is not matched again
+	var expectErr *ConsoleExpectError
+	require.ErrorAs(t, driver.Expect("Password:"), &expectErr)
+}
+
+func TestConsoleConcurrency(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{coalesce: true})
+	go c.pump(io.Discard)
+	q := &Qemu{console: c}
+
+	const lines = 200
+	go func() {
+		for i := 0; i < lines; i++ {
+			_, _ = fmt.Fprintf(server, "line %d\n", i)
+		}
+		_, _ = server.Write([]byte("done"))
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cursor := q.ConsoleCursor()
+			for !q.ConsoleContains("done") {
+				_ = q.ConsoleStats()
+				_, _ = q.ConsoleSince(q.ConsoleMark())
+				_ = c.lastLine()
+			}
+			require.NoError(t, cursor.Expect("done"))
+		}()
+	}
+	// the shared expectations are serialized, each line is consumed once
+	var matched int32
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				_, err := q.ConsoleExpectMatch("line")
+				require.NoError(t, err)
+				if atomic.AddInt32(&matched, 1) >= lines/2 {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, q.ConsoleExpect("done"))
+	_ = server.Close()
+}
@@ -0,0 +1,79 @@
+package vmtest
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CoverageTag is a 9p mount tag of the coverage share
+const CoverageTag = "vmtest-coverage"
+
+// QemuCoverage collects coverage data produced inside the guest (Go binaries built with -cover, kernel gcov/kcov dumps).
+//
+// The guest gets a writable 9p share with CoverageTag mount tag. Guest code writes coverage files there,
+// e.g. Go binaries with 'GOCOVERDIR=/mnt/coverage'. When the VM stops the files are copied to OutputDir,
+// where 'go tool covdata' can merge them with the host test coverage.
+type QemuCoverage struct {
+	// OutputDir is a host directory that receives the coverage files. Default is the host test coverage directory:
+	// '-test.gocoverdir' flag value or $GOCOVERDIR.
+	OutputDir string
+}
+
+// outputDir returns the configured or the host test coverage directory
+func (c *QemuCoverage) outputDir() (string, error) {
+	if c.OutputDir != "" {
+		return c.OutputDir, nil
+	}
+	if f := flag.Lookup("test.gocoverdir"); f != nil && f.Value.String() != "" {
+		return f.Value.String(), nil
+	}
+	if dir := os.Getenv("GOCOVERDIR"); dir != "" {
+		return dir, nil
+	}
+	return "", fmt.Errorf("coverage output directory is not specified and host test coverage is not enabled")
+}
+
+// collectCoverage copies files from the coverage share to the output directory
+func collectCoverage(shareDir, outputDir string) error {
+	if err := os.MkdirAll(outputDir, 0o755); err != nil {
+		return err
+	}
+	return filepath.Walk(shareDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(shareDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(outputDir, rel)
+		if info.IsDir() {
+			return os.MkdirAll(dest, 0o755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFile(path, dest)
+	})
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,24 @@
+package vmtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectCoverage(t *testing.T) {
+	share := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(share, "kernel"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(share, "covmeta.1234"), []byte("meta"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(share, "kernel", "kcov.out"), []byte("kcov"), 0o644))
+
+	output := filepath.Join(t.TempDir(), "out")
+	require.NoError(t, collectCoverage(share, output))
+
+	data, err := os.ReadFile(filepath.Join(output, "kernel", "kcov.out"))
+	require.NoError(t, err)
+	require.Equal(t, "kcov", string(data))
+	require.FileExists(t, filepath.Join(output, "covmeta.1234"))
+}
@@ -0,0 +1,99 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CrashDumpTag is a 9p mount tag of the crash dump share
+const CrashDumpTag = "vmtest-crash"
+
+// QemuCrashDump reserves memory for a Linux crash kernel and shares a host directory where the guest kdump
+// saves the vmcore after a panic.
+//
+// The guest is responsible for loading the crash kernel (e.g. 'kexec -p') and for configuring kdump
+// to mount the share with CrashDumpTag mount tag and to write the dump there, as 'vmcore' file or
+// 'vmcore*' files in a subdirectory.
+type QemuCrashDump struct {
+	// CrashKernel is a size of the memory reserved for the crash kernel ('crashkernel=' kernel parameter),
+	// default is 256M
+	CrashKernel string
+	// Dir is a host directory that receives the dumps. If empty then every VM start creates a temporary directory
+	// in QemuOptions.ScratchDir, see Qemu.CrashDumpDir(). The directory is not removed when the VM stops so
+	// the dump outlives the test.
+	Dir string
+}
+
+// crashDumpDir prepares the crash dump host directory, the temporary one is created in scratch
+func (c *QemuCrashDump) crashDumpDir(scratch, pattern string) (string, error) {
+	if c.Dir != "" {
+		return c.Dir, os.MkdirAll(c.Dir, 0o777)
+	}
+	return os.MkdirTemp(scratch, pattern)
+}
+
+func (c *QemuCrashDump) kernelParam() string {
+	if c.CrashKernel == "" {
+		return "256M"
+	}
+	return c.CrashKernel
+}
+
+// findCrashDump looks for a vmcore file under dir
+func findCrashDump(dir string) (string, error) {
+	var found string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if found == "" && info.Mode().IsRegular() && strings.HasPrefix(info.Name(), "vmcore") && !strings.HasSuffix(info.Name(), ".tmp") {
+			found = path
+		}
+		return nil
+	})
+	return found, err
+}
+
+// CrashDumpDir returns the host directory that receives the crash dumps of the VM, it is empty unless
+// QemuOptions.CrashDump is set
+func (q *Qemu) CrashDumpDir() string {
+	return q.crashDumpDir
+}
+
+// CrashDump returns a host path of the vmcore saved by the guest kdump or an empty string if there is no dump
+func (q *Qemu) CrashDump() (string, error) {
+	if q.crashDumpDir == "" {
+		return "", fmt.Errorf("crash dumps are not enabled, see QemuOptions.CrashDump")
+	}
+	return findCrashDump(q.crashDumpDir)
+}
+
+// WaitCrashDump waits until the guest kdump saves the vmcore and returns its host path.
+// The dump is considered complete once the file size stops changing.
+func (q *Qemu) WaitCrashDump(timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+	var lastSize int64 = -1
+	for {
+		path, err := q.CrashDump()
+		if err != nil {
+			return "", err
+		}
+		if path != "" {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return "", err
+			}
+			if fi.Size() > 0 && fi.Size() == lastSize {
+				return path, nil
+			}
+			lastSize = fi.Size()
+		}
+		if time.Now().After(deadline) {
+			return "", fmt.Errorf("no crash dump found after %v", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,51 @@
+package vmtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCrashDump(t *testing.T) {
+	_, err := (&Qemu{}).CrashDump()
+	require.ErrorContains(t, err, "not enabled")
+
+	dir := t.TempDir()
+	q := &Qemu{crashDumpDir: dir}
+	path, err := q.CrashDump()
+	require.NoError(t, err)
+	require.Empty(t, path)
+
+	// kdump writes the dump into a timestamped subdirectory under a temporary name first
+	dumpDir := filepath.Join(dir, "127.0.0.1-2024-01-01-00:00:00")
+	require.NoError(t, os.Mkdir(dumpDir, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dumpDir, "vmcore-incomplete.tmp"), []byte("core"), 0o644))
+	path, err = q.CrashDump()
+	require.NoError(t, err)
+	require.Empty(t, path)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dumpDir, "vmcore"), []byte("core"), 0o644))
+	path, err = q.WaitCrashDump(5 * time.Second)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dumpDir, "vmcore"), path)
+
+	_, err = (&Qemu{crashDumpDir: t.TempDir()}).WaitCrashDump(0)
+	require.ErrorContains(t, err, "no crash dump")
+}
+
+func TestCrashDumpDir(t *testing.T) {
+	useFakeQemu(t)
+	opts := QemuOptions{Kernel: "testdata/hello-arm.bin", CrashDump: &QemuCrashDump{}, ScratchDir: t.TempDir()}
+	q, err := NewQemu(&opts)
+	require.NoError(t, err)
+	defer q.Kill()
+
+	require.Empty(t, opts.CrashDump.Dir)
+	require.DirExists(t, q.CrashDumpDir())
+	require.Equal(t, opts.ScratchDir, filepath.Dir(q.CrashDumpDir()))
+	virtfs, _ := paramValue(q.Cmdline(), "-virtfs")
+	require.Contains(t, virtfs, "path="+q.CrashDumpDir()+",mount_tag="+CrashDumpTag)
+}
@@ -0,0 +1,70 @@
+package vmtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrNoSpace is returned when a directory has not enough free space for the VM files
+var ErrNoSpace = errors.New("not enough free disk space")
+
+// defaultMinFreeSpace is the free space required for the VM temporary files unless QemuOptions.MinFreeSpace is set
+const defaultMinFreeSpace = 256 << 20
+
+// CheckFreeSpace returns an error wrapping ErrNoSpace if the filesystem of dir has less than need bytes available.
+// It is useful before creating large overlays and images.
+func CheckFreeSpace(dir string, need int64) error {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return fmt.Errorf("statfs %v: %v", dir, err)
+	}
+	avail := int64(st.Bavail) * int64(st.Bsize)
+	if avail < need {
+		return fmt.Errorf("%w at %v: %v MiB available, %v MiB needed", ErrNoSpace, dir, avail>>20, (need+(1<<20)-1)>>20)
+	}
+	return nil
+}
+
+// scratchDir returns the directory for the large VM files like crash dumps and wrapper reports
+func scratchDir(opts *QemuOptions) string {
+	if opts.ScratchDir != "" {
+		return opts.ScratchDir
+	}
+	return os.TempDir()
+}
+
+// checkVMSpace verifies there is enough free space for the temporary files (QemuOptions.TempDir) and the large
+// artifacts (QemuOptions.ScratchDir)
+func checkVMSpace(opts *QemuOptions) error {
+	need := opts.MinFreeSpace
+	if need == 0 {
+		need = defaultMinFreeSpace
+	}
+	if need < 0 {
+		return nil
+	}
+	for _, dir := range []string{opts.TempDir, opts.ScratchDir} {
+		if dir != "" {
+			if err := os.MkdirAll(dir, 0o755); err != nil {
+				return err
+			}
+		}
+	}
+	temp := opts.TempDir
+	if temp == "" {
+		temp = os.TempDir()
+	}
+	dirs := []string{temp}
+	if scratch := scratchDir(opts); scratch != temp {
+		dirs = append(dirs, scratch)
+	}
+	for _, dir := range dirs {
+		if err := CheckFreeSpace(dir, need); err != nil {
+			return err
+		}
+	}
+	return nil
+}
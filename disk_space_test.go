@@ -0,0 +1,23 @@
+package vmtest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFreeSpace(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, CheckFreeSpace(dir, 1))
+	require.ErrorIs(t, CheckFreeSpace(dir, 1<<62), ErrNoSpace)
+
+	scratch := filepath.Join(dir, "scratch")
+	require.NoError(t, checkVMSpace(&QemuOptions{ScratchDir: scratch}))
+	require.DirExists(t, scratch)
+	temp := filepath.Join(dir, "temp")
+	require.NoError(t, checkVMSpace(&QemuOptions{TempDir: temp}))
+	require.DirExists(t, temp)
+	require.ErrorIs(t, checkVMSpace(&QemuOptions{MinFreeSpace: 1 << 62}), ErrNoSpace)
+	require.NoError(t, checkVMSpace(&QemuOptions{MinFreeSpace: -1}))
+}
@@ -0,0 +1,96 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Environment variables that augment every VM started by vmtest, they allow CI operators to tune
+// the emulator globally without patching the tests
+const (
+	// EnvQemuBinary overrides the qemu binary, e.g. '/opt/qemu/bin/qemu-system-x86_64'
+	EnvQemuBinary = "VMTEST_QEMU_BINARY"
+	// EnvQemuExtraArgs is a list of additional qemu parameters in shell syntax, e.g. "-accel tcg,thread=multi".
+	// They are appended to the end of the command line.
+	EnvQemuExtraArgs = "VMTEST_QEMU_EXTRA_ARGS"
+)
+
+// qemuBinary returns the qemu binary name for the architecture unless it is overridden with EnvQemuBinary
+func qemuBinary(arch QemuArchitecture) string {
+	if binary := os.Getenv(EnvQemuBinary); binary != "" {
+		return binary
+	}
+	return fmt.Sprintf("qemu-system-%v", arch)
+}
+
+// envExtraArgs returns qemu parameters specified with EnvQemuExtraArgs
+func envExtraArgs() ([]string, error) {
+	args, err := splitShellWords(os.Getenv(EnvQemuExtraArgs))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", EnvQemuExtraArgs, err)
+	}
+	return args, nil
+}
+
+// splitShellWords splits the string into words the way POSIX shell does it, honoring single quotes,
+// double quotes and backslash escapes. Variables and globs are not expanded.
+func splitShellWords(s string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune // the current quote character or 0
+		escaped bool
+	)
+	for _, c := range s {
+		switch {
+		case escaped:
+			// inside double quotes backslash escapes only the special characters
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", c) {
+				word.WriteRune('\\')
+			}
+			if c != '\n' { // backslash-newline is a line continuation
+				word.WriteRune(c)
+			}
+			escaped = false
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\\':
+			escaped = true
+			inWord = true
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if escaped {
+		return nil, fmt.Errorf("trailing backslash in %q", s)
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in %q", quote, s)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,40 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitShellWords(t *testing.T) {
+	tests := []struct {
+		input string
+		words []string
+	}{
+		{"", nil},
+		{"  -accel tcg,thread=multi  ", []string{"-accel", "tcg,thread=multi"}},
+		{`-append 'console=ttyS0 quiet'`, []string{"-append", "console=ttyS0 quiet"}},
+		{`-name "vm \"one\"" a\ b`, []string{"-name", `vm "one"`, "a b"}},
+		{`"a\nb" 'c\d' ''`, []string{`a\nb`, `c\d`, ""}},
+	}
+	for _, test := range tests {
+		words, err := splitShellWords(test.input)
+		require.NoError(t, err, test.input)
+		require.Equal(t, test.words, words, test.input)
+	}
+
+	_, err := splitShellWords(`-name "unterminated`)
+	require.Error(t, err)
+	_, err = splitShellWords(`trailing\`)
+	require.Error(t, err)
+}
+
+func TestEnvironmentOverrides(t *testing.T) {
+	t.Setenv(EnvQemuBinary, "/opt/qemu/bin/qemu-system-x86_64")
+	t.Setenv(EnvQemuExtraArgs, "-accel tcg,thread=multi")
+
+	argv, err := BuildCmdline(&QemuOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "/opt/qemu/bin/qemu-system-x86_64", argv[0])
+	require.Equal(t, []string{"-accel", "tcg,thread=multi"}, argv[len(argv)-2:])
+}
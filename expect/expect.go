@@ -0,0 +1,205 @@
+// Package expect exposes a vmtest VM console with the API of github.com/Netflix/go-expect, so the test helpers
+// written for go-expect can drive the VMs by switching the import path. The package does not depend on go-expect.
+//
+// The console is read with vmtest.ConsoleCursor, the matchers are checked against a single console line
+// (including the line being printed, e.g. a prompt) rather than the whole output read since the previous match.
+package expect
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anatol/vmtest"
+)
+
+// neverRe does not match anything, it waits for EOF
+var neverRe = regexp.MustCompile(`[^\s\S]`)
+
+// cursorVM is implemented by the vmtest backends
+type cursorVM interface {
+	vmtest.VM
+	ConsoleCursor() *vmtest.ConsoleCursor
+}
+
+// ConsoleOpts configures a Console
+type ConsoleOpts struct {
+	// ExpectTimeout is the default timeout of the expectations, zero waits till the console is closed
+	ExpectTimeout *time.Duration
+}
+
+// ConsoleOpt is an option of NewConsole()
+type ConsoleOpt func(*ConsoleOpts) error
+
+// WithDefaultTimeout sets the timeout of the expectations that do not specify one with WithTimeout()
+func WithDefaultTimeout(timeout time.Duration) ConsoleOpt {
+	return func(opts *ConsoleOpts) error {
+		opts.ExpectTimeout = &timeout
+		return nil
+	}
+}
+
+// Console is the go-expect Console of a VM. The expectations consume the output printed after NewConsole()
+// for this Console only, vmtest expectations of the VM are not affected.
+type Console struct {
+	vm     vmtest.VM
+	cursor *vmtest.ConsoleCursor
+	opts   ConsoleOpts
+}
+
+// NewConsole returns the Console of vm, one of the vmtest backends
+func NewConsole(vm vmtest.VM, opts ...ConsoleOpt) (*Console, error) {
+	c, ok := vm.(cursorVM)
+	if !ok {
+		return nil, fmt.Errorf("VM %T does not provide console cursors", vm)
+	}
+	console := &Console{vm: vm, cursor: c.ConsoleCursor()}
+	for _, opt := range opts {
+		if err := opt(&console.opts); err != nil {
+			return nil, err
+		}
+	}
+	return console, nil
+}
+
+// Send writes the string to the console
+func (c *Console) Send(s string) (int, error) {
+	if err := c.vm.ConsoleWrite(s); err != nil {
+		return 0, err
+	}
+	return len(s), nil
+}
+
+// SendLine writes the string followed by a newline to the console
+func (c *Console) SendLine(s string) (int, error) {
+	return c.Send(s + "\n")
+}
+
+// ExpectString waits until the console prints s
+func (c *Console) ExpectString(s string) (string, error) {
+	return c.Expect(String(s))
+}
+
+// ExpectEOF waits until the console is closed, i.e. the VM is stopped
+func (c *Console) ExpectEOF() (string, error) {
+	return c.Expect(EOF)
+}
+
+// Expect waits until one of the matchers matches and returns the output read until the end of the matched line.
+// The rest of the line is not matched by the following expectations.
+func (c *Console) Expect(opts ...ExpectOpt) (string, error) {
+	var options ExpectOpts
+	for _, opt := range opts {
+		if err := opt(&options); err != nil {
+			return "", err
+		}
+	}
+	re := neverRe
+	if len(options.Regexps) > 0 {
+		alternatives := make([]string, len(options.Regexps))
+		for i, r := range options.Regexps {
+			alternatives[i] = "(?:" + r.String() + ")"
+		}
+		var err error
+		if re, err = regexp.Compile(strings.Join(alternatives, "|")); err != nil {
+			return "", err
+		}
+	} else if !options.EOF {
+		return "", fmt.Errorf("no matchers are given")
+	}
+
+	timeout := c.opts.ExpectTimeout
+	if options.ReadTimeout != nil {
+		timeout = options.ReadTimeout
+	}
+	if timeout != nil {
+		c.cursor.SetDeadline(time.Now().Add(*timeout))
+		defer c.cursor.SetDeadline(time.Time{})
+	}
+
+	m, err := c.cursor.ExpectRE(re)
+	if err != nil {
+		var expectErr *vmtest.ConsoleExpectError
+		if options.EOF && errors.Is(err, io.EOF) && errors.As(err, &expectErr) {
+			return joinLines(expectErr.Lines), nil
+		}
+		return "", err
+	}
+	return joinLines(m.Before) + m.Line, nil
+}
+
+// Close releases the Console, the VM keeps running
+func (c *Console) Close() error {
+	return nil
+}
+
+func joinLines(lines []string) string {
+	var b strings.Builder
+	for _, l := range lines {
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// ExpectOpts are the matchers and the timeout of an expectation
+type ExpectOpts struct {
+	// Regexps are the patterns, any of them satisfies the expectation
+	Regexps []*regexp.Regexp
+	// EOF makes the closed console satisfy the expectation
+	EOF bool
+	// ReadTimeout overrides the default timeout of the Console
+	ReadTimeout *time.Duration
+}
+
+// ExpectOpt is an option of Console.Expect()
+type ExpectOpt func(*ExpectOpts) error
+
+// String matches any of the strings
+func String(strs ...string) ExpectOpt {
+	return func(opts *ExpectOpts) error {
+		for _, s := range strs {
+			opts.Regexps = append(opts.Regexps, regexp.MustCompile(regexp.QuoteMeta(s)))
+		}
+		return nil
+	}
+}
+
+// Regexp matches any of the regular expressions
+func Regexp(res ...*regexp.Regexp) ExpectOpt {
+	return func(opts *ExpectOpts) error {
+		opts.Regexps = append(opts.Regexps, res...)
+		return nil
+	}
+}
+
+// RegexpPattern matches any of the regular expression patterns
+func RegexpPattern(ps ...string) ExpectOpt {
+	return func(opts *ExpectOpts) error {
+		for _, p := range ps {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return err
+			}
+			opts.Regexps = append(opts.Regexps, re)
+		}
+		return nil
+	}
+}
+
+// EOF matches the closed console
+func EOF(opts *ExpectOpts) error {
+	opts.EOF = true
+	return nil
+}
+
+// WithTimeout fails the expectation with vmtest.ErrConsoleTimeout after the timeout
+func WithTimeout(timeout time.Duration) ExpectOpt {
+	return func(opts *ExpectOpts) error {
+		opts.ReadTimeout = &timeout
+		return nil
+	}
+}
@@ -0,0 +1,54 @@
+package expect
+
+import (
+	"bufio"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/anatol/vmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsole(t *testing.T) {
+	client, server := net.Pipe()
+	vm, err := vmtest.NewExternal(&vmtest.ExternalOptions{Conn: client})
+	require.NoError(t, err)
+	defer vm.Kill()
+
+	c, err := NewConsole(vm, WithDefaultTimeout(10*time.Second))
+	require.NoError(t, err)
+
+	go func() {
+		_, _ = server.Write([]byte("Welcome\r\nlogin: "))
+		r := bufio.NewReader(server)
+		line, _ := r.ReadString('\n')
+		_, _ = server.Write([]byte("\r\nHello " + line))
+		_, _ = r.ReadString('\n')
+		_, _ = server.Write([]byte("bye\r\n"))
+		_ = server.Close()
+	}()
+
+	out, err := c.ExpectString("login: ")
+	require.NoError(t, err)
+	require.Equal(t, "Welcome\nlogin: ", out)
+	_, err = c.SendLine("root")
+	require.NoError(t, err)
+
+	out, err = c.Expect(RegexpPattern(`Hello (\w+)`), String("Password:"))
+	require.NoError(t, err)
+	require.Equal(t, "\nHello root", out)
+
+	_, err = c.Expect(Regexp(regexp.MustCompile(`never`)), WithTimeout(50*time.Millisecond))
+	require.ErrorIs(t, err, vmtest.ErrConsoleTimeout)
+	_, err = c.SendLine("exit")
+	require.NoError(t, err)
+
+	out, err = c.ExpectEOF()
+	require.NoError(t, err)
+	require.Equal(t, "bye\n", out)
+
+	_, err = c.Expect()
+	require.Error(t, err)
+}
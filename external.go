@@ -0,0 +1,165 @@
+package vmtest
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ExternalOptions options for attaching to a VM that is not started by vmtest
+type ExternalOptions struct {
+	// Console is the VM console endpoint, one of:
+	//  'unix:/path/to/socket' - unix socket, e.g. qemu '-serial unix:/path,server'
+	//  'tcp:host:port' - TCP socket, e.g. qemu '-serial tcp::4444,server' or a serial console server
+	//  'pty:/dev/pts/N' - pseudo terminal or any other character device, e.g. qemu '-serial pty'
+	//  'ssh:[user@]host' - shell session started with 'ssh -tt'
+	Console string
+	// Conn is an already established console connection, it is used instead of Console
+	Conn io.ReadWriteCloser
+	// ShutdownHook is called by Shutdown(), it should power off the VM gracefully
+	ShutdownHook func() error
+	// KillHook is called by Kill(), it should stop the VM immediately
+	KillHook func() error
+	// Enable debug output
+	Verbose bool
+}
+
+// External is a VM managed by an infrastructure outside of vmtest. It provides the console API for it.
+type External struct {
+	console      *console
+	shutdownHook func() error
+	killHook     func() error
+	closeOnce    sync.Once
+}
+
+var _ VM = (*External)(nil) // ensure External implements VM interface
+
+// NewExternal attaches to the console of an already running VM
+func NewExternal(opts *ExternalOptions) (*External, error) {
+	conn := opts.Conn
+	if conn == nil {
+		var err error
+		conn, err = dialConsole(opts.Console)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	e := &External{
+		console:      newConsole(conn, consoleConfig{}),
+		shutdownHook: opts.ShutdownHook,
+		killHook:     opts.KillHook,
+	}
+	go e.console.pump(verboseStdout(opts.Verbose))
+
+	return e, nil
+}
+
+// dialConsole connects to the console endpoint in the ExternalOptions.Console format
+func dialConsole(endpoint string) (io.ReadWriteCloser, error) {
+	scheme, addr, ok := strings.Cut(endpoint, ":")
+	if !ok || addr == "" {
+		return nil, fmt.Errorf("invalid console endpoint %q", endpoint)
+	}
+	switch scheme {
+	case "unix", "tcp":
+		return net.Dial(scheme, addr)
+	case "pty":
+		return os.OpenFile(addr, os.O_RDWR, 0)
+	case "ssh":
+		return dialSSHConsole(addr)
+	default:
+		return nil, fmt.Errorf("unknown console endpoint type %q", scheme)
+	}
+}
+
+// cmdConn is a console connected to stdin/stdout of a process
+type cmdConn struct {
+	cmd *exec.Cmd
+	io.Reader
+	io.WriteCloser
+}
+
+func (c *cmdConn) Close() error {
+	_ = c.WriteCloser.Close()
+	if c.cmd.Process != nil {
+		_ = c.cmd.Process.Kill()
+	}
+	_ = c.cmd.Wait()
+	return nil
+}
+
+func dialSSHConsole(host string) (io.ReadWriteCloser, error) {
+	// -tt forces a terminal allocation so the remote shell is interactive even without local tty
+	return startSSHConsole((&SSHOptions{Host: host}).command("-tt"))
+}
+
+// startSSHConsole starts the ssh client with the console attached to its stdin and stdout
+func startSSHConsole(cmd *exec.Cmd) (io.ReadWriteCloser, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting ssh: %v", err)
+	}
+	return &cmdConn{cmd: cmd, Reader: stdout, WriteCloser: stdin}, nil
+}
+
+func (e *External) close() {
+	e.closeOnce.Do(func() {
+		_ = e.console.conn.Close()
+	})
+}
+
+// Shutdown calls ShutdownHook and detaches from the console
+func (e *External) Shutdown() {
+	if e.shutdownHook != nil {
+		if err := e.shutdownHook(); err != nil {
+			log.Printf("shutdown hook: %v", err)
+		}
+	}
+	e.close()
+}
+
+// Kill calls KillHook and detaches from the console
+func (e *External) Kill() {
+	if e.killHook != nil {
+		if err := e.killHook(); err != nil {
+			log.Printf("kill hook: %v", err)
+		}
+	}
+	e.close()
+}
+
+// ConsoleExpect waits until the vm console matches str
+func (e *External) ConsoleExpect(str string) error {
+	return e.console.expect(str)
+}
+
+// ConsoleExpectRE waits until the vm console matches regexp provided by re
+// returns array of matched strings
+func (e *External) ConsoleExpectRE(re *regexp.Regexp) ([]string, error) {
+	return e.console.expectRE(re)
+}
+
+// ConsoleWrite writes given string to the vm console
+func (e *External) ConsoleWrite(str string) error {
+	return e.console.write(str)
+}
+
+// ConsoleReader returns a reader of the console output that is not consumed by expectations yet
+func (e *External) ConsoleReader() io.Reader {
+	return e.console
+}
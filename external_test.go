@@ -0,0 +1,52 @@
+package vmtest
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalConsole(t *testing.T) {
+	socket := path.Join(t.TempDir(), "console.socket")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = conn.Write([]byte("Welcome\r\nlogin: "))
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		_, _ = conn.Write([]byte("hello " + line))
+	}()
+
+	killed := false
+	vm, err := NewExternal(&ExternalOptions{
+		Console:  "unix:" + socket,
+		KillHook: func() error { killed = true; return nil },
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, vm.ConsoleExpect("login:"))
+	require.NoError(t, vm.ConsoleWrite("root\n"))
+	m, err := vm.ConsoleExpectRE(regexp.MustCompile(`hello (\w+)`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"root"}, m)
+
+	vm.Kill()
+	require.True(t, killed)
+}
+
+func TestExternalConsoleEndpoint(t *testing.T) {
+	_, err := dialConsole("/dev/ttyS0")
+	require.Error(t, err)
+	_, err = dialConsole("serial:/dev/ttyS0")
+	require.Error(t, err)
+}
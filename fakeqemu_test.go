@@ -0,0 +1,138 @@
+package vmtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeQemuEnv makes the test binary act as qemu, see useFakeQemu()
+const fakeQemuEnv = "VMTEST_FAKE_QEMU"
+
+// fakeQemuIgnoreEnv is a comma separated list of the monitor and QMP commands the fake qemu replies to but
+// does not perform, e.g. to emulate a guest that ignores the power button
+const fakeQemuIgnoreEnv = "VMTEST_FAKE_QEMU_IGNORE"
+
+// fakeQemuExitEnv makes the fake qemu exit with the given status before it connects to the sockets, e.g. to
+// emulate qemu crashing at the start
+const fakeQemuExitEnv = "VMTEST_FAKE_QEMU_EXIT"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeQemuEnv) != "" {
+		fakeQemu(os.Args[1:])
+	}
+	os.Exit(m.Run())
+}
+
+// useFakeQemu makes the VMs of the test launch the test binary instead of qemu. The fake connects to the vmtest
+// sockets, replies to every QMP command with an empty result and prints "fake qemu started" to the console.
+// It exits on 'quit' commands and powers off on 'system_powerdown' (both the monitor and QMP ones) or once
+// the guest writes "poweroff" line to the console. With '-no-shutdown' it pauses instead of exiting at power off.
+func useFakeQemu(t *testing.T) {
+	t.Setenv(EnvQemuBinary, os.Args[0])
+	t.Setenv(EnvQemuExtraArgs, "")
+	t.Setenv(fakeQemuEnv, "1")
+}
+
+func fakeQemu(args []string) {
+	if status := os.Getenv(fakeQemuExitEnv); status != "" {
+		code, _ := strconv.Atoi(status)
+		os.Exit(code)
+	}
+	dial := func(flag string) net.Conn {
+		for i := 0; i+1 < len(args); i++ {
+			if args[i] != flag {
+				continue
+			}
+			network, addr, _ := strings.Cut(args[i+1], ":")
+			conn, err := net.Dial(network, addr)
+			if err != nil {
+				os.Exit(2)
+			}
+			return conn
+		}
+		os.Exit(2)
+		return nil
+	}
+	monitor := dial("-monitor")
+	console := dial("-serial")
+	qmp := dial("-qmp")
+
+	noShutdown := false
+	for _, a := range args {
+		noShutdown = noShutdown || a == "-no-shutdown"
+	}
+	ignored := map[string]bool{}
+	for _, cmd := range strings.Split(os.Getenv(fakeQemuIgnoreEnv), ",") {
+		ignored[cmd] = true
+	}
+
+	var qmpMutex sync.Mutex
+	send := func(msg string) {
+		qmpMutex.Lock()
+		defer qmpMutex.Unlock()
+		_, _ = qmp.Write([]byte(msg + "\n"))
+	}
+	event := func(name, data string) {
+		send(`{"event": "` + name + `", "data": ` + data + `, "timestamp": {"seconds": 1, "microseconds": 2}}`)
+	}
+	powerOff := func() {
+		event("SHUTDOWN", `{"guest": true, "reason": "guest-shutdown"}`)
+		if noShutdown {
+			event("STOP", `{}`)
+			return
+		}
+		os.Exit(0)
+	}
+
+	go func() {
+		send(`{"QMP": {"version": {}, "capabilities": []}}`)
+		scanner := bufio.NewScanner(qmp)
+		for scanner.Scan() {
+			var cmd qmpCommand
+			if err := json.Unmarshal(scanner.Bytes(), &cmd); err != nil {
+				os.Exit(3)
+			}
+			send(`{"return": {}}`)
+			if ignored[cmd.Execute] {
+				continue
+			}
+			switch cmd.Execute {
+			case "quit":
+				os.Exit(0)
+			case "system_powerdown":
+				powerOff()
+			}
+		}
+		os.Exit(0)
+	}()
+	go func() {
+		scanner := bufio.NewScanner(console)
+		for scanner.Scan() {
+			if strings.TrimSpace(scanner.Text()) == "poweroff" {
+				powerOff()
+			}
+		}
+	}()
+	_, _ = console.Write([]byte("fake qemu started\n"))
+
+	scanner := bufio.NewScanner(monitor)
+	for scanner.Scan() {
+		cmd := strings.TrimSpace(scanner.Text())
+		if ignored[cmd] {
+			continue
+		}
+		switch cmd {
+		case "quit":
+			os.Exit(0)
+		case "system_powerdown":
+			powerOff()
+		}
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,266 @@
+package vmtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// GuestTestFormat is a protocol a guest test runner reports its results with over the console
+type GuestTestFormat int
+
+const (
+	// GUEST_TESTS_TAP is the Test Anything Protocol, e.g. 'prove', bats or kselftest output
+	GUEST_TESTS_TAP GuestTestFormat = iota
+	// GUEST_TESTS_JSON is JSON lines in 'go test -json' (test2json) format
+	GUEST_TESTS_JSON
+)
+
+// GuestTestStatus is a result of a guest test
+type GuestTestStatus string
+
+const (
+	GUEST_TEST_PASS = GuestTestStatus("pass")
+	GUEST_TEST_FAIL = GuestTestStatus("fail")
+	GUEST_TEST_SKIP = GuestTestStatus("skip")
+)
+
+// GuestTestResult is a single test reported by the guest
+type GuestTestResult struct {
+	Name   string
+	Status GuestTestStatus
+	// Reason is the skip reason or the TAP directive explanation
+	Reason string
+	// Output are the lines the guest printed for the test: the TAP diagnostics and YAML block or
+	// the test2json output
+	Output []string
+	// Elapsed is the test run time, if reported
+	Elapsed time.Duration
+	// KernelMessages are the kernel log records printed while a failed kernel test ran, see RunKselftests()
+	// and KUnitResults()
+	KernelMessages KernelMessages
+}
+
+// guestTestParser converts the console lines to the test results
+type guestTestParser interface {
+	// line processes a console line, it returns the completed results and whether the suite is finished
+	line(l string) ([]GuestTestResult, bool, error)
+}
+
+// ConsoleGuestTests reads the results of a guest test suite from the console and reports every guest test as
+// a subtest of t with the same status, so the guest suite is a part of 'go test' output. The guest test runner
+// must be started already, e.g. with ConsoleWrite(). It returns once the suite finishes.
+func (q *Qemu) ConsoleGuestTests(t *testing.T, format GuestTestFormat) ([]GuestTestResult, error) {
+	results, err := q.console.guestTests(format, func(r GuestTestResult) {
+		t.Run(r.Name, func(t *testing.T) { reportGuestTest(t, r) })
+	})
+	return results, q.reportError(err)
+}
+
+// reportGuestTest sets the status of the subtest
+func reportGuestTest(t *testing.T, r GuestTestResult) {
+	for _, l := range r.Output {
+		t.Log(l)
+	}
+	for _, m := range r.KernelMessages {
+		t.Logf("dmesg: [%12.6f] %v", m.Timestamp.Seconds(), m.Message)
+	}
+	switch r.Status {
+	case GUEST_TEST_FAIL:
+		t.Fail()
+	case GUEST_TEST_SKIP:
+		t.Skip(r.Reason)
+	}
+}
+
+// guestTests parses the guest test results from the console, report is called for every result as soon as it
+// completes
+func (c *console) guestTests(format GuestTestFormat, report func(GuestTestResult)) ([]GuestTestResult, error) {
+	var p guestTestParser
+	switch format {
+	case GUEST_TESTS_TAP:
+		p = &tapParser{}
+	case GUEST_TESTS_JSON:
+		p = &test2jsonParser{}
+	case guestTestsKernel:
+		p = &kernelTestParser{}
+	default:
+		return nil, fmt.Errorf("unknown guest test format %v", format)
+	}
+
+	var results []GuestTestResult
+	var parseErr error
+	err := c.processLines(time.Time{}, func(data []byte, _ time.Time, _ int64) bool {
+		if !bytes.HasSuffix(data, []byte{'\n'}) {
+			return false // the partial line is processed again once it is completed
+		}
+		completed, done, err := p.line(string(bytes.TrimRight(data, "\r\n")))
+		for _, r := range completed {
+			results = append(results, r)
+			report(r)
+		}
+		parseErr = err
+		return done || err != nil
+	})
+	if err == nil {
+		err = parseErr
+	}
+	return results, err
+}
+
+var (
+	tapVersionRe = regexp.MustCompile(`^K?TAP version \d+$`)
+	tapPlanRe    = regexp.MustCompile(`^1\.\.(\d+)\s*(?:#\s*(.*))?$`)
+	tapResultRe  = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?([^#]*?)\s*(?:#\s*(\S+)\s*(.*))?$`)
+)
+
+// tapParser implements GUEST_TESTS_TAP. The lines preceding a result are its diagnostics, the YAML block
+// following it is attached to it too.
+type tapParser struct {
+	started bool
+	planned int // -1 if the plan is not seen yet
+	count   int
+	output  []string
+	// pending is the last result, it is completed by the following line unless that starts a YAML block
+	pending *GuestTestResult
+	yaml    bool
+}
+
+func (p *tapParser) line(l string) ([]GuestTestResult, bool, error) {
+	if !p.started {
+		if !tapVersionRe.MatchString(l) && !tapPlanRe.MatchString(l) && !tapResultRe.MatchString(l) {
+			return nil, false, nil // the output preceding the suite, e.g. the boot messages
+		}
+		p.started = true
+		p.planned = -1
+	}
+
+	if p.pending != nil {
+		if p.yaml {
+			if strings.TrimSpace(l) == "..." {
+				p.yaml = false
+			} else {
+				p.pending.Output = append(p.pending.Output, l)
+			}
+			return nil, false, nil
+		}
+		if strings.TrimSpace(l) == "---" && strings.HasPrefix(l, " ") {
+			p.yaml = true
+			return nil, false, nil
+		}
+	}
+
+	var completed []GuestTestResult
+	flush := func() {
+		if p.pending != nil {
+			completed = append(completed, *p.pending)
+			p.pending = nil
+		}
+	}
+
+	switch {
+	case tapVersionRe.MatchString(l):
+	case strings.HasPrefix(l, "Bail out!"):
+		flush()
+		return completed, true, fmt.Errorf("guest tests bailed out: %v", strings.TrimSpace(strings.TrimPrefix(l, "Bail out!")))
+	case tapPlanRe.MatchString(l):
+		flush()
+		p.planned, _ = strconv.Atoi(tapPlanRe.FindStringSubmatch(l)[1])
+		// a plan following the results ends the suite
+		return completed, p.count > 0 || p.planned == 0, nil
+	case tapResultRe.MatchString(l):
+		flush()
+		p.pending = p.result(tapResultRe.FindStringSubmatch(l))
+		if p.count == p.planned {
+			flush()
+			return completed, true, nil
+		}
+	default:
+		p.output = append(p.output, strings.TrimPrefix(strings.TrimPrefix(l, "#"), " "))
+	}
+	return completed, false, nil
+}
+
+// finish returns the pending result once no YAML block can follow it
+func (p *tapParser) finish() []GuestTestResult {
+	p.yaml = false
+	if p.pending == nil {
+		return nil
+	}
+	r := *p.pending
+	p.pending = nil
+	return []GuestTestResult{r}
+}
+
+func (p *tapParser) result(m []string) *GuestTestResult {
+	p.count++
+	r := &GuestTestResult{Name: m[3], Status: GUEST_TEST_PASS, Output: p.output}
+	p.output = nil
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("test %d", p.count)
+	}
+	if m[1] != "" {
+		r.Status = GUEST_TEST_FAIL
+	}
+	switch strings.ToUpper(m[4]) {
+	case "SKIP", "SKIPPED":
+		r.Status = GUEST_TEST_SKIP
+		r.Reason = m[5]
+	case "TODO":
+		// the failures of TODO tests are expected
+		r.Status = GUEST_TEST_SKIP
+		r.Reason = "TODO " + m[5]
+	}
+	return r
+}
+
+// test2jsonParser implements GUEST_TESTS_JSON
+type test2jsonParser struct {
+	output map[string][]string
+}
+
+func (p *test2jsonParser) line(l string) ([]GuestTestResult, bool, error) {
+	if !strings.HasPrefix(l, "{") {
+		return nil, false, nil
+	}
+	var ev struct {
+		Action  string
+		Test    string
+		Output  string
+		Elapsed float64
+	}
+	if err := json.Unmarshal([]byte(l), &ev); err != nil {
+		return nil, false, nil // not an event, e.g. a JSON log message of the guest
+	}
+	if p.output == nil {
+		p.output = map[string][]string{}
+	}
+	switch ev.Action {
+	case "output":
+		if ev.Test != "" {
+			p.output[ev.Test] = append(p.output[ev.Test], strings.TrimRight(ev.Output, "\n"))
+		}
+	case "pass", "fail", "skip":
+		if ev.Test == "" {
+			// the package result ends the suite
+			return nil, true, nil
+		}
+		r := GuestTestResult{
+			Name:    ev.Test,
+			Status:  GuestTestStatus(ev.Action),
+			Output:  p.output[ev.Test],
+			Elapsed: time.Duration(ev.Elapsed * float64(time.Second)),
+		}
+		delete(p.output, ev.Test)
+		if r.Status == GUEST_TEST_SKIP {
+			r.Reason = "skipped in the guest"
+		}
+		return []GuestTestResult{r}, false, nil
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,64 @@
+package vmtest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func guestTestsConsole(t *testing.T, output string) *console {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	go c.pump(nil)
+	go func() {
+		_, _ = server.Write([]byte(output))
+	}()
+	t.Cleanup(func() { _ = server.Close() })
+	return c
+}
+
+func TestGuestTestsTAP(t *testing.T) {
+	c := guestTestsConsole(t, "[    1.0] systemd: started\r\n# ./run-tests\r\nTAP version 13\r\n1..4\r\n"+
+		"ok 1 - mount\r\n# checking quota\r\nnot ok 2 - quota\r\n  ---\r\n  got: 5\r\n  ...\r\n"+
+		"ok 3 - network # SKIP no carrier\r\nnot ok 4 xattr # TODO not implemented\r\n# ")
+
+	var reported []string
+	results, err := c.guestTests(GUEST_TESTS_TAP, func(r GuestTestResult) { reported = append(reported, r.Name) })
+	require.NoError(t, err)
+	require.Equal(t, []string{"mount", "quota", "network", "xattr"}, reported)
+	require.Equal(t, GuestTestResult{Name: "mount", Status: GUEST_TEST_PASS}, results[0])
+	require.Equal(t, GuestTestResult{Name: "quota", Status: GUEST_TEST_FAIL, Output: []string{"checking quota", "  got: 5"}}, results[1])
+	require.Equal(t, GuestTestResult{Name: "network", Status: GUEST_TEST_SKIP, Reason: "no carrier"}, results[2])
+	require.Equal(t, GUEST_TEST_SKIP, results[3].Status)
+
+	// the plan following the results
+	c = guestTestsConsole(t, "ok\r\nok 2 second\r\n1..2\r\n")
+	results, err = c.guestTests(GUEST_TESTS_TAP, func(GuestTestResult) {})
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	require.Equal(t, "test 1", results[0].Name)
+
+	c = guestTestsConsole(t, "1..3\r\nok 1 first\r\nBail out! disk is missing\r\n")
+	results, err = c.guestTests(GUEST_TESTS_TAP, func(GuestTestResult) {})
+	require.ErrorContains(t, err, "disk is missing")
+	require.Len(t, results, 1)
+}
+
+func TestGuestTestsJSON(t *testing.T) {
+	c := guestTestsConsole(t, `{"Action":"run","Test":"TestMount"}`+"\r\n"+
+		`{"Action":"output","Test":"TestMount","Output":"=== RUN   TestMount\n"}`+"\r\n"+
+		"[    2.0] random: crng init done\r\n"+
+		`{"Action":"pass","Test":"TestMount","Elapsed":0.5}`+"\r\n"+
+		`{"Action":"skip","Test":"TestQuota","Elapsed":0}`+"\r\n"+
+		`{"Action":"pass","Package":"example.com/guest","Elapsed":0.6}`+"\r\n")
+
+	q := &Qemu{console: c}
+	results, err := q.ConsoleGuestTests(t, GUEST_TESTS_JSON)
+	require.NoError(t, err)
+	require.Equal(t, []GuestTestResult{
+		{Name: "TestMount", Status: GUEST_TEST_PASS, Output: []string{"=== RUN   TestMount"}, Elapsed: 500 * time.Millisecond},
+		{Name: "TestQuota", Status: GUEST_TEST_SKIP, Reason: "skipped in the guest"},
+	}, results)
+}
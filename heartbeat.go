@@ -0,0 +1,21 @@
+package vmtest
+
+import (
+	"context"
+	"time"
+)
+
+// heartbeat prints the VM progress every interval till ctx is done, i.e. the qemu process exits.
+// The messages go to VerboseOutput or the standard logger.
+func (q *Qemu) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			q.logf("vm running, %v elapsed, last line: %q", now.Sub(q.startTime).Round(time.Second), q.console.lastLine())
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package img
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// BusyboxOptions configures a minimal initramfs built around busybox
+type BusyboxOptions struct {
+	// Busybox is a path to a statically linked busybox binary for the guest architecture,
+	// default is 'busybox' looked up in $PATH
+	Busybox string
+	// Files maps guest paths to host files copied into the initramfs, e.g. test binaries
+	Files map[string]string
+	// Commands are shell commands executed by the default init script before it starts the console shell
+	Commands []string
+	// Init replaces the default init script. Busybox applets are available in /bin.
+	Init string
+	// Gzip compresses the initramfs, it requires CONFIG_RD_GZIP kernel option
+	Gzip bool
+}
+
+var defaultInit = template.Must(template.New("init").Parse(`#!/bin/busybox sh
+/bin/busybox --install -s /bin
+export PATH=/bin
+mkdir -p /proc /sys /dev /tmp
+mount -t proc proc /proc
+mount -t sysfs sysfs /sys
+mount -t devtmpfs devtmpfs /dev
+{{range .}}{{.}}
+{{end}}setsid cttyhack sh
+poweroff -f
+`))
+
+// BusyboxInitramfs writes an initramfs image to output. The image boots into a root shell at the console.
+func BusyboxInitramfs(output string, opts *BusyboxOptions) error {
+	busybox := opts.Busybox
+	if busybox == "" {
+		var err error
+		if busybox, err = exec.LookPath("busybox"); err != nil {
+			return err
+		}
+	}
+	busyboxData, err := os.ReadFile(busybox)
+	if err != nil {
+		return err
+	}
+
+	init := []byte(opts.Init)
+	if opts.Init == "" {
+		var buf bytes.Buffer
+		if err := defaultInit.Execute(&buf, opts.Commands); err != nil {
+			return err
+		}
+		init = buf.Bytes()
+	}
+	// the uncompressed size bounds the image size
+	need := int64(len(busyboxData) + len(init))
+	for _, host := range opts.Files {
+		fi, err := os.Stat(host)
+		if err != nil {
+			return err
+		}
+		need += fi.Size()
+	}
+	if err := checkOutputSpace(output, need); err != nil {
+		return err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var w io.Writer = f
+	var gz *gzip.Writer
+	if opts.Gzip {
+		gz = gzip.NewWriter(f)
+		w = gz
+	}
+
+	cpio := NewCpioWriter(w)
+	dirs := map[string]bool{}
+	addParents := func(name string) error {
+		var missing []string
+		for dir := path.Dir(name); dir != "/" && dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			missing = append(missing, dir)
+			dirs[dir] = true
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			if err := cpio.AddDir(missing[i], 0o755); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, dir := range []string{"/bin", "/dev", "/proc", "/sys", "/tmp"} {
+		if err := addParents(dir + "/x"); err != nil {
+			return err
+		}
+	}
+	// the kernel opens the initial console before init mounts devtmpfs
+	if err := cpio.AddCharDevice("/dev/console", 0o600, 5, 1); err != nil {
+		return err
+	}
+	if err := cpio.AddFile("/bin/busybox", 0o755, busyboxData); err != nil {
+		return err
+	}
+	if err := cpio.AddSymlink("/bin/sh", "busybox"); err != nil {
+		return err
+	}
+	if err := cpio.AddFile("/init", 0o755, init); err != nil {
+		return err
+	}
+
+	guestPaths := make([]string, 0, len(opts.Files))
+	for p := range opts.Files {
+		guestPaths = append(guestPaths, p)
+	}
+	sort.Strings(guestPaths)
+	for _, p := range guestPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("initramfs file path %q is not absolute", p)
+		}
+		data, err := os.ReadFile(opts.Files[p])
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(opts.Files[p])
+		if err != nil {
+			return err
+		}
+		if err := addParents(p); err != nil {
+			return err
+		}
+		if err := cpio.AddFile(p, uint32(fi.Mode().Perm()), data); err != nil {
+			return err
+		}
+	}
+
+	if err := cpio.Close(); err != nil {
+		return err
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
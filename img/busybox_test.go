@@ -0,0 +1,33 @@
+package img
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBusyboxInitramfs(t *testing.T) {
+	dir := t.TempDir()
+	busybox := filepath.Join(dir, "busybox")
+	require.NoError(t, os.WriteFile(busybox, []byte("ELF"), 0o755))
+	testBinary := filepath.Join(dir, "test")
+	require.NoError(t, os.WriteFile(testBinary, []byte("test"), 0o755))
+
+	output := filepath.Join(dir, "initramfs.cpio")
+	require.NoError(t, BusyboxInitramfs(output, &BusyboxOptions{
+		Busybox:  busybox,
+		Files:    map[string]string{"/usr/local/bin/test": testBinary},
+		Commands: []string{"/usr/local/bin/test"},
+	}))
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	entries := readCpioNames(t, data)
+	require.Equal(t, "ELF", entries["bin/busybox"])
+	require.Equal(t, "test", entries["usr/local/bin/test"])
+	require.Contains(t, entries, "usr/local/bin")
+	require.Contains(t, entries, "dev/console")
+	require.Contains(t, entries["init"], "\n/usr/local/bin/test\nsetsid cttyhack sh\n")
+}
@@ -0,0 +1,90 @@
+package img
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/anatol/vmtest"
+)
+
+// CacheDir returns the directory of downloaded images, it is $XDG_CACHE_HOME/vmtest/images
+func CacheDir() (string, error) {
+	userCache, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(userCache, "vmtest", "images"), nil
+}
+
+// Fetch downloads the file from url to the cache unless it is cached already and returns its local path.
+// If sum is not empty then the file is verified to have this hex encoded SHA-256 checksum.
+func Fetch(url, sum string) (string, error) {
+	dir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+	key := sha256.Sum256([]byte(url))
+	file := filepath.Join(dir, hex.EncodeToString(key[:8])+"-"+path.Base(url))
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	// other test processes might be downloading the same file
+	lock, err := vmtest.LockFile(file + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	if _, err := os.Stat(file); err == nil {
+		return file, nil
+	}
+	if err := download(url, sum, file); err != nil {
+		return "", fmt.Errorf("fetching %v: %v", url, err)
+	}
+	return file, nil
+}
+
+// download writes url content to output atomically
+func download(url, sum, output string) error {
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v", resp.Status)
+	}
+	if resp.ContentLength > 0 {
+		if err := vmtest.CheckFreeSpace(filepath.Dir(output), resp.ContentLength); err != nil {
+			return err
+		}
+	}
+
+	tmp := output + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); sum != "" && got != sum {
+		return fmt.Errorf("checksum mismatch: got %v, expected %v", got, sum)
+	}
+	return os.Rename(tmp, output)
+}
@@ -0,0 +1,38 @@
+package img
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFetch(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		_, _ = w.Write([]byte("image content"))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256([]byte("image content"))
+	file, err := Fetch(srv.URL+"/disk.qcow2", hex.EncodeToString(sum[:]))
+	require.NoError(t, err)
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "image content", string(data))
+
+	// the cached file is used
+	cached, err := Fetch(srv.URL+"/disk.qcow2", "")
+	require.NoError(t, err)
+	require.Equal(t, file, cached)
+	require.Equal(t, 1, requests)
+
+	_, err = Fetch(srv.URL+"/other.qcow2", "0000")
+	require.ErrorContains(t, err, "checksum mismatch")
+}
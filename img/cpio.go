@@ -0,0 +1,100 @@
+// Package img creates disk, CD-ROM and initramfs images for vmtest VMs, mostly without external tools
+package img
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anatol/vmtest"
+)
+
+// File mode type bits used in cpio headers
+const (
+	modeDir     = 0o040000
+	modeRegular = 0o100000
+	modeSymlink = 0o120000
+	modeCharDev = 0o020000
+)
+
+// checkOutputSpace verifies the filesystem of the output file has need bytes available, see vmtest.CheckFreeSpace
+func checkOutputSpace(output string, need int64) error {
+	return vmtest.CheckFreeSpace(filepath.Dir(output), need)
+}
+
+// CpioWriter writes 'newc' cpio archives, the format used by Linux initramfs. The entries written to a file
+// check its filesystem has space for them.
+type CpioWriter struct {
+	w      io.Writer
+	ino    int
+	offset int64
+	err    error
+}
+
+// NewCpioWriter creates a cpio archive writer
+func NewCpioWriter(w io.Writer) *CpioWriter {
+	return &CpioWriter{w: w, ino: 1}
+}
+
+func (c *CpioWriter) write(data []byte) {
+	if c.err != nil {
+		return
+	}
+	n, err := c.w.Write(data)
+	c.offset += int64(n)
+	c.err = err
+}
+
+func (c *CpioWriter) pad() {
+	if rem := c.offset % 4; rem != 0 {
+		c.write(make([]byte, 4-rem))
+	}
+}
+
+func (c *CpioWriter) entry(name string, mode uint32, data []byte, rdevMajor, rdevMinor int) error {
+	name = strings.TrimPrefix(name, "/")
+	nlink := 1
+	if mode&modeDir != 0 {
+		nlink = 2
+	}
+	header := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		c.ino, mode, 0, 0, nlink, 0, len(data), 0, 0, rdevMajor, rdevMinor, len(name)+1, 0)
+	c.ino++
+
+	if f, ok := c.w.(*os.File); ok && c.err == nil {
+		c.err = checkOutputSpace(f.Name(), int64(len(header)+len(name)+len(data)+8))
+	}
+	c.write([]byte(header))
+	c.write(append([]byte(name), 0))
+	c.pad()
+	c.write(data)
+	c.pad()
+	return c.err
+}
+
+// AddDir adds a directory entry
+func (c *CpioWriter) AddDir(name string, perm uint32) error {
+	return c.entry(name, modeDir|perm, nil, 0, 0)
+}
+
+// AddFile adds a regular file entry with the given content
+func (c *CpioWriter) AddFile(name string, perm uint32, data []byte) error {
+	return c.entry(name, modeRegular|perm, data, 0, 0)
+}
+
+// AddSymlink adds a symbolic link pointing to target
+func (c *CpioWriter) AddSymlink(name, target string) error {
+	return c.entry(name, modeSymlink|0o777, []byte(target), 0, 0)
+}
+
+// AddCharDevice adds a character device node
+func (c *CpioWriter) AddCharDevice(name string, perm uint32, major, minor int) error {
+	return c.entry(name, modeCharDev|perm, nil, major, minor)
+}
+
+// Close writes the archive trailer. It does not close the underlying writer.
+func (c *CpioWriter) Close() error {
+	return c.entry("TRAILER!!!", 0, nil, 0, 0)
+}
@@ -0,0 +1,44 @@
+package img
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readCpioNames parses newc archive and returns names and contents of its entries
+func readCpioNames(t *testing.T, data []byte) map[string]string {
+	entries := map[string]string{}
+	align := func(n int) int { return (n + 3) &^ 3 }
+	for off := 0; ; {
+		require.Equal(t, "070701", string(data[off:off+6]))
+		field := func(i int) int {
+			v, err := strconv.ParseUint(string(data[off+6+8*i:off+14+8*i]), 16, 32)
+			require.NoError(t, err)
+			return int(v)
+		}
+		size, nameSize := field(6), field(11)
+		name := string(data[off+110 : off+110+nameSize-1])
+		dataStart := align(off + 110 + nameSize)
+		if name == "TRAILER!!!" {
+			return entries
+		}
+		entries[name] = string(data[dataStart : dataStart+size])
+		off = align(dataStart + size)
+	}
+}
+
+func TestCpioWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewCpioWriter(&buf)
+	require.NoError(t, w.AddDir("/bin", 0o755))
+	require.NoError(t, w.AddFile("/bin/hello", 0o755, []byte("hello!")))
+	require.NoError(t, w.AddSymlink("/bin/sh", "hello"))
+	require.NoError(t, w.Close())
+	require.Zero(t, buf.Len()%4)
+
+	entries := readCpioNames(t, buf.Bytes())
+	require.Equal(t, map[string]string{"bin": "", "bin/hello": "hello!", "bin/sh": "hello"}, entries)
+}
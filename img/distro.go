@@ -0,0 +1,122 @@
+package img
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/anatol/vmtest"
+)
+
+// Distro is a Linux distribution image ready to boot in vmtest
+type Distro struct {
+	// Opts is a QemuOptions fragment that boots the image, add the test specific options to it.
+	// The image disk is in the snapshot mode so the cached image is never modified.
+	Opts vmtest.QemuOptions
+	// LoginPrompt is the console text printed once the guest is ready to log in
+	LoginPrompt string
+	// User and Password are the console login credentials
+	User, Password string
+}
+
+// credentials of the cloud images configured by the cloud-init seed
+const (
+	cloudUser     = "vmtest"
+	cloudPassword = "vmtest"
+)
+
+// CloudInitSeed writes a cloud-init NoCloud configuration ISO to output. It creates a user with the given password
+// and sudo rights, attach it as QemuOptions.CdRom.
+func CloudInitSeed(output, user, password string) error {
+	dir, err := os.MkdirTemp("", "vmtest-cidata")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	userData := fmt.Sprintf("#cloud-config\nuser: %v\npassword: %v\nchpasswd: { expire: False }\nssh_pwauth: True\n", user, password)
+	if err := os.WriteFile(filepath.Join(dir, "user-data"), []byte(userData), 0o644); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "meta-data"), []byte("instance-id: vmtest\nlocal-hostname: vmtest\n"), 0o644); err != nil {
+		return err
+	}
+	return BuildISO(dir, output, &ISOOptions{VolumeID: "cidata"})
+}
+
+// cloudDistro downloads the cloud image and prepares the cloud-init seed for it
+func cloudDistro(url string) (*Distro, error) {
+	image, err := Fetch(url, "")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := CacheDir()
+	if err != nil {
+		return nil, err
+	}
+	seed := filepath.Join(dir, "cloud-init-seed.iso")
+	lock, err := vmtest.LockFile(seed + ".lock")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	if _, err := os.Stat(seed); err != nil {
+		if err := CloudInitSeed(seed+".tmp", cloudUser, cloudPassword); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(seed+".tmp", seed); err != nil {
+			return nil, err
+		}
+	}
+	return &Distro{
+		Opts: vmtest.QemuOptions{
+			OperatingSystem: vmtest.OS_LINUX,
+			Disks:           []vmtest.QemuDisk{{Path: image, Format: "qcow2", Controller: "virtio-blk-pci", Snapshot: true}},
+			CdRom:           seed,
+			Memory:          &vmtest.QemuMemory{Size: "1G"},
+		},
+		LoginPrompt: "login:",
+		User:        cloudUser,
+		Password:    cloudPassword,
+	}, nil
+}
+
+// ArchLinuxCloud returns the Arch Linux cloud image of the given version, e.g. 'v20240101.205384' or 'latest'.
+// Note that 'latest' image is downloaded once and is not updated afterwards.
+func ArchLinuxCloud(version string) (*Distro, error) {
+	if version == "" {
+		version = "latest"
+	}
+	return cloudDistro("https://geo.mirror.pkgbuild.com/images/" + version + "/Arch-Linux-x86_64-cloudimg.qcow2")
+}
+
+// UbuntuCloud returns the Ubuntu server cloud image of the given release, e.g. 'jammy' or 'noble'
+func UbuntuCloud(release string) (*Distro, error) {
+	return cloudDistro(fmt.Sprintf("https://cloud-images.ubuntu.com/%v/current/%v-server-cloudimg-amd64.img", release, release))
+}
+
+// AlpineVirt returns the Alpine Linux 'virt' live ISO of the given version, e.g. '3.19.1'.
+// The live system allows to log in as root without password.
+func AlpineVirt(version string) (*Distro, error) {
+	parts := strings.Split(version, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid Alpine version %q", version)
+	}
+	branch := "v" + parts[0] + "." + parts[1]
+	url := fmt.Sprintf("https://dl-cdn.alpinelinux.org/alpine/%v/releases/x86_64/alpine-virt-%v-x86_64.iso",
+		branch, version)
+	iso, err := Fetch(url, "")
+	if err != nil {
+		return nil, err
+	}
+	return &Distro{
+		Opts: vmtest.QemuOptions{
+			OperatingSystem: vmtest.OS_LINUX,
+			CdRom:           iso,
+			Memory:          &vmtest.QemuMemory{Size: "512M"},
+		},
+		LoginPrompt: "localhost login:",
+		User:        "root",
+	}, nil
+}
@@ -0,0 +1,472 @@
+package img
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// FAT16 layout limits, see Microsoft FAT specification
+const (
+	fatMinClusters    = 4085
+	fatMaxClusters    = 65524
+	fatRootEntries    = 512
+	fatDirEntrySize   = 32
+	fatLFNChars       = 13
+	fatMaxClusterSize = 32 << 10
+	fatAttrVolumeID   = 0x08
+	fatAttrDir        = 0x10
+	fatAttrArchive    = 0x20
+	fatAttrLFN        = 0x0f
+)
+
+// FATOptions configures a FAT filesystem
+type FATOptions struct {
+	// Label is the volume label of up to 11 characters, e.g. 'ESP'
+	Label string
+}
+
+// fatNode is a file or a directory of the filesystem
+type fatNode struct {
+	name     string
+	hostPath string
+	isDir    bool
+	modTime  time.Time
+	size     int64
+	children []*fatNode
+
+	short    string   // 8.3 name padded to 11 characters
+	long     [][]byte // long name entries, empty if the short name is the file name
+	cluster  uint32   // first cluster, 0 for empty files
+	clusters uint32   // number of allocated clusters
+}
+
+// dirEntries renders the entries of the directory children
+func (d *fatNode) dirEntries() []byte {
+	var data []byte
+	for _, c := range d.children {
+		for _, e := range c.long {
+			data = append(data, e...)
+		}
+		data = append(data, fatDirEntry(c.short, c)...)
+	}
+	return data
+}
+
+// WriteFAT formats the partition number n of the raw disk image with a FAT16 filesystem holding the content
+// of dir, e.g. an EFI system partition with 'EFI/BOOT/BOOTX64.EFI'. The names that are not valid 8.3 names
+// are stored as long (VFAT) names. The partition must be between 2MiB and 2GiB.
+func WriteFAT(image string, n int, dir string, opts *FATOptions) error {
+	if opts == nil {
+		opts = &FATOptions{}
+	}
+	if len(opts.Label) > 11 || strings.IndexFunc(opts.Label, func(c rune) bool { return c < ' ' || c > '~' }) != -1 {
+		return fmt.Errorf("FAT label %q is not up to 11 ASCII characters", opts.Label)
+	}
+	parts, err := Partitions(image)
+	if err != nil {
+		return err
+	}
+	var part *Partition
+	for i := range parts {
+		if parts[i].Number == n {
+			part = &parts[i]
+		}
+	}
+	if part == nil {
+		return fmt.Errorf("%v: partition %d not found", image, n)
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	root := &fatNode{hostPath: dir, isDir: true, modTime: fi.ModTime()}
+	if err := readFATTree(root); err != nil {
+		return err
+	}
+
+	l, err := fatLayout(part.Size / sectorSize)
+	if err != nil {
+		return fmt.Errorf("%v: partition %d: %v", image, n, err)
+	}
+
+	// the clusters are allocated in the directory tree order, a directory gets enough clusters for
+	// the entries of its children
+	rootLimit := fatRootEntries
+	if opts.Label != "" {
+		rootLimit-- // the volume label takes an entry
+	}
+	next := uint32(2)
+	var allocate func(d *fatNode) error
+	allocate = func(d *fatNode) error {
+		used := map[string]bool{}
+		entries := 0
+		for _, c := range d.children {
+			var lfn bool
+			c.short, lfn = fatShortName(c.name, used)
+			if lfn {
+				c.long = fatLFNEntries(c.name, c.short)
+			}
+			entries += len(c.long) + 1
+		}
+		if d != root {
+			entries += 2 // '.' and '..'
+			d.clusters = uint32((int64(entries)*fatDirEntrySize + l.clusterSize - 1) / l.clusterSize)
+			d.cluster, next = next, next+d.clusters
+		} else if entries > rootLimit {
+			return fmt.Errorf("%v: the root directory has more than %d entries", dir, rootLimit)
+		}
+		for _, c := range d.children {
+			if c.isDir {
+				if err := allocate(c); err != nil {
+					return err
+				}
+			} else if c.size > 0 {
+				c.clusters = uint32((c.size + l.clusterSize - 1) / l.clusterSize)
+				c.cluster, next = next, next+c.clusters
+			}
+			if next-2 > l.clusters {
+				return fmt.Errorf("the content of %v does not fit partition %d of %d bytes", dir, n, part.Size)
+			}
+		}
+		return nil
+	}
+	if err := allocate(root); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := io.NewOffsetWriter(f, part.Start)
+
+	// the boot sector, the FATs and the root directory are rendered in memory, the data region follows them
+	meta := make([]byte, (l.reserved+2*l.fatSectors+l.rootSectors)*sectorSize)
+	volumeID := make([]byte, 4)
+	if _, err := rand.Read(volumeID); err != nil {
+		return err
+	}
+	copy(meta, fatBootSector(l, part.Start/sectorSize, volumeID, opts.Label))
+
+	fat := make([]byte, l.fatSectors*sectorSize)
+	binary.LittleEndian.PutUint16(fat[0:], 0xfff8)
+	binary.LittleEndian.PutUint16(fat[2:], 0xffff)
+	var chain func(d *fatNode)
+	chain = func(d *fatNode) {
+		if d.clusters > 0 {
+			for i := uint32(0); i < d.clusters; i++ {
+				next := uint16(d.cluster + i + 1)
+				if i == d.clusters-1 {
+					next = 0xffff
+				}
+				binary.LittleEndian.PutUint16(fat[(d.cluster+i)*2:], next)
+			}
+		}
+		for _, c := range d.children {
+			chain(c)
+		}
+	}
+	chain(root)
+	for i := int64(0); i < 2; i++ {
+		copy(meta[(l.reserved+i*l.fatSectors)*sectorSize:], fat)
+	}
+
+	rootDir := meta[(l.reserved+2*l.fatSectors)*sectorSize:]
+	off := 0
+	if opts.Label != "" {
+		label := &fatNode{modTime: time.Now()}
+		copy(rootDir, fatDirEntry(fatText(strings.ToUpper(opts.Label), 11), label))
+		rootDir[11] = fatAttrVolumeID
+		off += fatDirEntrySize
+	}
+	copy(rootDir[off:], root.dirEntries())
+	if _, err := w.WriteAt(meta, 0); err != nil {
+		return err
+	}
+
+	var write func(d *fatNode, parent *fatNode) error
+	write = func(d *fatNode, parent *fatNode) error {
+		if d != root {
+			data := make([]byte, int64(d.clusters)*l.clusterSize)
+			dot := fatDirEntry(".          ", d)
+			copy(data, dot)
+			dotdot := fatDirEntry("..         ", d)
+			parentCluster := uint16(0) // the root directory is referenced as cluster 0
+			if parent != root {
+				parentCluster = uint16(parent.cluster)
+			}
+			binary.LittleEndian.PutUint16(dotdot[26:], parentCluster)
+			copy(data[fatDirEntrySize:], dotdot)
+			copy(data[2*fatDirEntrySize:], d.dirEntries())
+			if _, err := w.WriteAt(data, l.clusterOffset(d.cluster)); err != nil {
+				return err
+			}
+		}
+		for _, c := range d.children {
+			if c.isDir {
+				if err := write(c, d); err != nil {
+					return err
+				}
+			} else if c.size > 0 {
+				if err := copyFATFile(io.NewOffsetWriter(w, l.clusterOffset(c.cluster)), c); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := write(root, nil); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// fatGeometry is the layout of a FAT16 filesystem, the sizes are in sectors unless specified otherwise
+type fatGeometry struct {
+	sectors           int64
+	sectorsPerCluster int64
+	clusterSize       int64 // in bytes
+	reserved          int64
+	fatSectors        int64
+	rootSectors       int64
+	clusters          uint32
+}
+
+// fatLayout chooses the smallest cluster size that keeps the number of clusters in the FAT16 range
+func fatLayout(sectors int64) (*fatGeometry, error) {
+	l := &fatGeometry{sectors: sectors, reserved: 1, rootSectors: fatRootEntries * fatDirEntrySize / sectorSize}
+	for spc := int64(1); spc*sectorSize <= fatMaxClusterSize; spc *= 2 {
+		data := sectors - l.reserved - l.rootSectors
+		clusters := data / spc
+		// the FATs take a part of the data region, the estimate is refined once
+		fatSectors := ((clusters+2)*2 + sectorSize - 1) / sectorSize
+		clusters = (data - 2*fatSectors) / spc
+		if clusters < fatMinClusters {
+			return nil, fmt.Errorf("%d bytes are too small for FAT16", sectors*sectorSize)
+		}
+		if clusters <= fatMaxClusters {
+			l.sectorsPerCluster, l.clusterSize = spc, spc*sectorSize
+			l.fatSectors, l.clusters = fatSectors, uint32(clusters)
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("%d bytes are too large for FAT16", sectors*sectorSize)
+}
+
+// clusterOffset returns the offset of the cluster in bytes from the start of the filesystem
+func (l *fatGeometry) clusterOffset(cluster uint32) int64 {
+	return (l.reserved+2*l.fatSectors+l.rootSectors)*sectorSize + int64(cluster-2)*l.clusterSize
+}
+
+func fatBootSector(l *fatGeometry, hidden int64, volumeID []byte, label string) []byte {
+	b := make([]byte, sectorSize)
+	copy(b, []byte{0xeb, 0x3c, 0x90})
+	copy(b[3:], "VMTEST  ")
+	binary.LittleEndian.PutUint16(b[11:], sectorSize)
+	b[13] = byte(l.sectorsPerCluster)
+	binary.LittleEndian.PutUint16(b[14:], uint16(l.reserved))
+	b[16] = 2 // number of FATs
+	binary.LittleEndian.PutUint16(b[17:], fatRootEntries)
+	if l.sectors < 1<<16 {
+		binary.LittleEndian.PutUint16(b[19:], uint16(l.sectors))
+	} else {
+		binary.LittleEndian.PutUint32(b[32:], uint32(l.sectors))
+	}
+	b[21] = 0xf8 // fixed disk
+	binary.LittleEndian.PutUint16(b[22:], uint16(l.fatSectors))
+	binary.LittleEndian.PutUint16(b[24:], 32) // sectors per track
+	binary.LittleEndian.PutUint16(b[26:], 64) // heads
+	binary.LittleEndian.PutUint32(b[28:], uint32(hidden))
+	b[36] = 0x80 // drive number
+	b[38] = 0x29 // extended boot signature
+	copy(b[39:], volumeID)
+	if label == "" {
+		label = "NO NAME"
+	}
+	copy(b[43:], fatText(strings.ToUpper(label), 11))
+	copy(b[54:], "FAT16   ")
+	b[510], b[511] = 0x55, 0xaa
+	return b
+}
+
+func readFATTree(dir *fatNode) error {
+	entries, err := os.ReadDir(dir.hostPath)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return fmt.Errorf("%v: only regular files and directories are supported", filepath.Join(dir.hostPath, e.Name()))
+		}
+		if len(utf16.Encode([]rune(e.Name()))) > 255 {
+			return fmt.Errorf("%v: the name is longer than 255 characters", filepath.Join(dir.hostPath, e.Name()))
+		}
+		child := &fatNode{
+			name:     e.Name(),
+			hostPath: filepath.Join(dir.hostPath, e.Name()),
+			isDir:    fi.IsDir(),
+			modTime:  fi.ModTime(),
+		}
+		if child.isDir {
+			if err := readFATTree(child); err != nil {
+				return err
+			}
+		} else {
+			if fi.Size() > 1<<32-1 {
+				return fmt.Errorf("%v is too large for FAT", child.hostPath)
+			}
+			child.size = fi.Size()
+		}
+		dir.children = append(dir.children, child)
+	}
+	sort.Slice(dir.children, func(i, j int) bool { return dir.children[i].name < dir.children[j].name })
+	return nil
+}
+
+// fatShortChars are the characters allowed in 8.3 names besides letters and digits
+const fatShortChars = "$%'-_@~`!(){}^#&"
+
+func fatShortChar(c rune) bool {
+	return c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(fatShortChars, c)
+}
+
+// fatShortName returns the padded 11 characters 8.3 name and whether a long name is needed. The names that
+// are not valid upper case 8.3 names get a unique 'NAME~1.EXT' alias.
+func fatShortName(name string, used map[string]bool) (string, bool) {
+	base, ext := name, ""
+	if i := strings.LastIndex(name, "."); i > 0 {
+		base, ext = name[:i], name[i+1:]
+	}
+	valid := len(base) <= 8 && len(ext) <= 3 && !strings.Contains(base, ".")
+	for _, c := range base + ext {
+		valid = valid && fatShortChar(c)
+	}
+	if valid {
+		short := fatText(base, 8) + fatText(ext, 3)
+		if !used[short] {
+			used[short] = true
+			return short, false
+		}
+	}
+
+	clean := func(s string, limit int) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if b.Len() == limit {
+				break
+			}
+			if fatShortChar(c) {
+				b.WriteRune(c)
+			} else if c != ' ' && c != '.' {
+				b.WriteRune('_')
+			}
+		}
+		return b.String()
+	}
+	base, ext = clean(base, 8), clean(ext, 3)
+	for i := 1; ; i++ {
+		suffix := fmt.Sprintf("~%d", i)
+		prefix := base
+		if len(prefix) > 8-len(suffix) {
+			prefix = prefix[:8-len(suffix)]
+		}
+		short := fatText(prefix+suffix, 8) + fatText(ext, 3)
+		if !used[short] {
+			used[short] = true
+			return short, true
+		}
+	}
+}
+
+// fatLFNEntries renders the long name entries that precede the short entry, the last part comes first
+func fatLFNEntries(name, short string) [][]byte {
+	var sum byte
+	for i := 0; i < 11; i++ {
+		sum = (sum&1)<<7 + sum>>1 + short[i]
+	}
+	chars := utf16.Encode([]rune(name))
+	if len(chars)%fatLFNChars != 0 {
+		chars = append(chars, 0)
+	}
+	for len(chars)%fatLFNChars != 0 {
+		chars = append(chars, 0xffff)
+	}
+	count := len(chars) / fatLFNChars
+	entries := make([][]byte, count)
+	for i := 0; i < count; i++ {
+		e := make([]byte, fatDirEntrySize)
+		e[0] = byte(i + 1)
+		if i == count-1 {
+			e[0] |= 0x40
+		}
+		e[11] = fatAttrLFN
+		e[13] = sum
+		part := chars[i*fatLFNChars:]
+		for j, off := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+			binary.LittleEndian.PutUint16(e[off:], part[j])
+		}
+		entries[count-1-i] = e
+	}
+	return entries
+}
+
+// fatDirEntry renders the short entry of the node
+func fatDirEntry(short string, n *fatNode) []byte {
+	e := make([]byte, fatDirEntrySize)
+	copy(e, short)
+	e[11] = fatAttrArchive
+	if n.isDir {
+		e[11] = fatAttrDir
+	}
+	t := n.modTime
+	if t.Year() < 1980 {
+		t = time.Date(1980, 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	fatTime := uint16(t.Hour()<<11 | t.Minute()<<5 | t.Second()/2)
+	fatDate := uint16((t.Year()-1980)<<9 | int(t.Month())<<5 | t.Day())
+	binary.LittleEndian.PutUint16(e[14:], fatTime) // creation
+	binary.LittleEndian.PutUint16(e[16:], fatDate)
+	binary.LittleEndian.PutUint16(e[18:], fatDate) // access
+	binary.LittleEndian.PutUint16(e[22:], fatTime) // modification
+	binary.LittleEndian.PutUint16(e[24:], fatDate)
+	binary.LittleEndian.PutUint16(e[26:], uint16(n.cluster))
+	if !n.isDir {
+		binary.LittleEndian.PutUint32(e[28:], uint32(n.size))
+	}
+	return e
+}
+
+// fatText pads s with spaces to length
+func fatText(s string, length int) string {
+	return s + strings.Repeat(" ", length-len(s))
+}
+
+func copyFATFile(w io.Writer, file *fatNode) error {
+	in, err := os.Open(file.hostPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	n, err := io.Copy(w, in)
+	if err != nil {
+		return err
+	}
+	if n != file.size {
+		return fmt.Errorf("%v changed while writing the filesystem", file.hostPath)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readFAT reads the files of the FAT16 filesystem at data, the keys are the paths with the long names and
+// the directories have "<dir>" content
+func readFAT(t *testing.T, data []byte) map[string]string {
+	require.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+	require.Equal(t, "FAT16   ", string(data[54:62]))
+	clusterSize := int(data[13]) * sectorSize
+	reserved := int(binary.LittleEndian.Uint16(data[14:]))
+	fatSize := int(binary.LittleEndian.Uint16(data[22:])) * sectorSize
+	rootEntries := int(binary.LittleEndian.Uint16(data[17:]))
+	fat := data[reserved*sectorSize:]
+	require.Equal(t, fat[:fatSize], data[reserved*sectorSize+fatSize:reserved*sectorSize+2*fatSize], "FAT copies differ")
+	rootDir := data[reserved*sectorSize+2*fatSize:]
+	dataRegion := rootDir[rootEntries*fatDirEntrySize:]
+
+	readChain := func(cluster uint16) []byte {
+		var out []byte
+		for cluster >= 2 && cluster < 0xfff8 {
+			start := int(cluster-2) * clusterSize
+			out = append(out, dataRegion[start:start+clusterSize]...)
+			cluster = binary.LittleEndian.Uint16(fat[int(cluster)*2:])
+		}
+		return out
+	}
+
+	files := map[string]string{}
+	var readDir func(prefix string, entries []byte)
+	readDir = func(prefix string, entries []byte) {
+		var long []uint16
+		for off := 0; off+fatDirEntrySize <= len(entries) && entries[off] != 0; off += fatDirEntrySize {
+			e := entries[off : off+fatDirEntrySize]
+			if e[11] == fatAttrLFN {
+				var part []uint16
+				for _, o := range []int{1, 3, 5, 7, 9, 14, 16, 18, 20, 22, 24, 28, 30} {
+					part = append(part, binary.LittleEndian.Uint16(e[o:]))
+				}
+				long = append(part, long...)
+				continue
+			}
+			if e[11]&fatAttrVolumeID != 0 || e[0] == '.' {
+				long = nil
+				continue
+			}
+			name := strings.TrimSpace(string(e[:8]))
+			if ext := strings.TrimSpace(string(e[8:11])); ext != "" {
+				name += "." + ext
+			}
+			if long != nil {
+				end := 0
+				for end < len(long) && long[end] != 0 {
+					end++
+				}
+				name = string(utf16.Decode(long[:end]))
+				long = nil
+			}
+			cluster := binary.LittleEndian.Uint16(e[26:])
+			if e[11]&fatAttrDir != 0 {
+				files[prefix+name] = "<dir>"
+				readDir(prefix+name+"/", readChain(cluster))
+			} else {
+				size := binary.LittleEndian.Uint32(e[28:])
+				files[prefix+name] = string(readChain(cluster)[:size])
+			}
+		}
+	}
+	readDir("", rootDir[:rootEntries*fatDirEntrySize])
+	return files
+}
+
+func TestWriteFAT(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "EFI", "BOOT"), 0o755))
+	loader := bytes.Repeat([]byte("MZ"), 10000) // spans several clusters
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "EFI", "BOOT", "BOOTX64.EFI"), loader, 0o644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "loader", "entries"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "loader", "loader.conf"), []byte("timeout 0\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "loader", "entries", "vmtest-linux.conf"), []byte("linux /vmlinuz\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "loader", "entries", "vmtest-linux-fallback.conf"), nil, 0o644))
+
+	image := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, GPT(image, &GPTOptions{Size: 64 << 20, Partitions: []GPTPartition{
+		{Name: "bios", Type: GPT_BIOS_BOOT, Size: 1 << 20},
+		{Name: "esp", Type: GPT_EFI_SYSTEM},
+	}}))
+	require.NoError(t, WriteFAT(image, 2, dir, &FATOptions{Label: "esp"}))
+
+	parts, err := Partitions(image)
+	require.NoError(t, err)
+	data, err := os.ReadFile(image)
+	require.NoError(t, err)
+	fs := data[parts[1].Start : parts[1].Start+parts[1].Size]
+	require.Equal(t, "ESP        ", string(fs[43:54]))
+	require.Equal(t, uint32(parts[1].Start/sectorSize), binary.LittleEndian.Uint32(fs[28:]))
+
+	require.Equal(t, map[string]string{
+		"EFI":                  "<dir>",
+		"EFI/BOOT":             "<dir>",
+		"EFI/BOOT/BOOTX64.EFI": string(loader),
+		"loader":               "<dir>",
+		"loader/entries":       "<dir>",
+		"loader/entries/vmtest-linux-fallback.conf": "",
+		"loader/entries/vmtest-linux.conf":          "linux /vmlinuz\n",
+		"loader/loader.conf":                        "timeout 0\n",
+	}, readFAT(t, fs))
+
+	require.ErrorContains(t, WriteFAT(image, 1, dir, nil), "too small")
+	require.ErrorContains(t, WriteFAT(image, 3, dir, nil), "not found")
+	require.ErrorContains(t, WriteFAT(image, 2, dir, &FATOptions{Label: "longer than 11"}), "11 ASCII")
+}
+
+func TestFATShortName(t *testing.T) {
+	used := map[string]bool{}
+	for _, tc := range []struct {
+		name, short string
+		lfn         bool
+	}{
+		{"BOOTX64.EFI", "BOOTX64 EFI", false},
+		{"EFI", "EFI        ", false},
+		{"grubx64.efi", "GRUBX6~1EFI", true},
+		{"grubx64.EFI", "GRUBX6~2EFI", true},
+		{"systemd-bootx64.efi", "SYSTEM~1EFI", true},
+		{"a b.conf", "AB~1    CON", true},
+	} {
+		short, lfn := fatShortName(tc.name, used)
+		require.Equal(t, tc.short, short, tc.name)
+		require.Equal(t, tc.lfn, lfn, tc.name)
+	}
+}
@@ -0,0 +1,217 @@
+package img
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// gptEntries is the number of partition entries, 128 entries of 128 bytes take 32 sectors
+	gptEntries      = 128
+	gptEntrySize    = 128
+	gptEntrySectors = gptEntries * gptEntrySize / sectorSize
+)
+
+// GPTType is a partition type GUID
+type GPTType string
+
+// Common partition types
+const (
+	GPT_EFI_SYSTEM       = GPTType("C12A7328-F81F-11D2-BA4B-00A0C93EC93B")
+	GPT_BIOS_BOOT        = GPTType("21686148-6449-6E6F-744E-656564454649")
+	GPT_LINUX_FILESYSTEM = GPTType("0FC63DAF-8483-4772-8E79-3D69D8477DE4")
+	GPT_LINUX_SWAP       = GPTType("0657FD6D-A4AB-43C4-84E5-0933C84B4F4F")
+	GPT_LINUX_LVM        = GPTType("E6D6D379-F507-44C2-A23C-238F2A3DF928")
+	GPT_LINUX_RAID       = GPTType("A19D880F-05FC-4D3B-A006-743F0F84911E")
+	GPT_LINUX_LUKS       = GPTType("CA7D7CCB-63ED-4C53-861C-1742536059CC")
+)
+
+// GPTPartition is a partition of a GUID partition table
+type GPTPartition struct {
+	// Name is the partition label e.g. /dev/disk/by-partlabel/$Name
+	Name string
+	// Type is the partition type, default is GPT_LINUX_FILESYSTEM
+	Type GPTType
+	// UUID is the unique partition GUID e.g. /dev/disk/by-partuuid/$UUID, a random one is used if empty
+	UUID string
+	// Start is the offset of the partition in bytes. If zero then the partition starts at the first 1MiB aligned
+	// offset after the previous partition.
+	Start int64
+	// Size of the partition in bytes, zero means the rest of the disk (the last partition only)
+	Size int64
+	// Attributes are the partition attribute flags e.g. bit 2 for 'legacy BIOS bootable'
+	Attributes uint64
+}
+
+// GPTOptions configures a GUID partition table
+type GPTOptions struct {
+	// Size of the disk image in bytes. If zero then the size of the existing output file is used.
+	Size int64
+	// DiskUUID is the disk GUID, a random one is used if empty
+	DiskUUID   string
+	Partitions []GPTPartition
+}
+
+// GPT writes a GUID partition table with a protective MBR to the raw disk image output. The image is created
+// as a sparse file if it does not exist, the content outside of the partition table structures is preserved.
+func GPT(output string, opts *GPTOptions) error {
+	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size := opts.Size
+	if size == 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	} else if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if size%sectorSize != 0 {
+		return fmt.Errorf("disk size %d is not a multiple of the sector size", size)
+	}
+	sectors := uint64(size / sectorSize)
+	// MBR, primary header and entries, backup entries and header
+	if sectors < 2*(1+gptEntrySectors)+1 {
+		return fmt.Errorf("disk of %d bytes is too small for GPT", size)
+	}
+	firstUsable := uint64(2 + gptEntrySectors)
+	lastUsable := sectors - 2 - gptEntrySectors
+
+	if len(opts.Partitions) > gptEntries {
+		return fmt.Errorf("GPT supports up to %d partitions", gptEntries)
+	}
+	starts := make([]int64, len(opts.Partitions))
+	sizes := make([]int64, len(opts.Partitions))
+	for i, p := range opts.Partitions {
+		starts[i], sizes[i] = p.Start, p.Size
+	}
+	extents, err := placePartitions(starts, sizes, firstUsable, lastUsable)
+	if err != nil {
+		return err
+	}
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range opts.Partitions {
+		typ := p.Type
+		if typ == "" {
+			typ = GPT_LINUX_FILESYSTEM
+		}
+		typeGUID, err := encodeGUID(string(typ))
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", i+1, err)
+		}
+		partGUID, err := encodeGUID(p.UUID)
+		if err != nil {
+			return fmt.Errorf("partition %d: %v", i+1, err)
+		}
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > 36 {
+			return fmt.Errorf("partition %d: name %q is longer than 36 characters", i+1, p.Name)
+		}
+
+		e := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		copy(e[0:], typeGUID)
+		copy(e[16:], partGUID)
+		binary.LittleEndian.PutUint64(e[32:], extents[i].first)
+		binary.LittleEndian.PutUint64(e[40:], extents[i].last)
+		binary.LittleEndian.PutUint64(e[48:], p.Attributes)
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	diskGUID, err := encodeGUID(opts.DiskUUID)
+	if err != nil {
+		return err
+	}
+
+	// the boot code area of the MBR is preserved e.g. for GRUB installed in BIOS mode
+	if _, err := f.WriteAt(protectiveMBR(sectors)[mbrTableOffset:], mbrTableOffset); err != nil {
+		return err
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+	primary := gptHeader(1, sectors-1, 2, firstUsable, lastUsable, diskGUID, entriesCRC)
+	backup := gptHeader(sectors-1, 1, sectors-1-gptEntrySectors, firstUsable, lastUsable, diskGUID, entriesCRC)
+	writes := []struct {
+		data []byte
+		lba  uint64
+	}{
+		{primary, 1},
+		{entries, 2},
+		{entries, sectors - 1 - gptEntrySectors},
+		{backup, sectors - 1},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, int64(w.lba*sectorSize)); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// protectiveMBR returns the MBR sector with a single 0xEE partition covering the whole disk
+func protectiveMBR(sectors uint64) []byte {
+	mbr := make([]byte, sectorSize)
+	size := sectors - 1
+	if size > 0xffffffff {
+		size = 0xffffffff
+	}
+	e := mbr[mbrEntriesOffset:]
+	copy(e[1:4], []byte{0x00, 0x02, 0x00}) // CHS of LBA 1
+	e[4] = 0xee
+	copy(e[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:], 1)
+	binary.LittleEndian.PutUint32(e[12:], uint32(size))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	return mbr
+}
+
+func gptHeader(current, backup, entriesLBA, firstUsable, lastUsable uint64, diskGUID []byte, entriesCRC uint32) []byte {
+	h := make([]byte, sectorSize)
+	copy(h, "EFI PART")
+	binary.LittleEndian.PutUint32(h[8:], 0x00010000) // revision 1.0
+	binary.LittleEndian.PutUint32(h[12:], 92)        // header size
+	binary.LittleEndian.PutUint64(h[24:], current)
+	binary.LittleEndian.PutUint64(h[32:], backup)
+	binary.LittleEndian.PutUint64(h[40:], firstUsable)
+	binary.LittleEndian.PutUint64(h[48:], lastUsable)
+	copy(h[56:72], diskGUID)
+	binary.LittleEndian.PutUint64(h[72:], entriesLBA)
+	binary.LittleEndian.PutUint32(h[80:], gptEntries)
+	binary.LittleEndian.PutUint32(h[84:], gptEntrySize)
+	binary.LittleEndian.PutUint32(h[88:], entriesCRC)
+	binary.LittleEndian.PutUint32(h[16:], crc32.ChecksumIEEE(h[:92]))
+	return h
+}
+
+// encodeGUID converts a textual GUID to its on-disk form where the first three fields are little-endian.
+// An empty string produces a random (version 4) GUID.
+func encodeGUID(s string) ([]byte, error) {
+	b := make([]byte, 16)
+	if s == "" {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		b[7] = b[7]&0x0f | 0x40 // version 4, the byte is the high byte of the little-endian third field
+		b[8] = b[8]&0x3f | 0x80
+		return b, nil
+	}
+	raw, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(raw) != 16 || len(s) != 36 {
+		return nil, fmt.Errorf("invalid GUID %q", s)
+	}
+	binary.LittleEndian.PutUint32(b[0:], binary.BigEndian.Uint32(raw[0:]))
+	binary.LittleEndian.PutUint16(b[4:], binary.BigEndian.Uint16(raw[4:]))
+	binary.LittleEndian.PutUint16(b[6:], binary.BigEndian.Uint16(raw[6:]))
+	copy(b[8:], raw[8:])
+	return b, nil
+}
@@ -0,0 +1,73 @@
+package img
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGPT(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "disk.img")
+	const size = 64 << 20
+	require.NoError(t, GPT(output, &GPTOptions{
+		Size:     size,
+		DiskUUID: "01234567-89AB-CDEF-0123-456789ABCDEF",
+		Partitions: []GPTPartition{
+			{Name: "esp", Type: GPT_EFI_SYSTEM, Size: 8 << 20},
+			{Name: "root", UUID: "6E6F6F72-0000-4000-8000-000000000001"},
+		},
+	}))
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Len(t, data, size)
+	require.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+	require.Equal(t, byte(0xee), data[446+4])
+
+	sectors := uint64(size / 512)
+	for _, lba := range []uint64{1, sectors - 1} {
+		h := data[lba*512 : lba*512+92]
+		require.Equal(t, "EFI PART", string(h[:8]))
+		require.Equal(t, lba, binary.LittleEndian.Uint64(h[24:]))
+		require.Equal(t, []byte{0x67, 0x45, 0x23, 0x01, 0xab, 0x89, 0xef, 0xcd, 0x01, 0x23}, h[56:66])
+
+		crc := binary.LittleEndian.Uint32(h[16:])
+		hdr := append([]byte(nil), h...)
+		binary.LittleEndian.PutUint32(hdr[16:], 0)
+		require.Equal(t, crc32.ChecksumIEEE(hdr), crc)
+
+		entriesLBA := binary.LittleEndian.Uint64(h[72:])
+		entries := data[entriesLBA*512 : entriesLBA*512+128*128]
+		require.Equal(t, crc32.ChecksumIEEE(entries), binary.LittleEndian.Uint32(h[88:]))
+
+		require.Equal(t, uint64(2048), binary.LittleEndian.Uint64(entries[32:]))
+		require.Equal(t, uint64(2048+8<<11-1), binary.LittleEndian.Uint64(entries[40:]))
+		require.Equal(t, []byte{'e', 0, 's', 0, 'p', 0, 0}, entries[56:63])
+		second := entries[128:]
+		require.Equal(t, []byte{0xaf, 0x3d, 0xc6, 0x0f}, second[:4]) // GPT_LINUX_FILESYSTEM
+		require.Equal(t, uint64(2048+8<<11), binary.LittleEndian.Uint64(second[32:]))
+		require.Equal(t, sectors-34, binary.LittleEndian.Uint64(second[40:]))
+	}
+
+	if _, err := exec.LookPath("sfdisk"); err == nil {
+		out, err := exec.Command("sfdisk", "--dump", output).CombinedOutput()
+		require.NoError(t, err, string(out))
+		require.Contains(t, strings.ToUpper(string(out)), "6E6F6F72-0000-4000-8000-000000000001")
+	}
+}
+
+func TestGPTErrors(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "disk.img")
+	require.Error(t, GPT(output, &GPTOptions{Size: 8 << 10}))
+	require.Error(t, GPT(output, &GPTOptions{Size: 8 << 20, Partitions: []GPTPartition{{Size: 16 << 20}}}))
+	require.Error(t, GPT(output, &GPTOptions{Size: 8 << 20, Partitions: []GPTPartition{{}, {}}}))
+	require.Error(t, GPT(output, &GPTOptions{Size: 8 << 20, Partitions: []GPTPartition{{Type: "foo"}}}))
+	require.Error(t, GPT(output, &GPTOptions{Size: 16 << 20, Partitions: []GPTPartition{
+		{Start: 1 << 20, Size: 4 << 20}, {Start: 4 << 20, Size: 1 << 20},
+	}}))
+}
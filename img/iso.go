@@ -0,0 +1,459 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	isoSectorSize = 2048
+	// isoMaxRecordSize is the limit of a directory record, its length is stored in a byte
+	isoMaxRecordSize = 255
+)
+
+// ISOOptions configures an ISO 9660 image
+type ISOOptions struct {
+	// VolumeID is a volume label e.g. 'cidata' for cloud-init NoCloud configuration disks
+	VolumeID string
+}
+
+// isoNode is a file or a directory of the image
+type isoNode struct {
+	name     string // original name, stored in Rock Ridge NM entry
+	id       string // ISO 9660 identifier
+	hostPath string
+	mode     os.FileMode
+	modTime  time.Time
+	size     int64
+	children []*isoNode
+	parent   *isoNode
+
+	extent  uint32 // first sector
+	dirSize int64  // size of the directory extent
+	dirNum  int    // 1-based number in the path table
+}
+
+func (n *isoNode) isDir() bool {
+	return n.mode.IsDir()
+}
+
+// BuildISO writes an ISO 9660 image with the content of dir to output. File names, permissions and
+// symlink-free directory structure are preserved using Rock Ridge extensions.
+func BuildISO(dir, output string, opts *ISOOptions) error {
+	if opts == nil {
+		opts = &ISOOptions{}
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	root := &isoNode{hostPath: dir, mode: fi.Mode(), modTime: fi.ModTime()}
+	if err := readISOTree(root); err != nil {
+		return err
+	}
+
+	// directories are laid out in breadth-first order as required by the path table
+	dirs := []*isoNode{root}
+	for i := 0; i < len(dirs); i++ {
+		dirs[i].dirNum = i + 1
+		for _, c := range dirs[i].children {
+			if c.isDir() {
+				dirs = append(dirs, c)
+			}
+		}
+	}
+
+	pathTable := buildPathTable(dirs, binary.LittleEndian) // only used to compute the size here
+	pathTableSectors := sectors(int64(len(pathTable)))
+
+	// layout: system area, PVD, terminator, L and M path tables, directories, files
+	next := uint32(18 + 2*pathTableSectors)
+	for _, d := range dirs {
+		d.dirSize = dirExtentSize(d)
+		d.extent = next
+		next += sectors(d.dirSize)
+	}
+	var files []*isoNode
+	for _, d := range dirs {
+		for _, c := range d.children {
+			if !c.isDir() {
+				if c.size > 0 {
+					c.extent = next
+					next += sectors(c.size)
+				}
+				files = append(files, c)
+			}
+		}
+	}
+	totalSectors := next
+	if err := checkOutputSpace(output, int64(totalSectors)*isoSectorSize); err != nil {
+		return err
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(make([]byte, 16*isoSectorSize)); err != nil {
+		return err
+	}
+	lPathTable := uint32(18)
+	mPathTable := lPathTable + pathTableSectors
+	pvd := primaryVolumeDescriptor(opts.VolumeID, root, totalSectors, uint32(len(pathTable)), lPathTable, mPathTable)
+	terminator := make([]byte, isoSectorSize)
+	copy(terminator, []byte{255, 'C', 'D', '0', '0', '1', 1})
+	for _, data := range [][]byte{
+		pvd, terminator,
+		padSector(buildPathTable(dirs, binary.LittleEndian)),
+		padSector(buildPathTable(dirs, binary.BigEndian)),
+	} {
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+	}
+	for _, d := range dirs {
+		if _, err := f.Write(dirExtent(d)); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		if file.size == 0 {
+			continue
+		}
+		if err := copyISOFile(f, file); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func readISOTree(dir *isoNode) error {
+	entries, err := os.ReadDir(dir.hostPath)
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() && !fi.Mode().IsRegular() {
+			return fmt.Errorf("iso: %v is not a regular file or directory", filepath.Join(dir.hostPath, e.Name()))
+		}
+		n := &isoNode{
+			name:     e.Name(),
+			hostPath: filepath.Join(dir.hostPath, e.Name()),
+			mode:     fi.Mode(),
+			modTime:  fi.ModTime(),
+			parent:   dir,
+		}
+		if !n.isDir() {
+			// the directory record stores the size as a 32-bit value
+			if fi.Size() > 1<<32-1 {
+				return fmt.Errorf("iso: %v is too large for ISO 9660", n.hostPath)
+			}
+			n.size = fi.Size()
+		}
+		n.id = isoIdentifier(e.Name(), n.isDir(), used)
+		if size := dirRecordSize(len(n.id), len(childSystemUse(n))); size > isoMaxRecordSize {
+			return fmt.Errorf("iso: name of %v is too long for a directory record", n.hostPath)
+		}
+		dir.children = append(dir.children, n)
+		if n.isDir() {
+			if err := readISOTree(n); err != nil {
+				return err
+			}
+		}
+	}
+	sort.Slice(dir.children, func(i, j int) bool { return dir.children[i].id < dir.children[j].id })
+	return nil
+}
+
+// isoIdentifier converts name to a unique ISO 9660 identifier of d-characters
+func isoIdentifier(name string, isDir bool, used map[string]bool) string {
+	base, ext := name, ""
+	if !isDir {
+		if idx := strings.LastIndexByte(name, '.'); idx > 0 {
+			base, ext = name[:idx], name[idx+1:]
+		}
+	}
+	clean := func(s string, max int) string {
+		var b strings.Builder
+		for _, c := range strings.ToUpper(s) {
+			if (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' {
+				b.WriteRune(c)
+			} else {
+				b.WriteByte('_')
+			}
+		}
+		s = b.String()
+		if len(s) > max {
+			s = s[:max]
+		}
+		return s
+	}
+	base, ext = clean(base, 24), clean(ext, 5)
+
+	for i := 0; ; i++ {
+		candidate := base
+		if i > 0 {
+			suffix := fmt.Sprintf("_%d", i)
+			if len(candidate)+len(suffix) > 24 {
+				candidate = candidate[:24-len(suffix)]
+			}
+			candidate += suffix
+		}
+		id := candidate
+		if !isDir {
+			id += "." + ext + ";1"
+		}
+		if !used[id] {
+			used[id] = true
+			return id
+		}
+	}
+}
+
+func sectors(size int64) uint32 {
+	return uint32((size + isoSectorSize - 1) / isoSectorSize)
+}
+
+func padSector(data []byte) []byte {
+	return append(data, make([]byte, int(sectors(int64(len(data))))*isoSectorSize-len(data))...)
+}
+
+func bothEndian32(v uint32) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint32(b, v)
+	binary.BigEndian.PutUint32(b[4:], v)
+	return b
+}
+
+func bothEndian16(v uint16) []byte {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b, v)
+	binary.BigEndian.PutUint16(b[2:], v)
+	return b
+}
+
+func isoRecordTime(t time.Time) []byte {
+	t = t.UTC()
+	return []byte{byte(t.Year() - 1900), byte(t.Month()), byte(t.Day()), byte(t.Hour()), byte(t.Minute()), byte(t.Second()), 0}
+}
+
+// Rock Ridge entries
+func suspSP() []byte {
+	return []byte{'S', 'P', 7, 1, 0xbe, 0xef, 0}
+}
+
+// suspER declares that the image uses Rock Ridge 1.10 extensions
+func suspER() []byte {
+	const id, desc = "RRIP_1991A", "ROCK RIDGE INTERCHANGE PROTOCOL"
+	er := []byte{'E', 'R', byte(8 + len(id) + len(desc)), 1, byte(len(id)), byte(len(desc)), 0, 1}
+	return append(append(er, id...), desc...)
+}
+
+func rripPX(mode os.FileMode) []byte {
+	m := uint32(mode.Perm())
+	links := uint32(1)
+	if mode.IsDir() {
+		m |= modeDir
+		links = 2
+	} else {
+		m |= modeRegular
+	}
+	px := []byte{'P', 'X', 36, 1}
+	px = append(px, bothEndian32(m)...)
+	px = append(px, bothEndian32(links)...)
+	px = append(px, bothEndian32(0)...) // uid
+	px = append(px, bothEndian32(0)...) // gid
+	return px
+}
+
+func rripNM(name string) []byte {
+	return append([]byte{'N', 'M', byte(5 + len(name)), 1, 0}, name...)
+}
+
+// dirRecordSize returns the size of a directory record with the given identifier and system use area lengths
+func dirRecordSize(idLen, systemUseLen int) int {
+	size := 33 + idLen
+	if idLen%2 == 0 {
+		size++ // padding field
+	}
+	size += systemUseLen
+	if size%2 == 1 {
+		size++
+	}
+	return size
+}
+
+// dirRecord renders a directory record. id is the raw identifier, \x00 for '.' and \x01 for '..'.
+func dirRecord(id string, target *isoNode, systemUse []byte) []byte {
+	size := uint32(target.size)
+	if target.isDir() {
+		size = uint32(sectors(target.dirSize)) * isoSectorSize
+	}
+	idLen := len(id)
+	recLen := dirRecordSize(idLen, len(systemUse))
+
+	var flags byte
+	if target.isDir() {
+		flags = 2
+	}
+	rec := []byte{byte(recLen), 0}
+	rec = append(rec, bothEndian32(target.extent)...)
+	rec = append(rec, bothEndian32(size)...)
+	rec = append(rec, isoRecordTime(target.modTime)...)
+	rec = append(rec, flags, 0, 0)
+	rec = append(rec, bothEndian16(1)...)
+	rec = append(rec, byte(idLen))
+	rec = append(rec, id...)
+	if idLen%2 == 0 {
+		rec = append(rec, 0)
+	}
+	rec = append(rec, systemUse...)
+	if len(rec) < recLen {
+		rec = append(rec, 0)
+	}
+	return rec
+}
+
+// dirRecords renders all records of the directory
+func dirRecords(d *isoNode) [][]byte {
+	parent := d.parent
+	if parent == nil {
+		parent = d
+	}
+	self := rripPX(d.mode)
+	if d.parent == nil {
+		// SUSP indicator must be the first entry of the root directory '.' record
+		self = append(append(suspSP(), suspER()...), self...)
+	}
+	records := [][]byte{
+		dirRecord("\x00", d, self),
+		dirRecord("\x01", parent, rripPX(parent.mode)),
+	}
+	for _, c := range d.children {
+		records = append(records, dirRecord(c.id, c, childSystemUse(c)))
+	}
+	return records
+}
+
+// childSystemUse returns the Rock Ridge entries of the record of n in its parent directory
+func childSystemUse(n *isoNode) []byte {
+	return append(rripPX(n.mode), rripNM(n.name)...)
+}
+
+// dirExtentSize computes the directory extent size. Records never cross sector boundaries.
+func dirExtentSize(d *isoNode) int64 {
+	var size int64
+	for _, r := range dirRecords(d) {
+		if size%isoSectorSize+int64(len(r)) > isoSectorSize {
+			size += isoSectorSize - size%isoSectorSize
+		}
+		size += int64(len(r))
+	}
+	return size
+}
+
+func dirExtent(d *isoNode) []byte {
+	var buf []byte
+	for _, r := range dirRecords(d) {
+		if len(buf)%isoSectorSize+len(r) > isoSectorSize {
+			buf = append(buf, make([]byte, isoSectorSize-len(buf)%isoSectorSize)...)
+		}
+		buf = append(buf, r...)
+	}
+	return padSector(buf)
+}
+
+func buildPathTable(dirs []*isoNode, order binary.ByteOrder) []byte {
+	var table []byte
+	for _, d := range dirs {
+		id := d.id
+		parent := 1
+		if d.parent == nil {
+			id = "\x00"
+		} else {
+			parent = d.parent.dirNum
+		}
+		entry := []byte{byte(len(id)), 0, 0, 0, 0, 0, 0, 0}
+		order.PutUint32(entry[2:], d.extent)
+		order.PutUint16(entry[6:], uint16(parent))
+		entry = append(entry, id...)
+		if len(id)%2 == 1 {
+			entry = append(entry, 0)
+		}
+		table = append(table, entry...)
+	}
+	return table
+}
+
+func isoText(s string, length int) []byte {
+	b := bytes.Repeat([]byte{' '}, length)
+	copy(b, s)
+	return b
+}
+
+func isoDescriptorTime(t time.Time) []byte {
+	return append([]byte(t.UTC().Format("20060102150405")+"00"), 0)
+}
+
+func primaryVolumeDescriptor(volumeID string, root *isoNode, totalSectors, pathTableSize, lPathTable, mPathTable uint32) []byte {
+	now := time.Now()
+	pvd := []byte{1, 'C', 'D', '0', '0', '1', 1, 0}
+	pvd = append(pvd, isoText("LINUX", 32)...)
+	pvd = append(pvd, isoText(volumeID, 32)...)
+	pvd = append(pvd, make([]byte, 8)...)
+	pvd = append(pvd, bothEndian32(totalSectors)...)
+	pvd = append(pvd, make([]byte, 32)...)
+	pvd = append(pvd, bothEndian16(1)...) // volume set size
+	pvd = append(pvd, bothEndian16(1)...) // volume sequence number
+	pvd = append(pvd, bothEndian16(isoSectorSize)...)
+	pvd = append(pvd, bothEndian32(pathTableSize)...)
+	lpt := make([]byte, 8)
+	binary.LittleEndian.PutUint32(lpt, lPathTable)
+	mpt := make([]byte, 8)
+	binary.BigEndian.PutUint32(mpt, mPathTable)
+	pvd = append(pvd, lpt...)
+	pvd = append(pvd, mpt...)
+	pvd = append(pvd, dirRecord("\x00", root, nil)...)
+	pvd = append(pvd, isoText("", 128)...) // volume set
+	pvd = append(pvd, isoText("", 128)...) // publisher
+	pvd = append(pvd, isoText("", 128)...) // data preparer
+	pvd = append(pvd, isoText("VMTEST", 128)...)
+	pvd = append(pvd, isoText("", 37*3)...) // copyright, abstract and bibliographic files
+	pvd = append(pvd, isoDescriptorTime(now)...)
+	pvd = append(pvd, isoDescriptorTime(now)...)
+	pvd = append(pvd, append(bytes.Repeat([]byte{'0'}, 16), 0)...) // expiration
+	pvd = append(pvd, isoDescriptorTime(now)...)
+	pvd = append(pvd, 1) // file structure version
+	return padSector(pvd)
+}
+
+func copyISOFile(w io.Writer, file *isoNode) error {
+	in, err := os.Open(file.hostPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	n, err := io.Copy(w, in)
+	if err != nil {
+		return err
+	}
+	if n != file.size {
+		return fmt.Errorf("iso: %v changed while building the image", file.hostPath)
+	}
+	_, err = w.Write(make([]byte, int64(sectors(n))*isoSectorSize-n))
+	return err
+}
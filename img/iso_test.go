@@ -0,0 +1,83 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBuildISO(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "user-data"), []byte("#cloud-config\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "meta-data"), []byte("instance-id: vmtest\n"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "scripts"), 0o755))
+
+	output := filepath.Join(t.TempDir(), "cidata.iso")
+	require.NoError(t, BuildISO(dir, output, &ISOOptions{VolumeID: "cidata"}))
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	pvd := data[16*isoSectorSize:]
+	require.Equal(t, "CD001", string(pvd[1:6]))
+	require.Equal(t, "cidata", string(bytes.TrimRight(pvd[40:72], " ")))
+
+	// walk the root directory records and collect Rock Ridge names with file contents
+	root := pvd[156:190]
+	extent := binary.LittleEndian.Uint32(root[2:])
+	size := binary.LittleEndian.Uint32(root[10:])
+	records := data[extent*isoSectorSize : extent*isoSectorSize+size]
+	files := map[string]string{}
+	for off := 0; off < len(records) && records[off] != 0; off += int(records[off]) {
+		rec := records[off : off+int(records[off])]
+		nm := bytes.Index(rec, []byte("NM"))
+		if nm == -1 {
+			continue // '.' and '..'
+		}
+		name := string(rec[nm+5 : nm+int(rec[nm+2])])
+		start := binary.LittleEndian.Uint32(rec[2:]) * isoSectorSize
+		length := binary.LittleEndian.Uint32(rec[10:])
+		if rec[25]&2 != 0 {
+			files[name] = "<dir>"
+		} else {
+			files[name] = string(data[start : start+length])
+		}
+	}
+	require.Equal(t, map[string]string{
+		"meta-data": "instance-id: vmtest\n",
+		"scripts":   "<dir>",
+		"user-data": "#cloud-config\n",
+	}, files)
+}
+
+func TestBuildISOLongName(t *testing.T) {
+	dir := t.TempDir()
+	long := strings.Repeat("a", 140) + ".conf"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, long), []byte("data"), 0o644))
+	output := filepath.Join(t.TempDir(), "long.iso")
+	require.NoError(t, BuildISO(dir, output, &ISOOptions{}))
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Contains(t, string(data), long)
+
+	// the record length is stored in a byte, so too long Rock Ridge names are rejected
+	require.NoError(t, os.WriteFile(filepath.Join(dir, strings.Repeat("b", 200)), []byte("data"), 0o644))
+	err = BuildISO(dir, output, &ISOOptions{})
+	require.ErrorContains(t, err, "is too long for a directory record")
+}
+
+func TestBuildISOLargeFile(t *testing.T) {
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, "large.img"))
+	require.NoError(t, err)
+	// a sparse file does not take the disk space
+	require.NoError(t, f.Truncate(1<<32))
+	require.NoError(t, f.Close())
+
+	err = BuildISO(dir, filepath.Join(t.TempDir(), "large.iso"), &ISOOptions{})
+	require.ErrorContains(t, err, "is too large for ISO 9660")
+}
@@ -0,0 +1,115 @@
+package img
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// luks2HeaderSize is the default size of the LUKS2 header and keyslots area
+const luks2HeaderSize = 16 << 20
+
+// LUKSTool is a host program that formats LUKS containers
+type LUKSTool string
+
+const (
+	// LUKS_QEMU_IMG creates LUKS1 containers with qemu-img, it does not need root and can encrypt an existing image
+	LUKS_QEMU_IMG = LUKSTool("qemu-img")
+	// LUKS_CRYPTSETUP creates LUKS2 containers with cryptsetup, the container is empty
+	LUKS_CRYPTSETUP = LUKSTool("cryptsetup")
+)
+
+// LUKSOptions configures an encrypted disk image created by LUKS()
+type LUKSOptions struct {
+	// Passphrase unlocks the container. Either Passphrase or KeyFile must be set.
+	Passphrase string
+	// KeyFile is a host file whose content is the key, e.g. the file added to the initramfs under test
+	KeyFile string
+	// Content is a raw image with the plaintext, e.g. a filesystem image. It is supported by LUKS_QEMU_IMG only.
+	Content string
+	// Size of the plaintext in bytes if Content is empty
+	Size int64
+	// Tool formats the container, default is LUKS_QEMU_IMG
+	Tool LUKSTool
+}
+
+// LUKS writes a LUKS encrypted disk image to output with the given passphrase or key file. Attach it as a raw
+// disk, so the guest decrypts it, e.g. with the initramfs under test.
+func LUKS(output string, opts *LUKSOptions) error {
+	if (opts.Passphrase == "") == (opts.KeyFile == "") {
+		return fmt.Errorf("LUKS image needs either a passphrase or a key file")
+	}
+	if opts.Content == "" && opts.Size <= 0 {
+		return fmt.Errorf("LUKS image needs either content or size")
+	}
+	size := opts.Size
+	if opts.Content != "" {
+		fi, err := os.Stat(opts.Content)
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	}
+	// the LUKS2 header takes 16MiB, LUKS1 one is smaller
+	if err := checkOutputSpace(output, size+luks2HeaderSize); err != nil {
+		return err
+	}
+
+	keyFile := opts.KeyFile
+	if keyFile == "" {
+		// the passphrase is passed with a file, so it does not show up in the host process list
+		dir, err := os.MkdirTemp("", "vmtest-luks")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		keyFile = filepath.Join(dir, "key")
+		if err := os.WriteFile(keyFile, []byte(opts.Passphrase), 0o600); err != nil {
+			return err
+		}
+	}
+
+	args, err := luksCommand(output, keyFile, opts)
+	if err != nil {
+		return err
+	}
+	if opts.Tool == LUKS_CRYPTSETUP {
+		// cryptsetup formats an existing file
+		f, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		if err := f.Truncate(opts.Size + luks2HeaderSize); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%v: %v: %s", args[0], err, out)
+	}
+	return nil
+}
+
+// luksCommand returns the command line formatting the container
+func luksCommand(output, keyFile string, opts *LUKSOptions) ([]string, error) {
+	switch opts.Tool {
+	case "", LUKS_QEMU_IMG:
+		secret := "secret,id=sec0,format=raw,file=" + keyFile
+		if opts.Content != "" {
+			return []string{"qemu-img", "convert", "--object", secret, "-f", "raw", "-O", "luks", "-o", "key-secret=sec0", opts.Content, output}, nil
+		}
+		return []string{"qemu-img", "create", "--object", secret, "-f", "luks", "-o", "key-secret=sec0", output, strconv.FormatInt(opts.Size, 10)}, nil
+	case LUKS_CRYPTSETUP:
+		if opts.Content != "" {
+			return nil, fmt.Errorf("cryptsetup cannot encrypt an existing image, use LUKS_QEMU_IMG")
+		}
+		return []string{"cryptsetup", "luksFormat", "--type", "luks2", "--batch-mode", "--key-file", keyFile, output}, nil
+	default:
+		return nil, fmt.Errorf("unknown LUKS tool %q", opts.Tool)
+	}
+}
@@ -0,0 +1,37 @@
+package img
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/anatol/vmtest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLUKSCommand(t *testing.T) {
+	args, err := luksCommand("disk.img", "/tmp/key", &LUKSOptions{Size: 1 << 20})
+	require.NoError(t, err)
+	require.Equal(t, []string{"qemu-img", "create", "--object", "secret,id=sec0,format=raw,file=/tmp/key",
+		"-f", "luks", "-o", "key-secret=sec0", "disk.img", "1048576"}, args)
+
+	args, err = luksCommand("disk.img", "/tmp/key", &LUKSOptions{Content: "rootfs.img"})
+	require.NoError(t, err)
+	require.Equal(t, "convert", args[1])
+	require.Equal(t, "rootfs.img", args[len(args)-2])
+
+	_, err = luksCommand("disk.img", "/tmp/key", &LUKSOptions{Content: "rootfs.img", Tool: LUKS_CRYPTSETUP})
+	require.Error(t, err)
+
+	require.Error(t, LUKS("disk.img", &LUKSOptions{Size: 1 << 20}))
+	require.ErrorIs(t, LUKS(filepath.Join(t.TempDir(), "disk.img"), &LUKSOptions{Passphrase: "1234", Size: 1 << 62}), vmtest.ErrNoSpace)
+}
+
+func TestLUKS(t *testing.T) {
+	if _, err := exec.LookPath("qemu-img"); err != nil {
+		t.Skip("qemu-img is not installed")
+	}
+	output := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, LUKS(output, &LUKSOptions{Passphrase: "1234", Size: 16 << 20}))
+	require.FileExists(t, output)
+}
@@ -0,0 +1,121 @@
+package img
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// MBRType is a partition type of the MBR partition table
+type MBRType byte
+
+// Common partition types
+const (
+	MBR_FAT32_LBA  = MBRType(0x0c)
+	MBR_LINUX_SWAP = MBRType(0x82)
+	MBR_LINUX      = MBRType(0x83)
+	MBR_LINUX_LVM  = MBRType(0x8e)
+	MBR_EFI_SYSTEM = MBRType(0xef)
+	MBR_LINUX_RAID = MBRType(0xfd)
+)
+
+// MBRPartition is a primary partition of an MBR partition table
+type MBRPartition struct {
+	// Type is the partition type, default is MBR_LINUX
+	Type MBRType
+	// Bootable sets the active flag, BIOS boot code of many bootloaders starts the active partition
+	Bootable bool
+	// Start is the offset of the partition in bytes. If zero then the partition starts at the first 1MiB aligned
+	// offset after the previous partition.
+	Start int64
+	// Size of the partition in bytes, zero means the rest of the disk (the last partition only)
+	Size int64
+}
+
+// MBROptions configures an MBR (DOS) partition table
+type MBROptions struct {
+	// Size of the disk image in bytes. If zero then the size of the existing output file is used.
+	Size int64
+	// DiskID is the disk signature e.g. PARTUUID=$DiskID-01, a random one is used if zero
+	DiskID uint32
+	// Partitions are up to 4 primary partitions
+	Partitions []MBRPartition
+}
+
+// MBR writes an MBR partition table to the raw disk image output. The image is created as a sparse file if it
+// does not exist, the boot code and the content outside of the table are preserved.
+func MBR(output string, opts *MBROptions) error {
+	if len(opts.Partitions) > mbrEntries {
+		return fmt.Errorf("MBR supports up to %d primary partitions", mbrEntries)
+	}
+	f, err := os.OpenFile(output, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	size := opts.Size
+	if size == 0 {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		size = fi.Size()
+	} else if err := f.Truncate(size); err != nil {
+		return err
+	}
+	if size%sectorSize != 0 {
+		return fmt.Errorf("disk size %d is not a multiple of the sector size", size)
+	}
+	sectors := uint64(size / sectorSize)
+	if sectors > 0xffffffff {
+		return fmt.Errorf("MBR supports disks up to 2TiB")
+	}
+	if sectors < 2 {
+		return fmt.Errorf("disk of %d bytes is too small for MBR", size)
+	}
+
+	starts := make([]int64, len(opts.Partitions))
+	sizes := make([]int64, len(opts.Partitions))
+	for i, p := range opts.Partitions {
+		starts[i], sizes[i] = p.Start, p.Size
+	}
+	extents, err := placePartitions(starts, sizes, 1, sectors-1)
+	if err != nil {
+		return err
+	}
+
+	table := make([]byte, sectorSize-mbrTableOffset)
+	id := opts.DiskID
+	if id == 0 {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return err
+		}
+		id = binary.LittleEndian.Uint32(b[:])
+	}
+	binary.LittleEndian.PutUint32(table, id)
+	for i, p := range opts.Partitions {
+		e := table[mbrEntriesOffset-mbrTableOffset+i*mbrEntrySize:]
+		if p.Bootable {
+			e[0] = 0x80
+		}
+		typ := p.Type
+		if typ == 0 {
+			typ = MBR_LINUX
+		}
+		// CHS addresses are not used by modern systems, 0xfeffff means the address is beyond CHS range
+		copy(e[1:4], []byte{0xfe, 0xff, 0xff})
+		e[4] = byte(typ)
+		copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+		binary.LittleEndian.PutUint32(e[8:], uint32(extents[i].first))
+		binary.LittleEndian.PutUint32(e[12:], uint32(extents[i].last-extents[i].first+1))
+	}
+	table[len(table)-2], table[len(table)-1] = 0x55, 0xaa
+
+	if _, err := f.WriteAt(table, mbrTableOffset); err != nil {
+		return err
+	}
+	return f.Close()
+}
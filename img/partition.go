@@ -0,0 +1,215 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	sectorSize = 512
+	// partitionAlign is the default alignment of partitions, 1MiB as used by fdisk and parted
+	partitionAlign = 1 << 20
+	// MBR layout: boot code, disk signature, partition entries and the boot signature
+	mbrBootCodeSize  = 440
+	mbrTableOffset   = 440
+	mbrEntriesOffset = 446
+	mbrEntrySize     = 16
+	mbrEntries       = 4
+	// the limits of the GPT entries read from the images, UEFI requires the entry size to be 128*2^n
+	gptMinEntrySize   = 128
+	gptMaxEntrySize   = 4096
+	gptMaxEntries     = 1024
+	gptMaxEntriesSize = 1 << 20
+)
+
+// extent is a partition location in sectors, last is inclusive
+type extent struct {
+	first, last uint64
+}
+
+// placePartitions converts partition starts and sizes in bytes to extents between the usable sectors.
+// A zero start places the partition at the first aligned sector after the previous one, a zero size
+// of the last partition takes the rest of the disk.
+func placePartitions(starts, sizes []int64, firstUsable, lastUsable uint64) ([]extent, error) {
+	extents := make([]extent, len(starts))
+	next := uint64(partitionAlign / sectorSize)
+	for i := range starts {
+		if starts[i]%sectorSize != 0 || sizes[i]%sectorSize != 0 {
+			return nil, fmt.Errorf("partition %d: start and size must be multiples of the sector size", i+1)
+		}
+		first := uint64(starts[i] / sectorSize)
+		if first == 0 {
+			first = next
+		}
+		last := lastUsable
+		if sizes[i] != 0 {
+			last = first + uint64(sizes[i]/sectorSize) - 1
+		} else if i != len(starts)-1 {
+			return nil, fmt.Errorf("partition %d: only the last partition may take the rest of the disk", i+1)
+		}
+		if first < firstUsable || last > lastUsable || last < first {
+			return nil, fmt.Errorf("partition %d does not fit the disk", i+1)
+		}
+		if i > 0 && first <= extents[i-1].last {
+			return nil, fmt.Errorf("partition %d overlaps with partition %d", i+1, i)
+		}
+		extents[i] = extent{first, last}
+		next = alignUp(last+1, partitionAlign/sectorSize)
+	}
+	return extents, nil
+}
+
+func alignUp(v, align uint64) uint64 {
+	return (v + align - 1) / align * align
+}
+
+// Partition is a partition location read from a disk image
+type Partition struct {
+	// Number is the partition number as used by Linux e.g. 2 for /dev/sda2
+	Number int
+	// Start and Size of the partition in bytes
+	Start, Size int64
+}
+
+// Partitions reads the GPT or MBR partition table of the raw disk image
+func Partitions(image string) ([]Partition, error) {
+	f, err := os.Open(image)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mbr := make([]byte, sectorSize)
+	if _, err := f.ReadAt(mbr, 0); err != nil {
+		return nil, err
+	}
+	if mbr[510] != 0x55 || mbr[511] != 0xaa {
+		return nil, fmt.Errorf("%v: no partition table", image)
+	}
+	if mbr[mbrEntriesOffset+4] == 0xee {
+		return readGPT(f, image)
+	}
+
+	var parts []Partition
+	for i := 0; i < mbrEntries; i++ {
+		e := mbr[mbrEntriesOffset+i*mbrEntrySize:]
+		if e[4] == 0 {
+			continue
+		}
+		parts = append(parts, Partition{
+			Number: i + 1,
+			Start:  int64(binary.LittleEndian.Uint32(e[8:])) * sectorSize,
+			Size:   int64(binary.LittleEndian.Uint32(e[12:])) * sectorSize,
+		})
+	}
+	return parts, nil
+}
+
+func readGPT(f *os.File, image string) ([]Partition, error) {
+	h := make([]byte, sectorSize)
+	if _, err := f.ReadAt(h, sectorSize); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(h[:8], []byte("EFI PART")) {
+		return nil, fmt.Errorf("%v: invalid GPT header", image)
+	}
+	entriesLBA := binary.LittleEndian.Uint64(h[72:])
+	num := binary.LittleEndian.Uint32(h[80:])
+	entrySize := binary.LittleEndian.Uint32(h[84:])
+	if entrySize < gptMinEntrySize || entrySize > gptMaxEntrySize || entrySize&(entrySize-1) != 0 ||
+		num > gptMaxEntries || num*entrySize > gptMaxEntriesSize {
+		return nil, fmt.Errorf("%v: invalid GPT entries: %d entries of %d bytes", image, num, entrySize)
+	}
+	entries := make([]byte, num*entrySize)
+	if _, err := f.ReadAt(entries, int64(entriesLBA*sectorSize)); err != nil {
+		return nil, err
+	}
+
+	var parts []Partition
+	zero := make([]byte, 16)
+	for i := uint32(0); i < num; i++ {
+		e := entries[i*entrySize:]
+		if bytes.Equal(e[:16], zero) {
+			continue
+		}
+		first := binary.LittleEndian.Uint64(e[32:])
+		last := binary.LittleEndian.Uint64(e[40:])
+		parts = append(parts, Partition{
+			Number: int(i) + 1,
+			Start:  int64(first * sectorSize),
+			Size:   int64((last - first + 1) * sectorSize),
+		})
+	}
+	return parts, nil
+}
+
+// WritePartition copies the content of src, e.g. a filesystem image, to the partition number n of the raw
+// disk image
+func WritePartition(image string, n int, src string) error {
+	parts, err := Partitions(image)
+	if err != nil {
+		return err
+	}
+	var part *Partition
+	for i := range parts {
+		if parts[i].Number == n {
+			part = &parts[i]
+		}
+	}
+	if part == nil {
+		return fmt.Errorf("%v: partition %d not found", image, n)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > part.Size {
+		return fmt.Errorf("%v of %d bytes does not fit partition %d of %d bytes", src, fi.Size(), n, part.Size)
+	}
+	return writeAt(image, part.Start, in)
+}
+
+// WriteBootCode installs the MBR boot code from src, e.g. syslinux mbr.bin or GRUB boot.img, to the raw disk
+// image. Only the first 440 bytes are used, so the partition table is preserved.
+func WriteBootCode(image, src string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if len(data) > mbrBootCodeSize {
+		data = data[:mbrBootCodeSize]
+	}
+	return writeAt(image, 0, bytes.NewReader(data))
+}
+
+// WriteAt copies the content of src to the raw disk image at the given offset in bytes, e.g. a bootloader
+// stage embedded between the MBR and the first partition
+func WriteAt(image string, offset int64, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeAt(image, offset, in)
+}
+
+func writeAt(image string, offset int64, r io.Reader) error {
+	f, err := os.OpenFile(image, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(io.NewOffsetWriter(f, offset), r); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,100 @@
+package img
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMBR(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, MBR(output, &MBROptions{
+		Size:   32 << 20,
+		DiskID: 0x12345678,
+		Partitions: []MBRPartition{
+			{Type: MBR_EFI_SYSTEM, Size: 4 << 20, Bootable: true},
+			{},
+		},
+	}))
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x78, 0x56, 0x34, 0x12}, data[440:444])
+	require.Equal(t, byte(0x80), data[446])
+	require.Equal(t, byte(0xef), data[446+4])
+	require.Equal(t, byte(0x83), data[462+4])
+	require.Equal(t, []byte{0x55, 0xaa}, data[510:512])
+
+	parts, err := Partitions(output)
+	require.NoError(t, err)
+	require.Equal(t, []Partition{
+		{Number: 1, Start: 1 << 20, Size: 4 << 20},
+		{Number: 2, Start: 5 << 20, Size: 32<<20 - 5<<20},
+	}, parts)
+
+	require.Error(t, MBR(output, &MBROptions{Partitions: make([]MBRPartition, 5)}))
+}
+
+func TestWritePartition(t *testing.T) {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "disk.img")
+	require.NoError(t, GPT(output, &GPTOptions{
+		Size:       16 << 20,
+		Partitions: []GPTPartition{{Type: GPT_BIOS_BOOT, Size: 1 << 20}, {Size: 4 << 20}},
+	}))
+	parts, err := Partitions(output)
+	require.NoError(t, err)
+	require.Equal(t, []Partition{{Number: 1, Start: 1 << 20, Size: 1 << 20}, {Number: 2, Start: 2 << 20, Size: 4 << 20}}, parts)
+
+	fs := filepath.Join(dir, "fs.img")
+	require.NoError(t, os.WriteFile(fs, []byte("filesystem"), 0o644))
+	require.NoError(t, WritePartition(output, 2, fs))
+	require.Error(t, WritePartition(output, 3, fs))
+	big := filepath.Join(dir, "big.img")
+	require.NoError(t, os.WriteFile(big, make([]byte, 5<<20), 0o644))
+	require.Error(t, WritePartition(output, 2, big))
+
+	boot := filepath.Join(dir, "boot.img")
+	require.NoError(t, os.WriteFile(boot, bytes.Repeat([]byte{0x90}, 512), 0o644))
+	require.NoError(t, WriteBootCode(output, boot))
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, "filesystem", string(data[2<<20:2<<20+10]))
+	require.Equal(t, bytes.Repeat([]byte{0x90}, 440), data[:440])
+	require.Equal(t, byte(0xee), data[446+4])
+
+	// rewriting the table keeps the boot code
+	require.NoError(t, GPT(output, &GPTOptions{Partitions: []GPTPartition{{}}}))
+	data, err = os.ReadFile(output)
+	require.NoError(t, err)
+	require.Equal(t, byte(0x90), data[0])
+}
+
+func TestPartitionsInvalidGPT(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "disk.img")
+	require.NoError(t, GPT(output, &GPTOptions{Size: 4 << 20, Partitions: []GPTPartition{{}}}))
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		num, entrySize uint32
+	}{
+		{128, 64},
+		{128, 129},
+		{128, 384},
+		{128, 8192},
+		{2048, 128},
+		{1024, 4096},
+	} {
+		header := data[sectorSize:]
+		binary.LittleEndian.PutUint32(header[80:], tc.num)
+		binary.LittleEndian.PutUint32(header[84:], tc.entrySize)
+		require.NoError(t, os.WriteFile(output, data, 0o644))
+		_, err := Partitions(output)
+		require.ErrorContains(t, err, "invalid GPT entries", "%d entries of %d bytes", tc.num, tc.entrySize)
+	}
+}
@@ -0,0 +1,34 @@
+// Package fakessh provides an ssh client for the tests of the SSH based backends
+package fakessh
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// script is an ssh client that runs the remote commands locally and logs its arguments
+const script = `#!/bin/sh
+echo "$@" >> "$0.log"
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-o|-p|-i) shift 2 ;;
+	-tt) shift ;;
+	*) break ;;
+	esac
+done
+shift
+[ $# -eq 0 ] && exec sh
+exec sh -c "$1"
+`
+
+// Install puts the fake ssh client first in PATH for the duration of the test and returns the path of
+// the file its invocations are logged to, one line of arguments per invocation
+func Install(t *testing.T) string {
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ssh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return filepath.Join(bin, "ssh.log")
+}
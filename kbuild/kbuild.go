@@ -0,0 +1,284 @@
+// Package kbuild builds Linux kernels for vmtest VMs and caches the built images
+package kbuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/anatol/vmtest"
+)
+
+// Options describes a kernel build
+type Options struct {
+	// SourceDir is a path to the kernel source tree
+	SourceDir string
+	// Defconfig is either a make target (e.g. 'defconfig', 'tinyconfig') or a path to a config file
+	Defconfig string
+	// Fragments is a list of config fragment files applied on top of Defconfig
+	Fragments []string
+	// Arch is the kernel ARCH value, default is the host architecture
+	Arch string
+	// CrossCompile is the CROSS_COMPILE toolchain prefix e.g. 'aarch64-linux-gnu-'
+	CrossCompile string
+	// CacheDir is a directory where built kernels are stored, default is $XDG_CACHE_HOME/vmtest/kbuild
+	CacheDir string
+	// Jobs is a number of parallel make jobs, default is the number of CPUs
+	Jobs int
+	// Verbose prints the build output
+	Verbose bool
+}
+
+// Build builds the kernel and returns a path to its image (bzImage, Image, ...) suitable for QemuOptions.Kernel.
+// The build is skipped if a kernel with the same sources and configuration has been built before. Sources
+// in a git tree are identified by the revision, the uncommitted changes and the untracked files. Sources
+// outside of git are identified by the names, sizes and modification times of their files.
+func Build(opts *Options) (string, error) {
+	if opts.SourceDir == "" {
+		return "", fmt.Errorf("kbuild: kernel source directory is not specified")
+	}
+	if opts.Defconfig == "" {
+		return "", fmt.Errorf("kbuild: defconfig is not specified")
+	}
+
+	cacheDir := opts.CacheDir
+	if cacheDir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(userCache, "vmtest", "kbuild")
+	}
+
+	key, err := cacheKey(opts)
+	if err != nil {
+		return "", err
+	}
+	entryDir := filepath.Join(cacheDir, key)
+	if err := os.MkdirAll(cacheDir, 0o755); err != nil {
+		return "", err
+	}
+	// parallel test processes building the same kernel wait for the first one
+	lock, err := vmtest.LockFile(entryDir + ".lock")
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+	if images, _ := filepath.Glob(filepath.Join(entryDir, "image-*")); len(images) == 1 {
+		return images[0], nil
+	}
+
+	buildDir := filepath.Join(entryDir, "build")
+	if err := os.MkdirAll(buildDir, 0o755); err != nil {
+		return "", err
+	}
+	image, err := build(opts, buildDir)
+	if err != nil {
+		return "", err
+	}
+
+	result := filepath.Join(entryDir, "image-"+filepath.Base(image))
+	if err := copyFile(image, result+".tmp"); err != nil {
+		return "", err
+	}
+	if err := os.Rename(result+".tmp", result); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+func build(opts *Options, buildDir string) (string, error) {
+	config := filepath.Join(buildDir, ".config")
+	if isFile(opts.Defconfig) {
+		if err := copyFile(opts.Defconfig, config); err != nil {
+			return "", err
+		}
+	} else if err := runMake(opts, buildDir, opts.Defconfig); err != nil {
+		return "", err
+	}
+
+	if len(opts.Fragments) > 0 {
+		// kconfig uses the last assignment of a symbol so appended fragments override the defconfig values
+		f, err := os.OpenFile(config, os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return "", err
+		}
+		for _, frag := range opts.Fragments {
+			data, err := os.ReadFile(frag)
+			if err != nil {
+				_ = f.Close()
+				return "", err
+			}
+			if _, err := f.Write(append(data, '\n')); err != nil {
+				_ = f.Close()
+				return "", err
+			}
+		}
+		if err := f.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := runMake(opts, buildDir, "olddefconfig"); err != nil {
+		return "", err
+	}
+
+	jobs := opts.Jobs
+	if jobs == 0 {
+		jobs = runtime.NumCPU()
+	}
+	if err := runMake(opts, buildDir, fmt.Sprintf("-j%d", jobs)); err != nil {
+		return "", err
+	}
+
+	out, err := exec.Command("make", append(makeArgs(opts, buildDir), "-s", "image_name")...).Output()
+	if err != nil {
+		return "", fmt.Errorf("kbuild: make image_name: %v", err)
+	}
+	return filepath.Join(buildDir, strings.TrimSpace(string(out))), nil
+}
+
+func makeArgs(opts *Options, buildDir string) []string {
+	args := []string{"-C", opts.SourceDir, "O=" + buildDir}
+	if opts.Arch != "" {
+		args = append(args, "ARCH="+opts.Arch)
+	}
+	if opts.CrossCompile != "" {
+		args = append(args, "CROSS_COMPILE="+opts.CrossCompile)
+	}
+	return args
+}
+
+func runMake(opts *Options, buildDir string, target string) error {
+	args := append(makeArgs(opts, buildDir), target)
+	if opts.Verbose {
+		log.Printf("kbuild: make %v", strings.Join(args, " "))
+	}
+	cmd := exec.Command("make", args...)
+	var output strings.Builder
+	if opts.Verbose {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	} else {
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kbuild: make %v: %v\n%v", target, err, output.String())
+	}
+	return nil
+}
+
+// cacheKey identifies the build by its sources revision and configuration
+func cacheKey(opts *Options) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "arch=%v\ncross=%v\n", opts.Arch, opts.CrossCompile)
+
+	if isFile(opts.Defconfig) {
+		if err := hashFile(h, opts.Defconfig); err != nil {
+			return "", err
+		}
+	} else {
+		fmt.Fprintf(h, "defconfig=%v\n", opts.Defconfig)
+	}
+	for _, frag := range opts.Fragments {
+		if err := hashFile(h, frag); err != nil {
+			return "", err
+		}
+	}
+
+	src, err := filepath.Abs(opts.SourceDir)
+	if err != nil {
+		return "", err
+	}
+	if rev, err := exec.Command("git", "-C", src, "rev-parse", "HEAD").Output(); err == nil {
+		fmt.Fprintf(h, "rev=%s\n", rev)
+		// uncommitted changes and new files are part of the build too
+		diff, err := exec.Command("git", "-C", src, "diff", "HEAD").Output()
+		if err != nil {
+			return "", fmt.Errorf("kbuild: git diff: %v", err)
+		}
+		h.Write(diff)
+		if err := hashUntracked(h, src); err != nil {
+			return "", err
+		}
+	} else {
+		fmt.Fprintf(h, "src=%v\n", src)
+		if err := hashTree(h, src); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16], nil
+}
+
+// hashUntracked writes the names and the content of the files git does not track in the source tree
+func hashUntracked(w io.Writer, src string) error {
+	out, err := exec.Command("git", "-C", src, "ls-files", "-z", "--others", "--exclude-standard").Output()
+	if err != nil {
+		return fmt.Errorf("kbuild: git ls-files: %v", err)
+	}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+		fmt.Fprintf(w, "untracked=%v\n", name)
+		if err := hashFile(w, filepath.Join(src, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashTree writes the names, sizes and modification times of the files in the source tree, these are what
+// make uses to decide on a rebuild
+func hashTree(w io.Writer, src string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(src, path)
+			fmt.Fprintf(w, "file=%v %d %d\n", rel, info.Size(), info.ModTime().UnixNano())
+		}
+		return nil
+	})
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func isFile(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
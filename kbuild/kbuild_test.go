@@ -0,0 +1,72 @@
+package kbuild
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	dir := t.TempDir()
+	frag := filepath.Join(dir, "debug.config")
+	require.NoError(t, os.WriteFile(frag, []byte("CONFIG_DEBUG_INFO=y\n"), 0o644))
+
+	opts := &Options{SourceDir: dir, Defconfig: "defconfig", Fragments: []string{frag}}
+	key1, err := cacheKey(opts)
+	require.NoError(t, err)
+
+	same, err := cacheKey(opts)
+	require.NoError(t, err)
+	require.Equal(t, key1, same)
+
+	require.NoError(t, os.WriteFile(frag, []byte("CONFIG_KASAN=y\n"), 0o644))
+	key2, err := cacheKey(opts)
+	require.NoError(t, err)
+	require.NotEqual(t, key1, key2)
+}
+
+func TestCacheKeySources(t *testing.T) {
+	src := t.TempDir()
+	file := filepath.Join(src, "init", "main.c")
+	require.NoError(t, os.MkdirAll(filepath.Dir(file), 0o755))
+	require.NoError(t, os.WriteFile(file, []byte("int main;\n"), 0o644))
+	opts := &Options{SourceDir: src, Defconfig: "defconfig"}
+
+	// a tree outside of git
+	key1, err := cacheKey(opts)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(file, []byte("int main(void);\n"), 0o644))
+	key2, err := cacheKey(opts)
+	require.NoError(t, err)
+	require.NotEqual(t, key1, key2)
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", src, "-c", "user.name=vmtest", "-c", "user.email=vmtest@localhost"}, args...)...)
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	git("init", "-q")
+	git("add", ".")
+	git("commit", "-q", "-m", "init")
+	committed, err := cacheKey(opts)
+	require.NoError(t, err)
+
+	// a new file that is not added to git yet
+	driver := filepath.Join(src, "drivers", "new.c")
+	require.NoError(t, os.MkdirAll(filepath.Dir(driver), 0o755))
+	require.NoError(t, os.WriteFile(driver, []byte("int probe;\n"), 0o644))
+	untracked, err := cacheKey(opts)
+	require.NoError(t, err)
+	require.NotEqual(t, committed, untracked)
+
+	require.NoError(t, os.WriteFile(driver, []byte("int probe(void);\n"), 0o644))
+	edited, err := cacheKey(opts)
+	require.NoError(t, err)
+	require.NotEqual(t, untracked, edited)
+}
@@ -0,0 +1,172 @@
+package vmtest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// kernelParam is a single 'key=value' or 'flag' kernel command line parameter
+type kernelParam struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+func (p kernelParam) String() string {
+	if p.hasValue {
+		return p.key + "=" + p.value
+	}
+	return p.key
+}
+
+// KernelCmdline is a builder for Linux kernel command line. Its result is used as QemuOptions.Append:
+//
+//	opts.Append = vmtest.NewKernelCmdline().Root("/dev/sda").Param("rw", "").Params()
+type KernelCmdline struct {
+	params []kernelParam
+}
+
+// NewKernelCmdline creates a kernel command line builder initialized with the given parameters,
+// each of them is either a 'key=value' pair or a 'flag'
+func NewKernelCmdline(params ...string) *KernelCmdline {
+	k := &KernelCmdline{}
+	for _, p := range params {
+		if key, value, ok := strings.Cut(p, "="); ok {
+			k.params = append(k.params, kernelParam{key: key, value: value, hasValue: true})
+		} else {
+			k.params = append(k.params, kernelParam{key: p})
+		}
+	}
+	return k
+}
+
+// Param adds 'key=value' parameter. If value is empty then the parameter is added as 'key' flag.
+func (k *KernelCmdline) Param(key, value string) *KernelCmdline {
+	k.params = append(k.params, kernelParam{key: key, value: value, hasValue: value != ""})
+	return k
+}
+
+// Root sets root filesystem device e.g. '/dev/sda1' or 'UUID=...'
+func (k *KernelCmdline) Root(dev string) *KernelCmdline {
+	return k.Param("root", dev)
+}
+
+// Console adds a console device e.g. 'ttyS0,115200'. The last specified console becomes /dev/console.
+func (k *KernelCmdline) Console(dev string) *KernelCmdline {
+	return k.Param("console", dev)
+}
+
+// Quiet disables most of the kernel log messages
+func (k *KernelCmdline) Quiet() *KernelCmdline {
+	return k.Param("quiet", "")
+}
+
+// Has reports whether the command line contains parameter with the given key
+func (k *KernelCmdline) Has(key string) bool {
+	return k.indexOf(key) != -1
+}
+
+// Values returns values of all 'key=value' parameters with the given key
+func (k *KernelCmdline) Values(key string) []string {
+	var values []string
+	for _, p := range k.params {
+		if p.key == key && p.hasValue {
+			values = append(values, p.value)
+		}
+	}
+	return values
+}
+
+// Remove deletes all parameters with the given key
+func (k *KernelCmdline) Remove(key string) *KernelCmdline {
+	params := k.params[:0]
+	for _, p := range k.params {
+		if p.key != key {
+			params = append(params, p)
+		}
+	}
+	k.params = params
+	return k
+}
+
+func (k *KernelCmdline) indexOf(key string) int {
+	for i, p := range k.params {
+		if p.key == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// Validate checks the command line for mistakes that make the boot misbehave in non-obvious ways:
+// the same console specified several times and conflicting root devices
+func (k *KernelCmdline) Validate() error {
+	consoles := make(map[string]bool)
+	for _, c := range k.Values("console") {
+		// 'ttyS0' and 'ttyS0,115200' refer to the same device
+		dev, _, _ := strings.Cut(c, ",")
+		if consoles[dev] {
+			return fmt.Errorf("kernel command line: duplicate console=%v", dev)
+		}
+		consoles[dev] = true
+	}
+
+	roots := k.Values("root")
+	for _, r := range roots {
+		if r != roots[0] {
+			return fmt.Errorf("kernel command line: conflicting root=%v and root=%v", roots[0], r)
+		}
+	}
+	return nil
+}
+
+// Params renders the command line as a list of parameters suitable for QemuOptions.Append
+func (k *KernelCmdline) Params() []string {
+	result := make([]string, len(k.params))
+	for i, p := range k.params {
+		result[i] = p.String()
+	}
+	return result
+}
+
+// String renders the command line as a single string
+func (k *KernelCmdline) String() string {
+	return strings.Join(k.Params(), " ")
+}
+
+// Default kernel console used for OS_LINUX guests
+const defaultKernelConsole = "ttyS0,115200"
+
+// applyLinuxDefaults adds parameters needed to interact with Linux guest over the serial console
+// unless the user has already specified them. The console device is added after the user's consoles,
+// so it stays /dev/console. If logLevel is zero then all kernel messages are printed
+// to the console (ignore_loglevel) unless the command line sets 'quiet' or 'loglevel' itself.
+func (k *KernelCmdline) applyLinuxDefaults(console string, logLevel int) {
+	if console == "" {
+		console = defaultKernelConsole
+	}
+	if !k.hasConsole(console) {
+		k.Console(console)
+	}
+	if k.Has("ignore_loglevel") || k.Has("loglevel") || k.Has("quiet") {
+		return
+	}
+	if logLevel != 0 {
+		k.Param("loglevel", strconv.Itoa(logLevel))
+	} else {
+		k.Param("ignore_loglevel", "")
+	}
+}
+
+// hasConsole reports whether the command line already has a console on the device of the given console,
+// e.g. 'console=ttyS0' for 'ttyS0,115200'
+func (k *KernelCmdline) hasConsole(console string) bool {
+	device, _, _ := strings.Cut(console, ",")
+	for _, v := range k.Values("console") {
+		if d, _, _ := strings.Cut(v, ","); d == device {
+			return true
+		}
+	}
+	return false
+}
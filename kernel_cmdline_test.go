@@ -0,0 +1,72 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelCmdline(t *testing.T) {
+	k := NewKernelCmdline("rd.luks.name=uuid=cryptroot").Root("/dev/mapper/cryptroot").Param("rw", "").Quiet()
+	require.NoError(t, k.Validate())
+	require.Equal(t, []string{"rd.luks.name=uuid=cryptroot", "root=/dev/mapper/cryptroot", "rw", "quiet"}, k.Params())
+	require.Equal(t, []string{"uuid=cryptroot"}, k.Values("rd.luks.name"))
+
+	k.Remove("quiet")
+	require.False(t, k.Has("quiet"))
+	require.Equal(t, "rd.luks.name=uuid=cryptroot root=/dev/mapper/cryptroot rw", k.String())
+}
+
+func TestKernelCmdlineValidation(t *testing.T) {
+	require.Error(t, NewKernelCmdline("console=ttyS0", "console=ttyS0,115200").Validate())
+	require.NoError(t, NewKernelCmdline("console=tty0", "console=ttyS0,115200").Validate())
+	require.Error(t, NewKernelCmdline("root=/dev/sda", "root=/dev/vda").Validate())
+}
+
+func TestKernelCmdlineLinuxDefaults(t *testing.T) {
+	opts := QemuOptions{
+		OperatingSystem: OS_LINUX,
+		Kernel:          "bzImage",
+		Append:          []string{"console=hvc0"},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "console=hvc0 console=ttyS0,115200 ignore_loglevel")
+
+	// the serial console stays /dev/console
+	opts.Append = []string{"console=tty0"}
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "console=tty0 console=ttyS0,115200 ignore_loglevel")
+
+	opts.Append = []string{"console=ttyS0,9600"}
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "console=ttyS0,9600 ignore_loglevel")
+
+	opts.Append = []string{"console=tty0"}
+	opts.KernelConsole = "hvc0"
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "console=tty0 console=hvc0 ignore_loglevel")
+}
+
+func TestKernelCmdlineDefaultsOverride(t *testing.T) {
+	k := NewKernelCmdline("quiet")
+	k.applyLinuxDefaults("", 0)
+	require.Equal(t, "quiet console=ttyS0,115200", k.String())
+
+	k = NewKernelCmdline()
+	k.applyLinuxDefaults("ttyAMA0", 4)
+	require.Equal(t, "console=ttyAMA0 loglevel=4", k.String())
+
+	opts := QemuOptions{
+		OperatingSystem:     OS_LINUX,
+		Kernel:              "bzImage",
+		Append:              []string{"rw"},
+		NoDefaultKernelArgs: true,
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "rw")
+}
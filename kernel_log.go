@@ -0,0 +1,110 @@
+package vmtest
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Linux kernel log levels
+const (
+	KERN_EMERG = iota
+	KERN_ALERT
+	KERN_CRIT
+	KERN_ERR
+	KERN_WARNING
+	KERN_NOTICE
+	KERN_INFO
+	KERN_DEBUG
+)
+
+// KernelMessage is a single Linux kernel log record printed to the console
+type KernelMessage struct {
+	// Timestamp is a time since the kernel boot
+	Timestamp time.Duration
+	// Level is the message log level e.g. KERN_ERR. The console shows log levels only with
+	// 'console_msg_format=syslog' kernel parameter, see QemuOptions.KernelMessageLevels, otherwise it is -1.
+	Level int
+	// Subsystem is a best effort guess of the message origin e.g. 'ACPI', 'pci' or 'EXT4-fs'
+	Subsystem string
+	// Message is the message text without the timestamp
+	Message string
+}
+
+// KernelMessages is a list of kernel log records
+type KernelMessages []KernelMessage
+
+// Severe returns messages whose level is known and is equal or more severe than level,
+// e.g. Severe(KERN_ERR) returns errors, critical, alert and emergency messages
+func (m KernelMessages) Severe(level int) KernelMessages {
+	var result KernelMessages
+	for _, msg := range m {
+		if msg.Level >= 0 && msg.Level <= level {
+			result = append(result, msg)
+		}
+	}
+	return result
+}
+
+// '<6>[    1.234567] message' where '<6>' is present only with console_msg_format=syslog
+var kernelMessageRe = regexp.MustCompile(`^(?:<(\d+)>)?\[\s*(\d+)\.(\d{6})\] (.*)$`)
+
+// 'ACPI: ...', 'EXT4-fs (sda1): ...', 'pci 0000:00:01.0: ...', 'usb 1-1: ...'
+var kernelSubsystemRe = regexp.MustCompile(`^([A-Za-z][\w.\-]*)(?: \S+| \([^)]*\))?: `)
+
+// ParseKernelMessage parses a console line printed by Linux kernel. It returns false if the line
+// does not look like a kernel message e.g. it was printed by userspace.
+func ParseKernelMessage(line string) (KernelMessage, bool) {
+	m := kernelMessageRe.FindStringSubmatch(line)
+	if m == nil {
+		return KernelMessage{}, false
+	}
+
+	level := -1
+	if m[1] != "" {
+		// syslog format may include facility, the level is in the lowest 3 bits
+		prio, _ := strconv.Atoi(m[1])
+		level = prio & 7
+	}
+	sec, _ := strconv.ParseInt(m[2], 10, 64)
+	usec, _ := strconv.ParseInt(m[3], 10, 64)
+
+	msg := KernelMessage{
+		Timestamp: time.Duration(sec)*time.Second + time.Duration(usec)*time.Microsecond,
+		Level:     level,
+		Message:   m[4],
+	}
+	if s := kernelSubsystemRe.FindStringSubmatch(msg.Message); s != nil {
+		msg.Subsystem = s[1]
+	}
+	return msg, true
+}
+
+// kernelLog collects kernel messages found among console lines
+type kernelLog struct {
+	mutex    sync.Mutex
+	messages KernelMessages
+}
+
+// addLine processes the next console line
+func (k *kernelLog) addLine(line string) {
+	msg, ok := ParseKernelMessage(line)
+	if !ok {
+		return
+	}
+	k.mutex.Lock()
+	k.messages = append(k.messages, msg)
+	k.mutex.Unlock()
+}
+
+func (k *kernelLog) get() KernelMessages {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	return append(KernelMessages(nil), k.messages...)
+}
+
+// KernelMessages returns Linux kernel messages printed to the console so far
+func (q *Qemu) KernelMessages() KernelMessages {
+	return q.console.kernelLog.get()
+}
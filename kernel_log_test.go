@@ -0,0 +1,42 @@
+package vmtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseKernelMessage(t *testing.T) {
+	msg, ok := ParseKernelMessage("[    1.234567] EXT4-fs (sda1): mounted filesystem with ordered data mode")
+	require.True(t, ok)
+	require.Equal(t, KernelMessage{
+		Timestamp: 1234567 * time.Microsecond,
+		Level:     -1,
+		Subsystem: "EXT4-fs",
+		Message:   "EXT4-fs (sda1): mounted filesystem with ordered data mode",
+	}, msg)
+
+	msg, ok = ParseKernelMessage("<3>[   12.000001] pci 0000:00:01.0: BAR 0: failed to assign")
+	require.True(t, ok)
+	require.Equal(t, KERN_ERR, msg.Level)
+	require.Equal(t, "pci", msg.Subsystem)
+
+	_, ok = ParseKernelMessage("[  OK  ] Reached target Basic System.")
+	require.False(t, ok)
+}
+
+func TestKernelLogLines(t *testing.T) {
+	var k kernelLog
+	var term terminal
+	for _, data := range []string{"<6>[    0.000000] Linux version 6.1\r\n<2>[    0.1", "00000] ACPI: critical\r\nWelcome\r\n"} {
+		for _, line := range term.write([]byte(data)) {
+			k.addLine(string(line))
+		}
+	}
+
+	messages := k.get()
+	require.Len(t, messages, 2)
+	require.Equal(t, "ACPI", messages[1].Subsystem)
+	require.Len(t, messages.Severe(KERN_ERR), 1)
+}
@@ -0,0 +1,162 @@
+package vmtest
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// guestTestsKernel is KTAP output of the kernel tests interleaved with the kernel log, it is used by
+// RunKselftests() and KUnitResults()
+const guestTestsKernel GuestTestFormat = -1
+
+// defaultKselftestDir is the location the distributions install the kernel selftests to
+const defaultKselftestDir = "/usr/libexec/kselftests"
+
+// KselftestOptions selects the kernel selftests run by RunKselftests()
+type KselftestOptions struct {
+	// Dir is the guest directory with run_kselftest.sh, default is /usr/libexec/kselftests
+	Dir string
+	// Collections are the collections to run, e.g. 'net' or 'timers'. Default is all installed collections.
+	Collections []string
+	// Tests are the individual tests to run in 'collection:test' format, e.g. 'timers:posix_timers'
+	Tests []string
+}
+
+func (o *KselftestOptions) cmdline() string {
+	dir := o.Dir
+	if dir == "" {
+		dir = defaultKselftestDir
+	}
+	cmd := "cd " + dir + " && ./run_kselftest.sh"
+	for _, c := range o.Collections {
+		cmd += " -c " + c
+	}
+	for _, t := range o.Tests {
+		cmd += " -t " + t
+	}
+	return cmd + "\n"
+}
+
+// RunKselftests runs the kernel selftests with the shell at the console and reports every test as a subtest
+// of t. The kernel messages printed while a failed test ran are attached to it.
+func (q *Qemu) RunKselftests(t *testing.T, opts *KselftestOptions) ([]GuestTestResult, error) {
+	if opts == nil {
+		opts = &KselftestOptions{}
+	}
+	if err := q.console.write(opts.cmdline()); err != nil {
+		return nil, err
+	}
+	return q.ConsoleGuestTests(t, guestTestsKernel)
+}
+
+// KUnitResults reads the results of the KUnit tests the kernel runs at boot and reports every test case as
+// a subtest of t, the subtests are named 'suite/case'. The tests are selected with 'kunit.filter_glob' kernel
+// parameter. The failure messages and the kernel log records printed while a failed test ran are attached to it.
+func (q *Qemu) KUnitResults(t *testing.T) ([]GuestTestResult, error) {
+	return q.ConsoleGuestTests(t, guestTestsKernel)
+}
+
+// kernelTestParser separates the kernel log from KTAP lines. Kernel tests print KTAP with kernel timestamps
+// (KUnit) or through userspace (kselftest), the other kernel messages are attached to the failed tests.
+type kernelTestParser struct {
+	tap      ktapParser
+	messages KernelMessages
+}
+
+func (p *kernelTestParser) line(l string) ([]GuestTestResult, bool, error) {
+	if msg, ok := ParseKernelMessage(l); ok {
+		if !isKTAPLine(msg.Message) {
+			p.messages = append(p.messages, msg)
+			return nil, false, nil
+		}
+		l = msg.Message
+	}
+	if trimmed := strings.TrimLeft(l, " \t"); tapVersionRe.MatchString(trimmed) || ktapSubtestRe.MatchString(trimmed) {
+		// the messages printed before the suite, e.g. the boot log, are not related to its tests
+		p.messages = nil
+	}
+	results, done, err := p.tap.line(l)
+	for i := range results {
+		if results[i].Status == GUEST_TEST_FAIL {
+			results[i].KernelMessages = p.messages
+		}
+	}
+	if len(results) > 0 {
+		p.messages = nil
+	}
+	return results, done, err
+}
+
+func isKTAPLine(l string) bool {
+	l = strings.TrimLeft(l, " \t")
+	return tapVersionRe.MatchString(l) || tapPlanRe.MatchString(l) || tapResultRe.MatchString(l) ||
+		strings.HasPrefix(l, "#") || strings.HasPrefix(l, "Bail out!")
+}
+
+var ktapSubtestRe = regexp.MustCompile(`^# Subtest: (.*)$`)
+
+// ktapParser handles nested KTAP: the subtests are indented by 4 spaces and the results are named after
+// their suites, e.g. 'suite/case'
+type ktapParser struct {
+	levels []*ktapLevel
+}
+
+type ktapLevel struct {
+	tap  tapParser
+	name string
+}
+
+func (p *ktapParser) line(l string) ([]GuestTestResult, bool, error) {
+	trimmed := strings.TrimLeft(l, " \t")
+	indent := l[:len(l)-len(trimmed)]
+	depth := strings.Count(indent, "\t") + strings.Count(indent, " ")/4
+	for len(p.levels) <= depth {
+		p.levels = append(p.levels, &ktapLevel{})
+	}
+
+	// a line at another level completes the pending results, YAML blocks are indented by 2 spaces only
+	var results []GuestTestResult
+	for d := len(p.levels) - 1; d >= 0; d-- {
+		if d != depth {
+			results = append(results, p.named(d, p.levels[d].tap.finish())...)
+		}
+	}
+
+	if depth > 0 {
+		level := p.levels[depth]
+		if m := ktapSubtestRe.FindStringSubmatch(trimmed); m != nil {
+			level.name = m[1]
+			level.tap = tapParser{}
+			return results, false, nil
+		}
+		if tapVersionRe.MatchString(trimmed) {
+			level.tap = tapParser{}
+			return results, false, nil
+		}
+		completed, _, err := level.tap.line(trimmed)
+		results = append(results, p.named(depth, completed)...)
+		if err != nil {
+			return results, true, err
+		}
+		return results, false, nil
+	}
+
+	// the top level results are the suites, they are reported after their subtests
+	completed, done, err := p.levels[0].tap.line(trimmed)
+	return append(results, completed...), done, err
+}
+
+// named prefixes the names of the results at the given depth with their suite names
+func (p *ktapParser) named(depth int, results []GuestTestResult) []GuestTestResult {
+	var prefix []string
+	for _, lv := range p.levels[1 : depth+1] {
+		if lv.name != "" {
+			prefix = append(prefix, lv.name)
+		}
+	}
+	for i := range results {
+		results[i].Name = strings.Join(append(prefix[:len(prefix):len(prefix)], results[i].Name), "/")
+	}
+	return results
+}
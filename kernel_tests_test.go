@@ -0,0 +1,61 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKUnitResults(t *testing.T) {
+	c := guestTestsConsole(t, "[    0.100000] ACPI: Core revision 20230628\r\n"+
+		"[    0.200000] KTAP version 1\r\n"+
+		"[    0.200001] 1..2\r\n"+
+		"[    0.200002]     KTAP version 1\r\n"+
+		"[    0.200003]     # Subtest: example\r\n"+
+		"[    0.200004]     1..3\r\n"+
+		"[    0.200005]     ok 1 example_simple_test\r\n"+
+		"[    0.200006]     ok 2 example_skip_test # SKIP this test should be skipped\r\n"+
+		"[    0.200007] BUG: kernel NULL pointer dereference, address: 0000000000000000\r\n"+
+		"[    0.200008]     # example_fail_test: EXPECTATION FAILED at lib/kunit/kunit-example-test.c:42\r\n"+
+		"[    0.200009]     not ok 3 example_fail_test\r\n"+
+		"[    0.200010] # example: pass:1 fail:1 skip:1 total:3\r\n"+
+		"[    0.200011] not ok 1 example\r\n"+
+		"[    0.300000]     KTAP version 1\r\n"+
+		"[    0.300001]     # Subtest: list\r\n"+
+		"[    0.300002]     1..1\r\n"+
+		"[    0.300003]     ok 1 list_test_init\r\n"+
+		"[    0.300004] ok 2 list\r\n")
+
+	results, err := c.guestTests(guestTestsKernel, func(GuestTestResult) {})
+	require.NoError(t, err)
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Name+":"+string(r.Status))
+	}
+	require.Equal(t, []string{
+		"example/example_simple_test:pass", "example/example_skip_test:skip", "example/example_fail_test:fail",
+		"example:fail", "list/list_test_init:pass", "list:pass",
+	}, names)
+	fail := results[2]
+	require.Equal(t, []string{"example_fail_test: EXPECTATION FAILED at lib/kunit/kunit-example-test.c:42"}, fail.Output)
+	require.Len(t, fail.KernelMessages, 1)
+	require.Equal(t, "BUG: kernel NULL pointer dereference, address: 0000000000000000", fail.KernelMessages[0].Message)
+	require.Nil(t, results[3].KernelMessages)
+}
+
+func TestKselftests(t *testing.T) {
+	opts := &KselftestOptions{Collections: []string{"net"}, Tests: []string{"timers:posix_timers"}}
+	require.Equal(t, "cd /usr/libexec/kselftests && ./run_kselftest.sh -c net -t timers:posix_timers\n", opts.cmdline())
+
+	c := guestTestsConsole(t, "# cd /usr/libexec/kselftests && ./run_kselftest.sh -t timers:posix_timers\r\n"+
+		"TAP version 13\r\n1..1\r\n# timeout set to 45\r\n# selftests: timers: posix_timers\r\n"+
+		"[   12.000000] posix_timers[123]: segfault at 0 ip 0000000000401000\r\n"+
+		"# not ok 1 check itimer virtual\r\nnot ok 1 selftests: timers: posix_timers # exit=1\r\n# ")
+	results, err := c.guestTests(guestTestsKernel, func(GuestTestResult) {})
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.Equal(t, "selftests: timers: posix_timers", results[0].Name)
+	require.Equal(t, GUEST_TEST_FAIL, results[0].Status)
+	require.Contains(t, results[0].Output, "not ok 1 check itimer virtual")
+	require.Len(t, results[0].KernelMessages, 1)
+}
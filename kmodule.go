@@ -0,0 +1,147 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Kernel taint flags, see Documentation/admin-guide/tainted-kernels.rst
+const (
+	TAINT_PROPRIETARY_MODULE = 1 << 0
+	TAINT_DIE                = 1 << 7
+	TAINT_WARN               = 1 << 9
+	TAINT_OOT_MODULE         = 1 << 12
+	TAINT_UNSIGNED_MODULE    = 1 << 13
+)
+
+// ModuleTestTag is a 9p mount tag of the share with the tested kernel module
+const ModuleTestTag = "vmtest-module"
+
+// ModuleTest describes a kernel module integration test run by RunModuleTest
+type ModuleTest struct {
+	// Opts configures the VM. The guest must provide a root shell at the console (see img.BusyboxInitramfs)
+	// and support 9p filesystem.
+	Opts QemuOptions
+	// Module is a host path to the built .ko file
+	Module string
+	// ModuleParams are passed to insmod
+	ModuleParams []string
+	// Commands are shell commands run after the module is loaded, each of them must succeed
+	Commands []string
+	// ExpectMessages must all be found among the kernel messages by the end of the test
+	ExpectMessages []*regexp.Regexp
+	// AllowKernelErrors tolerates kernel messages of KERN_ERR and more severe levels
+	AllowKernelErrors bool
+	// AllowedTaint is a set of taint flags tolerated in addition to TAINT_OOT_MODULE and TAINT_UNSIGNED_MODULE
+	AllowedTaint uint64
+}
+
+// ModuleTestResult contains the state of the guest after the test commands completed
+type ModuleTestResult struct {
+	// Taint is a value of /proc/sys/kernel/tainted
+	Taint uint64
+	// KernelMessages printed during the test
+	KernelMessages KernelMessages
+}
+
+// RunModuleTest boots a VM, loads the kernel module into it, runs the test commands and checks the kernel
+// log and taint flags. Problems are reported with t.Error.
+func RunModuleTest(t *testing.T, mt ModuleTest) *ModuleTestResult {
+	t.Helper()
+
+	opts, commands, err := moduleTestSetup(t.TempDir(), &mt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	qemu, err := NewQemu(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qemu.Kill()
+
+	shell := qemu.Shell()
+	for _, cmd := range commands {
+		_, code, err := shell.Run(cmd)
+		if err != nil {
+			t.Fatalf("%v: %v", cmd, err)
+		}
+		if code != 0 {
+			t.Errorf("%v: exit code %d", cmd, code)
+		}
+	}
+
+	out, code, err := shell.Run("cat /proc/sys/kernel/tainted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taint, err := parseTaint(out, code)
+	if err != nil {
+		t.Fatalf("kernel taint: %v", err)
+	}
+
+	result := &ModuleTestResult{Taint: taint, KernelMessages: qemu.KernelMessages()}
+	if unexpected := taint &^ (TAINT_OOT_MODULE | TAINT_UNSIGNED_MODULE | mt.AllowedTaint); unexpected != 0 {
+		t.Errorf("kernel is tainted: %#x", unexpected)
+	}
+	if !mt.AllowKernelErrors {
+		for _, msg := range result.KernelMessages.Severe(KERN_ERR) {
+			t.Errorf("kernel error: %v", msg.Message)
+		}
+	}
+	for _, re := range mt.ExpectMessages {
+		found := false
+		for _, msg := range result.KernelMessages {
+			if re.MatchString(msg.Message) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("kernel message matching %q not found", re)
+		}
+	}
+	return result
+}
+
+// parseTaint parses the output of 'cat /proc/sys/kernel/tainted', a failed or garbled read is an error rather
+// than an untainted kernel
+func parseTaint(out string, code int) (uint64, error) {
+	if code != 0 {
+		return 0, fmt.Errorf("cat /proc/sys/kernel/tainted: exit code %d", code)
+	}
+	taint, err := strconv.ParseUint(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected /proc/sys/kernel/tainted content %q", out)
+	}
+	return taint, nil
+}
+
+// moduleTestSetup copies the module to the share directory and returns the VM options and the guest commands
+// that load the module and run the test
+func moduleTestSetup(dir string, mt *ModuleTest) (*QemuOptions, []string, error) {
+	moduleName := filepath.Base(mt.Module)
+	data, err := os.ReadFile(mt.Module)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, moduleName), data, 0o644); err != nil {
+		return nil, nil, err
+	}
+
+	opts := mt.Opts
+	opts.Shares = append(append([]QemuShare(nil), opts.Shares...), QemuShare{Path: dir, Tag: ModuleTestTag, ReadOnly: true})
+	opts.KernelMessageLevels = true
+
+	mountDir := "/tmp/" + ModuleTestTag
+	commands := []string{
+		"mkdir -p " + mountDir,
+		fmt.Sprintf("mount -t 9p -o trans=virtio,version=9p2000.L %v %v", ModuleTestTag, mountDir),
+		strings.Join(append([]string{"insmod", mountDir + "/" + moduleName}, mt.ModuleParams...), " "),
+	}
+	return &opts, append(commands, mt.Commands...), nil
+}
@@ -0,0 +1,61 @@
+package vmtest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestModuleTestSetup(t *testing.T) {
+	module := filepath.Join(t.TempDir(), "hello.ko")
+	require.NoError(t, os.WriteFile(module, []byte("module"), 0o644))
+	shared := t.TempDir()
+	mt := ModuleTest{
+		Opts:         QemuOptions{Kernel: "bzImage", Shares: []QemuShare{{Path: shared, Tag: "data"}}},
+		Module:       module,
+		ModuleParams: []string{"debug=1"},
+		Commands:     []string{"cat /sys/module/hello/parameters/debug"},
+	}
+
+	dir := t.TempDir()
+	opts, commands, err := moduleTestSetup(dir, &mt)
+	require.NoError(t, err)
+	data, err := os.ReadFile(filepath.Join(dir, "hello.ko"))
+	require.NoError(t, err)
+	require.Equal(t, "module", string(data))
+	require.Equal(t, []string{
+		"mkdir -p /tmp/vmtest-module",
+		"mount -t 9p -o trans=virtio,version=9p2000.L vmtest-module /tmp/vmtest-module",
+		"insmod /tmp/vmtest-module/hello.ko debug=1",
+		"cat /sys/module/hello/parameters/debug",
+	}, commands)
+	// the caller's shares are kept
+	require.Len(t, mt.Opts.Shares, 1)
+
+	cmdline, err := buildCmdline(opts, "", nil)
+	require.NoError(t, err)
+	args := strings.Join(cmdline, " ")
+	require.Contains(t, args, "path="+shared+",mount_tag=data")
+	require.Contains(t, args, "path="+dir+",mount_tag="+ModuleTestTag+",security_model=none,id=fs1,readonly=on")
+	kernelArgs, _ := paramValue(cmdline, "-append")
+	require.Contains(t, kernelArgs, "console_msg_format=syslog")
+
+	_, _, err = moduleTestSetup(dir, &ModuleTest{Module: filepath.Join(dir, "missing.ko")})
+	require.Error(t, err)
+}
+
+func TestParseTaint(t *testing.T) {
+	taint, err := parseTaint("4608\n", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(TAINT_WARN|TAINT_OOT_MODULE), taint)
+
+	_, err = parseTaint("cat: /proc/sys/kernel/tainted: No such file or directory\n", 1)
+	require.ErrorContains(t, err, "exit code 1")
+	_, err = parseTaint("46\x1b[K08\n", 0)
+	require.Error(t, err)
+	_, err = parseTaint("", 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,40 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileLock is an exclusive advisory lock shared by all processes of the host, e.g. test binaries of different
+// packages started by 'go test -p N'. vmtest uses it to guard the image and kernel caches, it is useful for
+// other expensive artifacts shared between tests as well.
+type FileLock struct {
+	f *os.File
+}
+
+// LockFile waits till it acquires the lock of the file at path. The file is created if it does not exist.
+func LockFile(path string) (*FileLock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("locking %v: %v", path, err)
+	}
+	return &FileLock{f: f}, nil
+}
+
+// Unlock releases the lock
+func (l *FileLock) Unlock() error {
+	// closing the file releases the lock
+	return l.f.Close()
+}
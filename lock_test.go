@@ -0,0 +1,32 @@
+package vmtest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.lock")
+	l, err := LockFile(path)
+	require.NoError(t, err)
+
+	// flock locks are per open file description so it blocks within one process too
+	acquired := make(chan *FileLock)
+	go func() {
+		l2, err := LockFile(path)
+		require.NoError(t, err)
+		acquired <- l2
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the lock is acquired twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, l.Unlock())
+	l2 := <-acquired
+	require.NoError(t, l2.Unlock())
+}
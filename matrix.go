@@ -0,0 +1,44 @@
+package vmtest
+
+import "testing"
+
+// KernelSpec describes a kernel used by Matrix
+type KernelSpec struct {
+	// Name of the subtest, e.g. kernel version
+	Name string
+	// Kernel is a path to the kernel binary
+	Kernel string
+	// InitRamFs is a path to the initramfs image, if empty then QemuOptions.InitRamFs is used
+	InitRamFs string
+	// Append is a list of kernel parameters added to QemuOptions.Append
+	Append []string
+}
+
+// Matrix runs fn as a subtest for every kernel in the list. Each subtest boots a new VM configured with
+// opts and the kernel, the VM is killed once fn returns. The values generated for a VM, e.g. its crash dump
+// directory or identity, are not shared with the other subtests.
+func Matrix(t *testing.T, kernels []KernelSpec, opts QemuOptions, fn func(t *testing.T, qemu *Qemu)) {
+	for _, k := range kernels {
+		k := k
+		t.Run(k.Name, func(t *testing.T) {
+			kernelOpts := matrixOptions(opts, k)
+			qemu, err := NewQemu(&kernelOpts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer qemu.Kill()
+
+			fn(t, qemu)
+		})
+	}
+}
+
+// matrixOptions returns a copy of opts configured with the kernel k
+func matrixOptions(opts QemuOptions, k KernelSpec) QemuOptions {
+	opts.Kernel = k.Kernel
+	if k.InitRamFs != "" {
+		opts.InitRamFs = k.InitRamFs
+	}
+	opts.Append = append(append([]string(nil), opts.Append...), k.Append...)
+	return opts
+}
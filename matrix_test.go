@@ -0,0 +1,61 @@
+package vmtest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatrixOptions(t *testing.T) {
+	opts := QemuOptions{Kernel: "bzImage", InitRamFs: "initramfs.img", Append: make([]string, 1, 4)}
+	opts.Append[0] = "quiet"
+
+	first := matrixOptions(opts, KernelSpec{Name: "first", Kernel: "vmlinuz-first", Append: []string{"first"}})
+	second := matrixOptions(opts, KernelSpec{Name: "second", Kernel: "vmlinuz-second", InitRamFs: "second.img", Append: []string{"second"}})
+	require.Equal(t, "vmlinuz-first", first.Kernel)
+	require.Equal(t, "initramfs.img", first.InitRamFs)
+	require.Equal(t, []string{"quiet", "first"}, first.Append)
+	require.Equal(t, "vmlinuz-second", second.Kernel)
+	require.Equal(t, "second.img", second.InitRamFs)
+	require.Equal(t, []string{"quiet", "second"}, second.Append)
+
+	// the kernel parameters of a subtest must not leak into the others through the shared backing array
+	require.Equal(t, "bzImage", opts.Kernel)
+	require.Equal(t, []string{"quiet"}, opts.Append)
+}
+
+func TestMatrix(t *testing.T) {
+	useFakeQemu(t)
+	opts := QemuOptions{Append: []string{"quiet"}, CrashDump: &QemuCrashDump{}, ScratchDir: t.TempDir()}
+	kernels := []KernelSpec{
+		{Name: "first", Kernel: "testdata/hello-arm.bin", Append: []string{"first"}},
+		{Name: "second", Kernel: "testdata/hello-arm.bin", Append: []string{"second"}},
+	}
+
+	dirs := map[string]string{}
+	Matrix(t, kernels, opts, func(t *testing.T, q *Qemu) {
+		name := filepath.Base(t.Name())
+		kernelArgs, _ := paramValue(q.Cmdline(), "-append")
+		require.Contains(t, kernelArgs, "quiet "+name)
+
+		// a dump of the first kernel must not be reported for the others
+		dirs[name] = q.CrashDumpDir()
+		if name == "first" {
+			require.NoError(t, os.WriteFile(filepath.Join(q.CrashDumpDir(), "vmcore"), []byte("core"), 0o644))
+		}
+		path, err := q.CrashDump()
+		require.NoError(t, err)
+		if name == "first" {
+			require.Equal(t, filepath.Join(q.CrashDumpDir(), "vmcore"), path)
+		} else {
+			require.Empty(t, path)
+		}
+	})
+
+	require.Len(t, dirs, 2)
+	require.NotEqual(t, dirs["first"], dirs["second"])
+	require.Empty(t, opts.CrashDump.Dir)
+	require.Equal(t, []string{"quiet"}, opts.Append)
+}
@@ -0,0 +1,250 @@
+package netmock
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/anatol/vmtest"
+)
+
+// DNS record types and response codes, see RFC 1035
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeFormErr  = 1
+	dnsRcodeNXDomain = 3
+)
+
+// dnsTTL is the time-to-live of the answers, the records may change during the test
+const dnsTTL = 1
+
+// dnsUDPSize is the maximum size of the UDP messages, the larger responses are truncated, see RFC 1035
+const dnsUDPSize = 512
+
+// DNS is a mock DNS server with programmable A and AAAA records. slirp guest forwards carry only TCP
+// connections, so the server is reachable at an arbitrary guest address over TCP only, see ResolvConf().
+// Over UDP the server is reachable at a host port of the slirp host alias 10.0.2.2 like NTP, see GuestUDPAddr().
+type DNS struct {
+	addr     string
+	listener net.Listener
+	conn     net.PacketConn
+	mutex    sync.Mutex
+	records  map[string][]net.IP
+}
+
+// NewDNS starts a server the guest reaches at addr, e.g. '10.0.2.53:53'.
+// Add Forward() to QemuNIC.GuestForwards of the VM.
+func NewDNS(addr string) (*DNS, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	s := &DNS{addr: addr, listener: l, conn: conn, records: map[string][]net.IP{}}
+	go s.serve()
+	go s.serveUDP()
+	return s, nil
+}
+
+// SetRecord sets the addresses of the name, IPv4 addresses are served as A records and IPv6 ones as AAAA.
+// No addresses remove the name, so it resolves to NXDOMAIN.
+func (s *DNS) SetRecord(name string, ips ...net.IP) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	name = canonicalName(name)
+	if len(ips) == 0 {
+		delete(s.records, name)
+	} else {
+		s.records[name] = ips
+	}
+}
+
+// Forward returns the guest forward that routes the guest connections to the server
+func (s *DNS) Forward() vmtest.QemuGuestForward {
+	return vmtest.QemuGuestForward{Addr: s.addr, Listener: s.listener}
+}
+
+// ResolvConf returns /etc/resolv.conf content that makes the glibc resolver use the server over TCP.
+// musl ignores 'use-vc' and queries the nameservers over UDP port 53 only, so it cannot use the server.
+func (s *DNS) ResolvConf() string {
+	host, _, _ := net.SplitHostPort(s.addr)
+	return fmt.Sprintf("nameserver %v\noptions use-vc\n", host)
+}
+
+// GuestUDPAddr returns the server UDP address as seen by the guest in the default user mode network,
+// it suits the resolvers that accept a nameserver port, e.g. systemd-resolved, see ResolvedConf()
+func (s *DNS) GuestUDPAddr() string {
+	return fmt.Sprintf("10.0.2.2:%d", s.conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// ResolvedConf returns resolved.conf content that makes systemd-resolved use the server over UDP
+func (s *DNS) ResolvedConf() string {
+	return fmt.Sprintf("[Resolve]\nDNS=%v\n", s.GuestUDPAddr())
+}
+
+// Addr returns the server TCP address reachable from the host
+func (s *DNS) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// UDPAddr returns the server UDP address reachable from the host
+func (s *DNS) UDPAddr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Close stops the server
+func (s *DNS) Close() error {
+	return errors.Join(s.listener.Close(), s.conn.Close())
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+func (s *DNS) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle serves the queries of a connection, every message is prefixed with its 2 bytes length
+func (s *DNS) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		query := make([]byte, size)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		resp, err := s.answer(query, 0)
+		if err != nil {
+			return
+		}
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+		if _, err := conn.Write(append(out, resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveUDP serves the queries of the UDP socket, a response that does not fit is truncated to its header
+// and question, so the client retries over TCP
+func (s *DNS) serveUDP() {
+	buf := make([]byte, dnsUDPSize)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp, err := s.answer(buf[:n], dnsUDPSize)
+		if err != nil {
+			continue
+		}
+		_, _ = s.conn.WriteTo(resp, addr)
+	}
+}
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// answer returns the response to a single question query, the response larger than maxSize (unless it is 0)
+// is truncated
+func (s *DNS) answer(query []byte, maxSize int) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errDNSMalformed
+	}
+	id := query[:2]
+	flags := binary.BigEndian.Uint16(query[2:])
+	rd := flags & 0x0100 // recursion desired is copied to the response
+
+	// header: id, flags (response, authoritative, truncated, rcode), question, answer, authority and additional counts
+	header := func(tc, rcode uint16, answers int) []byte {
+		h := append([]byte(nil), id...)
+		h = binary.BigEndian.AppendUint16(h, 0x8000|0x0400|tc|rd|rcode)
+		h = binary.BigEndian.AppendUint16(h, 1)
+		h = binary.BigEndian.AppendUint16(h, uint16(answers))
+		return append(h, 0, 0, 0, 0)
+	}
+
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		h := header(0, dnsRcodeFormErr, 0)
+		binary.BigEndian.PutUint16(h[4:], 0)
+		return h, nil
+	}
+	var labels []string
+	off := 12
+	for {
+		if off >= len(query) {
+			return nil, errDNSMalformed
+		}
+		l := int(query[off])
+		off++
+		if l == 0 {
+			break
+		}
+		if l&0xc0 != 0 || off+l > len(query) {
+			return nil, errDNSMalformed // questions are never compressed
+		}
+		labels = append(labels, string(query[off:off+l]))
+		off += l
+	}
+	if off+4 > len(query) {
+		return nil, errDNSMalformed
+	}
+	qtype := binary.BigEndian.Uint16(query[off:])
+	qclass := binary.BigEndian.Uint16(query[off+2:])
+	question := query[12 : off+4]
+
+	s.mutex.Lock()
+	ips, ok := s.records[canonicalName(strings.Join(labels, "."))]
+	s.mutex.Unlock()
+	if !ok {
+		return append(header(0, dnsRcodeNXDomain, 0), question...), nil
+	}
+
+	var answers [][]byte
+	for _, ip := range ips {
+		data := ip.To4()
+		typ := uint16(dnsTypeA)
+		if data == nil {
+			data = ip.To16()
+			typ = dnsTypeAAAA
+		}
+		if typ != qtype || qclass != dnsClassIN {
+			continue
+		}
+		// the name is a pointer to the question
+		a := []byte{0xc0, 12}
+		a = binary.BigEndian.AppendUint16(a, typ)
+		a = binary.BigEndian.AppendUint16(a, dnsClassIN)
+		a = binary.BigEndian.AppendUint32(a, dnsTTL)
+		a = binary.BigEndian.AppendUint16(a, uint16(len(data)))
+		answers = append(answers, append(a, data...))
+	}
+	resp := append(header(0, 0, len(answers)), question...)
+	for _, a := range answers {
+		resp = append(resp, a...)
+	}
+	if maxSize != 0 && len(resp) > maxSize {
+		const truncated = 0x0200
+		resp = append(header(truncated, 0, 0), question...)
+	}
+	return resp, nil
+}
@@ -0,0 +1,49 @@
+// Package netmock provides host side mock servers reachable from vmtest guests over the user mode network,
+// so guest network clients are tested hermetically
+package netmock
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/anatol/vmtest"
+)
+
+// HTTP is a mock HTTP server visible to the guest at a fixed address
+type HTTP struct {
+	addr     string
+	listener net.Listener
+	server   *http.Server
+}
+
+// NewHTTP starts a server with the given handler, the guest reaches it at addr, e.g. '10.0.2.80:80'.
+// Add Forward() to QemuNIC.GuestForwards of the VM.
+func NewHTTP(addr string, handler http.Handler) (*HTTP, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &HTTP{addr: addr, listener: l, server: &http.Server{Handler: handler}}
+	go func() { _ = s.server.Serve(l) }()
+	return s, nil
+}
+
+// Forward returns the guest forward that routes the guest connections to the server
+func (s *HTTP) Forward() vmtest.QemuGuestForward {
+	return vmtest.QemuGuestForward{Addr: s.addr, Listener: s.listener}
+}
+
+// URL returns the server URL as seen by the guest
+func (s *HTTP) URL() string {
+	return "http://" + s.addr
+}
+
+// HostURL returns the server URL reachable from the host, e.g. for checking the mock itself
+func (s *HTTP) HostURL() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+// Close stops the server
+func (s *HTTP) Close() error {
+	return s.server.Close()
+}
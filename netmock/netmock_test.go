@@ -0,0 +1,123 @@
+package netmock
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNS(t *testing.T) {
+	s, err := NewDNS("10.0.2.53:53")
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetRecord("api.example.com", net.ParseIP("10.0.2.80"), net.ParseIP("fd00::80"))
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("tcp", s.Addr())
+		},
+	}
+	ips, err := r.LookupIP(context.Background(), "ip4", "API.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.2.80", ips[0].String())
+	ips, err = r.LookupIP(context.Background(), "ip6", "api.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "fd00::80", ips[0].String())
+
+	s.SetRecord("api.example.com")
+	_, err = r.LookupIP(context.Background(), "ip4", "api.example.com")
+	var dnsErr *net.DNSError
+	require.ErrorAs(t, err, &dnsErr)
+	require.True(t, dnsErr.IsNotFound)
+
+	require.Equal(t, "nameserver 10.0.2.53\noptions use-vc\n", s.ResolvConf())
+	require.Equal(t, "10.0.2.53:53", s.Forward().Addr)
+}
+
+func TestDNSUDP(t *testing.T) {
+	s, err := NewDNS("10.0.2.53:53")
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetRecord("api.example.com", net.ParseIP("10.0.2.80"))
+	var many []net.IP
+	for i := 0; i < 40; i++ {
+		many = append(many, net.IPv4(10, 0, 3, byte(i)))
+	}
+	s.SetRecord("many.example.com", many...)
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			if network == "udp" {
+				return net.Dial("udp", s.UDPAddr())
+			}
+			return net.Dial("tcp", s.Addr())
+		},
+	}
+	ips, err := r.LookupIP(context.Background(), "ip4", "api.example.com")
+	require.NoError(t, err)
+	require.Equal(t, "10.0.2.80", ips[0].String())
+	// the truncated UDP response makes the resolver retry over TCP
+	ips, err = r.LookupIP(context.Background(), "ip4", "many.example.com")
+	require.NoError(t, err)
+	require.Len(t, ips, len(many))
+
+	_, port, _ := net.SplitHostPort(s.UDPAddr())
+	require.Equal(t, "10.0.2.2:"+port, s.GuestUDPAddr())
+	require.Equal(t, "[Resolve]\nDNS=10.0.2.2:"+port+"\n", s.ResolvedConf())
+}
+
+func TestHTTP(t *testing.T) {
+	s, err := NewHTTP("10.0.2.80:80", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hello %v", r.URL.Path)
+	}))
+	require.NoError(t, err)
+	defer s.Close()
+
+	require.Equal(t, "http://10.0.2.80:80", s.URL())
+	resp, err := http.Get(s.HostURL() + "/status")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello /status", string(body))
+}
+
+func ntpTime(b []byte) time.Time {
+	v := binary.BigEndian.Uint64(b)
+	return time.Unix(int64(v>>32)-ntpEpochOffset, int64((v&0xffffffff)*uint64(time.Second)>>32))
+}
+
+func TestNTP(t *testing.T) {
+	s, err := NewNTP()
+	require.NoError(t, err)
+	defer s.Close()
+	s.SetOffset(-time.Hour)
+
+	conn, err := net.Dial("udp", s.Addr())
+	require.NoError(t, err)
+	defer conn.Close()
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // version 4, client mode
+	putNTPTime(req[40:], time.Now())
+	_, err = conn.Write(req)
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	resp := make([]byte, 48)
+	_, err = conn.Read(resp)
+	require.NoError(t, err)
+	require.Equal(t, byte(4<<3|4), resp[0])
+	require.Equal(t, req[40:48], resp[24:32])
+	require.WithinDuration(t, time.Now().Add(-time.Hour), ntpTime(resp[40:]), time.Second)
+
+	require.Equal(t, fmt.Sprintf("server 10.0.2.2 port %d iburst\n", s.Port()), s.ChronyConf())
+}
@@ -0,0 +1,132 @@
+package netmock
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP (1900) and Unix (1970) epochs
+const ntpEpochOffset = 2208988800
+
+// NTP is a mock NTP server serving a programmable time. slirp forwards UDP to the host alias address 10.0.2.2
+// to the host loopback, so the guest reaches the server at GuestAddr() without a guest forward.
+type NTP struct {
+	conn   net.PacketConn
+	mutex  sync.Mutex
+	offset time.Duration
+	// leap is the leap indicator announced to clients
+	leap byte
+}
+
+// NewNTP starts a server that serves the host time
+func NewNTP() (*NTP, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &NTP{conn: conn}
+	go s.serve()
+	return s, nil
+}
+
+// SetOffset shifts the served time from the host time, e.g. to check how the guest handles a clock step
+func (s *NTP) SetOffset(offset time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.offset = offset
+}
+
+// SetTime makes the server serve the given time from now on
+func (s *NTP) SetTime(t time.Time) {
+	s.SetOffset(time.Until(t))
+}
+
+// SetUnsynchronized makes the server announce its clock is not synchronized, well-behaved clients ignore it
+func (s *NTP) SetUnsynchronized(unsynchronized bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if unsynchronized {
+		s.leap = 3
+	} else {
+		s.leap = 0
+	}
+}
+
+// Now returns the time served to the clients
+func (s *NTP) Now() time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return time.Now().Add(s.offset)
+}
+
+// Port returns the server UDP port
+func (s *NTP) Port() int {
+	return s.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// GuestAddr returns the server address as seen by the guest in the default user mode network
+func (s *NTP) GuestAddr() string {
+	return fmt.Sprintf("10.0.2.2:%d", s.Port())
+}
+
+// ChronyConf returns chrony.conf line that makes chronyd use the server
+func (s *NTP) ChronyConf() string {
+	return fmt.Sprintf("server 10.0.2.2 port %d iburst\n", s.Port())
+}
+
+// TimesyncdConf returns systemd-timesyncd.conf content that makes systemd-timesyncd use the server
+func (s *NTP) TimesyncdConf() string {
+	return fmt.Sprintf("[Time]\nNTP=%v\n", s.GuestAddr())
+}
+
+// Addr returns the server address reachable from the host
+func (s *NTP) Addr() string {
+	return s.conn.LocalAddr().String()
+}
+
+// Close stops the server
+func (s *NTP) Close() error {
+	return s.conn.Close()
+}
+
+func (s *NTP) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received := s.Now()
+		const clientMode = 3
+		if n < 48 || buf[0]&0x7 != clientMode {
+			continue
+		}
+		s.mutex.Lock()
+		leap := s.leap
+		s.mutex.Unlock()
+
+		resp := make([]byte, 48)
+		version := buf[0] >> 3 & 0x7
+		const serverMode = 4
+		resp[0] = leap<<6 | version<<3 | serverMode
+		resp[1] = 1               // stratum: primary reference
+		resp[2] = buf[2]          // poll interval
+		resp[3] = 0xec            // precision: 2^-20 seconds
+		copy(resp[12:16], "LOCL") // reference id
+		putNTPTime(resp[16:], received.Add(-time.Minute))
+		copy(resp[24:32], buf[40:48]) // origin timestamp is the client transmit timestamp
+		putNTPTime(resp[32:], received)
+		putNTPTime(resp[40:], s.Now())
+		_, _ = s.conn.WriteTo(resp, addr)
+	}
+}
+
+// putNTPTime writes the time in the 64-bit NTP timestamp format
+func putNTPTime(b []byte, t time.Time) {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint64(b, secs<<32|frac)
+}
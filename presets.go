@@ -0,0 +1,86 @@
+package vmtest
+
+import "os"
+
+// ovmfPaths are locations of the x86_64 UEFI firmware (edk2 OVMF) installed by Linux distributions packages.
+// The unified images are used as '-bios' needs the code and the variables in one file.
+var ovmfPaths = []string{
+	"/usr/share/edk2/x64/OVMF.fd",     // Arch Linux
+	"/usr/share/ovmf/OVMF.fd",         // Debian, Ubuntu
+	"/usr/share/OVMF/OVMF.fd",         // older Ubuntu
+	"/usr/share/edk2/ovmf/OVMF.fd",    // Fedora edk2-ovmf-experimental
+	"/usr/share/qemu/ovmf-x86_64.bin", // openSUSE
+}
+
+// FindOVMF returns the path of the x86_64 UEFI firmware installed at the host or an empty string
+func FindOVMF() string {
+	for _, p := range ovmfPaths {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+// presetMemory is the guest RAM of the presets, enough for a distribution kernel and initramfs
+const presetMemory = "1G"
+
+// MinimalLinux is a preset for the direct kernel boot of an x86_64 Linux guest with the serial console,
+// a hardware RNG (so the boot does not stall waiting for entropy) and a user mode network interface.
+// Add the kernel, initramfs and disks, e.g. NewQemuWith(MinimalLinux(), WithKernel("bzImage")).
+func MinimalLinux() QemuOption {
+	return func(opts *QemuOptions) {
+		opts.OperatingSystem = OS_LINUX
+		if opts.Architecture == "" {
+			opts.Architecture = QEMU_X86_64
+		}
+		WithMemory(presetMemory)(opts)
+		opts.Params = append(opts.Params, "-device", "virtio-rng-pci")
+		opts.NICs = append(opts.NICs, QemuNIC{})
+	}
+}
+
+// UEFIx86 is a preset for an x86_64 q35 machine booting with the UEFI firmware, e.g. a disk image with
+// an EFI system partition. The firmware is found with FindOVMF(), NewQemu fails if it is not installed.
+func UEFIx86() QemuOption {
+	return func(opts *QemuOptions) {
+		MinimalLinux()(opts)
+		opts.Architecture = QEMU_X86_64
+		opts.Params = append(opts.Params, "-machine", "q35")
+		opts.BIOS = FindOVMF()
+		if opts.BIOS == "" {
+			// NewQemu reports the missing firmware
+			opts.BIOS = ovmfPaths[0]
+		}
+	}
+}
+
+// Aarch64Virt is a preset for the direct kernel boot of an aarch64 Linux guest at the generic 'virt' machine
+// with the PL011 serial console
+func Aarch64Virt() QemuOption {
+	return func(opts *QemuOptions) {
+		opts.Architecture = QEMU_AARCH64
+		MinimalLinux()(opts)
+		opts.Params = append(opts.Params, "-machine", "virt", "-cpu", "max")
+		opts.KernelConsole = "ttyAMA0,115200"
+	}
+}
+
+// MicroVM is a preset for the fast direct kernel boot of an x86_64 Linux guest at the minimalist 'microvm'
+// machine. It has no PCI bus, so all devices are virtio-mmio and the kernel needs CONFIG_VIRTIO_MMIO and
+// CONFIG_VIRTIO_MMIO_CMDLINE_DEVICES.
+func MicroVM() QemuOption {
+	return func(opts *QemuOptions) {
+		opts.OperatingSystem = OS_LINUX
+		opts.Architecture = QEMU_X86_64
+		WithMemory(presetMemory)(opts)
+		opts.Params = append(opts.Params,
+			"-machine", "microvm,isa-serial=on,rtc=on",
+			"-device", "virtio-rng-device",
+		)
+		opts.DiskController = DISK_CONTROLLER_VIRTIO_SCSI_DEVICE
+		opts.NICs = append(opts.NICs, QemuNIC{Model: "virtio-net-device"})
+		// the kernel does not need to probe the legacy devices
+		opts.Append = append(opts.Append, "reboot=t", "pci=off")
+	}
+}
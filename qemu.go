@@ -3,6 +3,7 @@ package vmtest
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -56,11 +57,25 @@ const (
 	QEMU_XTENSAEB     = QemuArchitecture("xtensaeb")
 )
 
+// OperatingSystem is a guest OS preset, it chooses default devices and parameters suitable for the system.
+// See the constants documentation for differences in behavior.
 type OperatingSystem int
 
 const (
 	OS_OTHER OperatingSystem = iota
+	// OS_LINUX adds the serial console and log level kernel parameters, see QemuOptions.NoDefaultKernelArgs.
+	// Shutdown() presses the ACPI power button that is handled by systemd-logind or acpid.
 	OS_LINUX
+	// OS_WINDOWS attaches disks to an AHCI (SATA) controller by default as Windows has no inbox virtio drivers and
+	// keeps the RTC in local time. Windows ignores the ACPI power button at the lock screen unless
+	// "Shutdown: Allow system to be shut down without having to log on" policy is set, so Shutdown() uses
+	// the guest agent if QemuOptions.GuestAgent is enabled. The console is available only if Windows
+	// Emergency Management Services are enabled ('bcdedit /ems on').
+	OS_WINDOWS
+	// OS_FREEBSD boots a FreeBSD guest from its disk image, the kernel parameters are not supported.
+	// The serial console needs 'console="comconsole"' in /boot/loader.conf. Shutdown() presses the ACPI
+	// power button that FreeBSD handles with a clean shutdown by default.
+	OS_FREEBSD
 )
 
 // QemuDisk represents a disk image supplied to qemu
@@ -69,10 +84,80 @@ type QemuDisk struct {
 	Path string
 	// Format is a disk format of the image e.g. 'raw' or 'qcow2'
 	Format string
-	// Controller specified what drive controller is used for this disk, if empty then default "scsi-hd" is used
+	// Controller specifies what drive device is used for this disk e.g. 'virtio-blk-pci', if empty then
+	// the default device of QemuOptions.DiskController is used ('scsi-hd' for virtio SCSI controllers)
 	Controller string
 	// List of arguments appended to the disk's "-device controller,$arg1,$arg2" parameter
 	DeviceParams []string
+	// BootIndex sets the disk boot priority ('bootindex' device property), devices with lower index boot first.
+	// Zero means the index is not set.
+	BootIndex int
+	// Snapshot writes the guest changes of the disk to a temporary file, the image stays intact ('snapshot=on')
+	Snapshot bool
+	// Shared allows several disks to use the same image, e.g. paths of a multipath device. The image locking
+	// is disabled and the device is attached with 'share-rw=on'.
+	Shared bool
+	// Throttle limits the disk I/O rate, e.g. to test the guest software under slow storage conditions
+	Throttle *QemuThrottle
+	// FaultInjection wraps the image into qemu blkdebug driver that fails the requests matching the rules
+	FaultInjection []QemuFaultRule
+}
+
+// QemuThrottle specifies disk I/O limits ('throttling.*' drive options), zero means no limit
+type QemuThrottle struct {
+	// IOPSTotal, IOPSRead and IOPSWrite limit the number of I/O operations per second
+	IOPSTotal, IOPSRead, IOPSWrite int
+	// BPSTotal, BPSRead and BPSWrite limit the number of bytes per second
+	BPSTotal, BPSRead, BPSWrite int64
+}
+
+func (t *QemuThrottle) params() []string {
+	var params []string
+	add := func(name string, value int64) {
+		if value != 0 {
+			params = append(params, fmt.Sprintf("throttling.%v=%d", name, value))
+		}
+	}
+	add("iops-total", int64(t.IOPSTotal))
+	add("iops-read", int64(t.IOPSRead))
+	add("iops-write", int64(t.IOPSWrite))
+	add("bps-total", t.BPSTotal)
+	add("bps-read", t.BPSRead)
+	add("bps-write", t.BPSWrite)
+	return params
+}
+
+// QemuSMBIOS represents SMBIOS/DMI system information (type 1) exposed to the guest
+type QemuSMBIOS struct {
+	// Manufacturer is reported as /sys/class/dmi/id/sys_vendor
+	Manufacturer string
+	// Product is reported as /sys/class/dmi/id/product_name
+	Product string
+	// Version is reported as /sys/class/dmi/id/product_version
+	Version string
+	// Serial is reported as /sys/class/dmi/id/product_serial
+	Serial string
+	// UUID is reported as /sys/class/dmi/id/product_uuid. It takes precedence over QemuOptions.UUID.
+	UUID string
+	// SKU is the system SKU number
+	SKU string
+	// Family is reported as /sys/class/dmi/id/product_family
+	Family string
+}
+
+// QemuMemory configures the guest RAM and its backend
+type QemuMemory struct {
+	// Size of the guest RAM e.g. '512M' or '2G' ('-m' qemu param)
+	Size string
+	// Hugepages backs the guest RAM with hugetlbfs pages. Path defaults to /dev/hugepages in this case.
+	Hugepages bool
+	// Shared maps the guest RAM with 'share=on' so external processes (vhost-user backends, virtiofsd) can access it.
+	// Path defaults to /dev/shm in this case.
+	Shared bool
+	// Path is a file or directory used by memory backend ('mem-path' parameter)
+	Path string
+	// Prealloc preallocates the whole guest RAM at startup
+	Prealloc bool
 }
 
 // QemuOptions options for qemu vm initialization
@@ -85,36 +170,228 @@ type QemuOptions struct {
 	Params []string
 	// Enable debug output
 	Verbose bool
+	// VerboseOutput receives the verbose output instead of stdout and the standard logger, e.g. WithTestingLogger(t)
+	VerboseOutput io.Writer
+	// VerbosePrefix starts every verbose output line, e.g. "[vm1] " to tell apart multiple VMs of a test
+	VerbosePrefix string
+	// VerboseColor prints vmtest messages and qemu stderr in colors different from the guest console output
+	VerboseColor bool
+	// Wrapper is a command qemu runs under, e.g. WrapperPerfRecord or []string{"strace", "-c", "--"}.
+	// ArtifactsPlaceholder in its arguments is replaced with ArtifactsDir path.
+	Wrapper []string
+	// ArtifactsDir is a directory for the VM output files like Wrapper reports. If it is empty and a Wrapper
+	// is specified then a temporary directory is created, see Qemu.ArtifactsDir().
+	ArtifactsDir string
+	// Name identifies the VM in the temporary file names and in the host process list ('-name'), so the files of
+	// concurrent VMs are distinguishable, e.g. 'vmtest-web-123456/console.socket'
+	Name string
+	// TempDir is a directory the VM sockets and other temporary files are created in, e.g. fast local storage
+	// in CI. Default is TMPDIR.
+	TempDir string
+	// ScratchDir is a directory for the large VM files like the temporary ArtifactsDir and CrashDump.Dir, e.g.
+	// a roomy disk distinct from TMPDIR where the sockets live. Default is TMPDIR.
+	ScratchDir string
+	// MinFreeSpace is the free space in bytes TMPDIR and ScratchDir must have before the VM starts, otherwise
+	// NewQemu fails with ErrNoSpace. Default is 256MiB, a negative value disables the check.
+	MinFreeSpace int64
+	// ChardevTransport specifies how the monitor, console, QMP and guest agent are connected, default is CHARDEV_UNIX.
+	// CHARDEV_TCP allows to run QEMU on a host without unix sockets support or in a different network namespace.
+	ChardevTransport ChardevTransport
+	// ChardevHost is an address listened for CHARDEV_TCP connections, default is 127.0.0.1
+	ChardevHost string
 	// The qemu vm is killed after this timeout
 	Timeout time.Duration
+	// Ephemeral boots all writable images in the snapshot mode ('-snapshot'), the guest changes are discarded
+	// when the VM stops. See QemuDisk.Snapshot to do it for particular disks.
+	Ephemeral bool
+	// AllowReboot lets the guest reboot. By default '-no-reboot' is passed and qemu exits once the guest resets.
+	AllowReboot bool
+	// NoShutdown keeps qemu running with the paused VM once the guest powers off ('-no-shutdown')
+	NoShutdown bool
+	// ResetLoop enables detection of rapid reset loops with AllowReboot, see QemuResetLoop
+	ResetLoop *QemuResetLoop
+	// RestartPolicy relaunches the VM if its start fails with a transient error
+	RestartPolicy *RestartPolicy
+	// StopPolicy specifies the timeouts of shutdown methods used by Stop()
+	StopPolicy QemuStopPolicy
+	// Heartbeat is an interval of progress messages printed when the verbose output is disabled, so CI systems
+	// with no-output timeouts do not kill long guest boots. Zero disables the messages.
+	Heartbeat time.Duration
 	// Kernel path to the kernel binary
 	Kernel string
 	// Path to ramfs image file
 	InitRamFs string
+	// DTB is a path to the device tree blob ('-dtb' qemu param) used by embedded boards
+	DTB string
+	// BIOS is a path to the firmware image ('-bios' qemu param), e.g. a custom OpenSBI build
+	BIOS string
 	// Array of '-disk' parameters
 	Disks []QemuDisk
-	// Append specifies kernel parameters ('-append' qemu param)
+	// DiskController is a controller for Disks that do not specify their device, default is
+	// DISK_CONTROLLER_VIRTIO_SCSI_PCI (DISK_CONTROLLER_AHCI for OS_WINDOWS)
+	DiskController DiskController
+	// Append specifies kernel parameters ('-append' qemu param), see also KernelCmdline builder.
+	// For OS_LINUX the serial console and ignore_loglevel parameters are added unless specified here.
 	Append []string
+	// ConsoleBufferSize is the maximum size of a single console read, default is 4096 bytes.
+	// Increase it for very chatty consoles to reduce the number of reads.
+	ConsoleBufferSize int
+	// ConsoleScrollback limits the size of console output kept for expectations, the oldest data is dropped
+	// when the limit is exceeded. Zero means unlimited. See Qemu.ConsoleDiscarded().
+	ConsoleScrollback int
+	// ConsoleRaw makes the console binary-safe: ANSI escape sequences are not filtered out and the output is not
+	// processed line by line, so KernelMessages() and ConsolePatterns are not available. The exact byte stream can be
+	// exchanged with ConsoleReader() and ConsoleWriteBytes(), e.g. for xmodem transfers or protobuf frames.
+	ConsoleRaw bool
+	// ConsoleExpectNewOutput makes the console expectations ignore the output printed before they are called.
+	// By default an expectation also searches the retained output not consumed by the previous expectations,
+	// so text printed before the call is found, see ConsoleScrollback.
+	ConsoleExpectNewOutput bool
+	// ConsoleSinks receive the rendered console output together with the verbose output, e.g. a log file or
+	// WithTestingLogger(t). Every sink is written independently, so a slow one does not delay the others.
+	ConsoleSinks []io.Writer
+	// Secrets are strings, e.g. passphrases written with ConsoleWrite(), redacted from the verbose output,
+	// ConsoleSinks, reports, console expectation errors and the console history. See also Qemu.AddSecret().
+	Secrets []string
+	// ConsoleCoalesce replaces identical repeated console lines in the verbose output and ConsoleSinks with
+	// a repeat count, limiting the log size when the guest floods the console. Expectations see every line.
+	ConsoleCoalesce bool
+	// ConsoleSpillFile is a file the console output dropped because of ConsoleScrollback limit is appended to
+	ConsoleSpillFile string
+	// ConsolePatterns are checked against every console line, e.g. CommonFailurePatterns.
+	// See also Qemu.AddConsolePattern().
+	ConsolePatterns []ConsolePattern
+	// KernelMessageLevels makes the kernel print log levels of its messages ('console_msg_format=syslog'),
+	// so they are available in KernelMessages()
+	KernelMessageLevels bool
+	// NoDefaultKernelArgs disables the console and log level parameters automatically added for OS_LINUX
+	NoDefaultKernelArgs bool
+	// KernelConsole is a console device added to the OS_LINUX kernel parameters, default is 'ttyS0,115200'.
+	// It is added after the consoles from Append unless Append already has the device.
+	KernelConsole string
+	// KernelLogLevel is a 'loglevel' added to the OS_LINUX kernel parameters instead of 'ignore_loglevel'
+	// e.g. 4 prints only warnings and more severe messages. Zero means all messages are printed.
+	KernelLogLevel int
 	// Value of '-cdrom' parameter
 	CdRom string
+	// VirtioDrivers is a path to virtio-win drivers ISO attached as an additional CD-ROM drive,
+	// see FindVirtioDriversISO() and Qemu.GuestInstallVirtioDrivers()
+	VirtioDrivers string
+	// Floppy is a path to the raw floppy disk image attached as drive A
+	Floppy string
+	// SDCard is a path to the raw SD card image attached to the board's SD controller (e.g. ARM vexpress or raspi)
+	SDCard string
+	// BootOrder is a list of drive letters to boot from in priority order: 'a' floppy, 'c' hard disk, 'd' CD-ROM,
+	// 'n' network. If it is empty and CdRom is set then the machine boots from CD-ROM.
+	BootOrder string
+	// BootMenu enables interactive boot menu of the firmware
+	BootMenu bool
+	// UUID of the machine ('-uuid' qemu param)
+	UUID string
+	// SMBIOS specifies system information strings visible to the guest via DMI
+	SMBIOS *QemuSMBIOS
+	// Identity makes the machine UUID, serial number and hostname unique per VM, see Qemu.Identity().
+	// It cannot be used together with UUID and the SMBIOS serial number and UUID.
+	Identity *QemuIdentity
+	// Memory configures the guest RAM size and its backend
+	Memory *QemuMemory
+	// VhostUser is a list of devices served by external vhost-user backends.
+	// The guest RAM is shared with the backends automatically, set Memory.Size to change its size.
+	VhostUser []QemuVhostUser
+	// NICs is a list of guest network interfaces
+	NICs []QemuNIC
+	// MACSeed makes the default NIC addresses of this VM different from other VMs, e.g. ones of the same test
+	MACSeed string
+	// USB is a list of USB devices attached to an xHCI controller
+	USB []QemuUSBDevice
+	// Shares is a list of host directories shared with the guest using virtio 9p filesystem
+	Shares []QemuShare
+	// Coverage collects coverage data written by the guest to a dedicated 9p share, see QemuCoverage
+	Coverage *QemuCoverage
+	// CrashDump reserves memory for Linux crash kernel and shares a directory for vmcore files, see QemuCrashDump
+	CrashDump *QemuCrashDump
+	// GuestAgent adds a virtio-serial channel for QEMU guest agent (qemu-ga). The agent needs to be running
+	// inside the VM to use GuestAgent(), Suspend() and other agent based functionality.
+	GuestAgent bool
+	// Input is a list of virtio input devices attached to the guest
+	Input []InputDevice
+	// Audio attaches a sound card to the guest
+	Audio *QemuAudio
+	// ACPITables is a list of additional ACPI tables passed to the guest
+	ACPITables []QemuACPITable
+	// Watchdog attaches an emulated watchdog device, its expiration can be awaited with WaitWatchdog()
+	Watchdog *QemuWatchdog
+	// Clock configures the guest real time clock. OS_WINDOWS keeps it in local time by default.
+	Clock *QemuClock
+	// GPU attaches a virtio-gpu display adapter. Its output can be inspected with Screenshot().
+	GPU *QemuGPU
+	// OCR is an engine used by ScreenExpect() to recognize text at the display, default is TesseractOCR
+	OCR OCREngine
+	// PassthroughPCI is a list of host PCI devices addresses (e.g. '0000:01:00.0') passed to the guest with VFIO.
+	// The devices must be bound to vfio-pci driver, it is verified before launch.
+	PassthroughPCI []string
+	// NestedVirtualization exposes VMX/SVM to the guest so it can run hypervisors itself. It enables KVM and
+	// uses '-cpu host' unless the CPU model is specified in Params. The host KVM support is probed before launch.
+	NestedVirtualization bool
+	// Confidential launches the guest as SEV or TDX confidential VM. The host capabilities are probed before launch.
+	Confidential *QemuConfidential
+
+	// OnStart is called once the VM is launched, before Start() returns. With RestartPolicy it is called
+	// for every launch attempt.
+	OnStart func(q *Qemu)
+	// OnConsoleLine is called for every console line with the Secrets redacted, except with ConsoleRaw.
+	// It is called from the console pump goroutine so it must not block.
+	OnConsoleLine func(line string)
+	// OnExit is called once the qemu process exits with the error of the process, nil if it exits successfully.
+	// Kill() and Shutdown() return after the callback is completed, so it must not stop the VM itself.
+	OnExit func(q *Qemu, err error)
+	// OnTimeout is called before OnExit if the VM is killed by Timeout or by the deadline of the Start() context
+	OnTimeout func(q *Qemu)
+	// ReadinessProbes are checked by WaitReady() to tell that the VM is usable
+	ReadinessProbes []ReadinessProbe
 }
 
 // Qemu represents a VM that is started by vmtest library
 type Qemu struct {
-	cmd                *exec.Cmd
-	waitCh             chan error
-	socketsDir         string
-	consoleListener    net.Listener
-	console            net.Conn
-	consolePumpData    []byte
-	consolePumpMutex   sync.Mutex
-	consoleDataEOF     bool
-	consoleData        []byte
-	consoleDataArrived bool
-	monitorListener    net.Listener
-	monitor            net.Conn
-	ctxCancel          context.CancelFunc
-	verbose            bool
+	opts            *QemuOptions
+	cmd             *exec.Cmd
+	stopped         bool // set once the process of the last Start() is reaped
+	exit            *qemuExit
+	exitHooksDone   chan struct{}
+	goroutines      sync.WaitGroup // the console pump and the heartbeat of the run
+	waitCh          chan error
+	socketsDir      string
+	consoleListener net.Listener
+	console         *console
+	consoleSpill    *os.File
+	monitorListener net.Listener
+	monitor         net.Conn
+	qmpListener     net.Listener
+	qmpConn         net.Conn
+	qmp             *qmpClient
+	qmpEventsMutex  sync.Mutex
+	qmpEventsCursor int
+	agentListener   net.Listener
+	agent           *guestAgent
+	coverageShare   string
+	crashDumpDir    string
+	coverageOutput  string
+	ocr             OCREngine
+	ctxCancel       context.CancelFunc
+	deadline        time.Time // the process is killed at it, see QemuOptions.Timeout
+	operatingSystem OperatingSystem
+	noShutdown      bool
+	binary          string
+	version         string // the first line of 'qemu -version' output
+	accel           string // the accelerator used, e.g. 'kvm' or 'tcg'
+	cmdline         []string
+	startTime       time.Time
+	artifactsDir    string
+	stderr          *tailBuffer
+	macs            []string
+	stopPolicy      QemuStopPolicy
+	identity        QemuIdentity
+	verbose         *verboseOutput // nil unless the verbose output is enabled
 }
 
 var _ VM = (*Qemu)(nil) // ensure Qemu implements VM interface
@@ -132,108 +409,262 @@ func quoteCmdline(cmdline []string) string {
 	return strings.Join(args, " ")
 }
 
-// NewQemu creates a new qemu instance and starts it
+// NewQemu creates a new qemu instance and starts it. The VM is relaunched on transient failures according to
+// QemuOptions.RestartPolicy.
 func NewQemu(opts *QemuOptions) (*Qemu, error) {
+	q := Configure(opts)
+	if err := q.Start(context.Background()); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Configure creates a qemu instance without starting it. The options can be modified and the planned command
+// line inspected before Start(). The other methods must not be called before the VM is started.
+func Configure(opts *QemuOptions) *Qemu {
+	return &Qemu{opts: opts}
+}
+
+// Options returns the configuration of the VM, the changes apply at the next Start()
+func (q *Qemu) Options() *QemuOptions {
+	return q.opts
+}
+
+// PlannedCmdline renders the command line the next Start() launches the VM with, see BuildCmdline.
+// The default identity values are generated, so they match the launched VM.
+func (q *Qemu) PlannedCmdline() ([]string, error) {
+	if err := q.generateIdentity(); err != nil {
+		return nil, err
+	}
+	o := *q.opts
+	q.applyIdentity(&o)
+	return BuildCmdline(&o)
+}
+
+// Start launches the configured VM, it is relaunched on transient failures according to
+// QemuOptions.RestartPolicy. Cancelling ctx kills the VM like QemuOptions.Timeout does.
+// A VM stopped with Kill() or Shutdown() or powered off by the guest can be started again with the same
+// configuration, e.g. to reboot into a new kernel. The console output, QMP events and the other state of
+// the previous run are discarded. Start must not be called concurrently with the other methods.
+func (q *Qemu) Start(ctx context.Context) error {
+	if q.cmd != nil && !q.stopped {
+		select {
+		case <-q.exit.done:
+			// the process exited by itself, release the previous run before its state is replaced
+			q.wait()
+		default:
+			return fmt.Errorf("qemu is already running, stop it with Kill() or Shutdown()")
+		}
+	}
+	if q.opts.RestartPolicy == nil {
+		return q.start(ctx)
+	}
+	return q.opts.RestartPolicy.start(ctx, q)
+}
+
+// start launches a single qemu instance. The resources of a failed start are released before it returns.
+func (q *Qemu) start(parent context.Context) (err error) {
+	o := *q.opts // the defaults and the generated values do not modify the caller's options
+	opts := &o
 	if opts.Timeout == 0 {
 		opts.Timeout = qemuDefaultTimeout
 	}
 	if opts.Architecture == "" {
 		opts.Architecture = QEMU_X86_64
 	}
+	if opts.OCR == nil {
+		opts.OCR = &TesseractOCR{}
+	}
 
-	tempDir, err := ioutil.TempDir("", "vmtest")
-	if err != nil {
-		return nil, err
+	if err := q.generateIdentity(); err != nil {
+		return err
 	}
+	q.applyIdentity(opts)
+	identity := q.identity
 
-	monitorFile := path.Join(tempDir, "monitor.socket")
-	monitorListener, err := net.Listen("unix", monitorFile)
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+	for _, addr := range opts.PassthroughPCI {
+		if err := checkVFIODevice(addr); err != nil {
+			return err
+		}
+	}
+	if opts.NestedVirtualization {
+		if err := ProbeNestedVirtualization(); err != nil {
+			return err
+		}
+	}
+	if opts.Confidential != nil {
+		if err := ProbeConfidential(opts.Confidential.Type); err != nil {
+			return err
+		}
+	}
+
+	macs, err := nicMACs(opts)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	consoleFile := path.Join(tempDir, "console.socket")
-	consoleListener, err := net.Listen("unix", consoleFile)
+	extraArgs, err := envExtraArgs()
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	qemuBinary := fmt.Sprintf("qemu-system-%v", opts.Architecture)
-	cmdline := []string{
-		"-monitor", fmt.Sprintf("unix:%v", monitorFile),
-		"-serial", fmt.Sprintf("unix:%v", consoleFile),
-		"-no-reboot",
-		"-nographic", "-display", "none",
+	if err := checkVMSpace(opts); err != nil {
+		return err
 	}
 
-	if opts.Kernel != "" {
-		cmdline = append(cmdline, "-kernel", opts.Kernel)
+	// cleanup releases the resources created so far if the start fails, in the reverse order
+	var cleanup []func()
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}()
+	closeOnError := func(c io.Closer) {
+		cleanup = append(cleanup, func() { _ = c.Close() })
 	}
-	if opts.InitRamFs != "" {
-		cmdline = append(cmdline, "-initrd", opts.InitRamFs)
+
+	tempDir, err := vmTempDir(opts)
+	if err != nil {
+		return err
 	}
+	cleanup = append(cleanup, func() { _ = os.RemoveAll(tempDir) })
 
-	if opts.Kernel == "" && len(opts.Append) > 0 {
-		// it comes from QEMU "qemu-system-x86_64: -append only allowed with -kernel option"
-		return nil, fmt.Errorf("opts.Append only allowed with opts.Kernel option")
+	// the chardev addresses are needed by the command line
+	addrs := chardevAddrs{}
+	monitorListener, err := listenChardev(opts, tempDir, monitorSocket, addrs)
+	if err != nil {
+		return err
 	}
-	kernelArgs := opts.Append
-	if opts.OperatingSystem == OS_LINUX {
-		kernelArgs = append(kernelArgs, "console=ttyS0,115200", "ignore_loglevel")
+	closeOnError(monitorListener)
+	consoleListener, err := listenChardev(opts, tempDir, consoleSocket, addrs)
+	if err != nil {
+		return err
+	}
+	closeOnError(consoleListener)
+	qmpListener, err := listenChardev(opts, tempDir, qmpSocket, addrs)
+	if err != nil {
+		return err
 	}
-	if len(kernelArgs) > 0 && opts.Kernel != "" {
-		cmdline = append(cmdline, "-append", strings.Join(kernelArgs, " "))
+	closeOnError(qmpListener)
+	var agentListener net.Listener
+	if opts.GuestAgent {
+		agentListener, err = listenChardev(opts, tempDir, agentSocket, addrs)
+		if err != nil {
+			return err
+		}
+		closeOnError(agentListener)
 	}
 
-	if opts.Architecture == "x86_64" {
-		// cmdline = append(cmdline, "-device", "e1000,netdev=net0", "-netdev", "user,id=net0,hostfwd=tcp::5555-:22")
+	var crashDumpDir string
+	if opts.CrashDump != nil {
+		crashDumpDir, err = opts.CrashDump.crashDumpDir(scratchDir(opts), tempPattern(opts, "vmtest-crash"))
+		if err != nil {
+			return err
+		}
+		if opts.CrashDump.Dir == "" {
+			cleanup = append(cleanup, func() { _ = os.RemoveAll(crashDumpDir) })
+		}
+		// the share of the temporary directory is added to the copy, the caller's options stay intact
+		crashDump := *opts.CrashDump
+		crashDump.Dir = crashDumpDir
+		opts.CrashDump = &crashDump
 	}
-	if len(opts.Params) > 0 {
-		cmdline = append(cmdline, opts.Params...)
+
+	qemuBinary := qemuBinary(opts.Architecture)
+	cmdline, err := buildCmdline(opts, tempDir, addrs)
+	if err != nil {
+		return err
 	}
+	cmdline = append(cmdline, extraArgs...)
 
-	if opts.CdRom != "" {
-		cmdline = append(cmdline, "-boot", "d", "-cdrom", opts.CdRom)
+	var coverageShare, coverageOutput string
+	if opts.Coverage != nil {
+		coverageOutput, err = opts.Coverage.outputDir()
+		if err != nil {
+			return err
+		}
+		coverageShare = path.Join(tempDir, coverageDir)
+		if err := os.Mkdir(coverageShare, 0o777); err != nil {
+			return err
+		}
 	}
 
-	if len(opts.Disks) > 0 {
-		cmdline = append(cmdline, "-device", "virtio-scsi-pci,id=scsi")
+	if err := writeFaultRules(opts, tempDir); err != nil {
+		return err
 	}
-	for i, d := range opts.Disks {
-		format := ""
-		if d.Format != "" {
-			format = fmt.Sprintf("format=%s,", d.Format)
+
+	var consoleSpill *os.File
+	if opts.ConsoleSpillFile != "" {
+		consoleSpill, err = os.OpenFile(opts.ConsoleSpillFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
 		}
-		controller := d.Controller
-		if controller == "" {
-			controller = "scsi-hd"
+		closeOnError(consoleSpill)
+	}
+
+	var artifacts string
+	if len(opts.Wrapper) > 0 || opts.ArtifactsDir != "" {
+		artifacts, err = artifactsDir(opts)
+		if err != nil {
+			return err
 		}
-		drive := fmt.Sprintf("drive=hd%v", i)
-		deviceParams := append([]string{controller, drive}, d.DeviceParams...)
-		cmdline = append(cmdline, "-drive", format+fmt.Sprintf("if=none,id=hd%d,file=%s", i, d.Path),
-			"-device", strings.Join(deviceParams, ","))
 	}
+	binary, args := wrapCommand(opts.Wrapper, artifacts, qemuBinary, cmdline)
+	version := qemuVersion(qemuBinary)
 
+	var verbose *verboseOutput
 	if opts.Verbose {
-		log.Printf("QEMU command line: %v %v", qemuBinary, quoteCmdline(cmdline))
+		verbose = newVerboseOutput(opts)
+		var secrets consoleSecrets
+		for _, secret := range opts.Secrets {
+			secrets.add(secret)
+		}
+		verbose.logf("QEMU command line: %v %v", binary, secrets.redactString(quoteCmdline(args)))
 	}
 
-	ctx, ctxCancel := context.WithTimeout(context.Background(), opts.Timeout)
+	ctx, ctxCancel := context.WithTimeout(parent, opts.Timeout)
+	cleanup = append(cleanup, ctxCancel)
+	deadline, _ := ctx.Deadline()
 
-	cmd := exec.CommandContext(ctx, qemuBinary, cmdline...)
-	if opts.Verbose {
+	cmd := exec.CommandContext(ctx, binary, args...)
+	if artifacts != "" {
+		cmd.Env = append(os.Environ(), EnvArtifactsDir+"="+artifacts)
+	}
+	stderr := &tailBuffer{limit: reportStderrSize}
+	cmd.Stderr = stderr
+	var consoleOut io.Writer
+	if verbose != nil {
+		consoleOut = verbose.console()
 		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		cmd.Stdout = consoleOut
+		cmd.Stderr = io.MultiWriter(verbose.stderr(), stderr)
 	}
 	err = cmd.Start()
 	if err != nil {
-		ctxCancel()
-		return nil, fmt.Errorf("starting QEMU: %v", err)
+		return fmt.Errorf("starting QEMU: %v", err)
+	}
+	startTime := time.Now()
+
+	// exitError adds the environment report to the error of qemu process that exited during the start
+	exitError := func(err error) error {
+		return &QemuError{Err: fmt.Errorf("%w: %w", ErrQemuExited, err), Report: newQemuReport(cmdline, qemuBinary, version, stderr)}
 	}
 
 	waitCh := make(chan error, 1)
+	exit := &qemuExit{done: make(chan struct{})}
+	// the process is killed with ctx and reaped before its files are removed
+	cleanup = append(cleanup, func() {
+		ctxCancel()
+		<-exit.done
+	})
 	go func() {
 		err := cmd.Wait()
+		exit.err = err
+		close(exit.done)
 		waitCh <- err
 		if err != nil {
 			ctxCancel()
@@ -241,6 +672,10 @@ func NewQemu(opts *QemuOptions) (*Qemu, error) {
 			// deadlock if qemu exits immediately:
 			monitorListener.Close()
 			consoleListener.Close()
+			qmpListener.Close()
+			if agentListener != nil {
+				agentListener.Close()
+			}
 		}
 	}()
 
@@ -248,111 +683,773 @@ func NewQemu(opts *QemuOptions) (*Qemu, error) {
 	if err != nil {
 		select {
 		case waitErr := <-waitCh:
-			return nil, waitErr
+			return exitError(waitErr)
 		default:
-			return nil, err
+			return err
 		}
 	}
+	closeOnError(monitor)
 	console, err := consoleListener.Accept()
 	if err != nil {
 		select {
 		case waitErr := <-waitCh:
-			return nil, waitErr
+			return exitError(waitErr)
 		default:
-			return nil, err
+			return err
+		}
+	}
+	closeOnError(console)
+	qmpConn, err := qmpListener.Accept()
+	if err != nil {
+		select {
+		case waitErr := <-waitCh:
+			return exitError(waitErr)
+		default:
+			return err
 		}
 	}
+	closeOnError(qmpConn)
+	qmp, err := newQMPClient(qmpConn)
+	if err != nil {
+		return err
+	}
+	accel := queryAccel(qmp, cmdline)
+	var agent *guestAgent
+	if agentListener != nil {
+		agentConn, err := agentListener.Accept()
+		if err != nil {
+			select {
+			case waitErr := <-waitCh:
+				return exitError(waitErr)
+			default:
+				return err
+			}
+		}
+		closeOnError(agentConn)
+		agent = newGuestAgent(agentConn)
+	}
 
-	qemu := &Qemu{
+	*q = Qemu{
+		opts:            q.opts,
 		cmd:             cmd,
 		waitCh:          waitCh,
 		socketsDir:      tempDir,
 		monitorListener: monitorListener,
 		monitor:         monitor,
 		consoleListener: consoleListener,
-		console:         console,
+		console: newConsole(console, consoleConfig{
+			bufferSize:    opts.ConsoleBufferSize,
+			scrollback:    opts.ConsoleScrollback,
+			spill:         consoleSpill,
+			raw:           opts.ConsoleRaw,
+			newOutputOnly: opts.ConsoleExpectNewOutput,
+			coalesce:      opts.ConsoleCoalesce,
+		}),
+		consoleSpill:    consoleSpill,
+		qmpListener:     qmpListener,
+		qmpConn:         qmpConn,
+		qmp:             qmp,
+		ocr:             opts.OCR,
+		agentListener:   agentListener,
+		agent:           agent,
+		coverageShare:   coverageShare,
+		crashDumpDir:    crashDumpDir,
+		coverageOutput:  coverageOutput,
 		ctxCancel:       ctxCancel,
-		verbose:         opts.Verbose,
+		deadline:        deadline,
+		operatingSystem: opts.OperatingSystem,
+		noShutdown:      opts.NoShutdown,
+		binary:          qemuBinary,
+		version:         version,
+		accel:           accel,
+		cmdline:         cmdline,
+		startTime:       startTime,
+		artifactsDir:    artifacts,
+		stderr:          stderr,
+		macs:            macs,
+		stopPolicy:      opts.StopPolicy,
+		identity:        identity,
+		verbose:         verbose,
+		exit:            exit,
+		exitHooksDone:   make(chan struct{}),
 	}
 
-	go qemu.consolePump(opts.Verbose)
+	for _, p := range opts.ConsolePatterns {
+		q.AddConsolePattern(p)
+	}
+	if opts.ResetLoop != nil {
+		q.AddConsolePattern(opts.ResetLoop.pattern(&q.console.patterns))
+	}
+	if opts.OnConsoleLine != nil {
+		q.AddConsolePattern(ConsolePattern{Name: "OnConsoleLine", Regexp: anyLineRe, Severity: PATTERN_CALLBACK, Callback: opts.OnConsoleLine})
+	}
 
-	return qemu, nil
+	for _, secret := range opts.Secrets {
+		q.AddSecret(secret)
+	}
+	for _, w := range opts.ConsoleSinks {
+		q.console.sinks.add(w)
+	}
+	q.goroutines.Add(1)
+	go func() {
+		defer q.goroutines.Done()
+		q.console.pump(consoleOut)
+	}()
+	if opts.Heartbeat != 0 && verbose == nil {
+		q.goroutines.Add(1)
+		go func() {
+			defer q.goroutines.Done()
+			q.heartbeat(ctx, opts.Heartbeat)
+		}()
+	}
+	go q.exitHooks(ctx, exit)
+	if opts.OnStart != nil {
+		opts.OnStart(q)
+	}
+
+	return nil
 }
 
-// List of escape sequences produced by Seabios/Linux
-var ansiRe = regexp.MustCompile(`\x1b(c|M|\[(\d+;\d+H|=3h|[\d;]+m|\?7l|2J|K))`)
+// maxUnixSocketPath is the longest unix socket path the kernel accepts (sun_path without the terminating NUL)
+const maxUnixSocketPath = 107
 
-func (q *Qemu) consolePump(verbose bool) {
-	var buf [4096]byte
-	dataLength := 0
+// tempPattern returns the temporary file name pattern with the VM name, e.g. 'vmtest-web-*'
+func tempPattern(opts *QemuOptions, prefix string) string {
+	if opts.Name == "" {
+		return prefix
+	}
+	return prefix + "-" + opts.Name + "-"
+}
 
-	for {
-		num, err := q.console.Read(buf[dataLength:])
-		if num > 0 {
-			dataLength += num
-			toPrint := buf[:dataLength]
-			dataLength = 0
+// vmTempDir creates the directory for the VM sockets and temporary files
+func vmTempDir(opts *QemuOptions) (string, error) {
+	if opts.TempDir != "" {
+		if err := os.MkdirAll(opts.TempDir, 0o755); err != nil {
+			return "", err
+		}
+	}
+	dir, err := ioutil.TempDir(opts.TempDir, tempPattern(opts, "vmtest"))
+	if err != nil {
+		return "", err
+	}
+	if sock := path.Join(dir, consoleSocket); len(sock) > maxUnixSocketPath &&
+		(opts.ChardevTransport == "" || opts.ChardevTransport == CHARDEV_UNIX) {
+		_ = os.Remove(dir)
+		return "", fmt.Errorf("socket path %v is longer than %d bytes, use a shorter QemuOptions.TempDir or Name", sock, maxUnixSocketPath)
+	}
+	return dir, nil
+}
 
-			// remove ANSI escape sequences
-			if bytes.Contains(toPrint, []byte{'\x1b'}) {
-				toPrint = ansiRe.ReplaceAll(toPrint, []byte{})
-				// Sometimes ASCII sequences are not fully pumped to the buffer yet.
-				// Print out the beginning of the string but leave incomplete ASCII sequence in the buffer to process it later
-				asciiStart := bytes.LastIndexByte(toPrint, '\x1b')
+// dryRunSocketsDir is a placeholder for the sockets directory used by BuildCmdline
+var dryRunSocketsDir = path.Join(os.TempDir(), "vmtest")
 
-				const asciiSeqMaxLength = 30 // some sequences might be up to 20 symbols
-				if asciiStart != -1 && len(toPrint)-asciiStart < asciiSeqMaxLength {
-					// If incomplete ASCII sequence starts close to the end of the buffer
-					// then copy the sequence back to the beginning of buf and the rest is
-					// printed out.
-					copy(buf[:], toPrint[asciiStart:])
-					dataLength = len(toPrint) - asciiStart
-					toPrint = toPrint[:asciiStart]
-				}
-			}
+// BuildCmdline renders the full qemu command line, including the binary name, for the given options without
+// launching the VM. EnvQemuBinary and EnvQemuExtraArgs environment overrides are applied. The sockets are
+// located at a placeholder directory, NewQemu uses a unique temporary one.
+func BuildCmdline(opts *QemuOptions) ([]string, error) {
+	o := *opts // the defaults do not modify the caller's options
+	if o.Architecture == "" {
+		o.Architecture = QEMU_X86_64
+	}
+	if err := o.Validate(); err != nil {
+		return nil, err
+	}
+	cmdline, err := buildCmdline(&o, dryRunSocketsDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	extraArgs, err := envExtraArgs()
+	if err != nil {
+		return nil, err
+	}
+	argv := append([]string{qemuBinary(o.Architecture)}, cmdline...)
+	return append(argv, extraArgs...), nil
+}
 
-			if verbose {
-				_, _ = os.Stdout.Write(toPrint)
-			}
+// Validate checks that the files referenced by the options exist and the options are compatible with each other.
+// It does not probe the host capabilities (VFIO, nested and confidential virtualization), NewQemu does it before launch.
+func (opts *QemuOptions) Validate() error {
+	files := []struct{ name, path string }{
+		{"opts.Kernel", opts.Kernel},
+		{"opts.InitRamFs", opts.InitRamFs},
+		{"opts.CdRom", opts.CdRom},
+		{"opts.Floppy", opts.Floppy},
+		{"opts.SDCard", opts.SDCard},
+	}
+	for i, d := range opts.Disks {
+		files = append(files, struct{ name, path string }{fmt.Sprintf("opts.Disks[%d]", i), d.Path})
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		if err := checkFileExists(f.path); err != nil {
+			return fmt.Errorf("%v: %v", f.name, err)
+		}
+	}
+	for i, s := range opts.Shares {
+		if fi, err := os.Stat(s.Path); err != nil {
+			return fmt.Errorf("opts.Shares[%d]: %v", i, err)
+		} else if !fi.IsDir() {
+			return fmt.Errorf("opts.Shares[%d]: %v is not a directory", i, s.Path)
+		}
+	}
+
+	// buildCmdline verifies the rest of the options while rendering them
+	_, err := buildCmdline(opts, dryRunSocketsDir, nil)
+	return err
+}
+
+// checkCompatibility verifies combinations of the options that cannot be used together
+func (opts *QemuOptions) checkCompatibility() error {
+	if opts.Kernel == "" {
+		switch {
+		case len(opts.Append) > 0:
+			// it comes from QEMU "qemu-system-x86_64: -append only allowed with -kernel option"
+			return fmt.Errorf("opts.Append only allowed with opts.Kernel option")
+		case opts.InitRamFs != "":
+			return fmt.Errorf("opts.InitRamFs only allowed with opts.Kernel option")
+		case opts.CrashDump != nil:
+			return fmt.Errorf("opts.CrashDump requires opts.Kernel option")
+		}
+	}
+	if opts.Kernel != "" && (opts.OperatingSystem == OS_WINDOWS || opts.OperatingSystem == OS_FREEBSD) {
+		return fmt.Errorf("opts.Kernel is supported only for OS_LINUX and OS_OTHER guests")
+	}
+	if opts.NoDefaultKernelArgs && (opts.KernelConsole != "" || opts.KernelLogLevel != 0) {
+		return fmt.Errorf("opts.KernelConsole and opts.KernelLogLevel cannot be used with opts.NoDefaultKernelArgs")
+	}
+	if opts.KernelLogLevel < 0 {
+		return fmt.Errorf("invalid opts.KernelLogLevel %d", opts.KernelLogLevel)
+	}
+	if opts.ConsoleSpillFile != "" && opts.ConsoleScrollback == 0 {
+		return fmt.Errorf("opts.ConsoleSpillFile requires opts.ConsoleScrollback option")
+	}
+	if opts.Identity != nil && (opts.UUID != "" || opts.SMBIOS != nil && (opts.SMBIOS.UUID != "" || opts.SMBIOS.Serial != "")) {
+		return fmt.Errorf("opts.Identity cannot be used with opts.UUID and SMBIOS UUID or serial number")
+	}
+	if opts.Confidential != nil && opts.BIOS != "" {
+		return fmt.Errorf("opts.BIOS cannot be used with opts.Confidential, use its Firmware field instead")
+	}
+	x86 := opts.Architecture == "" || opts.Architecture == QEMU_X86_64 || opts.Architecture == QEMU_I386
+	if opts.NestedVirtualization && !x86 {
+		return fmt.Errorf("opts.NestedVirtualization is supported only for x86 architectures")
+	}
+	if opts.Confidential != nil && opts.Architecture != "" && opts.Architecture != QEMU_X86_64 {
+		return fmt.Errorf("opts.Confidential is supported only for %v architecture", QEMU_X86_64)
+	}
+	return nil
+}
+
+// Names of the QEMU sockets, with CHARDEV_UNIX transport they are created in the VM sockets directory
+const (
+	monitorSocket = "monitor.socket"
+	consoleSocket = "console.socket"
+	qmpSocket     = "qmp.socket"
+	agentSocket   = "agent.socket"
+	// coverageDir is a directory shared with the guest to collect its coverage data
+	coverageDir = "coverage"
+)
+
+// buildCmdline renders qemu command line arguments for the given options. QEMU connects to the monitor,
+// console and QMP sockets listed in addrs, the rest are unix sockets located at socketsDir.
+func buildCmdline(opts *QemuOptions, socketsDir string, addrs chardevAddrs) ([]string, error) {
+	if err := opts.checkCompatibility(); err != nil {
+		return nil, err
+	}
+
+	cmdline := []string{
+		"-monitor", addrs.backend(socketsDir, monitorSocket),
+		"-serial", addrs.backend(socketsDir, consoleSocket),
+		"-qmp", addrs.backend(socketsDir, qmpSocket),
+	}
+	if opts.Name != "" {
+		cmdline = append(cmdline, "-name", strings.ReplaceAll(opts.Name, ",", ",,"))
+	}
+	if opts.Ephemeral {
+		cmdline = append(cmdline, "-snapshot")
+	}
+	if !opts.AllowReboot {
+		cmdline = append(cmdline, "-no-reboot")
+	}
+	if opts.NoShutdown {
+		cmdline = append(cmdline, "-no-shutdown")
+	}
+	if opts.GuestAgent {
+		cmdline = append(cmdline,
+			"-chardev", "socket,id=qga0,"+addrs.socketParams(socketsDir, agentSocket),
+			"-device", "virtio-serial",
+			"-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+	}
+	if opts.GPU != nil && opts.GPU.Virgl {
+		// virgl renders the display using host GL, it needs a display backend with EGL context
+		cmdline = append(cmdline, "-display", "egl-headless")
+	} else {
+		cmdline = append(cmdline, "-nographic", "-display", "none")
+	}
+
+	if opts.Kernel != "" {
+		cmdline = append(cmdline, "-kernel", opts.Kernel)
+	}
+	if opts.InitRamFs != "" {
+		cmdline = append(cmdline, "-initrd", opts.InitRamFs)
+	}
+	if opts.DTB != "" {
+		if err := checkFileExists(opts.DTB); err != nil {
+			return nil, fmt.Errorf("opts.DTB: %v", err)
+		}
+		cmdline = append(cmdline, "-dtb", opts.DTB)
+	}
+	if opts.BIOS != "" {
+		if err := checkFileExists(opts.BIOS); err != nil {
+			return nil, fmt.Errorf("opts.BIOS: %v", err)
+		}
+		cmdline = append(cmdline, "-bios", opts.BIOS)
+	}
+
+	if opts.Clock != nil {
+		cmdline = append(cmdline, opts.Clock.params()...)
+	} else if opts.OperatingSystem == OS_WINDOWS {
+		cmdline = append(cmdline, "-rtc", "base=localtime")
+	}
+	kernelArgs := NewKernelCmdline(opts.Append...)
+	if opts.KernelMessageLevels && !kernelArgs.Has("console_msg_format") {
+		kernelArgs.Param("console_msg_format", "syslog")
+	}
+	if opts.CrashDump != nil && !kernelArgs.Has("crashkernel") {
+		kernelArgs.Param("crashkernel", opts.CrashDump.kernelParam())
+	}
+	if opts.Identity != nil && opts.Identity.Hostname != "" && opts.OperatingSystem == OS_LINUX && !kernelArgs.Has("systemd.hostname") {
+		kernelArgs.Param("systemd.hostname", opts.Identity.Hostname)
+	}
+	if opts.OperatingSystem == OS_LINUX && !opts.NoDefaultKernelArgs {
+		kernelArgs.applyLinuxDefaults(opts.KernelConsole, opts.KernelLogLevel)
+	}
+	if err := kernelArgs.Validate(); err != nil {
+		return nil, err
+	}
+	if len(kernelArgs.params) > 0 && opts.Kernel != "" {
+		cmdline = append(cmdline, "-append", kernelArgs.String())
+	}
+
+	if opts.Confidential != nil {
+		confidential, err := opts.Confidential.params(opts.Params)
+		if err != nil {
+			return nil, err
+		}
+		cmdline = append(cmdline, confidential...)
+	}
+
+	if opts.UUID != "" {
+		if !uuidRe.MatchString(opts.UUID) {
+			return nil, fmt.Errorf("invalid machine UUID %q", opts.UUID)
+		}
+		cmdline = append(cmdline, "-uuid", opts.UUID)
+	}
+	if opts.SMBIOS != nil {
+		smbios, err := opts.SMBIOS.param()
+		if err != nil {
+			return nil, err
+		}
+		if smbios != "" {
+			cmdline = append(cmdline, "-smbios", smbios)
+		}
+	}
+	if opts.Identity != nil {
+		identity, err := opts.Identity.params()
+		if err != nil {
+			return nil, err
+		}
+		cmdline = append(cmdline, identity...)
+	}
+
+	memoryOpts := opts.Memory
+	if len(opts.VhostUser) > 0 {
+		shared := QemuMemory{Size: defaultVhostUserMemory}
+		if memoryOpts != nil {
+			shared = *memoryOpts
+		}
+		shared.Shared = true
+		memoryOpts = &shared
+	}
+	if memoryOpts != nil {
+		memory, err := memoryOpts.params()
+		if err != nil {
+			return nil, err
+		}
+		cmdline = append(cmdline, memory...)
+	}
+	vhostUser, err := vhostUserParams(opts)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = append(cmdline, vhostUser...)
+	nics, err := nicsParams(opts)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = append(cmdline, nics...)
 
-			q.consolePumpMutex.Lock()
-			q.consoleData = append(q.consoleData, toPrint...)
-			q.consoleDataArrived = true
-			q.consolePumpMutex.Unlock()
+	if opts.Architecture == "x86_64" {
+		// cmdline = append(cmdline, "-device", "e1000,netdev=net0", "-netdev", "user,id=net0,hostfwd=tcp::5555-:22")
+	}
+	if opts.NestedVirtualization {
+		// opts.Confidential might have enabled KVM already
+		nested, err := nestedParams(append(cmdline[:len(cmdline):len(cmdline)], opts.Params...))
+		if err != nil {
+			return nil, err
 		}
+		cmdline = append(cmdline, nested...)
+	}
+	if len(opts.Params) > 0 {
+		cmdline = append(cmdline, opts.Params...)
+	}
+
+	boot, err := bootParam(opts)
+	if err != nil {
+		return nil, err
+	}
+	if boot != "" {
+		cmdline = append(cmdline, "-boot", boot)
+	}
+	if opts.CdRom != "" {
+		// the same drive as '-cdrom' creates, with an id ChangeCdrom() and EjectCdrom() find it by
+		cmdline = append(cmdline, "-drive", "file="+escapeParam(opts.CdRom)+",media=cdrom,index=2,id="+cdromDrive)
+	}
+	if opts.VirtioDrivers != "" {
+		drivers, err := virtioDriversParams(opts.VirtioDrivers)
+		if err != nil {
+			return nil, err
+		}
+		cmdline = append(cmdline, drivers...)
+	}
+	if opts.Floppy != "" {
+		cmdline = append(cmdline, "-drive", "if=floppy,index=0,format=raw,file="+escapeParam(opts.Floppy))
+	}
+	if opts.SDCard != "" {
+		cmdline = append(cmdline, "-drive", "if=sd,index=0,format=raw,file="+escapeParam(opts.SDCard))
+	}
+
+	disks, err := disksParams(opts, socketsDir)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = append(cmdline, disks...)
 
+	usb, err := usbParams(opts.USB)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = append(cmdline, usb...)
+	cmdline = append(cmdline, vfioParams(opts.PassthroughPCI)...)
+
+	input, err := inputParams(opts.Input)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = append(cmdline, input...)
+	if opts.Audio != nil {
+		cmdline = append(cmdline, opts.Audio.params()...)
+	}
+	if opts.GPU != nil {
+		cmdline = append(cmdline, opts.GPU.params()...)
+	}
+	if opts.Watchdog != nil {
+		cmdline = append(cmdline, opts.Watchdog.params()...)
+	}
+	shares := opts.Shares
+	if opts.Coverage != nil {
+		shares = append(shares[:len(shares):len(shares)], QemuShare{Path: path.Join(socketsDir, coverageDir), Tag: CoverageTag})
+	}
+	if opts.CrashDump != nil && opts.CrashDump.Dir != "" {
+		shares = append(shares[:len(shares):len(shares)], QemuShare{Path: opts.CrashDump.Dir, Tag: CrashDumpTag})
+	}
+	virtfs, err := sharesParams(shares)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = append(cmdline, virtfs...)
+	for _, t := range opts.ACPITables {
+		table, err := t.param()
 		if err != nil {
-			if err == io.EOF {
-				q.consoleDataEOF = true
-			} else {
-				log.Print(err)
+			return nil, err
+		}
+		cmdline = append(cmdline, "-acpitable", table)
+	}
+
+	return cmdline, nil
+}
+
+// DiskController is a storage controller the disks are attached to
+type DiskController string
+
+const (
+	// DISK_CONTROLLER_VIRTIO_SCSI_PCI is a virtio SCSI controller at PCI bus, disks default to 'scsi-hd' devices
+	DISK_CONTROLLER_VIRTIO_SCSI_PCI = DiskController("virtio-scsi-pci")
+	// DISK_CONTROLLER_VIRTIO_SCSI_DEVICE is a virtio-mmio SCSI controller for machines without PCI (e.g. microvm
+	// or ARM boards), disks default to 'scsi-hd' devices
+	DISK_CONTROLLER_VIRTIO_SCSI_DEVICE = DiskController("virtio-scsi-device")
+	// DISK_CONTROLLER_AHCI is an ICH9 SATA controller, disks default to 'ide-hd' devices
+	DISK_CONTROLLER_AHCI = DiskController("ahci")
+	// DISK_CONTROLLER_NONE adds no controller, every disk needs to specify a device that does not need one
+	// e.g. 'virtio-blk-pci', 'virtio-blk-device' or 'nvme,serial=1'
+	DISK_CONTROLLER_NONE = DiskController("none")
+)
+
+// ahciPorts is the number of SATA ports of the emulated ICH9 AHCI controller
+const ahciPorts = 6
+
+// disksParams renders '-drive' and '-device' parameters for opts.Disks. A controller is added only if
+// any of the disks devices needs its bus.
+func disksParams(opts *QemuOptions, socketsDir string) ([]string, error) {
+	controller := opts.DiskController
+	if controller == "" {
+		if opts.OperatingSystem == OS_WINDOWS {
+			controller = DISK_CONTROLLER_AHCI
+		} else {
+			controller = DISK_CONTROLLER_VIRTIO_SCSI_PCI
+		}
+	}
+
+	var defaultDevice, bus string
+	switch controller {
+	case DISK_CONTROLLER_VIRTIO_SCSI_PCI, DISK_CONTROLLER_VIRTIO_SCSI_DEVICE:
+		defaultDevice, bus = "scsi-hd", "scsi-"
+	case DISK_CONTROLLER_AHCI:
+		defaultDevice, bus = "ide-hd", "ide-"
+	case DISK_CONTROLLER_NONE:
+	default:
+		return nil, fmt.Errorf("unknown disk controller %q", controller)
+	}
+
+	var params []string
+	controllerNeeded := false
+	ahciPort := 0
+	for i, d := range opts.Disks {
+		format := ""
+		if d.Format != "" {
+			format = fmt.Sprintf("format=%s,", d.Format)
+		}
+		device := d.Controller
+		if device == "" {
+			if defaultDevice == "" {
+				return nil, fmt.Errorf("disk %v: Controller must be specified with DISK_CONTROLLER_NONE", d.Path)
 			}
-			return
+			device = defaultDevice
+		}
+		deviceParams := []string{device, fmt.Sprintf("drive=hd%v", i)}
+		if bus != "" && strings.HasPrefix(device, bus) {
+			controllerNeeded = true
+			if controller == DISK_CONTROLLER_AHCI {
+				if ahciPort == ahciPorts {
+					return nil, fmt.Errorf("AHCI controller supports up to %d disks", ahciPorts)
+				}
+				deviceParams = append(deviceParams, fmt.Sprintf("bus=ahci.%d", ahciPort))
+				ahciPort++
+			}
+		}
+		if d.BootIndex != 0 {
+			deviceParams = append(deviceParams, fmt.Sprintf("bootindex=%d", d.BootIndex))
 		}
+		if d.Shared {
+			deviceParams = append(deviceParams, "share-rw=on")
+		}
+		deviceParams = append(deviceParams, d.DeviceParams...)
+		file := d.Path
+		if len(d.FaultInjection) > 0 {
+			if _, err := renderFaultRules(d.FaultInjection); err != nil {
+				return nil, fmt.Errorf("disk %v: %v", d.Path, err)
+			}
+			// the rules file is written by NewQemu
+			file = fmt.Sprintf("blkdebug:%v:%v", blkdebugConfig(socketsDir, i), d.Path)
+		}
+		drive := format + fmt.Sprintf("if=none,id=hd%d,file=%s", i, file)
+		if d.Snapshot {
+			drive += ",snapshot=on"
+		}
+		if d.Shared {
+			drive += ",file.locking=off"
+		}
+		if d.Throttle != nil {
+			if tp := d.Throttle.params(); len(tp) > 0 {
+				drive += "," + strings.Join(tp, ",")
+			}
+		}
+		params = append(params, "-drive", drive, "-device", strings.Join(deviceParams, ","))
+	}
+
+	if !controllerNeeded {
+		return params, nil
+	}
+	id := "scsi"
+	if controller == DISK_CONTROLLER_AHCI {
+		id = "ahci"
+	}
+	return append([]string{"-device", fmt.Sprintf("%v,id=%v", controller, id)}, params...), nil
+}
+
+// checkFileExists verifies that path points to a regular file
+func checkFileExists(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("%v is a directory", path)
+	}
+	return nil
+}
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// escapeParam escapes an option value so it can be used inside a comma-separated qemu parameter
+func escapeParam(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// param renders the value of '-smbios type=1,...' parameter
+func (s *QemuSMBIOS) param() (string, error) {
+	if s.UUID != "" && !uuidRe.MatchString(s.UUID) {
+		return "", fmt.Errorf("invalid SMBIOS UUID %q", s.UUID)
+	}
+
+	fields := []struct{ key, value string }{
+		{"manufacturer", s.Manufacturer},
+		{"product", s.Product},
+		{"version", s.Version},
+		{"serial", s.Serial},
+		{"uuid", s.UUID},
+		{"sku", s.SKU},
+		{"family", s.Family},
+	}
+	var params []string
+	for _, f := range fields {
+		if f.value != "" {
+			params = append(params, f.key+"="+escapeParam(f.value))
+		}
+	}
+	if len(params) == 0 {
+		return "", nil
+	}
+	return "type=1," + strings.Join(params, ","), nil
+}
+
+// bootParam renders the value of '-boot' parameter
+func bootParam(opts *QemuOptions) (string, error) {
+	order := opts.BootOrder
+	if order == "" && opts.CdRom != "" {
+		order = "d"
+	}
+	for _, c := range order {
+		if !strings.ContainsRune("acdn", c) {
+			return "", fmt.Errorf("invalid boot device %q in opts.BootOrder", c)
+		}
+	}
 
-		if num == 0 {
-			time.Sleep(50 * time.Millisecond)
+	var params []string
+	if order != "" {
+		params = append(params, "order="+order)
+	}
+	if opts.BootMenu {
+		params = append(params, "menu=on")
+	}
+	return strings.Join(params, ","), nil
+}
+
+const memoryBackendID = "mem0"
+
+// params renders '-m' and memory backend parameters
+func (m *QemuMemory) params() ([]string, error) {
+	if m.Size == "" {
+		return nil, fmt.Errorf("memory size is not specified")
+	}
+	params := []string{"-m", m.Size}
+
+	path := m.Path
+	if path == "" {
+		switch {
+		case m.Hugepages:
+			path = "/dev/hugepages"
+		case m.Shared:
+			path = "/dev/shm"
+		default:
+			// regular anonymous memory, no backend needed
+			return params, nil
 		}
 	}
+	if _, err := os.Stat(path); m.Hugepages && err != nil {
+		return nil, fmt.Errorf("hugepages: %v", err)
+	}
 
+	backend := []string{
+		"memory-backend-file",
+		"id=" + memoryBackendID,
+		"size=" + m.Size,
+		"mem-path=" + escapeParam(path),
+	}
+	if m.Shared {
+		backend = append(backend, "share=on")
+	}
+	if m.Prealloc {
+		backend = append(backend, "prealloc=on")
+	}
+	params = append(params,
+		"-object", strings.Join(backend, ","),
+		"-numa", "node,memdev="+memoryBackendID)
+	return params, nil
 }
 
 func (q *Qemu) wait() {
 	if err := <-q.waitCh; err != nil {
 		log.Printf("Got error while waiting for Qemu process completion: %v", err)
 	}
+	if q.exitHooksDone != nil {
+		<-q.exitHooksDone
+	}
+	q.stopped = true
 	q.ctxCancel()
 
-	_ = q.console.Close()
+	_ = q.console.conn.Close()
 	_ = q.consoleListener.Close()
 	_ = q.monitor.Close()
 	_ = q.monitorListener.Close()
+	_ = q.qmpConn.Close()
+	_ = q.qmpListener.Close()
+	if q.agent != nil {
+		_ = q.agent.conn.Close()
+		_ = q.agentListener.Close()
+	}
+	q.goroutines.Wait()
+	if q.coverageShare != "" {
+		if err := collectCoverage(q.coverageShare, q.coverageOutput); err != nil {
+			log.Printf("Cannot collect guest coverage: %v", err)
+		}
+	}
+	if q.consoleSpill != nil {
+		_ = q.consoleSpill.Close()
+	}
 	if err := os.RemoveAll(q.socketsDir); err != nil {
 		log.Printf("Cannot remove temporary dir %v: %v", q.socketsDir, err)
 	}
 }
 
+// PID returns the process id of the qemu emulator, e.g. to attach perf, strace or bpftrace to it.
+// With QemuOptions.Wrapper it is the process id of the wrapper.
+func (q *Qemu) PID() int {
+	return q.cmd.Process.Pid
+}
+
+// Cmdline returns the command line the qemu process was started with, the first element is the binary.
+// It can be logged to reproduce the VM outside of the test.
+func (q *Qemu) Cmdline() []string {
+	return append([]string{q.binary}, q.cmdline...)
+}
+
+// StartTime returns the time the qemu process was started at
+func (q *Qemu) StartTime() time.Time {
+	return q.startTime
+}
+
 // Kill shuts down the vm using qemu's 'kill' command
 func (q *Qemu) Kill() {
 	if _, err := q.monitor.Write([]byte("quit\n")); err != nil {
@@ -361,106 +1458,172 @@ func (q *Qemu) Kill() {
 	q.wait()
 }
 
-// Shutdown shuts down the vm using qemu's 'system_powerdown' command
+// Shutdown shuts down the vm using qemu's 'system_powerdown' command. OS_WINDOWS guests are shut down
+// with the guest agent if it is enabled. The vm is killed if the guest does not power off within
+// QemuStopPolicy.ACPI timeout, by default it waits till QemuOptions.Timeout.
 func (q *Qemu) Shutdown() {
-	if _, err := q.monitor.Write([]byte("system_powerdown\n")); err != nil {
-		log.Printf("monitor: %v", err)
+	timeout := q.stopPolicy.ACPI
+	if timeout == 0 {
+		timeout = time.Until(q.deadline)
+	}
+	if _, err := q.ShutdownWait(timeout); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+}
+
+// ShutdownWait requests the guest to power off like Shutdown does and waits for QMP SHUTDOWN event up to timeout.
+// With QemuOptions.NoShutdown qemu is quit after the event. It reports whether the guest powered off by itself.
+// If the event does not arrive then the vm is killed and an error is returned, e.g. when the guest ignores
+// the request or qemu is reaped by QemuOptions.Timeout.
+func (q *Qemu) ShutdownWait(timeout time.Duration) (bool, error) {
+	cursor := q.qmp.eventCursor()
+	if err := q.requestShutdown(); err != nil {
+		q.Kill()
+		return false, err
+	}
+	ev, _, err := q.qmp.waitEvent(cursor, timeout, "SHUTDOWN")
+	if err != nil {
+		q.Kill()
+		return false, err
+	}
+	if q.noShutdown {
+		// qemu keeps running with the powered off VM, it might exit before the reply is sent
+		_, _ = q.qmp.execute("quit", nil)
 	}
 	q.wait()
+
+	var shutdown struct {
+		Guest bool `json:"guest"`
+	}
+	if err := json.Unmarshal(ev.Data, &shutdown); err != nil {
+		return false, fmt.Errorf("qmp: SHUTDOWN event: %v", err)
+	}
+	return shutdown.Guest, nil
 }
 
-// LineProcessor accepts byte array as input data. It returns whether processing has matched the input line
-// and thus processing need to be stopped.
-type LineProcessor func(data []byte) bool
+func (q *Qemu) requestShutdown() error {
+	if q.operatingSystem == OS_WINDOWS && q.agent != nil {
+		// guest-shutdown does not reply on success
+		_, err := q.agent.execute("guest-shutdown", nil, false)
+		if err == nil {
+			return nil
+		}
+		log.Printf("guest agent shutdown: %v", err)
+	}
+	_, err := q.monitor.Write([]byte("system_powerdown\n"))
+	return err
+}
 
 // ConsoleExpect waits until qemu console matches str
 func (q *Qemu) ConsoleExpect(str string) error {
-	match := []byte(str)
-	p := func(data []byte) bool {
-		return bytes.Contains(data, match)
-	}
-	return q.consoleProcess(p)
+	return q.reportError(q.console.expect(str))
+}
+
+// ConsoleStats returns the console output volume and rates
+func (q *Qemu) ConsoleStats() ConsoleStats {
+	return q.console.getStats()
+}
+
+// ConsoleContains reports whether str is in the console output retained for expectations, it does not block
+// and does not consume the output
+func (q *Qemu) ConsoleContains(str string) bool {
+	return q.console.contains(str)
 }
 
 // ConsoleExpectRE waits until qemu console matches regexp provided by re
 // returns array of matched strings
 func (q *Qemu) ConsoleExpectRE(re *regexp.Regexp) ([]string, error) {
-	var matches []string
-	p := func(data []byte) bool {
-		m := re.FindAllSubmatch(data, -1)
-		if m == nil {
-			return false
-		}
-		for _, s := range m {
-			matches = append(matches, string(s[1]))
+	m, err := q.console.expectRE(re)
+	return m, q.reportError(err)
+}
+
+// ConsoleExpectMatch waits until qemu console matches str and returns the matched line with its context.
+// If the console is closed before then *ConsoleExpectError with the lines seen is returned,
+// it is wrapped into *QemuError with the VM environment report.
+func (q *Qemu) ConsoleExpectMatch(str string) (*ConsoleMatch, error) {
+	match := []byte(str)
+	m, err := q.console.expectMatch(str, func(line []byte) []int {
+		idx := bytes.Index(line, match)
+		if idx == -1 {
+			return nil
 		}
-		return true
-	}
-	err := q.consoleProcess(p)
+		return []int{idx, idx + len(match)}
+	})
+	return m, q.reportError(err)
+}
+
+// ConsoleExpectREMatch waits until qemu console matches regexp provided by re and returns the matched line
+// with its submatches and context. If the console is closed before then *ConsoleExpectError with the lines
+// seen is returned, it is wrapped into *QemuError with the VM environment report.
+func (q *Qemu) ConsoleExpectREMatch(re *regexp.Regexp) (*ConsoleMatch, error) {
+	m, err := q.console.expectMatch(re.String(), re.FindSubmatchIndex)
+	return m, q.reportError(err)
+}
+
+// ConsoleCollectUntil returns every console line observed from the call till the line matching re, the matching
+// line is the last element. It allows to assert on the whole output of a guest command, not just its terminator.
+func (q *Qemu) ConsoleCollectUntil(re *regexp.Regexp) ([]string, error) {
+	m, err := q.ConsoleExpectREMatch(re)
 	if err != nil {
 		return nil, err
 	}
+	return append(m.Before, m.Line), nil
+}
 
-	return matches, nil
-}
-
-func (q *Qemu) consoleProcess(processor LineProcessor) error {
-	var buf []byte
-	for {
-		q.consolePumpMutex.Lock()
-		buf = append(buf, q.consoleData...)
-		newDataArrived := q.consoleDataArrived
-		consoleDataEOF := q.consoleDataEOF
-		q.consoleData = nil
-		q.consoleDataArrived = false
-		q.consolePumpMutex.Unlock()
-
-		if newDataArrived {
-			for {
-				var newLine bool
-
-				idx := bytes.IndexByte(buf, '\n')
-				if idx == -1 {
-					// In some cases we want to check str on lines without '\n'.
-					// For example when the process prints "Please enter the password: '
-					idx = len(buf)
-				} else {
-					idx++ // remove trailing \n
-					newLine = true
-				}
-				toProcess := buf[:idx]
-				if newLine {
-					buf = buf[idx:]
-				}
+// ConsoleExpectCount waits until at least n console lines match re. It fails if they do not arrive within the given
+// time, e.g. to verify that all CPUs were brought up or a retry loop made the expected number of attempts.
+func (q *Qemu) ConsoleExpectCount(re *regexp.Regexp, n int, within time.Duration) error {
+	count, err := q.console.countMatches(re, n, time.Now().Add(within), false)
+	if err == ErrConsoleTimeout {
+		err = fmt.Errorf("%q matched %d lines within %v, expected at least %d: %w", re, count, within, n, err)
+	}
+	return q.reportError(err)
+}
 
-				matched := processor(toProcess)
+// ConsoleExpectExactCount checks that exactly n console lines match re within the given time.
+// It always consumes the console output for the whole time window.
+func (q *Qemu) ConsoleExpectExactCount(re *regexp.Regexp, n int, within time.Duration) error {
+	count, err := q.console.countMatches(re, n, time.Now().Add(within), true)
+	if err != nil && err != ErrConsoleTimeout {
+		return q.reportError(err)
+	}
+	if count != n {
+		return q.reportError(fmt.Errorf("%q matched %d lines within %v, expected %d", re, count, within, n))
+	}
+	return nil
+}
 
-				if matched {
-					// add non-processed data back to the pump
-					q.consolePumpMutex.Lock()
-					q.consoleData = append(buf, q.consoleData...)
-					q.consoleDataArrived = true
-					q.consolePumpMutex.Unlock()
+// ConsoleProcess feeds the console output to processor line by line till it returns true. The lines include
+// trailing '\n' except the line that is being printed (e.g. a prompt). The processed lines are consumed, so
+// it can be used to implement custom matchers, counters and log scrapers on top of the console.
+func (q *Qemu) ConsoleProcess(processor LineProcessor) error {
+	return q.console.process(processor)
+}
 
-					return nil
-				}
+// ConsoleProcessTimed is ConsoleProcess with the processor receiving the time the line arrived at
+func (q *Qemu) ConsoleProcessTimed(processor TimedLineProcessor) error {
+	return q.console.processTimed(processor)
+}
 
-				if !newLine {
-					break
-				}
-			}
-		} else if consoleDataEOF {
-			return io.EOF
-		} else {
-			// QEMU did not fill the buffer completely. In this case let's sleep a bit and give QEMU
-			// a chance to do some work.
-			time.Sleep(50 * time.Millisecond)
-		}
-	}
+// ConsoleDiscarded returns the number of console output bytes dropped because of QemuOptions.ConsoleScrollback limit
+func (q *Qemu) ConsoleDiscarded() int64 {
+	return q.console.discardedBytes()
 }
 
 // ConsoleWrite writes given string to qemu console
 func (q *Qemu) ConsoleWrite(str string) error {
-	_, err := q.console.Write([]byte(str))
+	return q.console.write(str)
+}
+
+// ConsoleWriteBytes writes binary data to qemu console
+func (q *Qemu) ConsoleWriteBytes(data []byte) error {
+	_, err := q.console.conn.Write(data)
 	return err
 }
+
+// ConsoleReader returns a reader of the console output that is not consumed by expectations yet.
+// Reads block till the data arrives and return io.EOF once the VM is stopped. Unless QemuOptions.ConsoleRaw is set
+// the reader returns completed lines as rendered by the terminal emulator.
+func (q *Qemu) ConsoleReader() io.Reader {
+	return q.console
+}
@@ -0,0 +1,83 @@
+package vmtest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// QemuACPITable is an ACPI table injected into the guest firmware tables ('-acpitable' qemu param)
+type QemuACPITable struct {
+	// File is a path to the complete table including its header
+	File string
+	// Data is a path to the table body, the header is generated from the fields below
+	Data string
+	// Signature of the table e.g. 'SSDT', up to 4 characters
+	Signature string
+	// Revision of the table
+	Revision uint8
+	// OEMID is an OEM identifier, up to 6 characters
+	OEMID string
+	// OEMTableID is an OEM table identifier, up to 8 characters
+	OEMTableID string
+	// OEMRevision is an OEM revision number
+	OEMRevision uint32
+	// ASLCompilerID is an identifier of the compiler that built the table, up to 4 characters
+	ASLCompilerID string
+	// ASLCompilerRevision is a revision of the compiler that built the table
+	ASLCompilerRevision uint32
+}
+
+func (a *QemuACPITable) param() (string, error) {
+	if (a.File == "") == (a.Data == "") {
+		return "", fmt.Errorf("acpi table: exactly one of File and Data must be specified")
+	}
+	if a.File != "" {
+		if err := checkFileExists(a.File); err != nil {
+			return "", fmt.Errorf("acpi table: %v", err)
+		}
+		return "file=" + escapeParam(a.File), nil
+	}
+	if err := checkFileExists(a.Data); err != nil {
+		return "", fmt.Errorf("acpi table: %v", err)
+	}
+
+	lengths := []struct {
+		name, value string
+		max         int
+	}{
+		{"signature", a.Signature, 4},
+		{"OEM id", a.OEMID, 6},
+		{"OEM table id", a.OEMTableID, 8},
+		{"ASL compiler id", a.ASLCompilerID, 4},
+	}
+	for _, l := range lengths {
+		if len(l.value) > l.max {
+			return "", fmt.Errorf("acpi table: %v %q is longer than %d characters", l.name, l.value, l.max)
+		}
+	}
+
+	var params []string
+	if a.Signature != "" {
+		params = append(params, "sig="+a.Signature)
+	}
+	if a.Revision != 0 {
+		params = append(params, fmt.Sprintf("rev=%d", a.Revision))
+	}
+	if a.OEMID != "" {
+		params = append(params, "oem_id="+escapeParam(a.OEMID))
+	}
+	if a.OEMTableID != "" {
+		params = append(params, "oem_table_id="+escapeParam(a.OEMTableID))
+	}
+	if a.OEMRevision != 0 {
+		params = append(params, fmt.Sprintf("oem_rev=%d", a.OEMRevision))
+	}
+	if a.ASLCompilerID != "" {
+		params = append(params, "asl_compiler_id="+escapeParam(a.ASLCompilerID))
+	}
+	if a.ASLCompilerRevision != 0 {
+		params = append(params, fmt.Sprintf("asl_compiler_rev=%d", a.ASLCompilerRevision))
+	}
+	params = append(params, "data="+escapeParam(a.Data))
+	return strings.Join(params, ","), nil
+}
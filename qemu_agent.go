@@ -0,0 +1,241 @@
+package vmtest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// guestAgentTimeout limits time spent waiting for a guest agent response
+	guestAgentTimeout = 30 * time.Second
+	// guestExecPollInterval is the pause between the status checks of a program run by GuestExec()
+	guestExecPollInterval = 100 * time.Millisecond
+)
+
+// guestAgent talks to QEMU guest agent (qemu-ga) running inside the VM over a virtio-serial port
+type guestAgent struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	mutex  sync.Mutex
+}
+
+func newGuestAgent(conn net.Conn) *guestAgent {
+	return &guestAgent{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (a *guestAgent) send(command string, args interface{}) error {
+	data, err := json.Marshal(qmpCommand{Execute: command, Arguments: args})
+	if err != nil {
+		return err
+	}
+	_, err = a.conn.Write(append(data, '\n'))
+	return err
+}
+
+// sync flushes responses left from previous (e.g. timed out) commands. The agent echoes the random id back
+// and every message received before it is discarded.
+func (a *guestAgent) sync() error {
+	id := rand.Int63n(1 << 31)
+	if err := a.send("guest-sync", map[string]int64{"id": id}); err != nil {
+		return err
+	}
+	for {
+		line, err := a.reader.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var msg struct {
+			Return int64 `json:"return"`
+		}
+		if json.Unmarshal(line, &msg) == nil && msg.Return == id {
+			return nil
+		}
+	}
+}
+
+// execute sends the command to the guest agent. If wantReply is false then the command response is not awaited,
+// it is used for commands like 'guest-suspend-ram' or 'guest-shutdown' that do not reply on success.
+func (a *guestAgent) execute(command string, args interface{}, wantReply bool) (json.RawMessage, error) {
+	return a.executeTimeout(command, args, wantReply, guestAgentTimeout)
+}
+
+// executeTimeout is execute() waiting for the agent up to the timeout
+func (a *guestAgent) executeTimeout(command string, args interface{}, wantReply bool, timeout time.Duration) (json.RawMessage, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if err := a.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	defer a.conn.SetDeadline(time.Time{})
+
+	if err := a.sync(); err != nil {
+		return nil, fmt.Errorf("guest agent is not responding: %v", err)
+	}
+	if err := a.send(command, args); err != nil {
+		return nil, fmt.Errorf("guest agent %v: %v", command, err)
+	}
+	if !wantReply {
+		return nil, nil
+	}
+
+	line, err := a.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("guest agent %v: %v", command, err)
+	}
+	var resp qmpMessage
+	if err := json.Unmarshal(line, &resp); err != nil {
+		return nil, fmt.Errorf("guest agent %v: %v", command, err)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Return, nil
+}
+
+// GuestAgent executes QEMU guest agent command with given arguments and returns its raw JSON result.
+// It requires QemuOptions.GuestAgent enabled and qemu-ga running inside the VM.
+// See https://qemu.readthedocs.io/en/latest/interop/qemu-ga-ref.html for the list of commands.
+func (q *Qemu) GuestAgent(command string, args interface{}) (json.RawMessage, error) {
+	if q.agent == nil {
+		return nil, fmt.Errorf("guest agent is not enabled, see QemuOptions.GuestAgent")
+	}
+	return q.agent.execute(command, args, true)
+}
+
+// GuestExecResult is a result of a process executed by the guest agent
+type GuestExecResult struct {
+	ExitCode int
+	Stdout   []byte
+	Stderr   []byte
+}
+
+// GuestExec runs the program inside the VM using the guest agent, waits for its completion and returns its output.
+// It waits as long as the VM runs, see GuestExecContext() to limit the time.
+func (q *Qemu) GuestExec(path string, args ...string) (*GuestExecResult, error) {
+	return q.GuestExecContext(context.Background(), path, args...)
+}
+
+// GuestExecContext is GuestExec that stops waiting for the program once ctx is done. The program is not killed.
+func (q *Qemu) GuestExecContext(ctx context.Context, path string, args ...string) (*GuestExecResult, error) {
+	resp, err := q.GuestAgent("guest-exec", map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var exec struct {
+		PID int `json:"pid"`
+	}
+	if err := json.Unmarshal(resp, &exec); err != nil {
+		return nil, fmt.Errorf("guest-exec: %v", err)
+	}
+
+	for {
+		resp, err := q.GuestAgent("guest-exec-status", map[string]int{"pid": exec.PID})
+		if err != nil {
+			return nil, err
+		}
+		var status struct {
+			Exited   bool   `json:"exited"`
+			ExitCode int    `json:"exitcode"`
+			Signal   int    `json:"signal"`
+			OutData  []byte `json:"out-data"` // base64 encoded
+			ErrData  []byte `json:"err-data"`
+		}
+		if err := json.Unmarshal(resp, &status); err != nil {
+			return nil, fmt.Errorf("guest-exec-status: %v", err)
+		}
+		if status.Exited {
+			exitCode := status.ExitCode
+			if status.Signal != 0 {
+				exitCode = 128 + status.Signal
+			}
+			return &GuestExecResult{ExitCode: exitCode, Stdout: status.OutData, Stderr: status.ErrData}, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("guest-exec %v: %w", path, ctx.Err())
+		case <-time.After(guestExecPollInterval):
+		}
+	}
+}
+
+// guestFileChunk is the size of data transferred with a single guest-file-read/guest-file-write command
+const guestFileChunk = 64 * 1024
+
+// guestFileOpen opens the file inside the VM and returns its guest agent handle
+func (q *Qemu) guestFileOpen(path, mode string) (int, error) {
+	resp, err := q.GuestAgent("guest-file-open", map[string]string{"path": path, "mode": mode})
+	if err != nil {
+		return 0, err
+	}
+	var handle int
+	if err := json.Unmarshal(resp, &handle); err != nil {
+		return 0, fmt.Errorf("guest-file-open: %v", err)
+	}
+	return handle, nil
+}
+
+func (q *Qemu) guestFileClose(handle int) error {
+	_, err := q.GuestAgent("guest-file-close", map[string]int{"handle": handle})
+	return err
+}
+
+// GuestWriteFile copies data to the file inside the VM using the guest agent, the file is truncated if it exists
+func (q *Qemu) GuestWriteFile(path string, data []byte) error {
+	handle, err := q.guestFileOpen(path, "wb")
+	if err != nil {
+		return err
+	}
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > guestFileChunk {
+			chunk = chunk[:guestFileChunk]
+		}
+		// []byte is marshaled as base64 string
+		if _, err := q.GuestAgent("guest-file-write", map[string]interface{}{"handle": handle, "buf-b64": chunk}); err != nil {
+			_ = q.guestFileClose(handle)
+			return err
+		}
+		data = data[len(chunk):]
+	}
+	return q.guestFileClose(handle)
+}
+
+// GuestReadFile reads the file inside the VM using the guest agent
+func (q *Qemu) GuestReadFile(path string) ([]byte, error) {
+	handle, err := q.guestFileOpen(path, "rb")
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	for {
+		resp, err := q.GuestAgent("guest-file-read", map[string]int{"handle": handle, "count": guestFileChunk})
+		if err != nil {
+			_ = q.guestFileClose(handle)
+			return nil, err
+		}
+		var read struct {
+			Buf []byte `json:"buf-b64"`
+			EOF bool   `json:"eof"`
+		}
+		if err := json.Unmarshal(resp, &read); err != nil {
+			_ = q.guestFileClose(handle)
+			return nil, fmt.Errorf("guest-file-read: %v", err)
+		}
+		data = append(data, read.Buf...)
+		if read.EOF || len(read.Buf) == 0 {
+			break
+		}
+	}
+	return data, q.guestFileClose(handle)
+}
@@ -0,0 +1,164 @@
+package vmtest
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeGuestAgent emulates qemu-ga over conn, guest-sync is handled by the fake. The other commands are replied
+// with the result of reply(command, arguments) unless it is nil.
+func fakeGuestAgent(conn net.Conn, reply func(cmd string, args json.RawMessage) interface{}) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var cmd struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &cmd) != nil {
+			return
+		}
+		var result interface{}
+		if cmd.Execute == "guest-sync" {
+			var args struct {
+				ID int64 `json:"id"`
+			}
+			_ = json.Unmarshal(cmd.Arguments, &args)
+			result = args.ID
+		} else {
+			result = reply(cmd.Execute, cmd.Arguments)
+		}
+		if result == nil {
+			continue
+		}
+		resp, _ := json.Marshal(map[string]interface{}{"return": result})
+		if _, err := fmt.Fprintf(conn, "%s\n", resp); err != nil {
+			return
+		}
+	}
+}
+
+// fakeGuestFiles emulates qemu-ga file commands over conn, the files content is kept in files map
+func fakeGuestFiles(conn net.Conn, files map[string][]byte) {
+	var (
+		openPath string
+		offset   int
+	)
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var cmd struct {
+			Execute   string `json:"execute"`
+			Arguments struct {
+				ID    int64  `json:"id"`
+				Path  string `json:"path"`
+				Mode  string `json:"mode"`
+				Buf   []byte `json:"buf-b64"`
+				Count int    `json:"count"`
+			} `json:"arguments"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &cmd) != nil {
+			return
+		}
+		args := cmd.Arguments
+		var reply interface{}
+		switch cmd.Execute {
+		case "guest-sync":
+			reply = args.ID
+		case "guest-file-open":
+			openPath, offset = args.Path, 0
+			if args.Mode == "wb" {
+				files[openPath] = nil
+			}
+			reply = 1
+		case "guest-file-write":
+			files[openPath] = append(files[openPath], args.Buf...)
+			reply = map[string]interface{}{"count": len(args.Buf), "eof": false}
+		case "guest-file-read":
+			data := files[openPath][offset:]
+			if len(data) > args.Count {
+				data = data[:args.Count]
+			}
+			offset += len(data)
+			reply = map[string]interface{}{"count": len(data), "buf-b64": data, "eof": offset == len(files[openPath])}
+		case "guest-file-close":
+			reply = map[string]interface{}{}
+		}
+		resp, _ := json.Marshal(map[string]interface{}{"return": reply})
+		if _, err := fmt.Fprintf(conn, "%s\n", resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestGuestFileTransfer(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	files := map[string][]byte{}
+	go fakeGuestFiles(server, files)
+
+	q := &Qemu{agent: newGuestAgent(client)}
+	data := bytes.Repeat([]byte("0123456789"), guestFileChunk/5) // spans several chunks
+	require.NoError(t, q.GuestWriteFile(`C:\test.bin`, data))
+
+	got, err := q.GuestReadFile(`C:\test.bin`)
+	require.NoError(t, err)
+	require.Equal(t, data, got)
+}
+
+// fakeGuestExec emulates qemu-ga guest-exec commands over conn. The program is reported as exited once
+// run(path, args) returns true for its status poll, with the given exit code and output.
+func fakeGuestExec(conn net.Conn, run func(path string, args []string) (exited bool, code int, out string)) {
+	var (
+		path string
+		args []string
+	)
+	fakeGuestAgent(conn, func(cmd string, raw json.RawMessage) interface{} {
+		switch cmd {
+		case "guest-exec":
+			var exec struct {
+				Path string   `json:"path"`
+				Arg  []string `json:"arg"`
+			}
+			_ = json.Unmarshal(raw, &exec)
+			path, args = exec.Path, exec.Arg
+			return map[string]int{"pid": 42}
+		case "guest-exec-status":
+			exited, code, out := run(path, args)
+			return map[string]interface{}{"exited": exited, "exitcode": code, "out-data": []byte(out)}
+		}
+		return map[string]interface{}{}
+	})
+}
+
+func TestGuestExec(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	polls := 0
+	go fakeGuestExec(server, func(path string, args []string) (bool, int, string) {
+		polls++
+		if args[0] == "hang" {
+			return false, 0, ""
+		}
+		return polls == 3, 7, path + " " + args[0] + "\n"
+	})
+	q := &Qemu{agent: newGuestAgent(client)}
+
+	res, err := q.GuestExec("/bin/echo", "hello")
+	require.NoError(t, err)
+	require.Equal(t, 7, res.ExitCode)
+	require.Equal(t, "/bin/echo hello\n", string(res.Stdout))
+	require.Equal(t, 3, polls)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	_, err = q.GuestExecContext(ctx, "/bin/sleep", "hang")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,72 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// QemuFaultRule is a blkdebug 'inject-error' rule that fails the disk requests, e.g. to test filesystem and RAID
+// error paths. See https://qemu-project.gitlab.io/qemu/devel/blkdebug.html
+type QemuFaultRule struct {
+	// Event is the block layer event that triggers the error, e.g. 'read_aio', 'write_aio' or 'flush_to_disk'
+	Event string
+	// Errno is the error returned to the guest, default is 5 (EIO)
+	Errno int
+	// Sector limits the rule to the requests touching this sector, nil means any sector
+	Sector *int64
+	// Once removes the rule after the first injected error
+	Once bool
+	// Immediately fails the request before it is submitted to the image
+	Immediately bool
+}
+
+// blkdebugConfig returns the path of the generated rules file of the i-th disk
+func blkdebugConfig(socketsDir string, i int) string {
+	return path.Join(socketsDir, fmt.Sprintf("blkdebug%d.conf", i))
+}
+
+// renderFaultRules renders the blkdebug rules file
+func renderFaultRules(rules []QemuFaultRule) (string, error) {
+	var sb strings.Builder
+	for _, r := range rules {
+		if r.Event == "" {
+			return "", fmt.Errorf("blkdebug rule event is not specified")
+		}
+		errno := r.Errno
+		if errno == 0 {
+			errno = 5 // EIO
+		}
+		fmt.Fprintf(&sb, "[inject-error]\nevent = \"%v\"\nerrno = \"%d\"\n", r.Event, errno)
+		if r.Sector != nil {
+			fmt.Fprintf(&sb, "sector = \"%d\"\n", *r.Sector)
+		}
+		fmt.Fprintf(&sb, "once = \"%v\"\nimmediately = \"%v\"\n\n", onOff(r.Once), onOff(r.Immediately))
+	}
+	return sb.String(), nil
+}
+
+// writeFaultRules writes blkdebug rules files of the disks with fault injection to socketsDir
+func writeFaultRules(opts *QemuOptions, socketsDir string) error {
+	for i, d := range opts.Disks {
+		if len(d.FaultInjection) == 0 {
+			continue
+		}
+		config, err := renderFaultRules(d.FaultInjection)
+		if err != nil {
+			return fmt.Errorf("disk %v: %v", d.Path, err)
+		}
+		if err := os.WriteFile(blkdebugConfig(socketsDir, i), []byte(config), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func onOff(v bool) string {
+	if v {
+		return "on"
+	}
+	return "off"
+}
@@ -0,0 +1,206 @@
+package vmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// cdromDrive is the drive id of QemuOptions.CdRom
+const cdromDrive = "cd0"
+
+// cdromDevice finds the guest device (its qdev id or QOM path) the VM CD-ROM drive is attached to.
+// QMP block commands address the media by the guest device, the drive name argument is deprecated.
+func (q *Qemu) cdromDevice() (string, error) {
+	devices, err := q.BlockInfo()
+	if err != nil {
+		return "", err
+	}
+	for _, d := range devices {
+		if d.Device != cdromDrive {
+			continue
+		}
+		if d.QDev == "" {
+			return "", fmt.Errorf("CD-ROM drive %v is not attached to a guest device", cdromDrive)
+		}
+		return d.QDev, nil
+	}
+	return "", fmt.Errorf("the VM has no CD-ROM drive, use QemuOptions.CdRom to attach one")
+}
+
+// ChangeCdrom inserts the ISO image at path into the VM CD-ROM drive, replacing the current media.
+func (q *Qemu) ChangeCdrom(path string) error {
+	device, err := q.cdromDevice()
+	if err != nil {
+		return err
+	}
+	_, err = q.QMP("blockdev-change-medium", map[string]string{
+		"id":       device,
+		"filename": path,
+		"format":   "raw",
+	})
+	return err
+}
+
+// EjectCdrom removes the media from the VM CD-ROM drive
+func (q *Qemu) EjectCdrom() error {
+	device, err := q.cdromDevice()
+	if err != nil {
+		return err
+	}
+	_, err = q.QMP("eject", map[string]interface{}{
+		"id":    device,
+		"force": true,
+	})
+	return err
+}
+
+// QemuBlockJob is a block job (mirror, commit or backup) running against a live VM disk
+type QemuBlockJob struct {
+	q *Qemu
+	// ID is the QMP job id
+	ID string
+	// cursor is the events history position at the job start, so the job events are never missed
+	cursor int
+}
+
+// BlockJobInfo is the job progress reported by QMP query-block-jobs
+type BlockJobInfo struct {
+	ID     string `json:"device"`
+	Type   string `json:"type"`
+	Len    int64  `json:"len"`
+	Offset int64  `json:"offset"`
+	Ready  bool   `json:"ready"`
+	Status string `json:"status"`
+}
+
+// blockJobEvent is the data of BLOCK_JOB_* QMP events
+type blockJobEvent struct {
+	Device string `json:"device"`
+	Error  string `json:"error"`
+}
+
+// diskDrive returns the drive id of the i-th QemuOptions.Disks entry
+func diskDrive(disk int) string {
+	return fmt.Sprintf("hd%d", disk)
+}
+
+func (q *Qemu) startBlockJob(command, id string, args map[string]interface{}) (*QemuBlockJob, error) {
+	cursor := q.qmp.eventCursor()
+	args["job-id"] = id
+	if _, err := q.QMP(command, args); err != nil {
+		return nil, err
+	}
+	return &QemuBlockJob{q: q, ID: id, cursor: cursor}, nil
+}
+
+// DriveMirror starts copying the disk (index in QemuOptions.Disks) to the target image of the given format.
+// Once the copy is synchronized the job keeps mirroring the guest writes till it is completed with Complete().
+func (q *Qemu) DriveMirror(disk int, target, format string) (*QemuBlockJob, error) {
+	return q.startBlockJob("drive-mirror", "mirror-"+diskDrive(disk), map[string]interface{}{
+		"device": diskDrive(disk),
+		"target": target,
+		"format": format,
+		"sync":   "full",
+	})
+}
+
+// DriveBackup starts a point-in-time copy of the disk (index in QemuOptions.Disks) to the target image of
+// the given format. Use Wait() to wait for its end.
+func (q *Qemu) DriveBackup(disk int, target, format string) (*QemuBlockJob, error) {
+	return q.startBlockJob("drive-backup", "backup-"+diskDrive(disk), map[string]interface{}{
+		"device": diskDrive(disk),
+		"target": target,
+		"format": format,
+		"sync":   "full",
+	})
+}
+
+// BlockCommit starts merging the active overlay of the disk (index in QemuOptions.Disks) into its backing image.
+// Use Complete() to finish it.
+func (q *Qemu) BlockCommit(disk int) (*QemuBlockJob, error) {
+	return q.startBlockJob("block-commit", "commit-"+diskDrive(disk), map[string]interface{}{
+		"device": diskDrive(disk),
+	})
+}
+
+// BlockJobs returns the progress of the running block jobs
+func (q *Qemu) BlockJobs() ([]BlockJobInfo, error) {
+	resp, err := q.QMP("query-block-jobs", nil)
+	if err != nil {
+		return nil, err
+	}
+	var jobs []BlockJobInfo
+	if err := json.Unmarshal(resp, &jobs); err != nil {
+		return nil, fmt.Errorf("query-block-jobs: %v", err)
+	}
+	return jobs, nil
+}
+
+// Progress returns the job progress, it fails if the job is not running
+func (j *QemuBlockJob) Progress() (*BlockJobInfo, error) {
+	jobs, err := j.q.BlockJobs()
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.ID == j.ID {
+			return &job, nil
+		}
+	}
+	return nil, fmt.Errorf("block job %v is not running", j.ID)
+}
+
+// waitEvent waits for one of the named events of this job
+func (j *QemuBlockJob) waitEvent(timeout time.Duration, names ...string) (string, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		ev, pos, err := j.q.qmp.waitEvent(j.cursor, time.Until(deadline), names...)
+		if err != nil {
+			return "", fmt.Errorf("block job %v: %v", j.ID, err)
+		}
+		j.cursor = pos + 1
+		var data blockJobEvent
+		if err := json.Unmarshal(ev.Data, &data); err != nil {
+			return "", fmt.Errorf("%v event: %v", ev.Event, err)
+		}
+		if data.Device != j.ID {
+			continue
+		}
+		if data.Error != "" {
+			return "", fmt.Errorf("block job %v failed: %v", j.ID, data.Error)
+		}
+		return ev.Event, nil
+	}
+}
+
+// Wait waits till the job ends. Mirror and commit jobs end only after Complete().
+func (j *QemuBlockJob) Wait(timeout time.Duration) error {
+	ev, err := j.waitEvent(timeout, "BLOCK_JOB_COMPLETED", "BLOCK_JOB_CANCELLED")
+	if err != nil {
+		return err
+	}
+	if ev == "BLOCK_JOB_CANCELLED" {
+		return fmt.Errorf("block job %v is cancelled", j.ID)
+	}
+	return nil
+}
+
+// Complete waits till the mirror or commit job is synchronized, switches the disk to the job target and waits
+// for the job end
+func (j *QemuBlockJob) Complete(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	if _, err := j.waitEvent(timeout, "BLOCK_JOB_READY"); err != nil {
+		return err
+	}
+	if _, err := j.q.QMP("block-job-complete", map[string]string{"device": j.ID}); err != nil {
+		return err
+	}
+	return j.Wait(time.Until(deadline))
+}
+
+// Cancel stops the job, a synchronized mirror job leaves a consistent copy of the disk at the target
+func (j *QemuBlockJob) Cancel() error {
+	_, err := j.q.QMP("block-job-cancel", map[string]string{"device": j.ID})
+	return err
+}
@@ -0,0 +1,62 @@
+package vmtest
+
+import (
+	"fmt"
+	"net"
+	"path"
+)
+
+// ChardevTransport specifies how QEMU character devices (monitor, console, QMP, guest agent) are connected to vmtest
+type ChardevTransport string
+
+const (
+	// CHARDEV_UNIX connects the devices over unix sockets in a temporary directory
+	CHARDEV_UNIX ChardevTransport = "unix"
+	// CHARDEV_TCP connects the devices over TCP, vmtest listens at ChardevHost with OS assigned ports
+	CHARDEV_TCP ChardevTransport = "tcp"
+)
+
+// defaultChardevHost is an address listened by CHARDEV_TCP transport if QemuOptions.ChardevHost is empty
+const defaultChardevHost = "127.0.0.1"
+
+// chardevAddrs maps a socket name (e.g. consoleSocket) to the address QEMU connects to.
+// Names missing in the map are unix sockets located at the sockets directory.
+type chardevAddrs map[string]net.Addr
+
+// listenChardev starts listening for the QEMU character device connection with the given socket name
+func listenChardev(opts *QemuOptions, socketsDir, name string, addrs chardevAddrs) (net.Listener, error) {
+	switch opts.ChardevTransport {
+	case "", CHARDEV_UNIX:
+		return net.Listen("unix", path.Join(socketsDir, name))
+	case CHARDEV_TCP:
+		host := opts.ChardevHost
+		if host == "" {
+			host = defaultChardevHost
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+		if err != nil {
+			return nil, err
+		}
+		addrs[name] = l.Addr()
+		return l, nil
+	default:
+		return nil, fmt.Errorf("unknown chardev transport %q", opts.ChardevTransport)
+	}
+}
+
+// backend renders the address of the socket in the form accepted by '-serial', '-monitor' and '-qmp',
+// e.g. 'unix:/tmp/vmtest123/console.socket' or 'tcp:127.0.0.1:4567'
+func (a chardevAddrs) backend(socketsDir, name string) string {
+	if addr, ok := a[name].(*net.TCPAddr); ok {
+		return "tcp:" + addr.String()
+	}
+	return "unix:" + path.Join(socketsDir, name)
+}
+
+// socketParams renders the address of the socket in the form accepted by '-chardev socket'
+func (a chardevAddrs) socketParams(socketsDir, name string) string {
+	if addr, ok := a[name].(*net.TCPAddr); ok {
+		return fmt.Sprintf("host=%v,port=%d", addr.IP, addr.Port)
+	}
+	return "path=" + escapeParam(path.Join(socketsDir, name))
+}
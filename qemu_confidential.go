@@ -0,0 +1,117 @@
+package vmtest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfidentialType defines a confidential computing technology used to launch the guest
+type ConfidentialType string
+
+const (
+	CONFIDENTIAL_SEV     = ConfidentialType("sev")
+	CONFIDENTIAL_SEV_SNP = ConfidentialType("sev-snp")
+	CONFIDENTIAL_TDX     = ConfidentialType("tdx")
+)
+
+// ErrConfidentialNotSupported is returned when the host lacks support for the requested confidential VM type.
+// Tests may check for it with errors.Is() and skip.
+var ErrConfidentialNotSupported = errors.New("confidential VM type is not supported by the host")
+
+// QemuConfidential configures a confidential (memory encrypted) guest. It requires KVM acceleration,
+// it is enabled unless QemuOptions.Params specify the accelerator.
+type QemuConfidential struct {
+	// Type of the confidential guest
+	Type ConfidentialType
+	// Firmware is a path to the OVMF build with SEV/TDX support, it is passed as '-bios'
+	Firmware string
+	// CBitPos is a position of the encryption bit in page table entries (SEV only), defaults to 51
+	CBitPos int
+	// ReducedPhysBits is a number of physical address bits lost by enabling encryption (SEV only), defaults to 1
+	ReducedPhysBits int
+	// Policy of the guest, see AMD SEV API specification (SEV only)
+	Policy uint64
+}
+
+const confidentialObjectID = "cgs0"
+
+// params renders the confidential guest parameters, the user specified qemu params are checked to use KVM
+func (c *QemuConfidential) params(params []string) ([]string, error) {
+	var result []string
+	if accel, ok := cmdlineAccel(params); !ok {
+		result = append(result, "-enable-kvm")
+	} else if accel != "kvm" {
+		return nil, fmt.Errorf("confidential guest requires kvm accelerator, got '%v'", accel)
+	}
+	if c.Firmware == "" {
+		return nil, fmt.Errorf("confidential guest requires firmware")
+	}
+	if err := checkFileExists(c.Firmware); err != nil {
+		return nil, fmt.Errorf("confidential guest firmware: %v", err)
+	}
+
+	cbitpos := c.CBitPos
+	if cbitpos == 0 {
+		cbitpos = 51
+	}
+	reducedPhysBits := c.ReducedPhysBits
+	if reducedPhysBits == 0 {
+		reducedPhysBits = 1
+	}
+
+	machine := []string{"confidential-guest-support=" + confidentialObjectID}
+	var object []string
+	switch c.Type {
+	case CONFIDENTIAL_SEV, CONFIDENTIAL_SEV_SNP:
+		kind := "sev-guest"
+		if c.Type == CONFIDENTIAL_SEV_SNP {
+			kind = "sev-snp-guest"
+		}
+		object = []string{
+			kind,
+			"id=" + confidentialObjectID,
+			fmt.Sprintf("cbitpos=%d", cbitpos),
+			fmt.Sprintf("reduced-phys-bits=%d", reducedPhysBits),
+		}
+		if c.Policy != 0 {
+			object = append(object, fmt.Sprintf("policy=%#x", c.Policy))
+		}
+	case CONFIDENTIAL_TDX:
+		object = []string{"tdx-guest", "id=" + confidentialObjectID}
+		machine = append(machine, "kernel-irqchip=split")
+	default:
+		return nil, fmt.Errorf("unknown confidential guest type %q", c.Type)
+	}
+
+	return append(result,
+		"-object", strings.Join(object, ","),
+		"-machine", strings.Join(machine, ","),
+		"-bios", c.Firmware,
+	), nil
+}
+
+// ProbeConfidential checks whether the host KVM supports the given type of confidential guests.
+// It returns an error wrapping ErrConfidentialNotSupported if it does not.
+func ProbeConfidential(t ConfidentialType) error {
+	var param string
+	switch t {
+	case CONFIDENTIAL_SEV:
+		param = "/sys/module/kvm_amd/parameters/sev"
+	case CONFIDENTIAL_SEV_SNP:
+		param = "/sys/module/kvm_amd/parameters/sev_snp"
+	case CONFIDENTIAL_TDX:
+		param = "/sys/module/kvm_intel/parameters/tdx"
+	default:
+		return fmt.Errorf("unknown confidential guest type %q", t)
+	}
+
+	if _, err := os.Stat("/dev/kvm"); err != nil {
+		return fmt.Errorf("%w: %v", ErrConfidentialNotSupported, err)
+	}
+	if !kvmParamEnabled(param) {
+		return fmt.Errorf("%w: %v is not enabled", ErrConfidentialNotSupported, param)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package vmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// InputDevice defines a kind of virtio input device
+type InputDevice string
+
+const (
+	INPUT_KEYBOARD = InputDevice("virtio-keyboard-pci")
+	INPUT_MOUSE    = InputDevice("virtio-mouse-pci")
+	INPUT_TABLET   = InputDevice("virtio-tablet-pci")
+)
+
+// QemuAudio configures a sound card attached to the guest
+type QemuAudio struct {
+	// Backend is a host audio backend e.g. 'none', 'wav' or 'pa'. Default is 'none' that discards the sound.
+	Backend string
+	// Device is a sound card model. Default is 'intel-hda' with 'hda-duplex' codec.
+	Device string
+	// List of backend parameters appended to "-audiodev" parameter e.g. "path=out.wav" for 'wav' backend
+	BackendParams []string
+}
+
+const audioBackendID = "audio0"
+
+// inputParams renders virtio input devices parameters
+func inputParams(devices []InputDevice) ([]string, error) {
+	var params []string
+	for _, d := range devices {
+		switch d {
+		case INPUT_KEYBOARD, INPUT_MOUSE, INPUT_TABLET:
+			params = append(params, "-device", string(d))
+		default:
+			return nil, fmt.Errorf("unknown input device %q", d)
+		}
+	}
+	return params, nil
+}
+
+// params renders audio backend and sound card parameters
+func (a *QemuAudio) params() []string {
+	backend := a.Backend
+	if backend == "" {
+		backend = "none"
+	}
+	audiodev := append([]string{backend, "id=" + audioBackendID}, a.BackendParams...)
+	params := []string{"-audiodev", strings.Join(audiodev, ",")}
+
+	if a.Device == "" || a.Device == "intel-hda" {
+		params = append(params, "-device", "intel-hda", "-device", "hda-duplex,audiodev="+audioBackendID)
+	} else {
+		params = append(params, "-device", a.Device+",audiodev="+audioBackendID)
+	}
+	return params
+}
+
+// WatchdogModel defines an emulated watchdog device
+type WatchdogModel string
+
+const (
+	// WATCHDOG_I6300ESB is a PCI watchdog for x86 and other PCI machines
+	WATCHDOG_I6300ESB = WatchdogModel("i6300esb")
+	// WATCHDOG_DIAG288 is a watchdog for s390x machines
+	WATCHDOG_DIAG288 = WatchdogModel("diag288")
+)
+
+// WatchdogAction defines what QEMU does once the watchdog timer expires
+type WatchdogAction string
+
+const (
+	WATCHDOG_RESET      = WatchdogAction("reset")
+	WATCHDOG_SHUTDOWN   = WatchdogAction("shutdown")
+	WATCHDOG_POWEROFF   = WatchdogAction("poweroff")
+	WATCHDOG_PAUSE      = WatchdogAction("pause")
+	WATCHDOG_DEBUG      = WatchdogAction("debug")
+	WATCHDOG_NONE       = WatchdogAction("none")
+	WATCHDOG_INJECT_NMI = WatchdogAction("inject-nmi")
+)
+
+// QemuWatchdog configures an emulated watchdog device
+type QemuWatchdog struct {
+	// Model of the watchdog, default is WATCHDOG_I6300ESB
+	Model WatchdogModel
+	// Action performed when the watchdog expires, default is WATCHDOG_RESET.
+	// Note that '-no-reboot' is enabled unless QemuOptions.AllowReboot is set, so reset action makes the VM exit.
+	Action WatchdogAction
+}
+
+func (w *QemuWatchdog) params() []string {
+	model := w.Model
+	if model == "" {
+		model = WATCHDOG_I6300ESB
+	}
+	action := w.Action
+	if action == "" {
+		action = WATCHDOG_RESET
+	}
+	return []string{"-device", string(model), "-watchdog-action", string(action)}
+}
+
+// QemuClock configures the guest real time clock, e.g. to test NTP clients against a skewed clock
+type QemuClock struct {
+	// Base is the RTC time at the VM start, default is the host time
+	Base time.Time
+	// LocalTime keeps the RTC in local time instead of UTC, as Windows expects
+	LocalTime bool
+	// VMClock drives the RTC by the VM clock instead of the host clock, so it does not advance while the VM
+	// is stopped and the guest sees a clock drift after Stop()/Cont()
+	VMClock bool
+}
+
+func (c *QemuClock) params() []string {
+	base := "utc"
+	if !c.Base.IsZero() {
+		t := c.Base.UTC()
+		if c.LocalTime {
+			t = c.Base.Local()
+		}
+		base = t.Format("2006-01-02T15:04:05")
+	} else if c.LocalTime {
+		base = "localtime"
+	}
+	rtc := "base=" + base
+	if c.VMClock {
+		rtc += ",clock=vm"
+	}
+	return []string{"-rtc", rtc}
+}
+
+// WaitWatchdog waits until the guest watchdog expires (QMP WATCHDOG event) and returns the action QEMU performed
+func (q *Qemu) WaitWatchdog(timeout time.Duration) (WatchdogAction, error) {
+	ev, err := q.WaitQMPEvent("WATCHDOG", timeout)
+	if err != nil {
+		return "", err
+	}
+	var data struct {
+		Action string `json:"action"`
+	}
+	if err := json.Unmarshal(ev.Data, &data); err != nil {
+		return "", fmt.Errorf("WATCHDOG event: %v", err)
+	}
+	return WatchdogAction(data.Action), nil
+}
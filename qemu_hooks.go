@@ -0,0 +1,28 @@
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"regexp"
+)
+
+// anyLineRe matches every console line for QemuOptions.OnConsoleLine
+var anyLineRe = regexp.MustCompile(``)
+
+// qemuExit is the result of the qemu process, err is set before done is closed
+type qemuExit struct {
+	done chan struct{}
+	err  error
+}
+
+// exitHooks calls QemuOptions.OnTimeout and OnExit once the qemu process exits, ctx is the context of the process
+func (q *Qemu) exitHooks(ctx context.Context, exit *qemuExit) {
+	defer close(q.exitHooksDone)
+	<-exit.done
+	if q.opts.OnTimeout != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		q.opts.OnTimeout(q)
+	}
+	if q.opts.OnExit != nil {
+		q.opts.OnExit(q, exit.err)
+	}
+}
@@ -0,0 +1,44 @@
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExitHooks(t *testing.T) {
+	var calls []string
+	var exitErr error
+	q := &Qemu{
+		opts: &QemuOptions{
+			OnTimeout: func(*Qemu) { calls = append(calls, "timeout") },
+			OnExit: func(_ *Qemu, err error) {
+				calls = append(calls, "exit")
+				exitErr = err
+			},
+		},
+		exitHooksDone: make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	exit := &qemuExit{done: make(chan struct{}), err: errors.New("signal: killed")}
+	close(exit.done)
+	q.exitHooks(ctx, exit)
+	require.Equal(t, []string{"timeout", "exit"}, calls)
+	require.EqualError(t, exitErr, "signal: killed")
+
+	// a regular exit does not report the timeout
+	calls = nil
+	q.exitHooksDone = make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	q.exitHooks(ctx, &qemuExit{done: exit.done})
+	require.Equal(t, []string{"exit"}, calls)
+	require.NoError(t, exitErr)
+	<-q.exitHooksDone
+}
@@ -0,0 +1,103 @@
+package vmtest
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// QemuIdentity is the machine identity of a VM. The empty fields are generated randomly for every Qemu instance,
+// so VMs of parallel tests do not collide when they register with external services even if they share
+// the options. The struct is not modified, the generated values are returned by Qemu.Identity() and kept
+// across restarts of the instance.
+type QemuIdentity struct {
+	// UUID is the machine UUID ('-uuid' qemu param) reported as /sys/class/dmi/id/product_uuid
+	UUID string
+	// Serial is the SMBIOS system serial number reported as /sys/class/dmi/id/product_serial
+	Serial string
+	// Hostname is passed with 'systemd.hostname' kernel parameter for the direct kernel boot of OS_LINUX guests
+	// and with 'system.hostname' systemd credential in SMBIOS OEM strings otherwise
+	Hostname string
+	// CloudInit passes the hostname and the UUID as the instance id to cloud-init NoCloud datasource with
+	// 'ds=nocloud;h=$Hostname;i=$UUID' serial number that replaces Serial in SMBIOS
+	CloudInit bool
+}
+
+// generate fills the empty fields
+func (id *QemuIdentity) generate() error {
+	if id.UUID == "" {
+		uuid, err := randomUUID()
+		if err != nil {
+			return err
+		}
+		id.UUID = uuid
+	}
+	// the UUID is random, so its parts make unique and still recognizable names
+	hex := strings.ReplaceAll(id.UUID, "-", "")
+	if id.Serial == "" {
+		id.Serial = "VMTEST" + strings.ToUpper(hex[20:])
+	}
+	if id.Hostname == "" {
+		id.Hostname = "vmtest-" + strings.ToLower(hex[:8])
+	}
+	return nil
+}
+
+// generateIdentity fills the identity of the VM from QemuOptions.Identity once, later starts reuse it
+func (q *Qemu) generateIdentity() error {
+	if q.opts.Identity == nil || q.identity.UUID != "" {
+		return nil
+	}
+	id := *q.opts.Identity
+	if err := id.generate(); err != nil {
+		return err
+	}
+	q.identity = id
+	return nil
+}
+
+// applyIdentity points the copy of the VM options to the generated identity
+func (q *Qemu) applyIdentity(opts *QemuOptions) {
+	if opts.Identity != nil {
+		id := q.identity
+		opts.Identity = &id
+	}
+}
+
+// params renders '-uuid' and '-smbios' parameters of the identity
+func (id *QemuIdentity) params() ([]string, error) {
+	var params []string
+	if id.UUID != "" {
+		if !uuidRe.MatchString(id.UUID) {
+			return nil, fmt.Errorf("invalid identity UUID %q", id.UUID)
+		}
+		params = append(params, "-uuid", id.UUID)
+	}
+	serial := id.Serial
+	if id.CloudInit {
+		serial = fmt.Sprintf("ds=nocloud;h=%s;i=%s", id.Hostname, id.UUID)
+	}
+	if serial != "" {
+		params = append(params, "-smbios", "type=1,serial="+escapeParam(serial))
+	}
+	if id.Hostname != "" {
+		params = append(params, "-smbios", "type=11,value=io.systemd.credential:system.hostname="+escapeParam(id.Hostname))
+	}
+	return params, nil
+}
+
+// randomUUID returns a random (version 4) UUID
+func randomUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Identity returns the machine identity of the VM, it is empty unless QemuOptions.Identity is set
+func (q *Qemu) Identity() QemuIdentity {
+	return q.identity
+}
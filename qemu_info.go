@@ -0,0 +1,108 @@
+package vmtest
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// BlockDevice is a block device reported by QMP query-block
+type BlockDevice struct {
+	// Device is the legacy drive name, e.g. 'ide1-cd0', it is empty for devices without a drive
+	Device string `json:"device"`
+	// QDev is the id or QOM path of the guest device
+	QDev      string `json:"qdev"`
+	Removable bool   `json:"removable"`
+	Locked    bool   `json:"locked"`
+	TrayOpen  bool   `json:"tray_open"`
+	// Inserted is the media of the device, nil if it is empty (e.g. ejected CD-ROM)
+	Inserted *struct {
+		File     string `json:"file"`
+		ReadOnly bool   `json:"ro"`
+		Driver   string `json:"drv"`
+	} `json:"inserted"`
+}
+
+// PCIDevice is a PCI device reported by QMP query-pci
+type PCIDevice struct {
+	Bus      int `json:"bus"`
+	Slot     int `json:"slot"`
+	Function int `json:"function"`
+	Class    struct {
+		Class int    `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"class_info"`
+	ID struct {
+		Vendor int `json:"vendor"`
+		Device int `json:"device"`
+	} `json:"id"`
+	// QDevID is the id of the device given with '-device ...,id='
+	QDevID string `json:"qdev_id"`
+}
+
+// CPU is a virtual CPU reported by QMP query-cpus-fast
+type CPU struct {
+	Index    int    `json:"cpu-index"`
+	QOMPath  string `json:"qom-path"`
+	ThreadID int    `json:"thread-id"`
+	Target   string `json:"target"`
+}
+
+// queryInfo executes QMP query command and decodes its result to v
+func (q *Qemu) queryInfo(command string, v interface{}) error {
+	resp, err := q.QMP(command, nil)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(resp, v); err != nil {
+		return fmt.Errorf("%v: %v", command, err)
+	}
+	return nil
+}
+
+// BlockInfo returns the VM block devices, e.g. to check a disk was actually detached
+func (q *Qemu) BlockInfo() ([]BlockDevice, error) {
+	var devices []BlockDevice
+	err := q.queryInfo("query-block", &devices)
+	return devices, err
+}
+
+// PCIInfo returns the PCI devices of all buses, including the devices behind PCI bridges
+func (q *Qemu) PCIInfo() ([]PCIDevice, error) {
+	type pciDevice struct {
+		PCIDevice
+		Bridge *struct {
+			Devices []json.RawMessage `json:"devices"`
+		} `json:"pci_bridge"`
+	}
+	var buses []struct {
+		Devices []json.RawMessage `json:"devices"`
+	}
+	if err := q.queryInfo("query-pci", &buses); err != nil {
+		return nil, err
+	}
+
+	var result []PCIDevice
+	var queue []json.RawMessage
+	for _, b := range buses {
+		queue = append(queue, b.Devices...)
+	}
+	for len(queue) > 0 {
+		var d pciDevice
+		if err := json.Unmarshal(queue[0], &d); err != nil {
+			return nil, fmt.Errorf("query-pci: %v", err)
+		}
+		queue = queue[1:]
+		result = append(result, d.PCIDevice)
+		if d.Bridge != nil {
+			queue = append(queue, d.Bridge.Devices...)
+		}
+	}
+	return result, nil
+}
+
+// CPUInfo returns the VM virtual CPUs
+func (q *Qemu) CPUInfo() ([]CPU, error) {
+	var cpus []CPU
+	err := q.queryInfo("query-cpus-fast", &cpus)
+	return cpus, err
+}
@@ -0,0 +1,95 @@
+package vmtest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Key is a keyboard key named by its QEMU 'qcode', e.g. KEY_DOWN, Key("2") or a combination Key("ctrl-x")
+type Key string
+
+// Keys used to navigate firmware and bootloader menus
+const (
+	KEY_UP        = Key("up")
+	KEY_DOWN      = Key("down")
+	KEY_LEFT      = Key("left")
+	KEY_RIGHT     = Key("right")
+	KEY_HOME      = Key("home")
+	KEY_END       = Key("end")
+	KEY_ENTER     = Key("ret")
+	KEY_ESC       = Key("esc")
+	KEY_TAB       = Key("tab")
+	KEY_BACKSPACE = Key("backspace")
+	KEY_DELETE    = Key("delete")
+	KEY_F2        = Key("f2")
+	KEY_F12       = Key("f12")
+)
+
+// keySequences are the escape sequences a VT100-compatible terminal sends over the serial line
+var keySequences = map[Key]string{
+	KEY_UP:        "\x1b[A",
+	KEY_DOWN:      "\x1b[B",
+	KEY_RIGHT:     "\x1b[C",
+	KEY_LEFT:      "\x1b[D",
+	KEY_HOME:      "\x1b[H",
+	KEY_END:       "\x1b[F",
+	KEY_ENTER:     "\r",
+	KEY_ESC:       "\x1b",
+	KEY_TAB:       "\t",
+	KEY_BACKSPACE: "\x7f",
+	KEY_DELETE:    "\x1b[3~",
+	KEY_F2:        "\x1bOQ",
+	KEY_F12:       "\x1b[24~",
+}
+
+// sequence returns the serial console input of the key
+func (k Key) sequence() (string, error) {
+	if s, ok := keySequences[k]; ok {
+		return s, nil
+	}
+	if len(k) == 1 {
+		return string(k), nil
+	}
+	if c := strings.TrimPrefix(string(k), "ctrl-"); len(c) == 1 && c[0] >= 'a' && c[0] <= 'z' {
+		return string(c[0] & 0x1f), nil
+	}
+	return "", fmt.Errorf("key %q has no serial console sequence", k)
+}
+
+// SendKeys presses the keys one by one at the emulated keyboard (QMP 'send-key'), it is read by the firmware
+// and bootloaders using the graphical console
+func (q *Qemu) SendKeys(keys ...Key) error {
+	for _, k := range keys {
+		var codes []map[string]string
+		for _, c := range strings.Split(string(k), "-") {
+			codes = append(codes, map[string]string{"type": "qcode", "data": c})
+		}
+		if _, err := q.QMP("send-key", map[string]interface{}{"keys": codes}); err != nil {
+			return fmt.Errorf("send key %v: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// ConsoleSendKeys types the keys at the serial console as a terminal would do, e.g. to navigate a bootloader
+// menu drawn on the serial console
+func (q *Qemu) ConsoleSendKeys(keys ...Key) error {
+	input, err := keysInput(keys)
+	if err != nil {
+		return err
+	}
+	return q.ConsoleWrite(input)
+}
+
+// keysInput returns the serial console input of the keys
+func keysInput(keys []Key) (string, error) {
+	var input string
+	for _, k := range keys {
+		s, err := k.sequence()
+		if err != nil {
+			return "", err
+		}
+		input += s
+	}
+	return input, nil
+}
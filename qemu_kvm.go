@@ -0,0 +1,76 @@
+package vmtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrNestedNotSupported is returned when the host KVM does not allow running hypervisors inside the guest.
+// Tests may check for it with errors.Is() and skip.
+var ErrNestedNotSupported = errors.New("nested virtualization is not supported by the host")
+
+// ProbeNestedVirtualization checks whether the host KVM module has nested virtualization enabled.
+// It returns an error wrapping ErrNestedNotSupported if it does not.
+func ProbeNestedVirtualization() error {
+	if _, err := os.Stat("/dev/kvm"); err != nil {
+		return fmt.Errorf("%w: %v", ErrNestedNotSupported, err)
+	}
+	for _, param := range []string{"/sys/module/kvm_intel/parameters/nested", "/sys/module/kvm_amd/parameters/nested"} {
+		if kvmParamEnabled(param) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: enable 'nested' parameter of kvm_intel/kvm_amd module", ErrNestedNotSupported)
+}
+
+// nestedParams returns parameters that expose VMX/SVM CPU features to the guest.
+// If the user already specified the CPU model in params then it is checked to provide the virtualization extensions.
+func nestedParams(params []string) ([]string, error) {
+	var result []string
+	if accel, ok := cmdlineAccel(params); !ok {
+		result = append(result, "-enable-kvm")
+	} else if accel != "kvm" {
+		return nil, fmt.Errorf("nested virtualization requires kvm accelerator, got '%v'", accel)
+	}
+
+	if cpu, ok := paramValue(params, "-cpu"); ok {
+		if strings.HasPrefix(cpu, "host") || strings.Contains(cpu, "+vmx") || strings.Contains(cpu, "+svm") {
+			return result, nil
+		}
+		return nil, fmt.Errorf("nested virtualization requires '-cpu host' or a CPU model with +vmx/+svm, got '-cpu %v'", cpu)
+	}
+	return append(result, "-cpu", "host"), nil
+}
+
+// kvmParamEnabled reports whether a boolean kernel module parameter is enabled
+func kvmParamEnabled(param string) bool {
+	data, err := os.ReadFile(param)
+	if err != nil {
+		return false
+	}
+	data = bytes.TrimSpace(data)
+	return bytes.Equal(data, []byte("Y")) || bytes.Equal(data, []byte("1"))
+}
+
+// containsParam reports whether the qemu command line params contain the given flag
+func containsParam(params []string, name string) bool {
+	_, ok := paramValue(params, name)
+	return ok
+}
+
+// paramValue returns the value following the given flag in qemu command line params
+func paramValue(params []string, name string) (string, bool) {
+	for i, p := range params {
+		if p != name {
+			continue
+		}
+		if i+1 < len(params) {
+			return params[i+1], true
+		}
+		return "", true
+	}
+	return "", false
+}
@@ -0,0 +1,217 @@
+package vmtest
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// SetLink sets the link status of the network device, e.g. QemuNIC.ID or an id given with '-netdev ...,id=' or
+// '-device ...,id='. The guest sees the carrier loss, so fail-over logic can be tested deterministically.
+func (q *Qemu) SetLink(nic string, up bool) error {
+	_, err := q.QMP("set_link", map[string]interface{}{
+		"name": nic,
+		"up":   up,
+	})
+	return err
+}
+
+// NetBackend is a type of the host side of the guest network interface ('-netdev' type)
+type NetBackend string
+
+const (
+	NET_USER   = NetBackend("user")   // user mode network (slirp), no host privileges needed
+	NET_TAP    = NetBackend("tap")    // host tap interface, see QemuNIC.BackendParams to configure it
+	NET_SOCKET = NetBackend("socket") // ethernet frames tunneled over a host socket, see SocketNetwork
+)
+
+// socketNetworkGroup is a multicast group of SocketNetwork hubs, the networks differ by port
+const socketNetworkGroup = "230.0.0.1"
+
+// SocketNetwork is a private ethernet segment shared by VMs of a test. It is a qemu multicast socket hub bound to
+// the loopback interface, so it needs no host privileges.
+type SocketNetwork struct {
+	port  int
+	mutex sync.Mutex
+	nics  int // the number of the attached interfaces
+}
+
+// NewSocketNetwork allocates a new network
+func NewSocketNetwork() (*SocketNetwork, error) {
+	// pick an unused port, the hubs are identified by it
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return &SocketNetwork{port: conn.LocalAddr().(*net.UDPAddr).Port}, nil
+}
+
+// NIC returns an interface connected to the network, add it to QemuOptions.NICs of every VM. Every interface
+// gets a distinct MAC address, the network port and the interface number form it, so the addresses do not
+// collide with qemu 52:54:00 ones.
+func (n *SocketNetwork) NIC() QemuNIC {
+	n.mutex.Lock()
+	i := n.nics
+	n.nics++
+	n.mutex.Unlock()
+	return QemuNIC{
+		Backend:       NET_SOCKET,
+		BackendParams: []string{fmt.Sprintf("mcast=%v:%d", socketNetworkGroup, n.port), "localaddr=127.0.0.1"},
+		MAC:           fmt.Sprintf("52:54:%02x:%02x:%02x:%02x", n.port>>8, n.port&0xff, i>>8&0xff, i&0xff),
+	}
+}
+
+// QemuNIC is a guest network interface
+type QemuNIC struct {
+	// ID of the netdev, it is used by SetLink(). Default is 'net<index>'.
+	ID string
+	// Backend is the host side of the interface, default is NET_USER
+	Backend NetBackend
+	// Model is the guest device, default is 'virtio-net-pci'
+	Model string
+	// BackendParams are appended to '-netdev' parameter, e.g. 'hostfwd=tcp::10022-:22' or 'ifname=tap0,script=no'
+	BackendParams []string
+	// Queues enables multi-queue virtio-net with the given number of queue pairs, e.g. to exercise RSS and XPS
+	// in the guest. It requires NET_TAP backend.
+	Queues int
+	// Vhost enables in-kernel vhost-net acceleration. It requires NET_TAP backend.
+	Vhost bool
+	// DeviceParams are appended to '-device' parameter, e.g. 'rss=on'
+	DeviceParams []string
+	// GuestForwards deliver connections from the guest to the host listeners. They require NET_USER backend.
+	GuestForwards []QemuGuestForward
+	// MAC is the guest interface address. Default is derived from QemuOptions.MACSeed and the interface index,
+	// so it is stable across runs. See Qemu.MAC().
+	MAC string
+}
+
+// QemuGuestForward delivers TCP connections from the guest to a well-known address to a host listener, e.g. to mock
+// an external API the guest software talks to. Every connection is relayed by netcat ('nc') that must be installed
+// at the host.
+type QemuGuestForward struct {
+	// Addr is the address the guest connects to, e.g. '10.0.2.100:80'. It must belong to the user mode network,
+	// 10.0.2.0/24 by default.
+	Addr string
+	// Listener is a host TCP listener provided by the test, it accepts the guest connections
+	Listener net.Listener
+}
+
+// param renders 'guestfwd' parameter of the user mode network
+func (f *QemuGuestForward) param() (string, error) {
+	host, port, err := net.SplitHostPort(f.Addr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host).To4() == nil {
+		return "", fmt.Errorf("guest forward address %v must be an IPv4 address", f.Addr)
+	}
+	if f.Listener == nil {
+		return "", fmt.Errorf("guest forward %v has no listener", f.Addr)
+	}
+	addr, ok := f.Listener.Addr().(*net.TCPAddr)
+	if !ok {
+		return "", fmt.Errorf("guest forward %v listener must be a TCP listener, got %v", f.Addr, f.Listener.Addr())
+	}
+	target := addr.IP.String()
+	if addr.IP.IsUnspecified() {
+		target = "127.0.0.1"
+	}
+	// the command runs for every guest connection with the connection at its stdin and stdout
+	return fmt.Sprintf("guestfwd=tcp:%v:%v-cmd:nc %v %d", host, port, target, addr.Port), nil
+}
+
+// defaultMAC returns a locally administered address in qemu 52:54:00 prefix derived from the seed and index
+func defaultMAC(seed string, index int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%d", seed, index)))
+	return fmt.Sprintf("52:54:00:%02x:%02x:%02x", sum[0], sum[1], sum[2])
+}
+
+// nicMACs returns the addresses of the network interfaces
+func nicMACs(opts *QemuOptions) ([]string, error) {
+	var macs []string
+	for i, n := range opts.NICs {
+		mac := n.MAC
+		if mac == "" {
+			mac = defaultMAC(opts.MACSeed, i)
+		} else if _, err := net.ParseMAC(mac); err != nil {
+			return nil, fmt.Errorf("NIC %v: %v", n.id(i), err)
+		}
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+// MAC returns the address of the nic-th QemuOptions.NICs interface
+func (q *Qemu) MAC(nic int) (string, error) {
+	if nic < 0 || nic >= len(q.macs) {
+		return "", fmt.Errorf("NIC %d is out of range, the VM has %d NICs", nic, len(q.macs))
+	}
+	return q.macs[nic], nil
+}
+
+// MACInterfaceName returns the name systemd/udev gives to the interface with the given address under the 'mac'
+// naming policy, e.g. 'enx525400123456'
+func MACInterfaceName(mac string) string {
+	return "enx" + strings.ReplaceAll(strings.ToLower(mac), ":", "")
+}
+
+func (n *QemuNIC) id(i int) string {
+	if n.ID != "" {
+		return n.ID
+	}
+	return fmt.Sprintf("net%d", i)
+}
+
+// nicsParams renders '-netdev' and '-device' parameters of the network interfaces
+func nicsParams(opts *QemuOptions) ([]string, error) {
+	macs, err := nicMACs(opts)
+	if err != nil {
+		return nil, err
+	}
+	var params []string
+	for i, n := range opts.NICs {
+		id := n.id(i)
+		backend := n.Backend
+		if backend == "" {
+			backend = NET_USER
+		}
+		model := n.Model
+		if model == "" {
+			model = "virtio-net-pci"
+		}
+
+		netdev := []string{string(backend), "id=" + id}
+		device := []string{model, "netdev=" + id, "mac=" + macs[i]}
+		if (n.Queues > 1 || n.Vhost) && backend != NET_TAP {
+			return nil, fmt.Errorf("NIC %v: multiple queues and vhost require NET_TAP backend", id)
+		}
+		if n.Queues > 1 {
+			if !strings.HasPrefix(model, "virtio-net") {
+				return nil, fmt.Errorf("NIC %v: multiple queues require virtio-net device, got %v", id, model)
+			}
+			// a vector per each rx and tx queue plus config and control vectors
+			netdev = append(netdev, fmt.Sprintf("queues=%d", n.Queues))
+			device = append(device, "mq=on", fmt.Sprintf("vectors=%d", 2*n.Queues+2))
+		}
+		if n.Vhost {
+			netdev = append(netdev, "vhost=on")
+		}
+		if len(n.GuestForwards) > 0 && backend != NET_USER {
+			return nil, fmt.Errorf("NIC %v: guest forwards require NET_USER backend", id)
+		}
+		for _, f := range n.GuestForwards {
+			fwd, err := f.param()
+			if err != nil {
+				return nil, fmt.Errorf("NIC %v: %v", id, err)
+			}
+			netdev = append(netdev, fwd)
+		}
+		netdev = append(netdev, n.BackendParams...)
+		device = append(device, n.DeviceParams...)
+		params = append(params, "-netdev", strings.Join(netdev, ","), "-device", strings.Join(device, ","))
+	}
+	return params, nil
+}
@@ -0,0 +1,100 @@
+package vmtest
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+// OCREngine recognizes text on VM display images
+type OCREngine interface {
+	// Recognize returns text found at the image
+	Recognize(img image.Image) (string, error)
+}
+
+// TesseractOCR is OCREngine implemented with tesseract command line tool
+type TesseractOCR struct {
+	// Binary is a path to tesseract executable, default is 'tesseract' looked up in $PATH
+	Binary string
+	// Language of the text e.g. 'eng'
+	Language string
+}
+
+var _ OCREngine = (*TesseractOCR)(nil)
+
+// Recognize implements OCREngine
+func (t *TesseractOCR) Recognize(img image.Image) (string, error) {
+	dir, err := os.MkdirTemp("", "vmtest-ocr")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	input := path.Join(dir, "screen.png")
+	f, err := os.Create(input)
+	if err != nil {
+		return "", err
+	}
+	if err := png.Encode(f, img); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	binary := t.Binary
+	if binary == "" {
+		binary = "tesseract"
+	}
+	args := []string{input, "stdout"}
+	if t.Language != "" {
+		args = append(args, "-l", t.Language)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(binary, args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract: %v: %s", err, stderr.String())
+	}
+	return string(out), nil
+}
+
+// normalizeSpaces collapses all whitespace sequences to a single space, OCR output is not precise about them
+func normalizeSpaces(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// ScreenExpect waits up to timeout until the text appears at the VM display. The display is recognized with
+// QemuOptions.OCR engine, by default tesseract is used.
+func (q *Qemu) ScreenExpect(text string, timeout time.Duration) error {
+	want := normalizeSpaces(text)
+	deadline := time.Now().Add(timeout)
+	for {
+		img, err := q.Screenshot()
+		if err != nil {
+			return err
+		}
+		got, err := q.ocr.Recognize(img)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(normalizeSpaces(got), want) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("screen does not contain %q after %v, recognized: %q", want, timeout, normalizeSpaces(got))
+		}
+		if q.verbose != nil {
+			q.verbose.logf("screen does not contain %q yet, recognized: %q", want, normalizeSpaces(got))
+		}
+		time.Sleep(time.Second)
+	}
+}
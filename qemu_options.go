@@ -0,0 +1,111 @@
+package vmtest
+
+import (
+	"io"
+	"time"
+)
+
+// QemuOption modifies QemuOptions. The options are composable, so QemuOptions can grow without breaking
+// the callers and common configurations can be shared as presets, see Compose().
+type QemuOption func(opts *QemuOptions)
+
+// NewQemuWith starts a VM configured by the options applied in order to zero QemuOptions, e.g.
+// NewQemuWith(WithKernel("bzImage"), WithDisk(QemuDisk{Path: "rootfs.img", Format: "raw"}), WithTimeout(time.Minute))
+func NewQemuWith(options ...QemuOption) (*Qemu, error) {
+	opts := &QemuOptions{}
+	return NewQemu(opts.Apply(options...))
+}
+
+// Apply applies the options in order and returns o. The scalar options override the earlier values,
+// the list ones (disks, kernel parameters, qemu parameters) append to them.
+func (o *QemuOptions) Apply(options ...QemuOption) *QemuOptions {
+	for _, opt := range options {
+		opt(o)
+	}
+	return o
+}
+
+// Compose combines the options into one, e.g. to define a preset
+func Compose(options ...QemuOption) QemuOption {
+	return func(opts *QemuOptions) {
+		opts.Apply(options...)
+	}
+}
+
+// WithArchitecture sets QemuOptions.Architecture
+func WithArchitecture(arch QemuArchitecture) QemuOption {
+	return func(opts *QemuOptions) { opts.Architecture = arch }
+}
+
+// WithOperatingSystem sets QemuOptions.OperatingSystem
+func WithOperatingSystem(os OperatingSystem) QemuOption {
+	return func(opts *QemuOptions) { opts.OperatingSystem = os }
+}
+
+// WithKernel sets QemuOptions.Kernel
+func WithKernel(kernel string) QemuOption {
+	return func(opts *QemuOptions) { opts.Kernel = kernel }
+}
+
+// WithInitRamFs sets QemuOptions.InitRamFs
+func WithInitRamFs(initramfs string) QemuOption {
+	return func(opts *QemuOptions) { opts.InitRamFs = initramfs }
+}
+
+// WithAppend adds kernel parameters to QemuOptions.Append
+func WithAppend(args ...string) QemuOption {
+	return func(opts *QemuOptions) { opts.Append = append(opts.Append, args...) }
+}
+
+// WithParams adds qemu parameters to QemuOptions.Params
+func WithParams(params ...string) QemuOption {
+	return func(opts *QemuOptions) { opts.Params = append(opts.Params, params...) }
+}
+
+// WithDisk adds a disk to QemuOptions.Disks
+func WithDisk(disk QemuDisk) QemuOption {
+	return func(opts *QemuOptions) { opts.Disks = append(opts.Disks, disk) }
+}
+
+// WithNIC adds a network interface to QemuOptions.NICs
+func WithNIC(nic QemuNIC) QemuOption {
+	return func(opts *QemuOptions) { opts.NICs = append(opts.NICs, nic) }
+}
+
+// WithMemory sets the guest RAM size, e.g. '2G'. The memory configuration is replaced rather than modified,
+// so the options copied from a shared base keep their own.
+func WithMemory(size string) QemuOption {
+	return func(opts *QemuOptions) {
+		var memory QemuMemory
+		if opts.Memory != nil {
+			memory = *opts.Memory
+		}
+		memory.Size = size
+		opts.Memory = &memory
+	}
+}
+
+// WithTimeout sets QemuOptions.Timeout
+func WithTimeout(timeout time.Duration) QemuOption {
+	return func(opts *QemuOptions) { opts.Timeout = timeout }
+}
+
+// WithName sets QemuOptions.Name
+func WithName(name string) QemuOption {
+	return func(opts *QemuOptions) { opts.Name = name }
+}
+
+// WithVerbose enables the verbose output, it goes to w unless it is nil, e.g. WithTestingLogger(t)
+func WithVerbose(w io.Writer) QemuOption {
+	return func(opts *QemuOptions) {
+		opts.Verbose = true
+		if w != nil {
+			opts.VerboseOutput = w
+		}
+	}
+}
+
+// WithConsolePattern adds a pattern to QemuOptions.ConsolePatterns
+func WithConsolePattern(p ConsolePattern) QemuOption {
+	return func(opts *QemuOptions) { opts.ConsolePatterns = append(opts.ConsolePatterns, p) }
+}
@@ -0,0 +1,162 @@
+package vmtest
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Suspend puts the guest to sleep (suspend-to-RAM, ACPI S3) using the guest agent and waits for
+// QMP SUSPEND event up to timeout. It requires QemuOptions.GuestAgent.
+func (q *Qemu) Suspend(timeout time.Duration) error {
+	if q.agent == nil {
+		return fmt.Errorf("suspend requires the guest agent, see QemuOptions.GuestAgent")
+	}
+	cursor := q.qmp.eventCursor()
+	// guest-suspend-ram does not reply on success
+	if _, err := q.agent.execute("guest-suspend-ram", nil, false); err != nil {
+		return err
+	}
+	_, _, err := q.qmp.waitEvent(cursor, timeout, "SUSPEND")
+	return err
+}
+
+// Hibernate puts the guest to suspend-to-disk (ACPI S4) using the guest agent and waits for
+// QMP SUSPEND_DISK event up to timeout. QEMU exits once the guest saved its state. It requires
+// QemuOptions.GuestAgent.
+func (q *Qemu) Hibernate(timeout time.Duration) error {
+	if q.agent == nil {
+		return fmt.Errorf("hibernate requires the guest agent, see QemuOptions.GuestAgent")
+	}
+	cursor := q.qmp.eventCursor()
+	if _, err := q.agent.execute("guest-suspend-disk", nil, false); err != nil {
+		return err
+	}
+	_, _, err := q.qmp.waitEvent(cursor, timeout, "SUSPEND_DISK")
+	return err
+}
+
+// Wakeup resumes the suspended guest and waits for QMP WAKEUP event up to timeout
+func (q *Qemu) Wakeup(timeout time.Duration) error {
+	cursor := q.qmp.eventCursor()
+	if _, err := q.QMP("system_wakeup", nil); err != nil {
+		return err
+	}
+	_, _, err := q.qmp.waitEvent(cursor, timeout, "WAKEUP")
+	return err
+}
+
+// StopMethod is a way Stop() terminated the vm
+type StopMethod string
+
+const (
+	STOP_GUEST_AGENT StopMethod = "guest-agent" // 'guest-shutdown' guest agent command
+	STOP_ACPI        StopMethod = "acpi"        // ACPI power button press with 'system_powerdown'
+	STOP_QUIT        StopMethod = "quit"        // qemu monitor 'quit' command, the guest is not notified
+	STOP_KILL        StopMethod = "kill"        // SIGKILL of the qemu process
+)
+
+// QemuStopPolicy specifies how long Stop() waits for every shutdown method before escalating to the next one.
+// Zero value means the default timeout.
+type QemuStopPolicy struct {
+	// GuestAgent is the timeout of the guest agent shutdown, default is 30s. It is used if QemuOptions.GuestAgent is set.
+	GuestAgent time.Duration
+	// ACPI is the timeout of the ACPI powerdown, default is 30s
+	ACPI time.Duration
+	// Quit is the timeout of the monitor 'quit' command, default is 5s
+	Quit time.Duration
+}
+
+const (
+	defaultStopGuestAgentTimeout = 30 * time.Second
+	defaultStopACPITimeout       = 30 * time.Second
+	defaultStopQuitTimeout       = 5 * time.Second
+)
+
+// Stop shuts the vm down gracefully, escalating to more forceful methods if the previous one does not stop it in
+// time: guest agent shutdown, ACPI powerdown, monitor 'quit' and finally SIGKILL. The timeouts are specified by
+// QemuOptions.StopPolicy. It returns the method that worked. If ctx is done before the vm stops then it is killed
+// and ctx error is returned.
+func (q *Qemu) Stop(ctx context.Context) (StopMethod, error) {
+	methods := []struct {
+		method  StopMethod
+		timeout time.Duration
+		stop    func() error
+	}{
+		{STOP_GUEST_AGENT, durationOr(q.stopPolicy.GuestAgent, defaultStopGuestAgentTimeout), func() error {
+			// guest-shutdown does not reply on success
+			_, err := q.agent.execute("guest-shutdown", nil, false)
+			return err
+		}},
+		{STOP_ACPI, durationOr(q.stopPolicy.ACPI, defaultStopACPITimeout), func() error {
+			_, err := q.QMP("system_powerdown", nil)
+			return err
+		}},
+		{STOP_QUIT, durationOr(q.stopPolicy.Quit, defaultStopQuitTimeout), func() error {
+			_, err := q.monitor.Write([]byte("quit\n"))
+			return err
+		}},
+	}
+
+	for _, m := range methods {
+		if q.agent == nil && m.method == STOP_GUEST_AGENT {
+			continue
+		}
+		cursor := q.qmp.eventCursor()
+		if err := m.stop(); err != nil {
+			q.logf("stop with %v: %v", m.method, err)
+			continue
+		}
+		if q.noShutdown && m.method != STOP_QUIT {
+			go q.qmp.quitOnShutdown(cursor, m.timeout)
+		}
+		exited, err := q.waitExit(ctx, m.timeout)
+		if err != nil {
+			break
+		}
+		if exited {
+			q.wait()
+			return m.method, nil
+		}
+		if q.verbose != nil {
+			q.verbose.logf("vm did not stop with %v in %v", m.method, m.timeout)
+		}
+	}
+
+	if err := q.cmd.Process.Kill(); err != nil {
+		q.logf("kill qemu: %v", err)
+	}
+	q.wait()
+	return STOP_KILL, ctx.Err()
+}
+
+// quitOnShutdown quits qemu if the guest powers off within timeout. With QemuOptions.NoShutdown qemu keeps
+// running with the powered off VM otherwise.
+func (c *qmpClient) quitOnShutdown(cursor int, timeout time.Duration) {
+	if _, _, err := c.waitEvent(cursor, timeout, "SHUTDOWN"); err == nil {
+		// qemu might exit before the reply is sent
+		_, _ = c.execute("quit", nil)
+	}
+}
+
+// waitExit waits up to timeout for the qemu process to exit. The exit status is left for wait().
+func (q *Qemu) waitExit(ctx context.Context, timeout time.Duration) (bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-q.waitCh:
+		q.waitCh <- err
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func durationOr(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
+	}
+	return d
+}
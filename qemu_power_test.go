@@ -0,0 +1,122 @@
+package vmtest
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// qmpEvent renders a QMP event message
+func qmpEvent(name, data string) string {
+	return `{"event": "` + name + `", "data": ` + data + `, "timestamp": {"seconds": 1, "microseconds": 2}}` + "\n"
+}
+
+// newPowerTestQemu connects a Qemu to a fake QMP server and a fake guest agent. The agent power commands that
+// do not reply emit the QMP events of the guest.
+func newPowerTestQemu(t *testing.T) *Qemu {
+	qmpClient, qmpServer := net.Pipe()
+	t.Cleanup(func() { qmpClient.Close() })
+	go fakeQMPServer(t, qmpServer, func(cmd string) string {
+		if cmd == "system_wakeup" {
+			return `{"return": {}}` + "\n" + qmpEvent("WAKEUP", `{}`)
+		}
+		return `{"return": {}}`
+	})
+	qmp, err := newQMPClient(qmpClient)
+	require.NoError(t, err)
+
+	agentClient, agentServer := net.Pipe()
+	t.Cleanup(func() { agentClient.Close() })
+	go fakeGuestAgent(agentServer, func(cmd string, _ json.RawMessage) interface{} {
+		switch cmd {
+		case "guest-suspend-ram":
+			_, _ = qmpServer.Write([]byte(qmpEvent("SUSPEND", `{}`)))
+		case "guest-suspend-disk":
+			_, _ = qmpServer.Write([]byte(qmpEvent("SUSPEND_DISK", `{}`)))
+		}
+		return nil
+	})
+	return &Qemu{qmp: qmp, agent: newGuestAgent(agentClient)}
+}
+
+func TestSuspendWakeup(t *testing.T) {
+	q := newPowerTestQemu(t)
+	require.NoError(t, q.Suspend(5*time.Second))
+	require.NoError(t, q.Wakeup(5*time.Second))
+	require.NoError(t, q.Hibernate(5*time.Second))
+
+	require.ErrorContains(t, (&Qemu{}).Suspend(time.Second), "guest agent")
+	require.ErrorContains(t, (&Qemu{}).Hibernate(time.Second), "guest agent")
+}
+
+func TestWaitQMPEventConcurrent(t *testing.T) {
+	q := newPowerTestQemu(t)
+	suspended := make(chan error, 1)
+	go func() {
+		_, err := q.WaitQMPEvent("SUSPEND", 5*time.Second)
+		suspended <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let the goroutine wait for its event first
+
+	// the pending SUSPEND wait does not block the others
+	_, err := q.QMP("system_wakeup", nil)
+	require.NoError(t, err)
+	ev, err := q.WaitQMPEvent("WAKEUP", time.Second)
+	require.NoError(t, err)
+	require.Equal(t, "WAKEUP", ev.Event)
+
+	_, err = q.agent.execute("guest-suspend-ram", nil, false)
+	require.NoError(t, err)
+	require.NoError(t, <-suspended)
+}
+
+func TestStopEscalation(t *testing.T) {
+	useFakeQemu(t)
+	// the ignored methods time out quickly, the method that works has time for qemu to exit
+	const short, long = 300 * time.Millisecond, 10 * time.Second
+
+	tests := []struct {
+		ignore string
+		policy QemuStopPolicy
+		method StopMethod
+		// escalated is the time spent waiting for the ignored methods
+		escalated time.Duration
+	}{
+		{"", QemuStopPolicy{ACPI: long, Quit: long}, STOP_ACPI, 0},
+		{"system_powerdown", QemuStopPolicy{ACPI: short, Quit: long}, STOP_QUIT, short},
+		{"system_powerdown,quit", QemuStopPolicy{ACPI: short, Quit: short}, STOP_KILL, 2 * short},
+	}
+	for _, test := range tests {
+		t.Setenv(fakeQemuIgnoreEnv, test.ignore)
+		opts := QemuOptions{Kernel: "testdata/hello-arm.bin", StopPolicy: test.policy, Timeout: time.Minute}
+		q, err := NewQemu(&opts)
+		require.NoError(t, err)
+		start := time.Now()
+		method, err := q.Stop(context.Background())
+		require.NoError(t, err, test.ignore)
+		require.Equal(t, test.method, method, test.ignore)
+		require.GreaterOrEqual(t, time.Since(start), test.escalated, test.ignore)
+		require.Less(t, time.Since(start), test.escalated+long, test.ignore)
+	}
+}
+
+func TestStopContext(t *testing.T) {
+	useFakeQemu(t)
+	t.Setenv(fakeQemuIgnoreEnv, "system_powerdown,quit")
+	opts := QemuOptions{Kernel: "testdata/hello-arm.bin", Timeout: time.Minute}
+	q, err := NewQemu(&opts)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	method, err := q.Stop(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, STOP_KILL, method)
+	// the default ACPI timeout is not waited for
+	require.Less(t, time.Since(start), defaultStopACPITimeout)
+}
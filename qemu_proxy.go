@@ -0,0 +1,198 @@
+package vmtest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// GuestProxy is a host-local SOCKS5 proxy into the guest user mode network. Every connection is forwarded to
+// the requested port of the guest regardless of the requested address, the port forwards are added on demand,
+// so the tests do not need to declare them upfront.
+type GuestProxy struct {
+	listener net.Listener
+	// forward returns the host address forwarded to the guest port
+	forward  func(port int) (string, error)
+	mutex    sync.Mutex
+	forwards map[int]string
+}
+
+// StartGuestProxy starts a SOCKS5 proxy into the user mode network of the NIC with the given id, e.g. QemuNIC.ID
+func (q *Qemu) StartGuestProxy(nic string) (*GuestProxy, error) {
+	return startGuestProxy(func(port int) (string, error) {
+		return q.hostForward(nic, port)
+	})
+}
+
+func startGuestProxy(forward func(port int) (string, error)) (*GuestProxy, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	p := &GuestProxy{listener: l, forward: forward, forwards: map[int]string{}}
+	go p.serve()
+	return p, nil
+}
+
+// hostForwardAttempts limits the retries of the forwards to the ports taken by other processes meanwhile
+const hostForwardAttempts = 5
+
+// hostForward adds a forward from a free host port to the guest port using 'hostfwd_add' monitor command
+func (q *Qemu) hostForward(nic string, port int) (string, error) {
+	var err error
+	for i := 0; i < hostForwardAttempts; i++ {
+		// find a free port, slirp does not allocate them itself. Another process might bind it before slirp does,
+		// then slirp fails to set up the rule and another port is tried.
+		var l net.Listener
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", err
+		}
+		addr := l.Addr().String()
+		hostPort := l.Addr().(*net.TCPAddr).Port
+		_ = l.Close()
+
+		err = q.humanMonitor(fmt.Sprintf("hostfwd_add %v tcp:127.0.0.1:%d-:%d", nic, hostPort, port))
+		if err == nil {
+			return addr, nil
+		}
+		if !strings.Contains(err.Error(), "Could not set up host forwarding rule") {
+			return "", err
+		}
+	}
+	return "", err
+}
+
+// Addr returns the proxy address, e.g. to use in 'socks5://' URLs
+func (p *GuestProxy) Addr() string {
+	return p.listener.Addr().String()
+}
+
+// Close stops the proxy. The established connections are not interrupted.
+func (p *GuestProxy) Close() error {
+	return p.listener.Close()
+}
+
+// Dial connects to the guest port through the proxy forwards, without the SOCKS5 protocol
+func (p *GuestProxy) Dial(port int) (net.Conn, error) {
+	p.mutex.Lock()
+	addr, ok := p.forwards[port]
+	if !ok {
+		var err error
+		addr, err = p.forward(port)
+		if err != nil {
+			p.mutex.Unlock()
+			return nil, err
+		}
+		p.forwards[port] = addr
+	}
+	p.mutex.Unlock()
+	return net.Dial("tcp", addr)
+}
+
+func (p *GuestProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			if err := p.handle(conn); err != nil {
+				log.Printf("guest proxy: %v", err)
+			}
+		}()
+	}
+}
+
+// SOCKS5 protocol constants, see RFC 1928
+const (
+	socksVersion          = 5
+	socksConnect          = 1
+	socksAddrIPv4         = 1
+	socksAddrDomain       = 3
+	socksAddrIPv6         = 4
+	socksSucceeded        = 0
+	socksConnRefused      = 5
+	socksCmdNotSupported  = 7
+	socksAddrNotSupported = 8
+)
+
+func (p *GuestProxy) handle(conn net.Conn) error {
+	defer conn.Close()
+
+	// greeting: version, number of auth methods, methods. Only 'no authentication' is supported.
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	if hdr[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %d", hdr[0])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, hdr[1])); err != nil {
+		return err
+	}
+	if _, err := conn.Write([]byte{socksVersion, 0}); err != nil {
+		return err
+	}
+
+	// request: version, command, reserved, address type, address, port
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return err
+	}
+	var addrLen int
+	switch req[3] {
+	case socksAddrIPv4:
+		addrLen = net.IPv4len
+	case socksAddrIPv6:
+		addrLen = net.IPv6len
+	case socksAddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return socksReply(conn, socksAddrNotSupported)
+	}
+	addrPort := make([]byte, addrLen+2)
+	if _, err := io.ReadFull(conn, addrPort); err != nil {
+		return err
+	}
+	if req[1] != socksConnect {
+		return socksReply(conn, socksCmdNotSupported)
+	}
+	port := int(binary.BigEndian.Uint16(addrPort[addrLen:]))
+
+	guest, err := p.Dial(port)
+	if err != nil {
+		_ = socksReply(conn, socksConnRefused)
+		return err
+	}
+	defer guest.Close()
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(guest, conn)
+		if c, ok := guest.(*net.TCPConn); ok {
+			_ = c.CloseWrite()
+		}
+		close(done)
+	}()
+	_, _ = io.Copy(conn, guest)
+	<-done
+	return nil
+}
+
+// socksReply sends the reply with the given status and an empty bound address
+func socksReply(conn net.Conn, status byte) error {
+	_, err := conn.Write([]byte{socksVersion, status, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
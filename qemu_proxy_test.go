@@ -0,0 +1,111 @@
+package vmtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGuestProxy(t *testing.T) {
+	// the guest service echoes the lines back
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	var forwarded []int
+	p, err := startGuestProxy(func(port int) (string, error) {
+		forwarded = append(forwarded, port)
+		return echo.Addr().String(), nil
+	})
+	require.NoError(t, err)
+	defer p.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", p.Addr())
+		require.NoError(t, err)
+
+		_, err = conn.Write([]byte{5, 1, 0})
+		require.NoError(t, err)
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		require.Equal(t, []byte{5, 0}, reply)
+
+		// CONNECT guest:8080
+		req := []byte{5, 1, 0, 3, 5}
+		req = append(req, "guest"...)
+		req = append(req, 0x1f, 0x90)
+		_, err = conn.Write(req)
+		require.NoError(t, err)
+		reply = make([]byte, 10)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		require.Equal(t, byte(0), reply[1])
+
+		msg := "hello " + strconv.Itoa(i) + "\n"
+		_, err = conn.Write([]byte(msg))
+		require.NoError(t, err)
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, msg, line)
+		require.NoError(t, conn.Close())
+	}
+	// the forward is added once per guest port
+	require.Equal(t, []int{8080}, forwarded)
+}
+
+func TestHostForwardRetry(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	var rules []string
+	go fakeQMPServerArgs(t, server, func(cmd string, args json.RawMessage) string {
+		if cmd != "human-monitor-command" {
+			return `{"return": {}}`
+		}
+		var hmp struct {
+			CommandLine string `json:"command-line"`
+		}
+		_ = json.Unmarshal(args, &hmp)
+		rules = append(rules, hmp.CommandLine)
+		switch {
+		case strings.HasPrefix(hmp.CommandLine, "hostfwd_add net1 "):
+			return `{"return": "Invalid host forwarding rule 'tcp:127.0.0.1:1-:80' (Bad protocol name)\r\n"}`
+		case len(rules) == 1:
+			// the port is taken by another process before slirp binds it
+			rule := strings.TrimPrefix(hmp.CommandLine, "hostfwd_add net0 ")
+			return `{"return": "Could not set up host forwarding rule '` + rule + `'\r\n"}`
+		default:
+			return `{"return": ""}`
+		}
+	})
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{qmp: qmp}
+
+	addr, err := q.hostForward("net0", 80)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	require.Equal(t, "hostfwd_add net0 tcp:"+addr+"-:80", rules[1])
+
+	_, err = q.hostForward("net1", 80)
+	require.ErrorContains(t, err, "Invalid host forwarding rule")
+	require.Len(t, rules, 3)
+}
@@ -0,0 +1,190 @@
+package vmtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// reportConsoleLines is the number of the last console lines kept for QemuReport
+	reportConsoleLines = 50
+	// reportStderrSize limits the size of qemu stderr kept for QemuReport
+	reportStderrSize = 64 * 1024
+	// versionTimeout limits 'qemu -version' run
+	versionTimeout = 10 * time.Second
+)
+
+// QemuReport describes the VM environment for triaging failures in CI logs
+type QemuReport struct {
+	// Cmdline is the qemu binary and its arguments
+	Cmdline []string
+	// Version is the output of 'qemu -version'
+	Version string
+	// Accel is the accelerator used by the VM, e.g. 'kvm' or 'tcg'
+	Accel string
+	// Console are the last console lines
+	Console []string
+	// Stderr is the tail of the qemu standard error output
+	Stderr string
+}
+
+func (r *QemuReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "QEMU command line: %v\n", quoteCmdline(r.Cmdline))
+	fmt.Fprintf(&sb, "QEMU version: %v\n", r.Version)
+	fmt.Fprintf(&sb, "QEMU accelerator: %v\n", r.Accel)
+	if len(r.Console) > 0 {
+		fmt.Fprintf(&sb, "last console lines:\n%v\n", strings.Join(r.Console, "\n"))
+	}
+	if r.Stderr != "" {
+		fmt.Fprintf(&sb, "QEMU stderr:\n%v\n", strings.TrimRight(r.Stderr, "\n"))
+	}
+	return sb.String()
+}
+
+// QemuError is returned by NewQemu and console expectations of a running VM. It contains the VM environment report.
+type QemuError struct {
+	Err    error
+	Report *QemuReport
+}
+
+func (e *QemuError) Error() string {
+	return fmt.Sprintf("%v\n%v", e.Err, e.Report)
+}
+
+func (e *QemuError) Unwrap() error {
+	return e.Err
+}
+
+// Report describes the VM environment: its command line, qemu version, accelerator, last console lines and stderr.
+// The version and the accelerator are captured at the VM start, so the report of a hung VM does not block.
+func (q *Qemu) Report() *QemuReport {
+	r := newQemuReport(q.cmdline, q.binary, q.version, q.stderr)
+	if q.accel != "" {
+		r.Accel = q.accel
+	}
+	r.Console = q.console.secrets.redactLines(q.console.recentLines())
+	r.Stderr = q.console.secrets.redactString(r.Stderr)
+	for i, arg := range r.Cmdline {
+		r.Cmdline[i] = q.console.secrets.redactString(arg)
+	}
+	return r
+}
+
+// queryAccel returns the accelerator used by the started VM, the accelerator found at the command line is used
+// unless qemu reports KVM
+func queryAccel(qmp *qmpClient, cmdline []string) string {
+	if resp, err := qmp.execute("query-kvm", nil); err == nil {
+		var kvm struct {
+			Enabled bool `json:"enabled"`
+		}
+		if json.Unmarshal(resp, &kvm) == nil && kvm.Enabled {
+			return "kvm"
+		}
+	}
+	return accelParam(cmdline)
+}
+
+var (
+	qemuVersionsMutex sync.Mutex
+	qemuVersions      = map[string]string{}
+)
+
+// qemuVersion returns the first line of 'qemu -version' output, it is run once per binary
+func qemuVersion(binary string) string {
+	qemuVersionsMutex.Lock()
+	defer qemuVersionsMutex.Unlock()
+	if v, ok := qemuVersions[binary]; ok {
+		return v
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	var version string
+	if out, err := exec.CommandContext(ctx, binary, "-version").Output(); err == nil {
+		// the first line is 'QEMU emulator version X', the rest is copyright
+		version, _, _ = strings.Cut(string(out), "\n")
+	} else {
+		version = fmt.Sprintf("unknown (%v)", err)
+	}
+	qemuVersions[binary] = version
+	return version
+}
+
+// reportError adds the VM environment report to err
+func (q *Qemu) reportError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &QemuError{Err: err, Report: q.Report()}
+}
+
+func newQemuReport(cmdline []string, binary, version string, stderr *tailBuffer) *QemuReport {
+	r := &QemuReport{
+		Cmdline: append([]string{binary}, cmdline...),
+		Version: version,
+		Accel:   accelParam(cmdline),
+	}
+	if stderr != nil {
+		r.Stderr = stderr.String()
+	}
+	return r
+}
+
+// accelParam returns the accelerator specified at the qemu command line, qemu defaults to 'tcg'
+func accelParam(params []string) string {
+	if accel, ok := cmdlineAccel(params); ok {
+		return accel
+	}
+	return "tcg"
+}
+
+// cmdlineAccel returns the accelerator set with '-enable-kvm', '-accel' or '-machine accel=' qemu parameters
+func cmdlineAccel(params []string) (string, bool) {
+	if containsParam(params, "-enable-kvm") {
+		return "kvm", true
+	}
+	if accel, ok := paramValue(params, "-accel"); ok {
+		name, _, _ := strings.Cut(accel, ",")
+		return name, true
+	}
+	for _, flag := range []string{"-machine", "-M"} {
+		machine, ok := paramValue(params, flag)
+		if !ok {
+			continue
+		}
+		for _, p := range strings.Split(machine, ",") {
+			if v, ok := strings.CutPrefix(p, "accel="); ok {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+// tailBuffer is an io.Writer that keeps the last written bytes only
+type tailBuffer struct {
+	mutex sync.Mutex
+	data  []byte
+	limit int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.data = append(b.data, p...)
+	if len(b.data) > b.limit {
+		b.data = append([]byte(nil), b.data[len(b.data)-b.limit:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return string(b.data)
+}
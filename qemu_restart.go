@@ -0,0 +1,59 @@
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrQemuExited is returned by NewQemu when the qemu process exits during the start, e.g. it crashed
+	ErrQemuExited = errors.New("qemu exited during the start")
+	// ErrNoConsoleOutput is returned by NewQemu when the VM prints nothing within RestartPolicy.ConsoleTimeout
+	ErrNoConsoleOutput = errors.New("no console output")
+)
+
+// RestartPolicy tears down and relaunches the VM if its start fails with a transient error. It helps with
+// flaky boots at oversubscribed CI hosts.
+type RestartPolicy struct {
+	// MaxAttempts is the maximum number of the VM launches
+	MaxAttempts int
+	// RetryOn are errors, matched with errors.Is, that cause a relaunch. Default is ErrQemuExited and ErrNoConsoleOutput.
+	RetryOn []error
+	// ConsoleTimeout fails the start with ErrNoConsoleOutput if the VM prints nothing to the console within
+	// this time. Zero disables the check.
+	ConsoleTimeout time.Duration
+}
+
+func (p *RestartPolicy) retryable(err error) bool {
+	retryOn := p.RetryOn
+	if len(retryOn) == 0 {
+		retryOn = []error{ErrQemuExited, ErrNoConsoleOutput}
+	}
+	for _, r := range retryOn {
+		if errors.Is(err, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// start launches the VM till it starts successfully, a non-transient error happens or the attempts are exhausted
+func (p *RestartPolicy) start(ctx context.Context, q *Qemu) error {
+	for attempt := 1; ; attempt++ {
+		// a failed start releases its process, sockets and temporary directories, so nothing of the
+		// failed attempt is left for the next one
+		err := q.start(ctx)
+		if err == nil && p.ConsoleTimeout != 0 && !q.console.waitOutput(time.Now().Add(p.ConsoleTimeout)) {
+			err = q.reportError(ErrNoConsoleOutput)
+			q.Kill()
+		}
+		if err == nil {
+			return nil
+		}
+		if attempt >= p.MaxAttempts || !p.retryable(err) {
+			return err
+		}
+		q.logf("vm start failed, relaunching (attempt %d of %d): %v", attempt+1, p.MaxAttempts, err)
+	}
+}
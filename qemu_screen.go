@@ -0,0 +1,125 @@
+package vmtest
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// QemuGPU configures a virtio-gpu display adapter. The display is rendered headless.
+type QemuGPU struct {
+	// Virgl enables 3D acceleration with virglrenderer. It requires host GL support.
+	Virgl bool
+	// Device is a GPU device model. Default is 'virtio-gpu-pci' or 'virtio-gpu-gl-pci' if Virgl is enabled.
+	Device string
+	// List of arguments appended to the device's "-device" parameter
+	DeviceParams []string
+}
+
+func (g *QemuGPU) params() []string {
+	device := g.Device
+	if device == "" {
+		if g.Virgl {
+			device = "virtio-gpu-gl-pci"
+		} else {
+			device = "virtio-gpu-pci"
+		}
+	}
+	return []string{"-device", strings.Join(append([]string{device}, g.DeviceParams...), ",")}
+}
+
+// Screendump saves the current content of the VM display to the file in PPM format
+func (q *Qemu) Screendump(filename string) error {
+	_, err := q.QMP("screendump", map[string]string{"filename": filename})
+	return err
+}
+
+// Screenshot captures the current content of the VM display
+func (q *Qemu) Screenshot() (image.Image, error) {
+	filename := path.Join(q.socketsDir, "screendump.ppm")
+	if err := q.Screendump(filename); err != nil {
+		return nil, err
+	}
+	defer os.Remove(filename)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return decodePPM(bufio.NewReader(f))
+}
+
+// ScreenExpectNonBlank waits until the VM display shows anything but a single solid color,
+// e.g. a boot splash or a compositor has been drawn
+func (q *Qemu) ScreenExpectNonBlank(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		img, err := q.Screenshot()
+		if err != nil {
+			return err
+		}
+		if !isBlankImage(img) {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("screen is still blank after %v", timeout)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+// isBlankImage reports whether all the image pixels have the same color
+func isBlankImage(img image.Image) bool {
+	b := img.Bounds()
+	if b.Empty() {
+		return true
+	}
+	first := img.At(b.Min.X, b.Min.Y)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if img.At(x, y) != first {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// decodePPM decodes binary (P6) PPM image produced by QEMU screendump command
+func decodePPM(r *bufio.Reader) (image.Image, error) {
+	var magic string
+	var width, height, maxval int
+	if _, err := fmt.Fscan(r, &magic, &width, &height, &maxval); err != nil {
+		return nil, fmt.Errorf("ppm header: %v", err)
+	}
+	if magic != "P6" {
+		return nil, fmt.Errorf("unsupported ppm format %q", magic)
+	}
+	if maxval != 255 {
+		return nil, fmt.Errorf("unsupported ppm maxval %d", maxval)
+	}
+	// single whitespace separates the header from the pixel data
+	if _, err := r.ReadByte(); err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	row := make([]byte, 3*width)
+	for y := 0; y < height; y++ {
+		if _, err := io.ReadFull(r, row); err != nil {
+			return nil, fmt.Errorf("ppm data: %v", err)
+		}
+		for x := 0; x < width; x++ {
+			img.SetRGBA(x, y, color.RGBA{R: row[3*x], G: row[3*x+1], B: row[3*x+2], A: 0xff})
+		}
+	}
+	return img, nil
+}
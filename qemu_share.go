@@ -0,0 +1,38 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+)
+
+// QemuShare is a host directory shared with the guest using virtio 9p filesystem.
+// The guest mounts it with 'mount -t 9p -o trans=virtio,version=9p2000.L $tag /mnt'.
+type QemuShare struct {
+	// Path is a host directory
+	Path string
+	// Tag is a mount tag used by the guest to identify the share
+	Tag string
+	// ReadOnly prevents the guest from modifying the directory
+	ReadOnly bool
+}
+
+// sharesParams renders '-virtfs' parameters
+func sharesParams(shares []QemuShare) ([]string, error) {
+	var params []string
+	for i, s := range shares {
+		if s.Tag == "" {
+			return nil, fmt.Errorf("share #%d: tag is not specified", i)
+		}
+		if fi, err := os.Stat(s.Path); err != nil {
+			return nil, fmt.Errorf("share %v: %v", s.Tag, err)
+		} else if !fi.IsDir() {
+			return nil, fmt.Errorf("share %v: %v is not a directory", s.Tag, s.Path)
+		}
+		virtfs := fmt.Sprintf("local,path=%s,mount_tag=%s,security_model=none,id=fs%d", escapeParam(s.Path), escapeParam(s.Tag), i)
+		if s.ReadOnly {
+			virtfs += ",readonly=on"
+		}
+		params = append(params, "-virtfs", virtfs)
+	}
+	return params, nil
+}
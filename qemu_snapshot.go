@@ -0,0 +1,41 @@
+package vmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// humanMonitor runs the human monitor (HMP) command over QMP. The commands report errors as their output,
+// so any output is returned as an error.
+func (q *Qemu) humanMonitor(command string) error {
+	out, err := q.QMP("human-monitor-command", map[string]string{"command-line": command})
+	if err != nil {
+		return err
+	}
+	var msg string
+	if err := json.Unmarshal(out, &msg); err != nil {
+		return err
+	}
+	if msg = strings.TrimSpace(msg); msg != "" {
+		name, _, _ := strings.Cut(command, " ")
+		return fmt.Errorf("%v: %v", name, msg)
+	}
+	return nil
+}
+
+// SaveSnapshot saves the machine state (RAM, devices and disks) under the name. All writable disks must be
+// in qcow2 format, the state is stored in the first of them.
+func (q *Qemu) SaveSnapshot(name string) error {
+	return q.humanMonitor("savevm " + name)
+}
+
+// LoadSnapshot restores the machine state saved by SaveSnapshot()
+func (q *Qemu) LoadSnapshot(name string) error {
+	return q.humanMonitor("loadvm " + name)
+}
+
+// DeleteSnapshot removes the machine state saved by SaveSnapshot()
+func (q *Qemu) DeleteSnapshot(name string) error {
+	return q.humanMonitor("delvm " + name)
+}
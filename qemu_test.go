@@ -1,10 +1,21 @@
 package vmtest
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"net"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
@@ -118,8 +129,14 @@ func TestRunArmInQemu(t *testing.T) {
 
 func TestAnsiEscapeRemoval(t *testing.T) {
 	check := func(in, expected string) {
-		got := ansiRe.ReplaceAllString(in, "")
-		require.Equal(t, expected, got)
+		var term terminal
+		var got []byte
+		for _, line := range term.write([]byte(in)) {
+			got = append(got, line...)
+			got = append(got, '\n')
+		}
+		got = append(got, term.current()...)
+		require.Equal(t, expected, string(got))
 	}
 
 	// this test data represents sequences printed by qemu/seabios/ovmf/linux/..
@@ -130,3 +147,976 @@ func TestAnsiEscapeRemoval(t *testing.T) {
 	check("[\u001B[0;32m  OK  \u001B[0m] Created slice \u001B[0;1;39mSlice /system/getty\u001B[0m.", "[  OK  ] Created slice Slice /system/getty.") // linux
 	check("30s)\n\u001BM\n\u001B[K[ ***  ] A start job is r", "30s)\n\n[ ***  ] A start job is r")                                                  // systemd
 }
+
+func TestSMBIOSCmdline(t *testing.T) {
+	opts := QemuOptions{
+		UUID: "e3a3c1a2-7b1e-4c57-9d0a-2d0a9a4e5f11",
+		SMBIOS: &QemuSMBIOS{
+			Manufacturer: "Acme, Inc.",
+			Product:      "Test Machine",
+			Serial:       "SN123",
+		},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "e3a3c1a2-7b1e-4c57-9d0a-2d0a9a4e5f11")
+	require.Contains(t, cmdline, "type=1,manufacturer=Acme,, Inc.,product=Test Machine,serial=SN123")
+
+	opts.UUID = "not-a-uuid"
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestFirmwareFilesValidation(t *testing.T) {
+	opts := QemuOptions{
+		Architecture: QEMU_RISCV64,
+		BIOS:         "testdata/hello-arm.bin",
+		DTB:          "testdata/hello-arm.bin",
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "-bios")
+	require.Contains(t, cmdline, "-dtb")
+
+	opts.DTB = "testdata/nonexistent.dtb"
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestMemoryBackendCmdline(t *testing.T) {
+	opts := QemuOptions{
+		Memory: &QemuMemory{Size: "1G", Shared: true, Path: "/tmp"},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "memory-backend-file,id=mem0,size=1G,mem-path=/tmp,share=on")
+	require.Contains(t, cmdline, "node,memdev=mem0")
+
+	opts.Memory = &QemuMemory{}
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestVhostUserCmdline(t *testing.T) {
+	opts := QemuOptions{
+		VhostUser: []QemuVhostUser{
+			{Type: VHOST_USER_FS, Socket: "/tmp/virtiofsd.sock", Tag: "share"},
+		},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "memory-backend-file,id=mem0,size=128M,mem-path=/dev/shm,share=on")
+	require.Contains(t, cmdline, "socket,id=vhu0,path=/tmp/virtiofsd.sock")
+	require.Contains(t, cmdline, "vhost-user-fs-pci,chardev=vhu0,tag=share")
+}
+
+func TestNestedVirtualizationCmdline(t *testing.T) {
+	params, err := nestedParams([]string{"-m", "1G"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-enable-kvm", "-cpu", "host"}, params)
+
+	params, err = nestedParams([]string{"-enable-kvm", "-cpu", "qemu64,+vmx"})
+	require.NoError(t, err)
+	require.Empty(t, params)
+
+	params, err = nestedParams([]string{"-accel", "kvm,kernel-irqchip=on"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-cpu", "host"}, params)
+
+	params, err = nestedParams([]string{"-machine", "q35,accel=kvm"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"-cpu", "host"}, params)
+
+	_, err = nestedParams([]string{"-cpu", "qemu64"})
+	require.Error(t, err)
+
+	_, err = nestedParams([]string{"-accel", "tcg,thread=multi"})
+	require.Error(t, err)
+
+	_, err = nestedParams([]string{"-M", "accel=tcg"})
+	require.Error(t, err)
+}
+
+func TestUSBCmdline(t *testing.T) {
+	opts := QemuOptions{
+		USB: []QemuUSBDevice{
+			{Type: USB_STORAGE, Path: "usb.img", Format: "raw"},
+			{Type: USB_HOST, VendorID: 0x046d, ProductID: 0xc52b},
+		},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "qemu-xhci,id=usb")
+	require.Contains(t, cmdline, "format=raw,if=none,id=usbhd0,file=usb.img")
+	require.Contains(t, cmdline, "usb-storage,bus=usb.0,drive=usbhd0")
+	require.Contains(t, cmdline, "usb-host,bus=usb.0,vendorid=0x046d,productid=0xc52b")
+}
+
+func TestConfidentialCmdline(t *testing.T) {
+	firmware := filepath.Join(t.TempDir(), "OVMF.fd")
+	require.NoError(t, os.WriteFile(firmware, nil, 0o644))
+
+	opts := QemuOptions{Confidential: &QemuConfidential{Type: CONFIDENTIAL_SEV_SNP, Firmware: firmware, Policy: 0x30000}}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "sev-snp-guest,id=cgs0,cbitpos=51,reduced-phys-bits=1,policy=0x30000")
+	require.Contains(t, cmdline, "confidential-guest-support=cgs0")
+	require.Contains(t, cmdline, "-enable-kvm")
+	bios, _ := paramValue(cmdline, "-bios")
+	require.Equal(t, firmware, bios)
+
+	opts.Confidential = &QemuConfidential{Type: CONFIDENTIAL_SEV, Firmware: firmware, CBitPos: 47, ReducedPhysBits: 5}
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "sev-guest,id=cgs0,cbitpos=47,reduced-phys-bits=5")
+
+	opts.Confidential = &QemuConfidential{Type: CONFIDENTIAL_TDX, Firmware: firmware}
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "tdx-guest,id=cgs0")
+	require.Contains(t, cmdline, "confidential-guest-support=cgs0,kernel-irqchip=split")
+
+	opts.Confidential = &QemuConfidential{Type: CONFIDENTIAL_TDX}
+	_, err = buildCmdline(&opts, "", nil)
+	require.ErrorContains(t, err, "requires firmware")
+	opts.Confidential = &QemuConfidential{Type: "cca", Firmware: firmware}
+	_, err = buildCmdline(&opts, "", nil)
+	require.ErrorContains(t, err, "unknown confidential guest type")
+
+	// KVM is not enabled twice
+	opts = QemuOptions{
+		Confidential:         &QemuConfidential{Type: CONFIDENTIAL_SEV, Firmware: firmware},
+		NestedVirtualization: true,
+		Params:               []string{"-accel", "kvm"},
+	}
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.NotContains(t, cmdline, "-enable-kvm")
+	opts.Params = nil
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	kvm := 0
+	for _, p := range cmdline {
+		if p == "-enable-kvm" {
+			kvm++
+		}
+	}
+	require.Equal(t, 1, kvm)
+
+	opts.Params = []string{"-accel", "tcg"}
+	_, err = buildCmdline(&opts, "", nil)
+	require.ErrorContains(t, err, "confidential guest requires kvm accelerator")
+
+	opts = QemuOptions{Confidential: &QemuConfidential{Type: CONFIDENTIAL_SEV, Firmware: firmware}, BIOS: firmware}
+	require.ErrorContains(t, opts.Validate(), "opts.BIOS cannot be used with opts.Confidential")
+	opts = QemuOptions{Confidential: &QemuConfidential{Type: CONFIDENTIAL_SEV, Firmware: firmware}, Architecture: QEMU_AARCH64}
+	require.ErrorContains(t, opts.Validate(), "supported only for")
+	require.Error(t, ProbeConfidential("cca"))
+}
+
+func TestFloppyAndSDCardCmdline(t *testing.T) {
+	opts := QemuOptions{Floppy: "dos,6.img", SDCard: "sdcard.img"}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "if=floppy,index=0,format=raw,file=dos,,6.img")
+	require.Contains(t, cmdline, "if=sd,index=0,format=raw,file=sdcard.img")
+
+	cmdline, err = buildCmdline(&QemuOptions{}, "", nil)
+	require.NoError(t, err)
+	require.NotContains(t, strings.Join(cmdline, " "), "if=floppy")
+	require.NotContains(t, strings.Join(cmdline, " "), "if=sd")
+
+	opts = QemuOptions{Floppy: filepath.Join(t.TempDir(), "missing.img")}
+	require.ErrorContains(t, opts.Validate(), "opts.Floppy")
+	opts = QemuOptions{SDCard: filepath.Join(t.TempDir(), "missing.img")}
+	require.ErrorContains(t, opts.Validate(), "opts.SDCard")
+}
+
+func TestVFIODeviceValidation(t *testing.T) {
+	root := t.TempDir()
+	defer func(old string) { sysfsRoot = old }(sysfsRoot)
+	sysfsRoot = root
+
+	addDevice := func(addr, driver string) {
+		dev := path.Join(root, "bus/pci/devices", addr)
+		require.NoError(t, os.MkdirAll(dev, 0o755))
+		require.NoError(t, os.MkdirAll(path.Join(root, "kernel/iommu_groups/7/devices", addr), 0o755))
+		require.NoError(t, os.Symlink("../../../kernel/iommu_groups/7", path.Join(dev, "iommu_group")))
+		if driver != "" {
+			require.NoError(t, os.Symlink("../../../bus/pci/drivers/"+driver, path.Join(dev, "driver")))
+		}
+	}
+	addDevice("0000:01:00.0", "vfio-pci")
+	require.NoError(t, checkVFIODevice("01:00.0"))
+
+	// the root port and the stubbed devices of the group do not need vfio-pci
+	addDevice("0000:00:01.0", "pcieport")
+	addDevice("0000:01:00.2", "pci-stub")
+	require.NoError(t, checkVFIODevice("01:00.0"))
+	require.ErrorContains(t, checkVFIODevice("00:01.0"), "bind it to vfio-pci")
+
+	// an unbound device does not prevent the group from being used but cannot be passed through itself
+	addDevice("0000:01:00.3", "")
+	require.NoError(t, checkVFIODevice("01:00.0"))
+	require.ErrorContains(t, checkVFIODevice("01:00.3"), "is not bound to any driver")
+
+	addDevice("0000:01:00.1", "snd_hda_intel")
+	require.ErrorContains(t, checkVFIODevice("01:00.0"), "0000:01:00.1")
+
+	require.Equal(t, []string{"-device", "vfio-pci,host=0000:01:00.0"}, vfioParams([]string{"01:00.0"}))
+}
+
+func TestInputAndAudioCmdline(t *testing.T) {
+	opts := QemuOptions{
+		Input: []InputDevice{INPUT_KEYBOARD, INPUT_TABLET},
+		Audio: &QemuAudio{},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "virtio-keyboard-pci")
+	require.Contains(t, cmdline, "virtio-tablet-pci")
+	require.Contains(t, cmdline, "none,id=audio0")
+	require.Contains(t, cmdline, "hda-duplex,audiodev=audio0")
+}
+
+func TestDecodePPM(t *testing.T) {
+	data := append([]byte("P6\n2 1\n255\n"), 0, 0, 0, 0xff, 0x80, 0x00)
+	img, err := decodePPM(bufio.NewReader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	require.Equal(t, image.Rect(0, 0, 2, 1), img.Bounds())
+	require.Equal(t, color.RGBA{R: 0xff, G: 0x80, A: 0xff}, img.At(1, 0))
+	require.False(t, isBlankImage(img))
+}
+
+// fakeOCR recognizes the texts one by one, the last one is repeated
+type fakeOCR struct {
+	texts []string
+	calls int
+}
+
+func (f *fakeOCR) Recognize(image.Image) (string, error) {
+	text := f.texts[f.calls]
+	if f.calls < len(f.texts)-1 {
+		f.calls++
+	}
+	return text, nil
+}
+
+func TestScreenExpect(t *testing.T) {
+	dir := t.TempDir()
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeQMPServer(t, server, func(cmd string) string {
+		if cmd == "screendump" {
+			data := append([]byte("P6\n1 1\n255\n"), 0, 0, 0)
+			if err := os.WriteFile(path.Join(dir, "screendump.ppm"), data, 0o644); err != nil {
+				return `{"error": {"class": "GenericError", "desc": "` + err.Error() + `"}}`
+			}
+		}
+		return `{"return": {}}`
+	})
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+
+	ocr := &fakeOCR{texts: []string{"Booting", "Welcome   to\nvmtest"}}
+	q := &Qemu{qmp: qmp, socketsDir: dir, ocr: ocr}
+	require.NoError(t, q.ScreenExpect("Welcome to vmtest", 5*time.Second))
+	require.Equal(t, 1, ocr.calls)
+
+	err = q.ScreenExpect("login:", 0)
+	require.ErrorContains(t, err, `screen does not contain "login:" after 0s, recognized: "Welcome to vmtest"`)
+}
+
+func TestBootOrderCmdline(t *testing.T) {
+	opts := QemuOptions{
+		CdRom: "installer.iso",
+		Disks: []QemuDisk{{Path: "disk.img", Format: "raw", BootIndex: 1}},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "order=d")
+	require.Contains(t, cmdline, "scsi-hd,drive=hd0,bootindex=1")
+
+	opts.BootOrder = "cn"
+	opts.BootMenu = true
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "order=cn,menu=on")
+
+	opts.BootOrder = "x"
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestACPITableCmdline(t *testing.T) {
+	opts := QemuOptions{
+		ACPITables: []QemuACPITable{
+			{Data: "testdata/hello-arm.bin", Signature: "SSDT", OEMID: "VMTEST", OEMRevision: 2},
+		},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "sig=SSDT,oem_id=VMTEST,oem_rev=2,data=testdata/hello-arm.bin")
+
+	opts.ACPITables[0].OEMID = "TOOLONGID"
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestChardevTransport(t *testing.T) {
+	opts := QemuOptions{ChardevTransport: CHARDEV_TCP, GuestAgent: true}
+	dir := t.TempDir()
+	addrs := chardevAddrs{}
+	for _, name := range []string{consoleSocket, agentSocket} {
+		l, err := listenChardev(&opts, dir, name, addrs)
+		require.NoError(t, err)
+		defer l.Close()
+	}
+	consolePort := addrs[consoleSocket].(*net.TCPAddr).Port
+	agentPort := addrs[agentSocket].(*net.TCPAddr).Port
+
+	cmdline, err := buildCmdline(&opts, dir, addrs)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, fmt.Sprintf("tcp:127.0.0.1:%d", consolePort))
+	require.Contains(t, cmdline, "unix:"+path.Join(dir, monitorSocket))
+	require.Contains(t, cmdline, fmt.Sprintf("socket,id=qga0,host=127.0.0.1,port=%d", agentPort))
+
+	opts.ChardevTransport = "udp"
+	_, err = listenChardev(&opts, dir, qmpSocket, addrs)
+	require.Error(t, err)
+}
+
+func TestVirtualBoxArgs(t *testing.T) {
+	opts := VirtualBoxOptions{CdRom: "installer.iso", Memory: 1024, Params: []string{"--nested-hw-virt", "on"}}
+	args := virtualBoxArgs(&opts, "/tmp/vm/console.socket")
+	require.Equal(t, []string{
+		"--uart1", "0x3F8", "4",
+		"--uartmode1", "server", "/tmp/vm/console.socket",
+		"--boot1", "dvd", "--boot2", "disk",
+		"--memory", "1024",
+		"--nested-hw-virt", "on",
+	}, args)
+}
+
+func TestOperatingSystemPresets(t *testing.T) {
+	opts := QemuOptions{
+		OperatingSystem: OS_WINDOWS,
+		Disks:           []QemuDisk{{Path: "windows.qcow2", Format: "qcow2"}},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "base=localtime")
+	require.Contains(t, cmdline, "ahci,id=ahci")
+	require.Contains(t, cmdline, "ide-hd,drive=hd0,bus=ahci.0")
+	require.NotContains(t, cmdline, "virtio-scsi-pci,id=scsi")
+
+	opts = QemuOptions{OperatingSystem: OS_FREEBSD, Kernel: "vmlinuz"}
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestRebootOptions(t *testing.T) {
+	cmdline, err := buildCmdline(&QemuOptions{}, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "-no-reboot")
+	require.NotContains(t, cmdline, "-no-shutdown")
+
+	cmdline, err = buildCmdline(&QemuOptions{AllowReboot: true, NoShutdown: true}, "", nil)
+	require.NoError(t, err)
+	require.NotContains(t, cmdline, "-no-reboot")
+	require.Contains(t, cmdline, "-no-shutdown")
+}
+
+func TestSnapshot(t *testing.T) {
+	opts := QemuOptions{
+		Disks: []QemuDisk{{Path: "rootfs.img", Format: "raw", Snapshot: true}, {Path: "data.img", Format: "raw"}},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "format=raw,if=none,id=hd0,file=rootfs.img,snapshot=on")
+	require.Contains(t, cmdline, "format=raw,if=none,id=hd1,file=data.img")
+	require.NotContains(t, cmdline, "-snapshot")
+
+	opts.Disks = append(opts.Disks, QemuDisk{Path: "data.img", Format: "raw", Shared: true})
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "format=raw,if=none,id=hd2,file=data.img,file.locking=off")
+	require.Contains(t, cmdline, "scsi-hd,drive=hd2,share-rw=on")
+
+	opts.Ephemeral = true
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "-snapshot")
+}
+
+func TestClock(t *testing.T) {
+	base := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	opts := QemuOptions{Clock: &QemuClock{Base: base, VMClock: true}}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "base=2030-01-02T03:04:05,clock=vm")
+
+	opts = QemuOptions{OperatingSystem: OS_WINDOWS}
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "base=localtime")
+}
+
+func TestDiskThrottle(t *testing.T) {
+	opts := QemuOptions{
+		Disks: []QemuDisk{{Path: "rootfs.img", Format: "raw", Throttle: &QemuThrottle{IOPSTotal: 100, BPSWrite: 1 << 20}}},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "format=raw,if=none,id=hd0,file=rootfs.img,throttling.iops-total=100,throttling.bps-write=1048576")
+}
+
+func TestDiskFaultInjection(t *testing.T) {
+	sector := int64(2048)
+	opts := QemuOptions{
+		Disks: []QemuDisk{{Path: "rootfs.img", Format: "raw", FaultInjection: []QemuFaultRule{
+			{Event: "read_aio", Sector: &sector, Once: true},
+			{Event: "write_aio", Errno: 28},
+		}}},
+	}
+	dir := t.TempDir()
+	cmdline, err := buildCmdline(&opts, dir, nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "format=raw,if=none,id=hd0,file=blkdebug:"+dir+"/blkdebug0.conf:rootfs.img")
+
+	require.NoError(t, writeFaultRules(&opts, dir))
+	config, err := os.ReadFile(path.Join(dir, "blkdebug0.conf"))
+	require.NoError(t, err)
+	require.Equal(t, `[inject-error]
+event = "read_aio"
+errno = "5"
+sector = "2048"
+once = "on"
+immediately = "off"
+
+[inject-error]
+event = "write_aio"
+errno = "28"
+once = "off"
+immediately = "off"
+
+`, string(config))
+
+	opts.Disks[0].FaultInjection = []QemuFaultRule{{Errno: 5}}
+	_, err = buildCmdline(&opts, dir, nil)
+	require.Error(t, err)
+}
+
+func TestNICs(t *testing.T) {
+	opts := QemuOptions{NICs: []QemuNIC{
+		{BackendParams: []string{"hostfwd=tcp::10022-:22"}},
+		{ID: "fast", Backend: NET_TAP, Queues: 4, Vhost: true, BackendParams: []string{"ifname=tap0", "script=no"}, DeviceParams: []string{"rss=on"}},
+	}}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "user,id=net0,hostfwd=tcp::10022-:22")
+	require.Contains(t, cmdline, "virtio-net-pci,netdev=net0,mac="+defaultMAC("", 0))
+	require.Contains(t, cmdline, "tap,id=fast,queues=4,vhost=on,ifname=tap0,script=no")
+	require.Contains(t, cmdline, "virtio-net-pci,netdev=fast,mac="+defaultMAC("", 1)+",mq=on,vectors=10,rss=on")
+
+	opts = QemuOptions{NICs: []QemuNIC{{Queues: 2}}}
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestGuestForwards(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	opts := QemuOptions{NICs: []QemuNIC{{GuestForwards: []QemuGuestForward{{Addr: "10.0.2.100:80", Listener: l}}}}}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, fmt.Sprintf("user,id=net0,guestfwd=tcp:10.0.2.100:80-cmd:nc 127.0.0.1 %d", port))
+
+	opts = QemuOptions{NICs: []QemuNIC{{GuestForwards: []QemuGuestForward{{Addr: "api.example.com:80", Listener: l}}}}}
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+
+	opts = QemuOptions{NICs: []QemuNIC{{Backend: NET_TAP, GuestForwards: []QemuGuestForward{{Addr: "10.0.2.100:80", Listener: l}}}}}
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestSocketNetwork(t *testing.T) {
+	n, err := NewSocketNetwork()
+	require.NoError(t, err)
+	opts := QemuOptions{NICs: []QemuNIC{n.NIC()}}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, fmt.Sprintf("socket,id=net0,mcast=230.0.0.1:%d,localaddr=127.0.0.1", n.port))
+
+	// the VMs share the network and keep the default MACSeed
+	vm1, vm2 := n.NIC(), n.NIC()
+	require.NotEqual(t, vm1.MAC, vm2.MAC)
+	macs, err := nicMACs(&QemuOptions{NICs: []QemuNIC{vm1}})
+	require.NoError(t, err)
+	require.Equal(t, vm1.MAC, macs[0])
+	require.NotEqual(t, defaultMAC("", 0), macs[0])
+}
+
+func TestNICMACs(t *testing.T) {
+	require.Regexp(t, `^52:54:00:[0-9a-f]{2}:[0-9a-f]{2}:[0-9a-f]{2}$`, defaultMAC("vm1", 0))
+	require.Equal(t, defaultMAC("vm1", 0), defaultMAC("vm1", 0))
+	require.NotEqual(t, defaultMAC("vm1", 0), defaultMAC("vm1", 1))
+	require.NotEqual(t, defaultMAC("vm1", 0), defaultMAC("vm2", 0))
+
+	macs, err := nicMACs(&QemuOptions{MACSeed: "vm1", NICs: []QemuNIC{{}, {MAC: "52:54:00:12:34:56"}}})
+	require.NoError(t, err)
+	require.Equal(t, []string{defaultMAC("vm1", 0), "52:54:00:12:34:56"}, macs)
+	require.Equal(t, "enx525400123456", MACInterfaceName(macs[1]))
+
+	q := &Qemu{macs: macs}
+	mac, err := q.MAC(1)
+	require.NoError(t, err)
+	require.Equal(t, "52:54:00:12:34:56", mac)
+	_, err = q.MAC(2)
+	require.ErrorContains(t, err, "NIC 2 is out of range")
+	_, err = q.MAC(-1)
+	require.Error(t, err)
+
+	_, err = nicMACs(&QemuOptions{NICs: []QemuNIC{{MAC: "52:54:00"}}})
+	require.Error(t, err)
+}
+
+func TestDiskController(t *testing.T) {
+	opts := QemuOptions{
+		Disks: []QemuDisk{{Path: "rootfs.img", Format: "raw", Controller: "virtio-blk-device"}},
+	}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.NotContains(t, cmdline, "virtio-scsi-pci,id=scsi")
+	require.Contains(t, cmdline, "virtio-blk-device,drive=hd0")
+
+	opts.Disks = append(opts.Disks, QemuDisk{Path: "data.img"})
+	opts.DiskController = DISK_CONTROLLER_VIRTIO_SCSI_DEVICE
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "virtio-scsi-device,id=scsi")
+	require.Contains(t, cmdline, "scsi-hd,drive=hd1")
+
+	opts.DiskController = DISK_CONTROLLER_NONE
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestValidateAndBuildCmdline(t *testing.T) {
+	opts := QemuOptions{
+		Architecture: QEMU_AARCH64,
+		Kernel:       "testdata/hello-arm.bin",
+		Params:       []string{"-machine", "virt"},
+	}
+	argv, err := BuildCmdline(&opts)
+	require.NoError(t, err)
+	require.Equal(t, "qemu-system-aarch64", argv[0])
+	require.Contains(t, argv, "testdata/hello-arm.bin")
+
+	opts.Disks = []QemuDisk{{Path: "testdata/nonexistent.img"}}
+	require.Error(t, opts.Validate())
+	opts.Disks = nil
+
+	opts.InitRamFs = "testdata/hello-arm.bin"
+	opts.Kernel = ""
+	require.Error(t, opts.Validate())
+
+	opts = QemuOptions{Architecture: QEMU_AARCH64, NestedVirtualization: true}
+	_, err = BuildCmdline(&opts)
+	require.Error(t, err)
+}
+
+func TestWrapCommand(t *testing.T) {
+	binary, args := wrapCommand(WrapperPerfRecord, "/tmp/artifacts", "qemu-system-x86_64", []string{"-m", "1G"})
+	require.Equal(t, "perf", binary)
+	require.Equal(t, []string{"record", "-g", "-o", "/tmp/artifacts/perf.data", "--", "qemu-system-x86_64", "-m", "1G"}, args)
+
+	binary, args = wrapCommand(nil, "", "qemu-system-x86_64", []string{"-m", "1G"})
+	require.Equal(t, "qemu-system-x86_64", binary)
+	require.Equal(t, []string{"-m", "1G"}, args)
+}
+
+func TestQemuReport(t *testing.T) {
+	client, server := net.Pipe()
+	stderr := &tailBuffer{limit: 8}
+	q := &Qemu{
+		console: newConsole(client, consoleConfig{}),
+		binary:  "/nonexistent/qemu-system-x86_64",
+		cmdline: []string{"-accel", "kvm,kernel-irqchip=on", "-m", "1G"},
+		stderr:  stderr,
+	}
+	go q.console.pump(nil)
+
+	_, _ = stderr.Write([]byte("qemu: warning: foo\n"))
+	_, _ = server.Write([]byte("Booting\nPanic\n"))
+	server.Close()
+
+	err := q.ConsoleExpect("login:")
+	var qemuErr *QemuError
+	require.ErrorAs(t, err, &qemuErr)
+	require.ErrorIs(t, err, io.EOF)
+	r := qemuErr.Report
+	require.Equal(t, []string{"/nonexistent/qemu-system-x86_64", "-accel", "kvm,kernel-irqchip=on", "-m", "1G"}, r.Cmdline)
+	require.Equal(t, "kvm", r.Accel)
+	require.Equal(t, []string{"Booting", "Panic"}, r.Console)
+	require.Equal(t, "ng: foo\n", r.Stderr)
+	require.Contains(t, err.Error(), "last console lines:\nBooting\nPanic")
+
+	require.Equal(t, "tcg", accelParam(nil))
+	require.Equal(t, "hvf", accelParam([]string{"-machine", "q35,accel=hvf"}))
+	require.Equal(t, "kvm", accelParam([]string{"-enable-kvm"}))
+
+	// the failed binary is run once and the result is cached
+	require.Contains(t, qemuVersion("/nonexistent/qemu-system-x86_64"), "unknown")
+	qemuVersions["/nonexistent/qemu-system-x86_64"] = "QEMU emulator version 9.0.0"
+	q.version = qemuVersion("/nonexistent/qemu-system-x86_64")
+	require.Equal(t, "QEMU emulator version 9.0.0", q.Report().Version)
+	delete(qemuVersions, "/nonexistent/qemu-system-x86_64")
+}
+
+func TestQueryAccel(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	queries := 0
+	go fakeQMPServer(t, server, func(cmd string) string {
+		if cmd == "query-kvm" {
+			queries++
+			return `{"return": {"enabled": true, "present": true}}`
+		}
+		return `{"return": {}}`
+	})
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{console: newConsole(nil, consoleConfig{}), qmp: qmp, cmdline: []string{"-accel", "tcg"}}
+	q.accel = queryAccel(qmp, q.cmdline)
+	require.Equal(t, "kvm", q.accel)
+	// the report reuses the accelerator captured at the start
+	require.Equal(t, "kvm", q.Report().Accel)
+	require.Equal(t, "kvm", q.Report().Accel)
+	require.Equal(t, 1, queries)
+}
+
+func TestHeartbeat(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	var buf bytes.Buffer
+	q := &Qemu{
+		opts:      &QemuOptions{VerboseOutput: &buf, VerbosePrefix: "[vm1] "},
+		console:   newConsole(client, consoleConfig{}),
+		startTime: time.Now(),
+	}
+	go q.console.pump(nil)
+	_, _ = server.Write([]byte("Booting\nStarting udev"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		q.heartbeat(ctx, 20*time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	require.Contains(t, buf.String(), `[vm1] vm running, 0s elapsed, last line: "Starting udev"`)
+}
+
+func TestRestartPolicyRetryable(t *testing.T) {
+	p := &RestartPolicy{}
+	require.True(t, p.retryable(&QemuError{Err: fmt.Errorf("%w: %w", ErrQemuExited, errors.New("exit status 1"))}))
+	require.True(t, p.retryable(ErrNoConsoleOutput))
+	require.False(t, p.retryable(errors.New("file not found")))
+
+	errFlaky := errors.New("flaky")
+	p.RetryOn = []error{errFlaky}
+	require.True(t, p.retryable(fmt.Errorf("boot: %w", errFlaky)))
+	require.False(t, p.retryable(ErrQemuExited))
+}
+
+func TestRestartPolicyCleanup(t *testing.T) {
+	useFakeQemu(t)
+	t.Setenv(fakeQemuExitEnv, "1")
+	tempDir, scratchDir := t.TempDir(), t.TempDir()
+	var log bytes.Buffer
+	opts := QemuOptions{
+		Kernel:        "testdata/hello-arm.bin",
+		TempDir:       tempDir,
+		ScratchDir:    scratchDir,
+		CrashDump:     &QemuCrashDump{},
+		RestartPolicy: &RestartPolicy{MaxAttempts: 3},
+		Timeout:       time.Minute,
+		VerboseOutput: &log,
+	}
+	_, err := NewQemu(&opts)
+	require.ErrorIs(t, err, ErrQemuExited)
+	require.Contains(t, log.String(), "vm start failed, relaunching (attempt 3 of 3)")
+
+	for _, dir := range []string{tempDir, scratchDir} {
+		left, err := filepath.Glob(filepath.Join(dir, "vmtest*"))
+		require.NoError(t, err)
+		require.Empty(t, left)
+	}
+}
+
+func TestConsoleWaitOutput(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newConsole(client, consoleConfig{})
+	go c.pump(nil)
+
+	require.False(t, c.waitOutput(time.Now().Add(20*time.Millisecond)))
+	go func() { _, _ = server.Write([]byte("SeaBIOS")) }()
+	require.True(t, c.waitOutput(time.Now().Add(time.Second)))
+}
+
+func TestVMTempDir(t *testing.T) {
+	base := t.TempDir()
+	opts := &QemuOptions{Name: "web", TempDir: filepath.Join(base, "ci")}
+	dir, err := vmTempDir(opts)
+	require.NoError(t, err)
+	require.Regexp(t, `^vmtest-web-\d+$`, filepath.Base(dir))
+	require.Equal(t, opts.TempDir, filepath.Dir(dir))
+
+	cmdline, err := buildCmdline(&QemuOptions{Name: "web,1"}, dir, nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "web,,1")
+
+	long := &QemuOptions{TempDir: filepath.Join(base, strings.Repeat("x", 100))}
+	_, err = vmTempDir(long)
+	require.ErrorContains(t, err, "longer than")
+}
+
+func TestQemuOptionsApply(t *testing.T) {
+	base := Compose(
+		WithOperatingSystem(OS_LINUX),
+		WithMemory("1G"),
+		WithAppend("quiet"),
+		WithTimeout(time.Minute),
+	)
+	opts := (&QemuOptions{}).Apply(
+		base,
+		WithKernel("bzImage"),
+		WithAppend("rd.debug"),
+		WithDisk(QemuDisk{Path: "rootfs.img", Format: "raw"}),
+		WithMemory("2G"),
+	)
+	require.Equal(t, OS_LINUX, opts.OperatingSystem)
+	require.Equal(t, "bzImage", opts.Kernel)
+	require.Equal(t, []string{"quiet", "rd.debug"}, opts.Append)
+	require.Equal(t, "2G", opts.Memory.Size)
+	require.Equal(t, time.Minute, opts.Timeout)
+	require.Len(t, opts.Disks, 1)
+
+	// options copied from a shared base do not change it
+	shared := QemuOptions{Memory: &QemuMemory{Size: "1G", Shared: true}}
+	copied := shared
+	copied.Apply(WithMemory("4G"))
+	require.Equal(t, QemuMemory{Size: "4G", Shared: true}, *copied.Memory)
+	require.Equal(t, QemuMemory{Size: "1G", Shared: true}, *shared.Memory)
+}
+
+func TestPresets(t *testing.T) {
+	opts := (&QemuOptions{}).Apply(MinimalLinux())
+	cmdline, err := buildCmdline(opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "virtio-rng-pci")
+	require.Contains(t, cmdline, "user,id=net0")
+
+	opts = (&QemuOptions{}).Apply(Aarch64Virt(), WithKernel("testdata/hello-arm.bin"), WithAppend("rdinit=/bin/sh"))
+	require.Equal(t, QEMU_AARCH64, opts.Architecture)
+	cmdline, err = buildCmdline(opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "virt")
+	kernelArgs, ok := paramValue(cmdline, "-append")
+	require.True(t, ok)
+	require.Contains(t, kernelArgs, "console=ttyAMA0,115200")
+
+	opts = (&QemuOptions{}).Apply(MicroVM(), WithKernel("testdata/hello-arm.bin"), WithDisk(QemuDisk{Path: "/dev/null", Format: "raw"}))
+	cmdline, err = buildCmdline(opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "microvm,isa-serial=on,rtc=on")
+	require.Contains(t, cmdline, "virtio-scsi-device,id=scsi")
+	require.NotContains(t, cmdline, "virtio-rng-pci")
+}
+
+func TestIdentity(t *testing.T) {
+	var first, second QemuIdentity
+	require.NoError(t, first.generate())
+	require.NoError(t, second.generate())
+	require.Regexp(t, uuidRe, first.UUID)
+	require.NotEqual(t, first.UUID, second.UUID)
+	require.NotEqual(t, first.Hostname, second.Hostname)
+	require.Regexp(t, `^VMTEST[0-9A-F]{12}$`, first.Serial)
+
+	id := QemuIdentity{UUID: "6e6f6f72-0000-4000-8000-000000000001", Hostname: "node1"}
+	require.NoError(t, id.generate())
+	require.Equal(t, "node1", id.Hostname)
+	opts := QemuOptions{OperatingSystem: OS_LINUX, Kernel: "testdata/hello-arm.bin", Identity: &id}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	uuid, _ := paramValue(cmdline, "-uuid")
+	require.Equal(t, "6e6f6f72-0000-4000-8000-000000000001", uuid)
+	require.Contains(t, cmdline, "type=1,serial=VMTEST000000000001")
+	require.Contains(t, cmdline, "type=11,value=io.systemd.credential:system.hostname=node1")
+	kernelArgs, _ := paramValue(cmdline, "-append")
+	require.Contains(t, kernelArgs, "systemd.hostname=node1")
+
+	id.CloudInit = true
+	cmdline, err = buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, cmdline, "type=1,serial=ds=nocloud;h=node1;i=6e6f6f72-0000-4000-8000-000000000001")
+
+	opts.UUID = id.UUID
+	_, err = buildCmdline(&opts, "", nil)
+	require.Error(t, err)
+}
+
+func TestConfigure(t *testing.T) {
+	q := Configure(&QemuOptions{Kernel: "testdata/hello-arm.bin", Identity: &QemuIdentity{}})
+	q.Options().Params = append(q.Options().Params, "-nodefaults")
+
+	cmdline, err := q.PlannedCmdline()
+	require.NoError(t, err)
+	require.Equal(t, qemuBinary(QEMU_X86_64), cmdline[0])
+	require.Contains(t, cmdline, "-nodefaults")
+	uuid, _ := paramValue(cmdline, "-uuid")
+	require.Equal(t, q.Identity().UUID, uuid)
+	require.Equal(t, QemuIdentity{}, *q.Options().Identity)
+	again, err := q.PlannedCmdline()
+	require.NoError(t, err)
+	require.Equal(t, cmdline, again)
+
+	q.cmd, q.exit = &exec.Cmd{}, &qemuExit{done: make(chan struct{})}
+	require.ErrorContains(t, q.Start(context.Background()), "already running")
+}
+
+func TestStartAfterGuestPoweroff(t *testing.T) {
+	useFakeQemu(t)
+	exited := make(chan error, 2)
+	q := Configure(&QemuOptions{
+		Kernel: "testdata/hello-arm.bin",
+		OnExit: func(_ *Qemu, err error) { exited <- err },
+	})
+
+	require.NoError(t, q.Start(context.Background()))
+	require.NoError(t, q.ConsoleExpect("fake qemu started"))
+	require.ErrorContains(t, q.Start(context.Background()), "already running")
+
+	require.NoError(t, q.ConsoleWrite("poweroff\n"))
+	require.NoError(t, <-exited)
+	require.NoError(t, q.Start(context.Background()))
+	require.NoError(t, q.ConsoleExpect("fake qemu started"))
+	q.Kill()
+	require.NoError(t, <-exited)
+}
+
+func TestShutdownWait(t *testing.T) {
+	useFakeQemu(t)
+	for _, noShutdown := range []bool{false, true} {
+		q, err := NewQemu(&QemuOptions{Kernel: "testdata/hello-arm.bin", NoShutdown: noShutdown, Timeout: time.Minute})
+		require.NoError(t, err)
+
+		start := time.Now()
+		guest, err := q.ShutdownWait(10 * time.Second)
+		require.NoError(t, err)
+		require.True(t, guest)
+		// the process exits by itself rather than being killed by the timeout
+		require.NoError(t, q.exit.err)
+		require.Less(t, time.Since(start), 10*time.Second)
+	}
+}
+
+func TestShutdownIgnored(t *testing.T) {
+	useFakeQemu(t)
+	t.Setenv(fakeQemuIgnoreEnv, "system_powerdown")
+
+	// without StopPolicy.ACPI the guest is given the rest of QemuOptions.Timeout
+	start := time.Now()
+	q, err := NewQemu(&QemuOptions{Kernel: "testdata/hello-arm.bin", Timeout: time.Second})
+	require.NoError(t, err)
+	q.Shutdown()
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	q, err = NewQemu(&QemuOptions{
+		Kernel:     "testdata/hello-arm.bin",
+		Timeout:    time.Minute,
+		StopPolicy: QemuStopPolicy{ACPI: 100 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	start = time.Now()
+	q.Shutdown()
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+func TestShutdownNoShutdown(t *testing.T) {
+	useFakeQemu(t)
+	opts := QemuOptions{Kernel: "testdata/hello-arm.bin", NoShutdown: true, Timeout: time.Minute}
+
+	q, err := NewQemu(&opts)
+	require.NoError(t, err)
+	start := time.Now()
+	q.Shutdown()
+	require.NoError(t, q.exit.err)
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	q, err = NewQemu(&opts)
+	require.NoError(t, err)
+	method, err := q.Stop(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, STOP_ACPI, method)
+	require.NoError(t, q.exit.err)
+}
+
+func TestIdentityPerVM(t *testing.T) {
+	useFakeQemu(t)
+	opts := QemuOptions{Kernel: "testdata/hello-arm.bin", Identity: &QemuIdentity{Hostname: "node"}}
+
+	first, err := NewQemu(&opts)
+	require.NoError(t, err)
+	defer first.Kill()
+	second, err := NewQemu(&opts)
+	require.NoError(t, err)
+	defer second.Kill()
+
+	require.NotEqual(t, first.Identity().UUID, second.Identity().UUID)
+	require.Equal(t, "node", first.Identity().Hostname)
+	require.Equal(t, QemuIdentity{Hostname: "node"}, *opts.Identity)
+	uuid, _ := paramValue(second.Cmdline(), "-uuid")
+	require.Equal(t, second.Identity().UUID, uuid)
+}
+
+func TestStartFailureCleanup(t *testing.T) {
+	useFakeQemu(t)
+	tempDir, scratchDir := t.TempDir(), t.TempDir()
+	opts := QemuOptions{
+		Kernel:     "testdata/hello-arm.bin",
+		TempDir:    tempDir,
+		ScratchDir: scratchDir,
+		CrashDump:  &QemuCrashDump{},
+		GuestAgent: true,
+		Timeout:    time.Minute,
+	}
+	requireEmpty := func(dir string) {
+		t.Helper()
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+
+	// qemu exits during the start
+	t.Setenv(fakeQemuExitEnv, "1")
+	_, err := NewQemu(&opts)
+	require.ErrorIs(t, err, ErrQemuExited)
+	requireEmpty(tempDir)
+	requireEmpty(scratchDir)
+
+	// qemu binary cannot be started
+	t.Setenv(EnvQemuBinary, filepath.Join(t.TempDir(), "missing-qemu"))
+	_, err = NewQemu(&opts)
+	require.ErrorContains(t, err, "starting QEMU")
+	requireEmpty(tempDir)
+	requireEmpty(scratchDir)
+}
@@ -0,0 +1,82 @@
+package vmtest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// USBDeviceType defines a kind of USB device attached to the guest
+type USBDeviceType string
+
+const (
+	USB_STORAGE  = USBDeviceType("usb-storage")
+	USB_KEYBOARD = USBDeviceType("usb-kbd")
+	USB_MOUSE    = USBDeviceType("usb-mouse")
+	USB_TABLET   = USBDeviceType("usb-tablet")
+	USB_SERIAL   = USBDeviceType("usb-serial")
+	// USB_HOST passes through a host USB device identified by VendorID:ProductID
+	USB_HOST = USBDeviceType("usb-host")
+)
+
+// QemuUSBDevice represents an emulated or passed through USB device
+type QemuUSBDevice struct {
+	// Type of the device
+	Type USBDeviceType
+	// Path is a disk image for USB_STORAGE or an output file for USB_SERIAL.
+	// If Path is empty for USB_SERIAL then the written data is discarded.
+	Path string
+	// Format is a disk format of USB_STORAGE image e.g. 'raw' or 'qcow2'
+	Format string
+	// VendorID of the host device for USB_HOST
+	VendorID uint16
+	// ProductID of the host device for USB_HOST
+	ProductID uint16
+	// List of arguments appended to the device's "-device" parameter
+	DeviceParams []string
+}
+
+const usbControllerID = "usb"
+
+// usbParams renders USB controller and devices parameters
+func usbParams(devices []QemuUSBDevice) ([]string, error) {
+	if len(devices) == 0 {
+		return nil, nil
+	}
+
+	params := []string{"-device", "qemu-xhci,id=" + usbControllerID}
+	for i, d := range devices {
+		device := []string{string(d.Type), "bus=" + usbControllerID + ".0"}
+		switch d.Type {
+		case USB_STORAGE:
+			if d.Path == "" {
+				return nil, fmt.Errorf("usb device #%d: storage image path is not specified", i)
+			}
+			format := ""
+			if d.Format != "" {
+				format = fmt.Sprintf("format=%s,", d.Format)
+			}
+			drive := fmt.Sprintf("usbhd%d", i)
+			params = append(params, "-drive", format+fmt.Sprintf("if=none,id=%s,file=%s", drive, escapeParam(d.Path)))
+			device = append(device, "drive="+drive)
+		case USB_SERIAL:
+			chardev := fmt.Sprintf("usbser%d", i)
+			if d.Path == "" {
+				params = append(params, "-chardev", "null,id="+chardev)
+			} else {
+				params = append(params, "-chardev", fmt.Sprintf("file,id=%s,path=%s", chardev, escapeParam(d.Path)))
+			}
+			device = append(device, "chardev="+chardev)
+		case USB_HOST:
+			if d.VendorID == 0 || d.ProductID == 0 {
+				return nil, fmt.Errorf("usb device #%d: host passthrough requires vendor and product ids", i)
+			}
+			device = append(device, fmt.Sprintf("vendorid=%#04x", d.VendorID), fmt.Sprintf("productid=%#04x", d.ProductID))
+		case USB_KEYBOARD, USB_MOUSE, USB_TABLET:
+		default:
+			return nil, fmt.Errorf("usb device #%d: unknown type %q", i, d.Type)
+		}
+		device = append(device, d.DeviceParams...)
+		params = append(params, "-device", strings.Join(device, ","))
+	}
+	return params, nil
+}
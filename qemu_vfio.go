@@ -0,0 +1,75 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sysfsRoot is a root of sysfs, the tests override it
+var sysfsRoot = "/sys"
+
+// normalizePCIAddress adds the default '0000' domain to PCI address if it is missing
+func normalizePCIAddress(addr string) string {
+	if strings.Count(addr, ":") == 1 {
+		return "0000:" + addr
+	}
+	return addr
+}
+
+// vfioGroupDrivers are the drivers the kernel allows for the other devices of a VFIO group, see
+// vfio_dev_driver_allowed(). PCIe root ports and bridges often share the group with the endpoints.
+var vfioGroupDrivers = map[string]bool{
+	"vfio-pci": true,
+	"pci-stub": true,
+	"pcieport": true,
+}
+
+// checkVFIODevice verifies that the host PCI device at addr is bound to vfio-pci driver and the other devices
+// in its IOMMU group do not prevent the group from being used, so the device can be passed through to the guest.
+func checkVFIODevice(addr string) error {
+	addr = normalizePCIAddress(addr)
+	devDir := filepath.Join(sysfsRoot, "bus/pci/devices", addr)
+	if _, err := os.Stat(devDir); err != nil {
+		return fmt.Errorf("pci device %v: %v", addr, err)
+	}
+
+	driver, err := os.Readlink(filepath.Join(devDir, "driver"))
+	if err != nil {
+		return fmt.Errorf("pci device %v is not bound to any driver, bind it to vfio-pci", addr)
+	}
+	if name := filepath.Base(driver); name != "vfio-pci" {
+		return fmt.Errorf("pci device %v is bound to %v driver, bind it to vfio-pci", addr, name)
+	}
+
+	group, err := os.Readlink(filepath.Join(devDir, "iommu_group"))
+	if err != nil {
+		return fmt.Errorf("pci device %v has no IOMMU group, is IOMMU enabled?", addr)
+	}
+	groupDevices := filepath.Join(sysfsRoot, "kernel/iommu_groups", filepath.Base(group), "devices")
+	entries, err := os.ReadDir(groupDevices)
+	if err != nil {
+		return fmt.Errorf("pci device %v: %v", addr, err)
+	}
+	for _, e := range entries {
+		driver, err := os.Readlink(filepath.Join(sysfsRoot, "bus/pci/devices", e.Name(), "driver"))
+		if err != nil {
+			// devices without a driver do not prevent the group from being used
+			continue
+		}
+		if name := filepath.Base(driver); !vfioGroupDrivers[name] {
+			return fmt.Errorf("pci device %v (IOMMU group %v of %v) is bound to %v driver, bind it to vfio-pci", e.Name(), filepath.Base(group), addr, name)
+		}
+	}
+	return nil
+}
+
+// vfioParams renders '-device vfio-pci' parameters for the given host PCI addresses
+func vfioParams(addrs []string) []string {
+	var params []string
+	for _, addr := range addrs {
+		params = append(params, "-device", "vfio-pci,host="+normalizePCIAddress(addr))
+	}
+	return params
+}
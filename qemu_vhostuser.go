@@ -0,0 +1,66 @@
+package vmtest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VhostUserType defines a kind of vhost-user device
+type VhostUserType string
+
+const (
+	VHOST_USER_NET = VhostUserType("net")
+	VHOST_USER_BLK = VhostUserType("blk")
+	VHOST_USER_FS  = VhostUserType("fs")
+)
+
+// QemuVhostUser represents a device whose data plane is implemented by an external vhost-user backend
+// (e.g. DPDK, SPDK or virtiofsd) listening at Socket
+type QemuVhostUser struct {
+	// Type of the device
+	Type VhostUserType
+	// Socket is a path to the unix socket the backend listens on
+	Socket string
+	// Tag is a mount tag of vhost-user-fs device, the guest mounts it with 'mount -t virtiofs $tag /mnt'
+	Tag string
+	// List of arguments appended to the device's "-device" parameter
+	DeviceParams []string
+}
+
+// defaultVhostUserMemory is used as a guest RAM size if vhost-user devices are present but opts.Memory is not set.
+// It matches QEMU default RAM size.
+const defaultVhostUserMemory = "128M"
+
+// vhostUserParams renders vhost-user devices parameters. vhost-user backends access the guest RAM directly
+// so the guest memory gets backed by a shared memory file.
+func vhostUserParams(opts *QemuOptions) ([]string, error) {
+	var params []string
+	for i, v := range opts.VhostUser {
+		if v.Socket == "" {
+			return nil, fmt.Errorf("vhost-user device #%d: socket is not specified", i)
+		}
+
+		chardev := fmt.Sprintf("vhu%d", i)
+		params = append(params, "-chardev", fmt.Sprintf("socket,id=%s,path=%s", chardev, escapeParam(v.Socket)))
+
+		var device []string
+		switch v.Type {
+		case VHOST_USER_NET:
+			netdev := fmt.Sprintf("vhunet%d", i)
+			params = append(params, "-netdev", fmt.Sprintf("vhost-user,id=%s,chardev=%s", netdev, chardev))
+			device = []string{"virtio-net-pci", "netdev=" + netdev}
+		case VHOST_USER_BLK:
+			device = []string{"vhost-user-blk-pci", "chardev=" + chardev}
+		case VHOST_USER_FS:
+			if v.Tag == "" {
+				return nil, fmt.Errorf("vhost-user-fs device #%d: tag is not specified", i)
+			}
+			device = []string{"vhost-user-fs-pci", "chardev=" + chardev, "tag=" + escapeParam(v.Tag)}
+		default:
+			return nil, fmt.Errorf("vhost-user device #%d: unknown type %q", i, v.Type)
+		}
+		device = append(device, v.DeviceParams...)
+		params = append(params, "-device", strings.Join(device, ","))
+	}
+	return params, nil
+}
@@ -0,0 +1,202 @@
+package vmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// QMPError is an error reported by QEMU in response to a QMP command
+type QMPError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *QMPError) Error() string {
+	return fmt.Sprintf("qmp: %v: %v", e.Class, e.Desc)
+}
+
+// QMPEvent is an asynchronous event emitted by QEMU e.g. SHUTDOWN or SUSPEND
+type QMPEvent struct {
+	// Event is a name of the event
+	Event string
+	// Data is event specific JSON data
+	Data json.RawMessage
+	// Timestamp is a time when QEMU emitted the event
+	Timestamp time.Time
+}
+
+type qmpMessage struct {
+	Return    json.RawMessage `json:"return"`
+	Error     *QMPError       `json:"error"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp struct {
+		Seconds      int64 `json:"seconds"`
+		Microseconds int64 `json:"microseconds"`
+	} `json:"timestamp"`
+	QMP json.RawMessage `json:"QMP"`
+}
+
+type qmpCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// qmpClient talks to QEMU using QEMU Machine Protocol
+type qmpClient struct {
+	conn      net.Conn
+	encoder   *json.Encoder
+	cmdMutex  sync.Mutex // only one command can be in flight
+	responses chan qmpMessage
+	readErr   error // set before responses is closed
+
+	eventsMutex   sync.Mutex
+	events        []QMPEvent    // all events received since the VM start
+	eventsArrived chan struct{} // closed when new events arrive or the connection is lost
+	eventsDone    bool
+}
+
+// newQMPClient performs QMP handshake over conn and starts processing incoming messages
+func newQMPClient(conn net.Conn) (*qmpClient, error) {
+	decoder := json.NewDecoder(conn)
+
+	var greeting qmpMessage
+	if err := decoder.Decode(&greeting); err != nil {
+		return nil, fmt.Errorf("qmp greeting: %v", err)
+	}
+	if greeting.QMP == nil {
+		return nil, fmt.Errorf("qmp: unexpected greeting message")
+	}
+
+	c := &qmpClient{
+		conn:          conn,
+		encoder:       json.NewEncoder(conn),
+		responses:     make(chan qmpMessage),
+		eventsArrived: make(chan struct{}),
+	}
+	go c.readLoop(decoder)
+
+	if _, err := c.execute("qmp_capabilities", nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *qmpClient) readLoop(decoder *json.Decoder) {
+	for {
+		var msg qmpMessage
+		if err := decoder.Decode(&msg); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			c.readErr = err
+			close(c.responses)
+
+			c.eventsMutex.Lock()
+			c.eventsDone = true
+			close(c.eventsArrived)
+			c.eventsMutex.Unlock()
+			return
+		}
+		if msg.Event != "" {
+			c.eventsMutex.Lock()
+			c.events = append(c.events, QMPEvent{
+				Event:     msg.Event,
+				Data:      msg.Data,
+				Timestamp: time.Unix(msg.Timestamp.Seconds, msg.Timestamp.Microseconds*1000),
+			})
+			close(c.eventsArrived)
+			c.eventsArrived = make(chan struct{})
+			c.eventsMutex.Unlock()
+			continue
+		}
+		c.responses <- msg
+	}
+}
+
+// execute sends a QMP command and waits for its response
+func (c *qmpClient) execute(command string, args interface{}) (json.RawMessage, error) {
+	c.cmdMutex.Lock()
+	defer c.cmdMutex.Unlock()
+
+	if err := c.encoder.Encode(qmpCommand{Execute: command, Arguments: args}); err != nil {
+		return nil, fmt.Errorf("qmp %v: %v", command, err)
+	}
+	resp, ok := <-c.responses
+	if !ok {
+		return nil, fmt.Errorf("qmp %v: %v", command, c.readErr)
+	}
+	if resp.Error != nil {
+		return nil, resp.Error
+	}
+	return resp.Return, nil
+}
+
+// eventCursor returns a position in the events history, events received later are located after it
+func (c *qmpClient) eventCursor() int {
+	c.eventsMutex.Lock()
+	defer c.eventsMutex.Unlock()
+	return len(c.events)
+}
+
+// waitEvent waits for an event with one of the given names located after cursor in the events history.
+// It returns the event and its position.
+func (c *qmpClient) waitEvent(cursor int, timeout time.Duration, names ...string) (*QMPEvent, int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.eventsMutex.Lock()
+		for i := cursor; i < len(c.events); i++ {
+			for _, n := range names {
+				if c.events[i].Event == n {
+					ev := c.events[i]
+					c.eventsMutex.Unlock()
+					return &ev, i, nil
+				}
+			}
+		}
+		cursor = len(c.events)
+		arrived, done := c.eventsArrived, c.eventsDone
+		c.eventsMutex.Unlock()
+
+		if done {
+			return nil, 0, fmt.Errorf("qmp: waiting for %v event: %v", names, c.readErr)
+		}
+		select {
+		case <-arrived:
+		case <-timer.C:
+			return nil, 0, fmt.Errorf("qmp: timeout waiting for %v event", names)
+		}
+	}
+}
+
+// WaitQMPEvent waits for QMP event with the given name. Only events received after the event returned by
+// the previous WaitQMPEvent call are considered, so an event emitted right before the call is not missed.
+// Concurrent calls waiting for different events do not block each other.
+func (q *Qemu) WaitQMPEvent(name string, timeout time.Duration) (*QMPEvent, error) {
+	q.qmpEventsMutex.Lock()
+	cursor := q.qmpEventsCursor
+	q.qmpEventsMutex.Unlock()
+
+	ev, pos, err := q.qmp.waitEvent(cursor, timeout, name)
+	if err != nil {
+		return nil, err
+	}
+	q.qmpEventsMutex.Lock()
+	if pos+1 > q.qmpEventsCursor {
+		q.qmpEventsCursor = pos + 1
+	}
+	q.qmpEventsMutex.Unlock()
+	return ev, nil
+}
+
+// QMP executes QEMU Machine Protocol command with given arguments and returns its raw JSON result.
+// See https://qemu.readthedocs.io/en/latest/interop/qemu-qmp-ref.html for the list of commands.
+func (q *Qemu) QMP(command string, args interface{}) (json.RawMessage, error) {
+	return q.qmp.execute(command, args)
+}
@@ -0,0 +1,230 @@
+package vmtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeQMPServer emulates QEMU side of QMP connection. It replies to every command with reply(command).
+func fakeQMPServer(t *testing.T, conn net.Conn, reply func(cmd string) string) {
+	fakeQMPServerArgs(t, conn, func(cmd string, args json.RawMessage) string { return reply(cmd) })
+}
+
+// fakeQMPServerArgs is fakeQMPServer that passes the command arguments to reply
+func fakeQMPServerArgs(t *testing.T, conn net.Conn, reply func(cmd string, args json.RawMessage) string) {
+	_, err := conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+	require.NoError(t, err)
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var cmd struct {
+			Execute   string          `json:"execute"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &cmd))
+		if _, err := conn.Write([]byte(reply(cmd.Execute, cmd.Arguments) + "\n")); err != nil {
+			return
+		}
+	}
+}
+
+func TestQMPClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go fakeQMPServer(t, server, func(cmd string) string {
+		switch cmd {
+		case "query-status":
+			return `{"event": "STOP", "data": {}, "timestamp": {"seconds": 1, "microseconds": 2}}` + "\n" +
+				`{"return": {"running": false, "status": "paused"}}`
+		case "qmp_capabilities":
+			return `{"return": {}}`
+		default:
+			return `{"error": {"class": "CommandNotFound", "desc": "The command ` + cmd + ` has not been found"}}`
+		}
+	})
+
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+
+	cursor := qmp.eventCursor()
+	resp, err := qmp.execute("query-status", nil)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"running": false, "status": "paused"}`, string(resp))
+
+	ev, _, err := qmp.waitEvent(cursor, time.Second, "STOP")
+	require.NoError(t, err)
+	require.Equal(t, "STOP", ev.Event)
+
+	_, err = qmp.execute("nonexistent", nil)
+	var qmpErr *QMPError
+	require.ErrorAs(t, err, &qmpErr)
+	require.Equal(t, "CommandNotFound", qmpErr.Class)
+
+	_, _, err = qmp.waitEvent(cursor, 10*time.Millisecond, "RESUME")
+	require.Error(t, err)
+}
+
+func TestBlockJob(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	event := func(name, data string) string {
+		return `{"event": "` + name + `", "data": ` + data + `, "timestamp": {"seconds": 1, "microseconds": 2}}` + "\n"
+	}
+	go fakeQMPServer(t, server, func(cmd string) string {
+		switch cmd {
+		case "drive-mirror":
+			return `{"return": {}}` + "\n" +
+				event("BLOCK_JOB_READY", `{"device": "mirror-hd1", "type": "mirror"}`) +
+				event("BLOCK_JOB_READY", `{"device": "mirror-hd0", "type": "mirror"}`)
+		case "block-job-complete":
+			return `{"return": {}}` + "\n" + event("BLOCK_JOB_COMPLETED", `{"device": "mirror-hd0", "type": "mirror"}`)
+		case "drive-backup":
+			return `{"return": {}}` + "\n" +
+				event("BLOCK_JOB_COMPLETED", `{"device": "backup-hd0", "type": "backup", "error": "No space left on device"}`)
+		case "query-block-jobs":
+			return `{"return": [{"device": "mirror-hd0", "type": "mirror", "len": 100, "offset": 50, "ready": false, "status": "running"}]}`
+		default:
+			return `{"return": {}}`
+		}
+	})
+
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{qmp: qmp}
+
+	job, err := q.DriveMirror(0, "/tmp/mirror.qcow2", "qcow2")
+	require.NoError(t, err)
+	progress, err := job.Progress()
+	require.NoError(t, err)
+	require.Equal(t, int64(50), progress.Offset)
+	require.NoError(t, job.Complete(time.Second))
+
+	job, err = q.DriveBackup(0, "/tmp/backup.qcow2", "qcow2")
+	require.NoError(t, err)
+	require.ErrorContains(t, job.Wait(time.Second), "No space left on device")
+}
+
+func TestQueryInfo(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go fakeQMPServer(t, server, func(cmd string) string {
+		switch cmd {
+		case "query-block":
+			return `{"return": [{"device": "cd0", "qdev": "/machine/unattached/device[23]", "removable": true, "locked": false, "tray_open": false},
+				{"device": "hd0", "qdev": "", "removable": false, "locked": false, "inserted": {"file": "rootfs.img", "ro": false, "drv": "raw"}}]}`
+		case "query-pci":
+			return `{"return": [{"bus": 0, "devices": [
+				{"bus": 0, "slot": 3, "function": 0, "class_info": {"class": 512, "desc": "Ethernet controller"}, "id": {"vendor": 32902, "device": 4110}, "qdev_id": "net0"},
+				{"bus": 0, "slot": 4, "function": 0, "class_info": {"class": 1540}, "id": {"vendor": 6966, "device": 1}, "qdev_id": "bridge",
+				 "pci_bridge": {"bus": {"number": 1}, "devices": [{"bus": 1, "slot": 0, "function": 0, "class_info": {"class": 256}, "id": {"vendor": 6900, "device": 4097}, "qdev_id": "disk"}]}}]}]}`
+		case "set_link":
+			return `{"error": {"class": "DeviceNotFound", "desc": "Device 'net1' not found"}}`
+		case "query-cpus-fast":
+			return `{"return": [{"cpu-index": 0, "qom-path": "/machine/unattached/device[0]", "thread-id": 1234, "target": "x86_64"}]}`
+		default:
+			return `{"return": {}}`
+		}
+	})
+
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{qmp: qmp}
+
+	blocks, err := q.BlockInfo()
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+	require.Nil(t, blocks[0].Inserted)
+	require.Equal(t, "rootfs.img", blocks[1].Inserted.File)
+	cdrom, err := q.cdromDevice()
+	require.NoError(t, err)
+	require.Equal(t, "/machine/unattached/device[23]", cdrom)
+
+	pci, err := q.PCIInfo()
+	require.NoError(t, err)
+	require.Len(t, pci, 3)
+	require.Equal(t, "Ethernet controller", pci[0].Class.Desc)
+	require.Equal(t, "disk", pci[2].QDevID)
+	require.Equal(t, 1, pci[2].Bus)
+
+	cpus, err := q.CPUInfo()
+	require.NoError(t, err)
+	require.Equal(t, []CPU{{Index: 0, QOMPath: "/machine/unattached/device[0]", ThreadID: 1234, Target: "x86_64"}}, cpus)
+
+	var qmpErr *QMPError
+	require.ErrorAs(t, q.SetLink("net1", false), &qmpErr)
+	require.Equal(t, "DeviceNotFound", qmpErr.Class)
+}
+
+func TestCdrom(t *testing.T) {
+	opts := QemuOptions{CdRom: "testdata/install,1.iso"}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	drive, _ := paramValue(cmdline, "-drive")
+	require.Equal(t, "file=testdata/install,,1.iso,media=cdrom,index=2,id=cd0", drive)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	commands := make(chan string, 10)
+	blocks := `{"return": [{"device": "ide1-cd1", "qdev": "/machine/unattached/device[20]", "removable": true},
+		{"device": "cd0", "qdev": "/machine/unattached/device[21]", "removable": true}]}`
+	go fakeQMPServerArgs(t, server, func(cmd string, args json.RawMessage) string {
+		switch cmd {
+		case "query-block":
+			return blocks
+		case "qmp_capabilities":
+		default:
+			commands <- cmd + " " + string(args)
+		}
+		return `{"return": {}}`
+	})
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{qmp: qmp}
+
+	require.NoError(t, q.ChangeCdrom("/tmp/drivers.iso"))
+	require.Equal(t, `blockdev-change-medium {"filename":"/tmp/drivers.iso","format":"raw","id":"/machine/unattached/device[21]"}`,
+		<-commands)
+	require.NoError(t, q.EjectCdrom())
+	require.Equal(t, `eject {"force":true,"id":"/machine/unattached/device[21]"}`, <-commands)
+
+	// other CD-ROM drives, e.g. QemuOptions.VirtioDrivers, are not used
+	blocks = `{"return": [{"device": "ide1-cd1", "removable": true}]}`
+	require.ErrorContains(t, q.EjectCdrom(), "the VM has no CD-ROM drive")
+}
+
+func TestWaitWatchdog(t *testing.T) {
+	opts := QemuOptions{Watchdog: &QemuWatchdog{Action: WATCHDOG_PAUSE}}
+	cmdline, err := buildCmdline(&opts, "", nil)
+	require.NoError(t, err)
+	require.Contains(t, strings.Join(cmdline, " "), "-device i6300esb -watchdog-action pause")
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go fakeQMPServer(t, server, func(cmd string) string {
+		if cmd == "stop" {
+			// the guest stops feeding the watchdog
+			return qmpEvent("WATCHDOG", `{"action": "pause"}`) + `{"return": {}}`
+		}
+		return `{"return": {}}`
+	})
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{qmp: qmp}
+
+	_, err = q.WaitWatchdog(50 * time.Millisecond)
+	require.ErrorContains(t, err, "timeout waiting for [WATCHDOG] event")
+	_, err = q.QMP("stop", nil)
+	require.NoError(t, err)
+	action, err := q.WaitWatchdog(time.Second)
+	require.NoError(t, err)
+	require.Equal(t, WATCHDOG_PAUSE, action)
+}
@@ -0,0 +1,165 @@
+package vmtest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+const (
+	// readinessInterval is the pause between the probe checks of WaitReady()
+	readinessInterval = 200 * time.Millisecond
+	// tcpProbeSettle is the time an accepted connection has to stay open, see TCPProbe
+	tcpProbeSettle = 200 * time.Millisecond
+	// agentProbeTimeout limits a single guest agent ping, the agent does not reply until it is started
+	agentProbeTimeout = 5 * time.Second
+)
+
+// ReadinessProbe checks whether the VM is usable, e.g. booted and running the service under test.
+// Probes are evaluated by WaitReady().
+type ReadinessProbe interface {
+	// Ready checks the VM once. It returns false while the VM is not ready yet and an error if the probe
+	// can never succeed, e.g. the VM does not support it.
+	Ready(vm VM) (bool, error)
+}
+
+// consoleVM is implemented by the backends with the vmtest console
+type consoleVM interface {
+	vmConsole() *console
+}
+
+func (q *Qemu) vmConsole() *console        { return q.console }
+func (vb *VirtualBox) vmConsole() *console { return vb.console }
+func (e *External) vmConsole() *console    { return e.console }
+
+// WaitReady checks the probes periodically till all of them report the VM ready. It fails once ctx is done,
+// a probe fails or the VM console is closed, i.e. the VM stopped.
+func WaitReady(ctx context.Context, vm VM, probes ...ReadinessProbe) error {
+	pending := probes
+	for {
+		var notReady []ReadinessProbe
+		for _, p := range pending {
+			ready, err := p.Ready(vm)
+			if err != nil {
+				return fmt.Errorf("readiness probe %v: %v", p, err)
+			}
+			if !ready {
+				notReady = append(notReady, p)
+			}
+		}
+		if len(notReady) == 0 {
+			return nil
+		}
+		pending = notReady
+
+		if c, ok := vm.(consoleVM); ok && c.vmConsole().eof() {
+			return fmt.Errorf("readiness probe %v: the VM console is closed: %w", pending[0], io.EOF)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("readiness probe %v: %w", pending[0], ctx.Err())
+		case <-time.After(readinessInterval):
+		}
+	}
+}
+
+// WaitReady waits till the VM passes QemuOptions.ReadinessProbes, see WaitReady()
+func (q *Qemu) WaitReady(ctx context.Context) error {
+	return q.reportError(WaitReady(ctx, q, q.opts.ReadinessProbes...))
+}
+
+// ConsoleProbe is ready once the retained console output matches Regexp, e.g. a login prompt or a message
+// of the service. The output consumed by expectations is matched as well.
+type ConsoleProbe struct {
+	Regexp *regexp.Regexp
+}
+
+// Ready implements ReadinessProbe
+func (p ConsoleProbe) Ready(vm VM) (bool, error) {
+	c, ok := vm.(consoleVM)
+	if !ok {
+		return false, fmt.Errorf("the VM has no console")
+	}
+	c.vmConsole().pumpMutex.Lock()
+	defer c.vmConsole().pumpMutex.Unlock()
+	out, err := c.vmConsole().since(ConsoleMark(c.vmConsole().historyOffset))
+	if err != nil {
+		return false, err
+	}
+	return p.Regexp.Match(out), nil
+}
+
+func (p ConsoleProbe) String() string {
+	return fmt.Sprintf("console %q", p.Regexp)
+}
+
+// TCPProbe is ready once a host address accepts connections, e.g. a port forwarded to the guest with 'hostfwd'
+// of QemuNIC.BackendParams. The user mode network accepts the forwarded connections before the guest does,
+// so the connection has to stay open for a while to count.
+type TCPProbe struct {
+	Addr string
+}
+
+// Ready implements ReadinessProbe
+func (p TCPProbe) Ready(VM) (bool, error) {
+	conn, err := net.DialTimeout("tcp", p.Addr, time.Second)
+	if err != nil {
+		return false, nil
+	}
+	defer conn.Close()
+	if err := conn.SetReadDeadline(time.Now().Add(tcpProbeSettle)); err != nil {
+		return false, err
+	}
+	// a server might greet the client or wait for its request, both keep the connection open
+	_, err = conn.Read(make([]byte, 1))
+	var netErr net.Error
+	return err == nil || errors.As(err, &netErr) && netErr.Timeout(), nil
+}
+
+func (p TCPProbe) String() string {
+	return "tcp " + p.Addr
+}
+
+// AgentProbe is ready once the QEMU guest agent responds, it requires QemuOptions.GuestAgent
+type AgentProbe struct{}
+
+// Ready implements ReadinessProbe
+func (AgentProbe) Ready(vm VM) (bool, error) {
+	q, ok := vm.(*Qemu)
+	if !ok {
+		return false, fmt.Errorf("the VM has no guest agent")
+	}
+	if q.agent == nil {
+		return false, fmt.Errorf("guest agent is not enabled, see QemuOptions.GuestAgent")
+	}
+	_, err := q.agent.executeTimeout("guest-ping", nil, true, agentProbeTimeout)
+	return err == nil, nil
+}
+
+func (AgentProbe) String() string {
+	return "guest agent"
+}
+
+// FileProbe is ready once the host file exists. The guest creates it in a directory shared with QemuShare
+// (9p), e.g. with 'touch /mnt/ready' at the end of the boot.
+type FileProbe struct {
+	Path string
+}
+
+// Ready implements ReadinessProbe
+func (p FileProbe) Ready(VM) (bool, error) {
+	_, err := os.Stat(p.Path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p FileProbe) String() string {
+	return "file " + p.Path
+}
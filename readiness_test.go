@@ -0,0 +1,87 @@
+package vmtest
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitReady(t *testing.T) {
+	client, server := net.Pipe()
+	c := newConsole(client, consoleConfig{})
+	go c.pump(nil)
+	q := &Qemu{console: c, opts: &QemuOptions{}}
+
+	ready := filepath.Join(t.TempDir(), "ready")
+	q.opts.ReadinessProbes = []ReadinessProbe{
+		ConsoleProbe{Regexp: regexp.MustCompile(`login: $`)},
+		FileProbe{Path: ready},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	err := q.WaitReady(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, `console "login: $"`)
+
+	// the prompt is consumed by the expectation before the wait
+	_, _ = server.Write([]byte("Welcome\nlogin: "))
+	require.NoError(t, q.ConsoleExpect("login:"))
+	done := make(chan error)
+	go func() { done <- q.WaitReady(context.Background()) }()
+	time.Sleep(2 * readinessInterval)
+	require.NoError(t, os.WriteFile(ready, nil, 0o644))
+	require.NoError(t, <-done)
+
+	_, err = AgentProbe{}.Ready(q)
+	require.ErrorContains(t, err, "guest agent is not enabled")
+	_, err = AgentProbe{}.Ready(&VirtualBox{})
+	require.Error(t, err)
+
+	require.NoError(t, server.Close())
+	err = WaitReady(context.Background(), q, FileProbe{Path: ready + ".missing"})
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestTCPProbe(t *testing.T) {
+	// the listener closes connections at once like the user mode network does without a guest server
+	forward, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer forward.Close()
+	go func() {
+		for {
+			conn, err := forward.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	ready, err := TCPProbe{Addr: forward.Addr().String()}.Ready(nil)
+	require.NoError(t, err)
+	require.False(t, ready)
+
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	ready, err = TCPProbe{Addr: server.Addr().String()}.Ready(nil)
+	require.NoError(t, err)
+	require.True(t, ready)
+
+	require.NoError(t, server.Close())
+	ready, err = TCPProbe{Addr: server.Addr().String()}.Ready(nil)
+	require.NoError(t, err)
+	require.False(t, ready)
+}
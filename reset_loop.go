@@ -0,0 +1,67 @@
+package vmtest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// ErrResetLoop is recorded as a console pattern failure when the guest keeps resetting, e.g. a bootloader
+// triple-faults right after the start. Check for it with errors.Is().
+var ErrResetLoop = errors.New("guest reset loop detected")
+
+// defaultResetBanner matches the first line the firmware prints after every reset
+var defaultResetBanner = regexp.MustCompile(`^(SeaBIOS \(version|U-Boot \d)`)
+
+const (
+	defaultResetLoopCount  = 3
+	defaultResetLoopWithin = 30 * time.Second
+)
+
+// QemuResetLoop detects rapid reset loops by the firmware banners repeated at the console. It is useful with
+// QemuOptions.AllowReboot, otherwise qemu exits at the first reset.
+type QemuResetLoop struct {
+	// Banner matches the console line printed after every reset, default matches SeaBIOS and U-Boot banners
+	Banner *regexp.Regexp
+	// Count is the number of banners that make a loop, default is 3
+	Count int
+	// Within is the time window of the banners, default is 30s
+	Within time.Duration
+}
+
+// pattern returns a console pattern recording ErrResetLoop failure once the loop is detected
+func (r *QemuResetLoop) pattern(patterns *consolePatterns) ConsolePattern {
+	banner := r.Banner
+	if banner == nil {
+		banner = defaultResetBanner
+	}
+	count := r.Count
+	if count == 0 {
+		count = defaultResetLoopCount
+	}
+	within := durationOr(r.Within, defaultResetLoopWithin)
+
+	var mutex sync.Mutex
+	var resets []time.Time
+	reported := false
+	return ConsolePattern{
+		Name:     "reset loop",
+		Regexp:   banner,
+		Severity: PATTERN_CALLBACK,
+		Callback: func(line string) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			now := time.Now()
+			resets = append(resets, now)
+			for len(resets) > 0 && now.Sub(resets[0]) > within {
+				resets = resets[1:]
+			}
+			if len(resets) >= count && !reported {
+				reported = true
+				patterns.fail(fmt.Errorf("%w: %q printed %d times within %v", ErrResetLoop, line, len(resets), within))
+			}
+		},
+	}
+}
@@ -0,0 +1,245 @@
+package vmtest
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Size of the emulated screen, bootloaders assume an 80x24 terminal at the serial line
+const (
+	screenWidth  = 80
+	screenHeight = 24
+)
+
+// acsCharacters maps the VT100 special graphics charset used to draw boxes to Unicode
+var acsCharacters = map[rune]rune{
+	'j': '┘', 'k': '┐', 'l': '┌', 'm': '└', 'n': '┼', 'q': '─', 't': '├', 'u': '┤', 'v': '┴', 'w': '┬', 'x': '│',
+}
+
+type screenCell struct {
+	r         rune
+	highlight bool
+}
+
+// screenLine is a row of the screen
+type screenLine struct {
+	text string
+	// highlighted is set if any character of the row is drawn in reverse video or with a non-default background
+	highlighted bool
+}
+
+// screen is a VT100 emulator that keeps the whole screen content. It shares the parser with terminal, but unlike
+// terminal it follows the cursor movement between rows, so full-screen menus drawn at the serial console
+// by bootloaders can be read.
+type screen struct {
+	mutex sync.Mutex
+	// cond is signaled when the screen is updated
+	cond      *sync.Cond
+	parser    vtParser
+	cells     [screenHeight][screenWidth]screenCell
+	row, col  int
+	highlight bool
+	acs       bool
+	// updates is incremented on every write
+	updates int
+}
+
+func (s *screen) init() {
+	s.cond = sync.NewCond(&s.mutex)
+	s.clear(0, 0, screenHeight, 0)
+}
+
+// write processes the console data
+func (s *screen) write(data []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.parser.parse(data, s)
+	s.updates++
+	s.cond.Broadcast()
+}
+
+func (s *screen) print(r rune) {
+	switch {
+	case r == '\n':
+		s.lineFeed()
+	case r == '\r':
+		s.col = 0
+	case r == '\b':
+		if s.col > 0 {
+			s.col--
+		}
+	case r == '\x0e': // shift out selects the graphics charset
+		s.acs = true
+	case r == '\x0f':
+		s.acs = false
+	case r >= ' ' && r != '\x7f':
+		s.put(r)
+	}
+}
+
+func (s *screen) charset(set, designator rune) {
+	if set == '(' {
+		s.acs = designator == '0'
+	}
+}
+
+func (s *screen) put(r rune) {
+	if s.acs {
+		if c, ok := acsCharacters[r]; ok {
+			r = c
+		}
+	}
+	if s.col >= screenWidth {
+		// auto wrap
+		s.col = 0
+		s.lineFeed()
+	}
+	s.cells[s.row][s.col] = screenCell{r, s.highlight}
+	s.col++
+}
+
+func (s *screen) lineFeed() {
+	if s.row < screenHeight-1 {
+		s.row++
+		return
+	}
+	copy(s.cells[:], s.cells[1:])
+	s.clear(screenHeight-1, 0, screenHeight, 0)
+}
+
+// clear erases the screen from the given position (inclusive) to the other one (exclusive)
+func (s *screen) clear(fromRow, fromCol, toRow, toCol int) {
+	for pos := fromRow*screenWidth + fromCol; pos < toRow*screenWidth+toCol; pos++ {
+		s.cells[pos/screenWidth][pos%screenWidth] = screenCell{r: ' '}
+	}
+}
+
+func (s *screen) execute(final rune, params []byte) {
+	switch final {
+	case 'A':
+		s.row -= csiParam(params, 0, 1)
+	case 'B':
+		s.row += csiParam(params, 0, 1)
+	case 'C':
+		s.col += csiParam(params, 0, 1)
+	case 'D':
+		s.col -= csiParam(params, 0, 1)
+	case 'G':
+		s.col = csiParam(params, 0, 1) - 1
+	case 'd':
+		s.row = csiParam(params, 0, 1) - 1
+	case 'H', 'f':
+		s.row, s.col = csiParam(params, 0, 1)-1, csiParam(params, 1, 1)-1
+	case 'J':
+		switch csiParam(params, 0, 0) {
+		case 0:
+			s.clear(s.row, s.col, screenHeight, 0)
+		case 1:
+			s.clear(0, 0, s.row, s.col+1)
+		default:
+			s.clear(0, 0, screenHeight, 0)
+		}
+	case 'K':
+		switch csiParam(params, 0, 0) {
+		case 0:
+			s.clear(s.row, s.col, s.row+1, 0)
+		case 1:
+			s.clear(s.row, 0, s.row, s.col+1)
+		default:
+			s.clear(s.row, 0, s.row+1, 0)
+		}
+	case 'm':
+		s.sgr(params)
+	}
+	s.row = clamp(s.row, 0, screenHeight-1)
+	s.col = clamp(s.col, 0, screenWidth)
+}
+
+// sgr tracks whether the text is highlighted, i.e. drawn in reverse video or with a non-default background
+func (s *screen) sgr(params []byte) {
+	fields := strings.Split(string(params), ";")
+	for i := 0; i < len(fields); i++ {
+		n, _ := strconv.Atoi(fields[i])
+		switch {
+		case n == 0 || n == 27 || n == 40 || n == 49:
+			s.highlight = false
+		case n == 7 || n > 40 && n <= 47 || n >= 100 && n <= 107:
+			s.highlight = true
+		case n == 38 || n == 48:
+			// extended colors: 5;N or 2;R;G;B
+			if i+1 < len(fields) && fields[i+1] == "2" {
+				i += 4
+			} else {
+				i += 2
+			}
+			if n == 48 {
+				s.highlight = true
+			}
+		}
+	}
+}
+
+func clamp(v, low, high int) int {
+	if v < low {
+		return low
+	}
+	if v > high {
+		return high
+	}
+	return v
+}
+
+// lines returns the screen rows with the trailing spaces trimmed
+func (s *screen) lines() []screenLine {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	lines := make([]screenLine, screenHeight)
+	for i, row := range s.cells {
+		var b strings.Builder
+		for _, c := range row {
+			b.WriteRune(c.r)
+			if c.highlight && c.r != ' ' {
+				lines[i].highlighted = true
+			}
+		}
+		lines[i].text = strings.TrimRight(b.String(), " ")
+	}
+	return lines
+}
+
+// cursorLine returns the text of the row with the cursor
+func (s *screen) cursorLine() string {
+	row := s.cursorRow()
+	return s.lines()[row].text
+}
+
+func (s *screen) cursorRow() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.row
+}
+
+// waitUpdate waits till the screen is updated after the given number of updates or until the deadline
+func (s *screen) waitUpdate(updates int, deadline time.Time) bool {
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		s.mutex.Lock()
+		s.cond.Broadcast()
+		s.mutex.Unlock()
+	})
+	defer timer.Stop()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.updates == updates && time.Now().Before(deadline) {
+		s.cond.Wait()
+	}
+	return s.updates != updates
+}
+
+func (s *screen) updateCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.updates
+}
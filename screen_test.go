@@ -0,0 +1,28 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScreen(t *testing.T) {
+	var s screen
+	s.init()
+	s.write([]byte("\x1b[2J\x1b[1;1Hheader"))
+	s.write([]byte("\x1b[3;5H\x1b(0lqk\x1b(B\x1b[4;5H\x1b[7mentry\x1b[0m \xe2\x86"))
+	s.write([]byte("\x91\r\n\x1b[10Gtext\x1b[1;3H\x1b[K"))
+
+	lines := s.lines()
+	require.Equal(t, "he", lines[0].text)
+	require.Equal(t, "    ┌─┐", lines[2].text)
+	require.Equal(t, screenLine{"    entry ↑", true}, lines[3])
+	require.Equal(t, screenLine{"         text", false}, lines[4])
+	require.Equal(t, "he", s.cursorLine())
+
+	// a line feed at the bottom row scrolls the screen
+	s.write([]byte("\x1b[24;1Hlast\n"))
+	require.Equal(t, "    ┌─┐", s.lines()[1].text)
+	require.Equal(t, "last", s.lines()[screenHeight-2].text)
+	require.Equal(t, "", s.lines()[screenHeight-1].text)
+}
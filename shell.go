@@ -0,0 +1,129 @@
+package vmtest
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shell runs commands in a POSIX shell attached to the VM console. Every command is surrounded by unique markers,
+// so its output is separated from the echoed command line, the prompt and other console messages.
+type Shell struct {
+	console *console
+	// Timeout limits the run time of every command, zero means no limit.
+	// A command that times out is interrupted with Ctrl-C.
+	Timeout time.Duration
+
+	mutex  sync.Mutex
+	id     string
+	seq    int
+	prompt string
+}
+
+func newShell(c *console) *Shell {
+	return &Shell{console: c, id: strconv.FormatInt(time.Now().UnixNano(), 36)}
+}
+
+// Shell returns a shell session at the vm console. The guest must provide a shell at the console already.
+func (q *Qemu) Shell() *Shell {
+	return newShell(q.console)
+}
+
+// Shell returns a shell session at the vm console. The guest must provide a shell at the console already.
+func (vb *VirtualBox) Shell() *Shell {
+	return newShell(vb.console)
+}
+
+// Shell returns a shell session at the vm console. The guest must provide a shell at the console already.
+func (e *External) Shell() *Shell {
+	return newShell(e.console)
+}
+
+// Run runs a single line command and returns its output with the lines separated by '\n' and its exit code
+func (s *Shell) Run(cmd string) (string, int, error) {
+	return s.run(cmd, "")
+}
+
+// RunWithInput runs a single line command with the given data passed to its stdin using a here-document
+func (s *Shell) RunWithInput(cmd string, input string) (string, int, error) {
+	return s.run(cmd, input)
+}
+
+// Prompt returns the shell prompt detected at the echoed command line of the last run
+func (s *Shell) Prompt() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.prompt
+}
+
+func (s *Shell) run(cmd string, input string) (string, int, error) {
+	if strings.ContainsAny(cmd, "\r\n") {
+		return "", 0, fmt.Errorf("shell command %q must be a single line", cmd)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seq++
+	id := fmt.Sprintf("%v_%d", s.id, s.seq)
+	begin := "__VMTEST_BEGIN_" + id + "__"
+	// the echoed command line contains '$?' so it does not match doneRe
+	doneRe := regexp.MustCompile(`^__VMTEST_DONE_` + id + `_(\d+)__$`)
+
+	// the whole command is a single line so the shell echoes it before its output
+	line := "echo " + begin + "; " + cmd
+	inputEOF := "__VMTEST_EOF_" + id + "__"
+	if input != "" {
+		line += " <<'" + inputEOF + "'"
+	}
+	line += "; echo __VMTEST_DONE_" + id + "_$?__\n"
+	if input != "" {
+		// the here-document is read together with the command line, before the command runs
+		if !strings.HasSuffix(input, "\n") {
+			input += "\n"
+		}
+		line += input + inputEOF + "\n"
+	}
+	if err := s.console.write(line); err != nil {
+		return "", 0, err
+	}
+
+	var deadline time.Time
+	if s.Timeout != 0 {
+		deadline = time.Now().Add(s.Timeout)
+	}
+	started := false
+	var output []string
+	var code int
+	err := s.console.processLines(deadline, func(data []byte, _ time.Time, _ int64) bool {
+		if !bytes.HasSuffix(data, []byte{'\n'}) {
+			return false // the partial line is processed again once it is completed
+		}
+		l := string(bytes.TrimRight(data, "\r\n"))
+		if !started {
+			if i := strings.Index(l, "echo "+begin); i != -1 {
+				s.prompt = l[:i]
+			}
+			started = l == begin
+			return false
+		}
+		if m := doneRe.FindStringSubmatch(l); m != nil {
+			code, _ = strconv.Atoi(m[1])
+			return true
+		}
+		output = append(output, l)
+		return false
+	})
+	if err != nil {
+		if err == ErrConsoleTimeout {
+			// interrupt the command so the shell is usable again
+			_ = s.console.write("\x03")
+		}
+		return strings.Join(output, "\n"), 0, s.console.expectError(cmd, output, err)
+	}
+	return strings.Join(output, "\n"), code, nil
+}
@@ -0,0 +1,108 @@
+package vmtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var fakeShellRe = regexp.MustCompile(`^echo (\S+); (.*?)( <<'(\S+)')?; echo __VMTEST_DONE_(\S+)_\$\?__$`)
+
+// fakeShell emulates a shell with the echo enabled and a few commands
+func fakeShell(t *testing.T, conn net.Conn) {
+	r := bufio.NewReader(conn)
+	_, _ = conn.Write([]byte("Welcome\r\n# "))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\n")
+		if strings.HasPrefix(line, "\x03") {
+			_, _ = conn.Write([]byte("^C\r\n# "))
+			line = line[1:]
+		}
+		_, _ = conn.Write([]byte(line + "\r\n"))
+		m := fakeShellRe.FindStringSubmatch(line)
+		if m == nil {
+			t.Errorf("unexpected shell input %q", line)
+			_ = conn.Close()
+			return
+		}
+		var input []string
+		if m[4] != "" {
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				l = strings.TrimRight(l, "\n")
+				_, _ = conn.Write([]byte("> " + l + "\r\n"))
+				if l == m[4] {
+					break
+				}
+				input = append(input, l)
+			}
+		}
+
+		out := m[1] + "\r\n"
+		code := 0
+		switch m[2] {
+		case "uname":
+			out += "Linux\r\n"
+		case "false":
+			code = 1
+		case "cat":
+			for _, l := range input {
+				out += l + "\r\n"
+			}
+		case "sleep 100":
+			_, _ = conn.Write([]byte(out))
+			continue
+		}
+		out += fmt.Sprintf("__VMTEST_DONE_%v_%d__\r\n# ", m[5], code)
+		_, _ = conn.Write([]byte(out))
+	}
+}
+
+func TestShell(t *testing.T) {
+	client, server := net.Pipe()
+	q := &Qemu{console: newConsole(client, consoleConfig{})}
+	go q.console.pump(nil)
+	go fakeShell(t, server)
+	defer server.Close()
+
+	shell := q.Shell()
+	out, code, err := shell.Run("uname")
+	require.NoError(t, err)
+	require.Equal(t, "Linux", out)
+	require.Equal(t, 0, code)
+	require.Equal(t, "# ", shell.Prompt())
+
+	_, code, err = shell.Run("false")
+	require.NoError(t, err)
+	require.Equal(t, 1, code)
+
+	out, code, err = shell.RunWithInput("cat", "foo\nbar")
+	require.NoError(t, err)
+	require.Equal(t, "foo\nbar", out)
+	require.Equal(t, 0, code)
+
+	shell.Timeout = 50 * time.Millisecond
+	_, _, err = shell.Run("sleep 100")
+	require.ErrorIs(t, err, ErrConsoleTimeout)
+
+	// the shell is usable after the interrupted command
+	out, _, err = shell.Run("uname")
+	require.NoError(t, err)
+	require.Equal(t, "Linux", out)
+
+	_, _, err = shell.Run("echo foo\necho bar")
+	require.Error(t, err)
+}
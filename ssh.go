@@ -0,0 +1,170 @@
+package vmtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	// sshFailure is the exit code of the ssh client when the connection fails
+	sshFailure = 255
+	// sshConnectTimeout limits the connection establishment, sshAliveInterval and sshAliveCount detect
+	// a connection to a machine that went away without closing it, e.g. on power off
+	sshConnectTimeout = "10"
+	sshAliveInterval  = "5"
+	sshAliveCount     = "3"
+)
+
+// SSHOptions configures a machine reachable by SSH, e.g. a bare metal test host or a cloud instance.
+// The system ssh client is used, so its configuration (~/.ssh/config, agent, known hosts) applies.
+type SSHOptions struct {
+	// Host is the machine address in '[user@]host' form
+	Host string
+	// Port of the SSH server, default is 22
+	Port int
+	// IdentityFile is the private key used instead of the client configured ones
+	IdentityFile string
+	// Args are additional ssh client arguments, e.g. '-o StrictHostKeyChecking=no'. They take precedence
+	// over the connection timeouts set by vmtest (ConnectTimeout, ServerAliveInterval and ServerAliveCountMax).
+	Args []string
+	// PoweroffCommand is run by Shutdown(), default is 'poweroff'. Unprivileged users might need 'sudo poweroff'.
+	PoweroffCommand string
+	// KillHook is called by Kill(), it should stop the machine immediately, e.g. with the cloud provider API.
+	// Without the hook Kill() only closes the session.
+	KillHook func() error
+	// Enable debug output
+	Verbose bool
+}
+
+// SSH is a machine driven over SSH. Its console is an interactive shell session, so the tests written
+// against the VM interface can target real hardware or cloud instances as well. The console is provided
+// by External like for 'ssh:' ExternalOptions.Console endpoints.
+type SSH struct {
+	*External
+	opts SSHOptions
+}
+
+var _ VM = (*SSH)(nil) // ensure SSH implements VM interface
+
+// NewSSH connects to the machine and opens the console session
+func NewSSH(opts *SSHOptions) (*SSH, error) {
+	if opts.Host == "" {
+		return nil, fmt.Errorf("ssh host is not specified")
+	}
+	s := &SSH{opts: *opts}
+	// -tt forces a terminal allocation so the remote shell is interactive even without local tty
+	conn, err := startSSHConsole(s.opts.command("-tt"))
+	if err != nil {
+		return nil, err
+	}
+	s.External, err = NewExternal(&ExternalOptions{
+		Conn:         conn,
+		ShutdownHook: s.poweroff,
+		KillHook:     opts.KillHook,
+		Verbose:      opts.Verbose,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Command returns the ssh client command that runs the remote command at the machine, e.g. to check that
+// the machine accepts the connections. The arguments are quoted for the remote shell.
+func (o *SSHOptions) Command(remote ...string) *exec.Cmd {
+	return o.command("", remote...)
+}
+
+func (o *SSHOptions) command(flag string, remote ...string) *exec.Cmd {
+	args := []string{"-o", "BatchMode=yes"}
+	if o.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(o.Port))
+	}
+	if o.IdentityFile != "" {
+		args = append(args, "-i", o.IdentityFile)
+	}
+	// ssh uses the first value of an option, so the defaults follow the user arguments
+	args = append(args, o.Args...)
+	args = append(args,
+		"-o", "ConnectTimeout="+sshConnectTimeout,
+		"-o", "ServerAliveInterval="+sshAliveInterval,
+		"-o", "ServerAliveCountMax="+sshAliveCount)
+	if flag != "" {
+		args = append(args, flag)
+	}
+	args = append(args, o.Host)
+	if len(remote) > 0 {
+		quoted := make([]string, len(remote))
+		for i, a := range remote {
+			quoted[i] = "'" + strings.ReplaceAll(a, "'", `'\''`) + "'"
+		}
+		args = append(args, strings.Join(quoted, " "))
+	}
+	return exec.Command("ssh", args...)
+}
+
+// run runs the remote command with the given input, the exit code of the ssh client failures is reported as error
+func (s *SSH) run(stdin []byte, remote ...string) (*GuestExecResult, error) {
+	cmd := s.opts.Command(remote...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() != sshFailure {
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh %v: %v: %v", s.opts.Host, err, strings.TrimSpace(stderr.String()))
+	}
+	return &GuestExecResult{ExitCode: cmd.ProcessState.ExitCode(), Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}, nil
+}
+
+// GuestExec runs the program in a separate SSH session and returns its output. The exit code 255 is
+// indistinguishable from the ssh client failures and it is reported as an error.
+func (s *SSH) GuestExec(path string, args ...string) (*GuestExecResult, error) {
+	return s.run(nil, append([]string{path}, args...)...)
+}
+
+// GuestReadFile reads the remote file
+func (s *SSH) GuestReadFile(path string) ([]byte, error) {
+	res, err := s.run(nil, "cat", "--", path)
+	if err != nil {
+		return nil, err
+	}
+	if res.ExitCode != 0 {
+		return nil, fmt.Errorf("reading %v: %v", path, strings.TrimSpace(string(res.Stderr)))
+	}
+	return res.Stdout, nil
+}
+
+// GuestWriteFile copies data to the remote file, the file is truncated if it exists
+func (s *SSH) GuestWriteFile(path string, data []byte) error {
+	res, err := s.run(data, "sh", "-c", `cat > "$1"`, "sh", path)
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("writing %v: %v", path, strings.TrimSpace(string(res.Stderr)))
+	}
+	return nil
+}
+
+// poweroff runs SSHOptions.PoweroffCommand, it is the shutdown hook of the console
+func (s *SSH) poweroff() error {
+	poweroff := s.opts.PoweroffCommand
+	if poweroff == "" {
+		poweroff = "poweroff"
+	}
+	// the machine drops the connection while the command runs, so the ssh failures are expected
+	cmd := s.opts.Command("sh", "-c", poweroff)
+	if out, err := cmd.CombinedOutput(); err != nil && cmd.ProcessState.ExitCode() != sshFailure {
+		return fmt.Errorf("%v: %v: %s", poweroff, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
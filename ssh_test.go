@@ -0,0 +1,52 @@
+package vmtest
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anatol/vmtest/internal/fakessh"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSH(t *testing.T) {
+	sshLog := fakessh.Install(t)
+
+	dir := t.TempDir()
+	killed := false
+	s, err := NewSSH(&SSHOptions{
+		Host:            "root@198.51.100.7",
+		Port:            2222,
+		PoweroffCommand: "touch " + filepath.Join(dir, "poweroff"),
+		KillHook:        func() error { killed = true; return nil },
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, s.ConsoleWrite("echo hello $((1 + 2))\n"))
+	require.NoError(t, s.ConsoleExpect("hello 3"))
+
+	res, err := s.GuestExec("sh", "-c", "echo out; echo 'it'\\''s err' >&2; exit 3")
+	require.NoError(t, err)
+	require.Equal(t, 3, res.ExitCode)
+	require.Equal(t, "out\n", string(res.Stdout))
+	require.Equal(t, "it's err\n", string(res.Stderr))
+
+	file := filepath.Join(dir, "file with spaces")
+	require.NoError(t, s.GuestWriteFile(file, []byte("data")))
+	data, err := s.GuestReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+	_, err = s.GuestReadFile(filepath.Join(dir, "missing"))
+	require.Error(t, err)
+
+	s.Shutdown()
+	require.FileExists(t, filepath.Join(dir, "poweroff"))
+	s.Kill()
+	require.True(t, killed)
+
+	log, err := os.ReadFile(sshLog)
+	require.NoError(t, err)
+	first, _, _ := strings.Cut(string(log), "\n")
+	require.Equal(t, "-o BatchMode=yes -p 2222 -o ConnectTimeout=10 -o ServerAliveInterval=5 -o ServerAliveCountMax=3 -tt root@198.51.100.7", first)
+}
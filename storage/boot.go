@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"testing"
+
+	"github.com/anatol/vmtest"
+	"github.com/anatol/vmtest/img"
+)
+
+// Firmware is the machine firmware that boots the disk of a BootTest
+type Firmware string
+
+const (
+	// FIRMWARE_BIOS is the qemu default SeaBIOS firmware that runs the MBR boot code
+	FIRMWARE_BIOS = Firmware("bios")
+	// FIRMWARE_UEFI is the OVMF firmware found with vmtest.FindOVMF(), it starts the removable media loader
+	// EFI/BOOT/BOOTX64.EFI of the EFI system partition, e.g. one written with img.WriteFAT()
+	FIRMWARE_UEFI = Firmware("uefi")
+)
+
+// bootMemory is the guest RAM of boot tests, OVMF needs more than the qemu default
+const bootMemory = "512M"
+
+// BootDisk is the default disk of a BootTest: a 64MiB disk with a BIOS boot partition (1) for GRUB core image
+// and an EFI system partition (2) taking the rest of the disk. The partitions have no filesystems, the ESP
+// is formatted by BootTest.Install, e.g. with img.WriteFAT().
+func BootDisk() Disk {
+	return Disk{
+		Size: 64 << 20,
+		Partitions: []img.GPTPartition{
+			{Name: "bios", Type: img.GPT_BIOS_BOOT, Size: 1 << 20},
+			{Name: "esp", Type: img.GPT_EFI_SYSTEM},
+		},
+	}
+}
+
+// BootTest is a bootloader install-and-boot round trip: a fresh disk is created, the test installs
+// the bootloader into it and the disk is booted until the console shows the expected output
+type BootTest struct {
+	// Disk is the boot disk layout, default is BootDisk()
+	Disk *Disk
+	// Install writes the bootloader into the raw disk image, e.g. with img.WriteBootCode() and
+	// img.WritePartition() for BIOS or with img.WriteFAT() of a directory with the EFI loaders for UEFI.
+	// It is called with a fresh disk for every firmware.
+	Install func(firmware Firmware, disk string) error
+	// Firmwares are booted one by one, default is BIOS and UEFI
+	Firmwares []Firmware
+	// Expect are the strings the console is expected to print in order, e.g. the bootloader banner
+	Expect []string
+	// Options configure the VM, e.g. vmtest.WithTimeout() or extra disks
+	Options []vmtest.QemuOption
+}
+
+// Run runs a subtest per firmware. The UEFI subtest is skipped if the firmware is not installed.
+func (b *BootTest) Run(t *testing.T) {
+	firmwares := b.Firmwares
+	if len(firmwares) == 0 {
+		firmwares = []Firmware{FIRMWARE_BIOS, FIRMWARE_UEFI}
+	}
+	for _, fw := range firmwares {
+		fw := fw
+		t.Run(string(fw), func(t *testing.T) {
+			if fw == FIRMWARE_UEFI && vmtest.FindOVMF() == "" {
+				t.Skip("UEFI firmware (OVMF) is not installed")
+			}
+			opts, err := b.prepare(fw, t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			qemu, err := vmtest.NewQemu(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer qemu.Kill()
+
+			for _, s := range b.Expect {
+				if err := qemu.ConsoleExpect(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// prepare builds the disk in dir, installs the bootloader and returns the VM configuration for the firmware
+func (b *BootTest) prepare(fw Firmware, dir string) (*vmtest.QemuOptions, error) {
+	disk := BootDisk()
+	if b.Disk != nil {
+		disk = *b.Disk
+	}
+	if disk.Name == "" {
+		disk.Name = "boot.img"
+	}
+	disks, err := (&Topology{Disks: []Disk{disk}}).Build(dir)
+	if err != nil {
+		return nil, err
+	}
+	if b.Install != nil {
+		if err := b.Install(fw, disks[0].Path); err != nil {
+			return nil, err
+		}
+	}
+	disks[0].BootIndex = 1
+
+	opts := &vmtest.QemuOptions{Architecture: vmtest.QEMU_X86_64}
+	vmtest.WithMemory(bootMemory)(opts)
+	if fw == FIRMWARE_UEFI {
+		opts.Params = append(opts.Params, "-machine", "q35")
+		opts.BIOS = vmtest.FindOVMF()
+	}
+	opts.Disks = disks
+	return opts.Apply(b.Options...), nil
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/anatol/vmtest"
+	"github.com/anatol/vmtest/img"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBootTestPrepare(t *testing.T) {
+	dir := t.TempDir()
+	boot := filepath.Join(dir, "boot.bin")
+	require.NoError(t, os.WriteFile(boot, []byte{0xeb, 0x63}, 0o644))
+
+	esp := filepath.Join(dir, "esp")
+	require.NoError(t, os.MkdirAll(filepath.Join(esp, "EFI", "BOOT"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(esp, "EFI", "BOOT", "BOOTX64.EFI"), []byte("MZ"), 0o644))
+
+	var installed []Firmware
+	b := &BootTest{
+		Install: func(fw Firmware, disk string) error {
+			installed = append(installed, fw)
+			if fw == FIRMWARE_UEFI {
+				if err := img.WriteFAT(disk, 2, esp, &img.FATOptions{Label: "ESP"}); err != nil {
+					return err
+				}
+			}
+			return img.WriteBootCode(disk, boot)
+		},
+		Options: []vmtest.QemuOption{vmtest.WithName("bootloader")},
+	}
+	opts, err := b.prepare(FIRMWARE_UEFI, dir)
+	require.NoError(t, err)
+	require.Equal(t, []Firmware{FIRMWARE_UEFI}, installed)
+	require.Equal(t, "bootloader", opts.Name)
+	require.Contains(t, opts.Params, "q35")
+	require.Len(t, opts.Disks, 1)
+	require.Equal(t, 1, opts.Disks[0].BootIndex)
+
+	parts, err := img.Partitions(opts.Disks[0].Path)
+	require.NoError(t, err)
+	require.Len(t, parts, 2)
+	data, err := os.ReadFile(opts.Disks[0].Path)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0xeb, 0x63}, data[:2])
+	require.Equal(t, "FAT16", string(data[parts[1].Start+54:parts[1].Start+59]))
+
+	opts, err = b.prepare(FIRMWARE_BIOS, dir)
+	require.NoError(t, err)
+	require.Empty(t, opts.BIOS)
+
+	b.Install = func(Firmware, string) error { return errors.New("install failed") }
+	_, err = b.prepare(FIRMWARE_BIOS, dir)
+	require.ErrorContains(t, err, "install failed")
+}
@@ -0,0 +1,124 @@
+// Package storage declares multi-disk layouts for storage stack tests (LVM, software RAID, multipath) and
+// bootloader tests, it creates the disk images ready to be attached to a vmtest VM
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/anatol/vmtest"
+	"github.com/anatol/vmtest/img"
+)
+
+// Disk is a disk of a topology
+type Disk struct {
+	// Name is the image file name, default is 'disk$N.img'
+	Name string
+	// Size of the disk in bytes
+	Size int64
+	// Serial is the disk serial number e.g. /dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_$Serial, default is
+	// 'vmtest$N'. virtio-blk devices support up to 20 characters.
+	Serial string
+	// Partitions of the disk GPT, if empty then the disk has no partition table
+	Partitions []img.GPTPartition
+	// Paths is the number of devices that attach the disk for multipath. Zero or one means a regular disk.
+	Paths int
+	// Controller is the drive device, see vmtest.QemuDisk.Controller
+	Controller string
+}
+
+// Topology is a set of disks
+type Topology struct {
+	Disks []Disk
+}
+
+// Add appends n disks of the given size with a single partition of type typ spanning the whole disk
+func (t *Topology) Add(n int, size int64, typ img.GPTType) *Topology {
+	for i := 0; i < n; i++ {
+		t.Disks = append(t.Disks, Disk{Size: size, Partitions: []img.GPTPartition{{Type: typ}}})
+	}
+	return t
+}
+
+// RAID returns a topology of n disks with a single Linux RAID partition each, e.g. members for 'mdadm --create'
+func RAID(n int, size int64) *Topology {
+	return new(Topology).Add(n, size, img.GPT_LINUX_RAID)
+}
+
+// LVM returns a topology of n disks with a single LVM physical volume partition each
+func LVM(n int, size int64) *Topology {
+	return new(Topology).Add(n, size, img.GPT_LINUX_LVM)
+}
+
+// Multipath returns a topology with one disk attached through the given number of paths
+func Multipath(paths int, size int64) *Topology {
+	return &Topology{Disks: []Disk{{Size: size, Paths: paths}}}
+}
+
+// Build creates the sparse raw disk images in dir and returns the disks to add to vmtest.QemuOptions.Disks.
+// Paths of a multipath disk share the image and the serial number.
+func (t *Topology) Build(dir string) ([]vmtest.QemuDisk, error) {
+	var disks []vmtest.QemuDisk
+	for i, d := range t.Disks {
+		name := d.Name
+		if name == "" {
+			name = fmt.Sprintf("disk%d.img", i)
+		}
+		serial := d.Serial
+		if serial == "" {
+			serial = fmt.Sprintf("vmtest%d", i)
+		}
+		path := filepath.Join(dir, name)
+		if err := createDisk(path, &d); err != nil {
+			return nil, fmt.Errorf("disk %v: %v", name, err)
+		}
+
+		paths := d.Paths
+		if paths < 1 {
+			paths = 1
+		}
+		for p := 0; p < paths; p++ {
+			disks = append(disks, vmtest.QemuDisk{
+				Path:         path,
+				Format:       "raw",
+				Controller:   d.Controller,
+				DeviceParams: []string{"serial=" + serial},
+				Shared:       paths > 1,
+			})
+		}
+	}
+	return disks, nil
+}
+
+// Attach builds the topology in dir and appends its disks to opts
+func (t *Topology) Attach(opts *vmtest.QemuOptions, dir string) error {
+	disks, err := t.Build(dir)
+	if err != nil {
+		return err
+	}
+	opts.Disks = append(opts.Disks, disks...)
+	return nil
+}
+
+func createDisk(path string, d *Disk) error {
+	if d.Size <= 0 {
+		return fmt.Errorf("size must be positive")
+	}
+	if len(d.Partitions) > 0 {
+		// the table is written over a fresh image
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return img.GPT(path, &img.GPTOptions{Size: d.Size, Partitions: d.Partitions})
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := f.Truncate(d.Size); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
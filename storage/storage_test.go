@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"os"
+	"testing"
+
+	"github.com/anatol/vmtest/img"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopology(t *testing.T) {
+	dir := t.TempDir()
+	topology := RAID(3, 32<<20)
+	topology.Disks = append(topology.Disks, Disk{Name: "spare.img", Size: 16 << 20, Serial: "spare"})
+	disks, err := topology.Build(dir)
+	require.NoError(t, err)
+	require.Len(t, disks, 4)
+	require.Equal(t, []string{"serial=vmtest1"}, disks[1].DeviceParams)
+	require.Equal(t, []string{"serial=spare"}, disks[3].DeviceParams)
+
+	fi, err := os.Stat(disks[0].Path)
+	require.NoError(t, err)
+	require.Equal(t, int64(32<<20), fi.Size())
+	data, err := os.ReadFile(disks[0].Path)
+	require.NoError(t, err)
+	require.Equal(t, "EFI PART", string(data[512:520]))
+	require.Equal(t, []byte{0x0f, 0x88, 0x9d, 0xa1}, data[1024:1028]) // GPT_LINUX_RAID
+
+	disks, err = Multipath(2, 16<<20).Build(dir)
+	require.NoError(t, err)
+	require.Len(t, disks, 2)
+	require.Equal(t, disks[0].Path, disks[1].Path)
+	require.True(t, disks[0].Shared)
+
+	_, err = new(Topology).Add(1, 0, img.GPT_LINUX_LVM).Build(dir)
+	require.Error(t, err)
+}
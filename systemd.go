@@ -0,0 +1,74 @@
+package vmtest
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Descriptions of the well-known systemd targets as printed in "Reached target ..." console messages
+var systemdTargetDescriptions = map[string]string{
+	"basic.target":              "Basic System",
+	"default.target":            "Main User Target",
+	"emergency.target":          "Emergency Mode",
+	"getty.target":              "Login Prompts",
+	"graphical.target":          "Graphical Interface",
+	"initrd.target":             "Initrd Default Target",
+	"initrd-root-fs.target":     "Initrd Root File System",
+	"initrd-switch-root.target": "Switch Root",
+	"local-fs.target":           "Local File Systems",
+	"multi-user.target":         "Multi-User System",
+	"network.target":            "Network",
+	"network-online.target":     "Network is Online",
+	"rescue.target":             "Rescue Mode",
+	"sysinit.target":            "System Initialization",
+}
+
+// WaitForSystemdTarget waits until systemd inside the VM reaches the target e.g. 'multi-user.target'.
+// If the guest agent is enabled then the target state is polled with systemctl, otherwise the console is
+// watched for "Reached target" status message. Status messages for targets not listed in
+// systemdTargetDescriptions are recognized only with 'systemd.status_unit_format=name' or 'combined' kernel parameter.
+func (q *Qemu) WaitForSystemdTarget(target string) error {
+	if q.agent != nil {
+		// the wait ends with the VM like the console expectation does
+		return q.WaitForUnit(context.Background(), target)
+	}
+
+	names := regexp.QuoteMeta(target)
+	if desc, ok := systemdTargetDescriptions[target]; ok {
+		names += "|" + regexp.QuoteMeta(desc)
+	}
+	re := regexp.MustCompile(`Reached target (` + names + `)\b`)
+	_, err := q.ConsoleExpectRE(re)
+	return err
+}
+
+// WaitForUnit waits until all the given systemd units are active, a failed unit is reported as an error.
+// It requires the guest agent. ctx limits the whole wait.
+func (q *Qemu) WaitForUnit(ctx context.Context, units ...string) error {
+	if q.agent == nil {
+		return fmt.Errorf("waiting for systemd units requires the guest agent, see QemuOptions.GuestAgent")
+	}
+	for _, unit := range units {
+		for {
+			res, err := q.GuestExecContext(ctx, "/usr/bin/systemctl", "is-active", unit)
+			if err != nil {
+				return err
+			}
+			if res.ExitCode == 0 {
+				break
+			}
+			if state := string(res.Stdout); state == "failed\n" {
+				return fmt.Errorf("systemd unit %v failed", unit)
+			}
+			select {
+			case <-ctx.Done():
+				return fmt.Errorf("systemd unit %v is %v: %w", unit, strings.TrimSpace(string(res.Stdout)), ctx.Err())
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package vmtest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForUnit(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	checks := map[string]int{}
+	go fakeGuestExec(server, func(path string, args []string) (bool, int, string) {
+		unit := args[1]
+		checks[unit]++
+		switch {
+		case unit == "broken.service":
+			return true, 3, "failed\n"
+		case unit == "slow.service" || checks[unit] < 2:
+			return true, 3, "activating\n"
+		default:
+			return true, 0, "active\n"
+		}
+	})
+	q := &Qemu{agent: newGuestAgent(client)}
+
+	require.NoError(t, q.WaitForUnit(context.Background(), "sshd.service", "multi-user.target"))
+	require.Equal(t, 2, checks["sshd.service"])
+	require.Equal(t, 2, checks["multi-user.target"])
+
+	require.ErrorContains(t, q.WaitForUnit(context.Background(), "broken.service"), "systemd unit broken.service failed")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := q.WaitForUnit(ctx, "slow.service")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorContains(t, err, "slow.service is activating")
+
+	require.ErrorContains(t, (&Qemu{}).WaitForUnit(context.Background(), "sshd.service"), "guest agent")
+}
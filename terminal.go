@@ -0,0 +1,232 @@
+package vmtest
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// terminal parser states
+const (
+	termGround = iota
+	termEscape
+	termCharset // ESC ( and similar sequences followed by a charset designator
+	termCSI
+	termOSC
+	termOSCEscape
+)
+
+// vtHandler performs the output recognized by vtParser
+type vtHandler interface {
+	// print prints the character or performs the control character
+	print(r rune)
+	// execute performs the CSI sequence with the given final character, private sequences like '?7l' change
+	// the terminal modes only and they are not passed
+	execute(final rune, params []byte)
+	// charset designates the charset to the set selected by the escape sequence, e.g. '(' for G0
+	charset(set, designator rune)
+}
+
+// vtParser splits the VT100 output into the characters and the escape sequences, it is shared by the console
+// emulators: terminal and screen
+type vtParser struct {
+	state   int
+	set     rune   // the set of the current charset designation sequence
+	params  []byte // parameters of the current CSI sequence
+	pending []byte // beginning of a UTF-8 character split between writes
+}
+
+// parse processes the data and passes the recognized output to h
+func (p *vtParser) parse(data []byte, h vtHandler) {
+	if len(p.pending) > 0 {
+		data = append(p.pending, data...)
+		p.pending = nil
+	}
+	if n := incompleteUTF8Suffix(data); n > 0 {
+		p.pending = append([]byte(nil), data[len(data)-n:]...)
+		data = data[:len(data)-n]
+	}
+
+	for len(data) > 0 {
+		r, size := utf8.DecodeRune(data)
+		data = data[size:]
+
+		switch p.state {
+		case termGround:
+			if r == '\x1b' {
+				p.state = termEscape
+			} else {
+				h.print(r)
+			}
+		case termEscape:
+			switch r {
+			case '[':
+				p.state = termCSI
+				p.params = p.params[:0]
+			case ']':
+				p.state = termOSC
+			case '(', ')', '*', '+', '#':
+				p.state = termCharset
+				p.set = r
+			default:
+				// single character sequences e.g. 'ESC c' reset or 'ESC M' reverse index
+				p.state = termGround
+			}
+		case termCharset:
+			h.charset(p.set, r)
+			p.state = termGround
+		case termCSI:
+			switch {
+			case r >= 0x30 && r <= 0x3f: // parameter bytes
+				p.params = append(p.params, byte(r))
+			case r >= 0x20 && r <= 0x2f: // intermediate bytes
+			case r >= 0x40 && r <= 0x7e:
+				if len(p.params) == 0 || p.params[0] < '<' {
+					h.execute(r, p.params)
+				}
+				p.state = termGround
+			default:
+				// malformed sequence
+				p.state = termGround
+			}
+		case termOSC:
+			switch r {
+			case '\a':
+				p.state = termGround
+			case '\x1b':
+				p.state = termOSCEscape
+			}
+		case termOSCEscape:
+			// 'ESC \' string terminator
+			p.state = termGround
+		}
+	}
+}
+
+// csiParam returns the i-th numeric parameter of a CSI sequence
+func csiParam(params []byte, i, def int) int {
+	fields := strings.Split(string(params), ";")
+	if i >= len(fields) {
+		return def
+	}
+	n, err := strconv.Atoi(fields[i])
+	if err != nil || n == 0 {
+		return def
+	}
+	return n
+}
+
+// maxTerminalColumn limits the cursor movement requested by the guest, so a sequence like 'ESC[999999999C'
+// does not make the line grow without bound
+const maxTerminalColumn = 4096
+
+// terminal is a minimal VT100 emulator that reconstructs logical lines of the console output. It handles
+// carriage return, backspace, cursor movement within the line and line erase sequences, so progress bars and
+// status redraws result in the text finally seen at the screen. Other sequences (colors, screen clears,
+// movement to other rows) are dropped.
+type terminal struct {
+	parser vtParser
+	line   []rune
+	col    int
+	lines  [][]byte // the lines completed by the current write
+}
+
+// write processes the console data and returns the lines completed by it, without line terminators
+func (t *terminal) write(data []byte) [][]byte {
+	t.lines = nil
+	t.parser.parse(data, t)
+	return t.lines
+}
+
+// current returns the content of the line that is not completed yet
+func (t *terminal) current() []byte {
+	return []byte(string(t.line))
+}
+
+func (t *terminal) print(r rune) {
+	switch {
+	case r == '\n':
+		t.lines = append(t.lines, t.current())
+		t.line = t.line[:0]
+		t.col = 0
+	case r == '\r':
+		t.col = 0
+	case r == '\b':
+		if t.col > 0 {
+			t.col--
+		}
+	case r == '\t':
+		t.put(r)
+	case r < ' ' || r == '\x7f':
+		// other control characters do not change the text
+	default:
+		t.put(r)
+	}
+}
+
+// put prints the character at the cursor position
+func (t *terminal) put(r rune) {
+	for len(t.line) < t.col {
+		t.line = append(t.line, ' ')
+	}
+	if t.col < len(t.line) {
+		t.line[t.col] = r
+	} else {
+		t.line = append(t.line, r)
+	}
+	t.col++
+}
+
+func (t *terminal) execute(final rune, params []byte) {
+	switch final {
+	case 'C': // cursor forward
+		if n := csiParam(params, 0, 1); n < maxTerminalColumn {
+			t.col += n
+		} else {
+			t.col = maxTerminalColumn
+		}
+	case 'D': // cursor back
+		t.col -= csiParam(params, 0, 1)
+		if t.col < 0 {
+			t.col = 0
+		}
+	case 'G': // cursor horizontal absolute
+		t.col = csiParam(params, 0, 1) - 1
+	case 'H', 'f': // cursor position, the row is ignored as the previous lines are already completed
+		t.col = csiParam(params, 1, 1) - 1
+	case 'K': // erase in line
+		switch csiParam(params, 0, 0) {
+		case 0:
+			if t.col < len(t.line) {
+				t.line = t.line[:t.col]
+			}
+		case 1:
+			for i := 0; i <= t.col && i < len(t.line); i++ {
+				t.line[i] = ' '
+			}
+		case 2:
+			t.line = t.line[:0]
+		}
+	}
+	if t.col > maxTerminalColumn {
+		t.col = maxTerminalColumn
+	}
+}
+
+// charset changes do not affect the text
+func (t *terminal) charset(set, designator rune) {}
+
+// incompleteUTF8Suffix returns the length of a multi-byte UTF-8 character that starts but does not end in b
+func incompleteUTF8Suffix(b []byte) int {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		start := b[len(b)-i]
+		if !utf8.RuneStart(start) {
+			continue
+		}
+		if start >= utf8.RuneSelf && !utf8.FullRune(b[len(b)-i:]) {
+			return i
+		}
+		return 0
+	}
+	return 0
+}
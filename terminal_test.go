@@ -0,0 +1,47 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTerminalLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		input []string // every element is a separate write
+		lines []string
+		left  string
+	}{
+		{"progress bar", []string{"Downloading  10%\r", "Downloading  55%\rDownloading 100%\n"}, []string{"Downloading 100%"}, ""},
+		{"erase line", []string{"[ ***  ] A start job is running\r\x1b[K[  OK  ] Started foo.\r\n"}, []string{"[  OK  ] Started foo."}, ""},
+		{"backspace", []string{"pasw\bsword: "}, nil, "password: "},
+		{"cursor movement", []string{"abcdef\x1b[3D\x1b[KXY\x1b[1GZ\n"}, []string{"ZbcXY"}, ""},
+		{"split sequence", []string{"\x1b[0;3", "2m  OK  \x1b", "[0m] Reached target\n"}, []string{"  OK  ] Reached target"}, ""},
+		{"osc title", []string{"\x1b]0;root@vm\a# "}, nil, "# "},
+		{"charset", []string{"\x1b(Bprompt$ "}, nil, "prompt$ "},
+		{"private modes", []string{"\x1b[?25l\x1b[?7hvisible\n"}, []string{"visible"}, ""},
+		{"utf8", []string{"Готово\xe2\x9c", "\x93\n"}, []string{"Готово✓"}, ""},
+	}
+	for _, test := range tests {
+		var term terminal
+		var lines []string
+		for _, data := range test.input {
+			for _, line := range term.write([]byte(data)) {
+				lines = append(lines, string(line))
+			}
+		}
+		require.Equal(t, test.lines, lines, test.name)
+		require.Equal(t, test.left, string(term.current()), test.name)
+	}
+}
+
+func TestTerminalHugeColumn(t *testing.T) {
+	for _, seq := range []string{"\x1b[999999999999C", "\x1b[999999999999G", "\x1b[1;999999999999H", "\x1b[5C\x1b[9223372036854775807C"} {
+		var term terminal
+		lines := term.write([]byte("ab" + seq + "c\n"))
+		require.Len(t, lines, 1, seq)
+		require.Len(t, lines[0], maxTerminalColumn+1, seq)
+		require.Equal(t, byte('c'), lines[0][maxTerminalColumn], seq)
+	}
+}
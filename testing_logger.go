@@ -0,0 +1,54 @@
+package vmtest
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+)
+
+// testingLogger is an io.Writer that sends every line to the test log
+type testingLogger struct {
+	mutex  sync.Mutex
+	t      testing.TB
+	buf    []byte
+	closed bool
+}
+
+// WithTestingLogger returns a writer for QemuOptions.VerboseOutput that routes the verbose output through t.Logf.
+// 'go test -v' interleaves the guest output with the test logs and non-verbose runs show it only if the test fails.
+// Enable QemuOptions.Verbose to use it. The output arriving after the test completion is dropped.
+func WithTestingLogger(t testing.TB) io.Writer {
+	l := &testingLogger{t: t}
+	t.Cleanup(l.close)
+	return l
+}
+
+func (l *testingLogger) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return len(p), nil
+	}
+	l.buf = append(l.buf, p...)
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i == -1 {
+			break
+		}
+		l.t.Log(string(bytes.TrimRight(l.buf[:i], "\r")))
+		l.buf = l.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// close flushes the incomplete line, t.Log must not be called after the test is completed
+func (l *testingLogger) close() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if len(l.buf) > 0 {
+		l.t.Log(string(l.buf))
+		l.buf = nil
+	}
+	l.closed = true
+}
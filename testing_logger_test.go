@@ -0,0 +1,37 @@
+package vmtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTB records the test log
+type fakeTB struct {
+	testing.TB
+	logs     []string
+	cleanups []func()
+}
+
+func (t *fakeTB) Log(args ...interface{}) {
+	t.logs = append(t.logs, args[0].(string))
+}
+
+func (t *fakeTB) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func TestTestingLogger(t *testing.T) {
+	tb := &fakeTB{}
+	w := WithTestingLogger(tb)
+	_, _ = w.Write([]byte("Booting\r\nlog"))
+	_, _ = w.Write([]byte("in: "))
+	require.Equal(t, []string{"Booting"}, tb.logs)
+
+	for _, f := range tb.cleanups {
+		f()
+	}
+	require.Equal(t, []string{"Booting", "login: "}, tb.logs)
+	_, _ = w.Write([]byte("late line\n"))
+	require.Equal(t, []string{"Booting", "login: "}, tb.logs)
+}
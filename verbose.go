@@ -0,0 +1,136 @@
+package vmtest
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// ANSI colors of the verbose output streams
+const (
+	verboseColorLog    = "\x1b[36m" // cyan
+	verboseColorStderr = "\x1b[31m" // red
+	verboseColorReset  = "\x1b[0m"
+)
+
+// verboseOutput multiplexes the guest console, qemu output and vmtest messages of a single VM into one writer.
+// Every line starts with the VM prefix and lines of different streams are never mixed.
+type verboseOutput struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	prefix string
+	color  bool
+	// custom is set if the output is redirected from stdout and the standard logger
+	custom bool
+	// midLine is the stream that printed an incomplete line
+	midLine *verboseStream
+}
+
+// verboseStream is a single source of the verbose output
+type verboseStream struct {
+	o     *verboseOutput
+	color string
+}
+
+func newVerboseOutput(opts *QemuOptions) *verboseOutput {
+	o := &verboseOutput{out: opts.VerboseOutput, prefix: opts.VerbosePrefix, color: opts.VerboseColor}
+	if o.out == nil {
+		o.out = os.Stdout
+	} else {
+		o.custom = true
+	}
+	return o
+}
+
+func (o *verboseOutput) stream(color string) *verboseStream {
+	if !o.color {
+		color = ""
+	}
+	return &verboseStream{o: o, color: color}
+}
+
+// console returns the writer for the guest console output
+func (o *verboseOutput) console() io.Writer {
+	return o.stream("")
+}
+
+// stderr returns the writer for the qemu stderr
+func (o *verboseOutput) stderr() io.Writer {
+	if !o.custom {
+		return os.Stderr
+	}
+	return o.stream(verboseColorStderr)
+}
+
+// logf prints a vmtest message. It goes to the standard logger unless the output is redirected.
+func (o *verboseOutput) logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !o.custom {
+		log.Print(o.prefix + msg)
+		return
+	}
+	_, _ = o.stream(verboseColorLog).Write([]byte(msg + "\n"))
+}
+
+// logf prints a vmtest message with the verbose output. If it is disabled the message goes to VerboseOutput
+// or the standard logger.
+func (q *Qemu) logf(format string, args ...interface{}) {
+	out := q.verbose
+	if out == nil {
+		out = newVerboseOutput(q.opts)
+	}
+	out.logf(format, args...)
+}
+
+func (s *verboseStream) Write(p []byte) (int, error) {
+	o := s.o
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	var out []byte
+	if o.midLine != nil && o.midLine != s {
+		// finish the line of the other stream
+		out = append(out, '\n')
+		o.midLine = nil
+	}
+	for data := p; len(data) > 0; {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i != -1 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		if o.midLine == nil {
+			out = append(out, o.prefix...)
+		}
+		if s.color != "" {
+			text := bytes.TrimSuffix(line, []byte{'\n'})
+			out = append(out, s.color...)
+			out = append(out, text...)
+			out = append(out, verboseColorReset...)
+			out = append(out, line[len(text):]...)
+		} else {
+			out = append(out, line...)
+		}
+		if bytes.HasSuffix(line, []byte{'\n'}) {
+			o.midLine = nil
+		} else {
+			o.midLine = s
+		}
+	}
+	if _, err := o.out.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// verboseStdout returns stdout if the verbose output is enabled and nil otherwise
+func verboseStdout(verbose bool) io.Writer {
+	if verbose {
+		return os.Stdout
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package vmtest
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerboseOutput(t *testing.T) {
+	var buf bytes.Buffer
+	o := newVerboseOutput(&QemuOptions{VerboseOutput: &buf, VerbosePrefix: "[vm1] "})
+	console := o.console()
+
+	_, _ = console.Write([]byte("Booting\nlogin: "))
+	o.logf("QEMU started")
+	_, _ = console.Write([]byte("root\n"))
+	_, _ = o.stderr().Write([]byte("warning\n"))
+	require.Equal(t, "[vm1] Booting\n[vm1] login: \n[vm1] QEMU started\n[vm1] root\n[vm1] warning\n", buf.String())
+
+	buf.Reset()
+	o = newVerboseOutput(&QemuOptions{VerboseOutput: &buf, VerboseColor: true})
+	_, _ = o.console().Write([]byte("Booting\n"))
+	o.logf("QEMU started")
+	require.Equal(t, "Booting\n"+verboseColorLog+"QEMU started"+verboseColorReset+"\n", buf.String())
+}
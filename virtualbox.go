@@ -0,0 +1,302 @@
+package vmtest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const virtualBoxDefaultTimeout = 60 * time.Second
+
+// VirtualBoxOptions options for VirtualBox vm initialization
+type VirtualBoxOptions struct {
+	// Name of the VM registered in VirtualBox, default is a unique 'vmtest*' name
+	Name string
+	// OSType is VirtualBox guest OS type, see 'VBoxManage list ostypes'. Default is 'Linux_64'.
+	OSType string
+	// Memory is the guest RAM size in megabytes
+	Memory int
+	// CPUs is the number of guest CPUs
+	CPUs int
+	// Disks is a list of disk images (vdi, vmdk, vhd) attached to the SATA controller
+	Disks []string
+	// CdRom is an ISO image attached to the IDE controller, the VM boots from it first
+	CdRom string
+	// Params are additional 'VBoxManage modifyvm' parameters
+	Params []string
+	// Enable debug output
+	Verbose bool
+	// The vm is powered off after this timeout
+	Timeout time.Duration
+}
+
+// VirtualBox represents a VirtualBox VM that is started by vmtest library
+type VirtualBox struct {
+	name       string
+	socketsDir string
+	mutex      sync.Mutex // guards console and timer, the timeout callback may run before NewVirtualBox returns
+	console    *console
+	timer      *time.Timer
+	stopOnce   sync.Once
+	verbose    bool
+}
+
+var _ VM = (*VirtualBox)(nil) // ensure VirtualBox implements VM interface
+
+// vboxManage runs VBoxManage with the given arguments and returns its output
+func vboxManage(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("VBoxManage", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("VBoxManage %v: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// virtualBoxArgs renders 'VBoxManage modifyvm' arguments for the given options
+func virtualBoxArgs(opts *VirtualBoxOptions, consolePath string) []string {
+	args := []string{
+		// COM1 is connected to a unix socket created by VirtualBox
+		"--uart1", "0x3F8", "4",
+		"--uartmode1", "server", consolePath,
+	}
+	if opts.CdRom != "" {
+		args = append(args, "--boot1", "dvd", "--boot2", "disk")
+	} else {
+		args = append(args, "--boot1", "disk", "--boot2", "none")
+	}
+	if opts.Memory != 0 {
+		args = append(args, "--memory", strconv.Itoa(opts.Memory))
+	}
+	if opts.CPUs != 0 {
+		args = append(args, "--cpus", strconv.Itoa(opts.CPUs))
+	}
+	return append(args, opts.Params...)
+}
+
+// NewVirtualBox creates and starts a headless VirtualBox VM. The VM is unregistered when it stops,
+// attached disk images are preserved.
+func NewVirtualBox(opts *VirtualBoxOptions) (*VirtualBox, error) {
+	if opts.Timeout == 0 {
+		opts.Timeout = virtualBoxDefaultTimeout
+	}
+	if opts.OSType == "" {
+		opts.OSType = "Linux_64"
+	}
+	for _, f := range append(opts.Disks[:len(opts.Disks):len(opts.Disks)], opts.CdRom) {
+		if f == "" {
+			continue
+		}
+		if err := checkFileExists(f); err != nil {
+			return nil, err
+		}
+	}
+
+	tempDir, err := ioutil.TempDir("", "vmtest")
+	if err != nil {
+		return nil, err
+	}
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(tempDir)
+	}
+
+	// the VM settings are stored at tempDir so they are removed together with the sockets
+	if _, err := vboxManage("createvm", "--name", name, "--ostype", opts.OSType, "--basefolder", tempDir, "--register"); err != nil {
+		_ = os.RemoveAll(tempDir)
+		return nil, err
+	}
+	vb := &VirtualBox{
+		name:       name,
+		socketsDir: tempDir,
+		verbose:    opts.Verbose,
+	}
+	if err := vb.configure(opts); err != nil {
+		vb.cleanup()
+		return nil, err
+	}
+
+	if _, err := vboxManage("startvm", name, "--type", "headless"); err != nil {
+		vb.cleanup()
+		return nil, err
+	}
+	vb.mutex.Lock()
+	vb.timer = time.AfterFunc(opts.Timeout, func() {
+		log.Printf("VirtualBox VM %v timed out", name)
+		vb.Kill()
+	})
+	vb.mutex.Unlock()
+
+	conn, err := dialVirtualBoxConsole(path.Join(tempDir, consoleSocket))
+	if err != nil {
+		vb.Kill()
+		return nil, err
+	}
+	vb.mutex.Lock()
+	vb.console = newConsole(conn, consoleConfig{})
+	vb.mutex.Unlock()
+	go vb.console.pump(verboseStdout(opts.Verbose))
+
+	return vb, nil
+}
+
+func (vb *VirtualBox) configure(opts *VirtualBoxOptions) error {
+	args := append([]string{"modifyvm", vb.name}, virtualBoxArgs(opts, path.Join(vb.socketsDir, consoleSocket))...)
+	if vb.verbose {
+		log.Printf("VBoxManage command line: %v", quoteCmdline(args))
+	}
+	if _, err := vboxManage(args...); err != nil {
+		return err
+	}
+
+	if len(opts.Disks) != 0 {
+		if _, err := vboxManage("storagectl", vb.name, "--name", "SATA", "--add", "sata", "--portcount", strconv.Itoa(len(opts.Disks))); err != nil {
+			return err
+		}
+		for i, d := range opts.Disks {
+			if _, err := vboxManage("storageattach", vb.name, "--storagectl", "SATA", "--port", strconv.Itoa(i), "--device", "0", "--type", "hdd", "--medium", d); err != nil {
+				return err
+			}
+		}
+	}
+	if opts.CdRom != "" {
+		if _, err := vboxManage("storagectl", vb.name, "--name", "IDE", "--add", "ide"); err != nil {
+			return err
+		}
+		if _, err := vboxManage("storageattach", vb.name, "--storagectl", "IDE", "--port", "0", "--device", "0", "--type", "dvddrive", "--medium", opts.CdRom); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dialVirtualBoxConsole connects to the serial port socket that VirtualBox creates shortly after the VM start
+func dialVirtualBoxConsole(socket string) (net.Conn, error) {
+	const attempts = 100
+	var err error
+	for i := 0; i < attempts; i++ {
+		var conn net.Conn
+		conn, err = net.Dial("unix", socket)
+		if err == nil {
+			return conn, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return nil, fmt.Errorf("connecting VirtualBox serial port: %v", err)
+}
+
+var vmStateRe = regexp.MustCompile(`^VMState="(.*)"$`)
+
+// state returns the VM state reported by VBoxManage, e.g. 'running' or 'poweroff'
+func (vb *VirtualBox) state() (string, error) {
+	out, err := vboxManage("showvminfo", vb.name, "--machinereadable")
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(strings.NewReader(out))
+	for scanner.Scan() {
+		if m := vmStateRe.FindStringSubmatch(scanner.Text()); m != nil {
+			return m[1], nil
+		}
+	}
+	return "", fmt.Errorf("VBoxManage showvminfo %v: VMState not found", vb.name)
+}
+
+// waitPoweroff waits till the VM is powered off or any other final state is reached
+func (vb *VirtualBox) waitPoweroff() {
+	for {
+		state, err := vb.state()
+		if err != nil {
+			log.Print(err)
+			return
+		}
+		switch state {
+		case "poweroff", "aborted", "saved":
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// cleanup unregisters the VM and removes its temporary files
+func (vb *VirtualBox) cleanup() {
+	vb.stopOnce.Do(func() {
+		vb.mutex.Lock()
+		if vb.timer != nil {
+			vb.timer.Stop()
+		}
+		if vb.console != nil {
+			_ = vb.console.conn.Close()
+		}
+		vb.mutex.Unlock()
+		// VirtualBox releases the session asynchronously after power off, retry unregistering for a bit
+		var err error
+		for i := 0; i < 10; i++ {
+			if _, err = vboxManage("unregistervm", vb.name); err == nil {
+				break
+			}
+			time.Sleep(500 * time.Millisecond)
+		}
+		if err != nil {
+			log.Print(err)
+		}
+		if err := os.RemoveAll(vb.socketsDir); err != nil {
+			log.Printf("Cannot remove temporary dir %v: %v", vb.socketsDir, err)
+		}
+	})
+}
+
+// Kill powers off the vm using 'VBoxManage controlvm poweroff'
+func (vb *VirtualBox) Kill() {
+	if _, err := vboxManage("controlvm", vb.name, "poweroff"); err != nil {
+		log.Print(err)
+	}
+	vb.waitPoweroff()
+	vb.cleanup()
+}
+
+// Shutdown presses the ACPI power button using 'VBoxManage controlvm acpipowerbutton' and waits till
+// the vm is powered off. The vm is killed if the guest ignores the event till the timeout.
+func (vb *VirtualBox) Shutdown() {
+	if _, err := vboxManage("controlvm", vb.name, "acpipowerbutton"); err != nil {
+		log.Print(err)
+	}
+	vb.waitPoweroff()
+	vb.cleanup()
+}
+
+// ConsoleExpect waits until the vm console matches str
+func (vb *VirtualBox) ConsoleExpect(str string) error {
+	return vb.console.expect(str)
+}
+
+// ConsoleExpectRE waits until the vm console matches regexp provided by re
+// returns array of matched strings
+func (vb *VirtualBox) ConsoleExpectRE(re *regexp.Regexp) ([]string, error) {
+	return vb.console.expectRE(re)
+}
+
+// ConsoleWrite writes given string to the vm console
+func (vb *VirtualBox) ConsoleWrite(str string) error {
+	return vb.console.write(str)
+}
+
+// ConsoleReader returns a reader of the console output that is not consumed by expectations yet
+func (vb *VirtualBox) ConsoleReader() io.Reader {
+	return vb.console
+}
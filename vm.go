@@ -2,7 +2,10 @@ package vmtest
 
 import "regexp"
 
-// VM represents a virtual machine instance that can be managed using API
+// VM represents a virtual machine instance that can be managed using API. The methods are safe for concurrent use.
+// The console expectations consume a single output stream, so concurrent calls are served one after another,
+// use ConsoleCursor to wait for different output in parallel.
+// Backends with more features implement the optional interfaces as well, see As().
 type VM interface {
 
 	// ConsoleExpect waits till particular string appears in the VM console output
@@ -0,0 +1,70 @@
+package vmtest
+
+import "io"
+
+// Optional capabilities of the VM backends. The VM interface has the functions every backend supports,
+// richer backends implement these interfaces as well, see As().
+
+// ConsoleReaderVM reads the console output as a stream
+type ConsoleReaderVM interface {
+	VM
+	// ConsoleReader returns a reader of the console output not consumed by the expectations yet
+	ConsoleReader() io.Reader
+}
+
+// SnapshotVM saves and restores the whole machine state
+type SnapshotVM interface {
+	VM
+	// SaveSnapshot saves the machine state under the name
+	SaveSnapshot(name string) error
+	// LoadSnapshot restores the machine state saved under the name
+	LoadSnapshot(name string) error
+	// DeleteSnapshot removes the saved state
+	DeleteSnapshot(name string) error
+}
+
+// ExecVM runs programs inside the guest
+type ExecVM interface {
+	VM
+	// GuestExec runs the program, waits for its completion and returns its output
+	GuestExec(path string, args ...string) (*GuestExecResult, error)
+}
+
+// FileTransferVM copies files to and from the guest
+type FileTransferVM interface {
+	VM
+	// GuestReadFile returns the content of the guest file
+	GuestReadFile(path string) ([]byte, error)
+	// GuestWriteFile creates or replaces the guest file with the data
+	GuestWriteFile(path string, data []byte) error
+}
+
+var (
+	_ ConsoleReaderVM = (*Qemu)(nil)
+	_ SnapshotVM      = (*Qemu)(nil)
+	_ ExecVM          = (*Qemu)(nil)
+	_ FileTransferVM  = (*Qemu)(nil)
+	_ ConsoleReaderVM = (*VirtualBox)(nil)
+	_ ConsoleReaderVM = (*External)(nil)
+	_ ConsoleReaderVM = (*SSH)(nil)
+	_ ExecVM          = (*SSH)(nil)
+	_ FileTransferVM  = (*SSH)(nil)
+)
+
+// As returns vm as the capability interface T, e.g. As[SnapshotVM](vm), and reports whether the backend
+// implements it. VMs wrapping other ones are unwrapped with their 'Unwrap() VM' method, so a wrapper does not
+// hide the capabilities of the inner VM.
+func As[T VM](vm VM) (T, bool) {
+	for vm != nil {
+		if t, ok := vm.(T); ok {
+			return t, true
+		}
+		u, ok := vm.(interface{ Unwrap() VM })
+		if !ok {
+			break
+		}
+		vm = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
@@ -0,0 +1,67 @@
+package vmtest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// wrappedVM is a VM decorator as written by the users of the package
+type wrappedVM struct {
+	VM
+}
+
+func (w wrappedVM) Unwrap() VM {
+	return w.VM
+}
+
+func TestAs(t *testing.T) {
+	var vm VM = &Qemu{}
+	s, ok := As[SnapshotVM](vm)
+	require.True(t, ok)
+	require.Equal(t, vm, s)
+	_, ok = As[ExecVM](vm)
+	require.True(t, ok)
+
+	ext := &External{}
+	_, ok = As[ConsoleReaderVM](ext)
+	require.True(t, ok)
+	_, ok = As[SnapshotVM](ext)
+	require.False(t, ok)
+	f, ok := As[FileTransferVM](ext)
+	require.False(t, ok)
+	require.Nil(t, f)
+
+	_, ok = As[FileTransferVM](wrappedVM{vm})
+	require.True(t, ok)
+	_, ok = As[FileTransferVM](wrappedVM{ext})
+	require.False(t, ok)
+	_, ok = As[SnapshotVM](nil)
+	require.False(t, ok)
+}
+
+func TestSnapshots(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	calls := 0
+	go fakeQMPServer(t, server, func(cmd string) string {
+		if cmd != "human-monitor-command" {
+			return `{"return": {}}`
+		}
+		calls++
+		if calls == 2 {
+			return `{"return": "Error: Device 'hd0' is writable but does not support snapshots\r\n"}`
+		}
+		return `{"return": ""}`
+	})
+
+	qmp, err := newQMPClient(client)
+	require.NoError(t, err)
+	q := &Qemu{qmp: qmp}
+
+	require.NoError(t, q.SaveSnapshot("booted"))
+	require.EqualError(t, q.LoadSnapshot("booted"), "loadvm: Error: Device 'hd0' is writable but does not support snapshots")
+	require.NoError(t, q.DeleteSnapshot("booted"))
+}
@@ -0,0 +1,66 @@
+package vmtest
+
+import (
+	"fmt"
+	"os"
+)
+
+// virtioDriversPaths are locations of virtio-win drivers ISO installed by Linux distributions packages
+var virtioDriversPaths = []string{
+	"/usr/share/virtio-win/virtio-win.iso",
+	"/usr/share/virtio/virtio-win.iso",
+}
+
+// FindVirtioDriversISO returns the path of virtio-win drivers ISO installed at the host.
+// The image can be downloaded from https://github.com/virtio-win/virtio-win-pkg-scripts
+func FindVirtioDriversISO() (string, error) {
+	for _, p := range virtioDriversPaths {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("virtio-win drivers ISO is not found, install virtio-win package")
+}
+
+// virtioDriversParams renders the parameters attaching the drivers ISO as an additional CD-ROM drive
+func virtioDriversParams(iso string) ([]string, error) {
+	if err := checkFileExists(iso); err != nil {
+		return nil, fmt.Errorf("opts.VirtioDrivers: %v", err)
+	}
+	// index 3 is the secondary IDE slave, -cdrom uses index 2
+	return []string{"-drive", "file=" + escapeParam(iso) + ",media=cdrom,readonly=on,index=3"}, nil
+}
+
+// GuestCmd runs the command with Windows 'cmd.exe /c' using the guest agent
+func (q *Qemu) GuestCmd(command string) (*GuestExecResult, error) {
+	return q.GuestExec("cmd.exe", "/c", command)
+}
+
+// GuestPowerShell runs the PowerShell script using the guest agent
+func (q *Qemu) GuestPowerShell(script string) (*GuestExecResult, error) {
+	return q.GuestExec("powershell.exe", "-NoProfile", "-NonInteractive", "-ExecutionPolicy", "Bypass", "-Command", script)
+}
+
+// pnputil exit code meaning the drivers are installed but the system needs a reboot
+const pnputilRebootRequired = 3010
+
+// GuestInstallVirtioDrivers installs all the drivers from the virtio-win ISO attached with QemuOptions.VirtioDrivers.
+// It returns whether Windows needs to be restarted to complete the installation.
+func (q *Qemu) GuestInstallVirtioDrivers() (bool, error) {
+	const script = `$v = Get-Volume | Where-Object FileSystemLabel -like 'virtio-win*' | Select-Object -First 1
+if (!$v) { Write-Error 'virtio-win volume is not found'; exit 1 }
+pnputil.exe /add-driver "$($v.DriveLetter):\*.inf" /subdirs /install
+exit $LASTEXITCODE`
+	res, err := q.GuestPowerShell(script)
+	if err != nil {
+		return false, err
+	}
+	switch res.ExitCode {
+	case 0:
+		return false, nil
+	case pnputilRebootRequired:
+		return true, nil
+	default:
+		return false, fmt.Errorf("installing virtio drivers: exit code %d: %s", res.ExitCode, res.Stderr)
+	}
+}
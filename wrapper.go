@@ -0,0 +1,59 @@
+package vmtest
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// ArtifactsPlaceholder is replaced with the artifacts directory path in QemuOptions.Wrapper arguments
+const ArtifactsPlaceholder = "{artifacts}"
+
+// EnvArtifactsDir is an environment variable with the artifacts directory path passed to the wrapper process
+const EnvArtifactsDir = "VMTEST_ARTIFACTS_DIR"
+
+// Wrappers for common profiling and debugging tools, see QemuOptions.Wrapper
+var (
+	// WrapperPerfRecord records the emulator CPU profile with call graphs to perf.data
+	WrapperPerfRecord = []string{"perf", "record", "-g", "-o", ArtifactsPlaceholder + "/perf.data", "--"}
+	// WrapperStrace traces the emulator system calls of all threads to strace.log
+	WrapperStrace = []string{"strace", "-f", "-o", ArtifactsPlaceholder + "/strace.log", "--"}
+	// WrapperRR records the emulator execution for replay debugging to rr-trace directory
+	WrapperRR = []string{"rr", "record", "-o", ArtifactsPlaceholder + "/rr-trace"}
+	// WrapperValgrind checks the emulator memory accesses, the report is written to valgrind.log
+	WrapperValgrind = []string{"valgrind", "--log-file=" + ArtifactsPlaceholder + "/valgrind.log"}
+)
+
+// wrapCommand prepends the wrapper with expanded placeholders to the qemu command line
+func wrapCommand(wrapper []string, artifactsDir, binary string, cmdline []string) (string, []string) {
+	if len(wrapper) == 0 {
+		return binary, cmdline
+	}
+	args := make([]string, 0, len(wrapper)+len(cmdline))
+	for _, w := range wrapper[1:] {
+		args = append(args, strings.ReplaceAll(w, ArtifactsPlaceholder, artifactsDir))
+	}
+	args = append(args, binary)
+	return wrapper[0], append(args, cmdline...)
+}
+
+// artifactsDir returns the directory for the VM output files. If opts.ArtifactsDir is empty then a new temporary
+// directory is created, it is preserved after the VM stops.
+func artifactsDir(opts *QemuOptions) (string, error) {
+	if opts.ArtifactsDir != "" {
+		return opts.ArtifactsDir, os.MkdirAll(opts.ArtifactsDir, 0o755)
+	}
+	dir, err := ioutil.TempDir(scratchDir(opts), tempPattern(opts, "vmtest-artifacts"))
+	if err != nil {
+		return "", err
+	}
+	log.Printf("VM artifacts are stored at %v", dir)
+	return dir, nil
+}
+
+// ArtifactsDir returns the directory where the VM output files (e.g. profiles from QemuOptions.Wrapper) are stored.
+// It is empty if the VM has no artifacts.
+func (q *Qemu) ArtifactsDir() string {
+	return q.artifactsDir
+}